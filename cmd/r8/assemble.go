@@ -2,11 +2,11 @@ package r8
 
 import (
 	"fmt"
+	"io"
 	"os"
+	"strings"
 
-	"encoding/binary"
 	"github.com/leon332157/risc-y-8/cmd/r8/assembler"
-	"github.com/leon332157/risc-y-8/cmd/r8/assembler/grammar"
 	"github.com/spf13/cobra"
 )
 
@@ -18,14 +18,16 @@ var (
 		Long:    "Assemble RISC-Y-8 assembly code into machine code",
 		RunE:    runAssemble,
 		Args:    cobra.ExactArgs(1),
-		Example: "r8 assemble -o a.out -f bin input.asm",
+		Example: "r8 assemble -o a.out -f bin input.asm\nr8 assemble -o a.out --listing a.lst --map a.map --source-map a.json input.asm\nr8 assemble -c -o input.o input.asm",
+		// assembly errors are reported as diagnostics, the usage text would hide them
+		SilenceUsage: true,
 	}
 )
 
 func runAssemble(cmd *cobra.Command, args []string) error {
 	infile := args[0]
 	outfile := cmd.Flag("output").Value.String()
-	//format := cmd.Flag("format").Value.String()
+	format := cmd.Flag("format").Value.String()
 	f, err := os.Open(infile)
 	if err != nil {
 		return fmt.Errorf("failed to open input file: %v", err)
@@ -35,35 +37,70 @@ func runAssemble(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("Stdin is not supported yet")
 	}
 
-	prog, err := grammar.Parser.Parse(infile, f)
-	if err != nil {
-		return fmt.Errorf("parse file %v %+v",err,prog);
+	object, _ := cmd.Flags().GetBool("object")
+	res, err := assembler.New(assembler.Options{Relocatable: object}).Assemble(infile, f)
+	if diags, ok := err.(assembler.Diagnostics); ok {
+		fmt.Fprint(os.Stderr, diags.Format())
+		return fmt.Errorf("assembly of %s failed", infile)
+	} else if err != nil {
+		return err
 	}
-	res,err := assembler.ParseLines(prog.Lines); // changes state in assembler package
-	if err != nil {
-		return fmt.Errorf("parse lines: %v %+v", err, res)
+	if len(res.Warnings) > 0 {
+		fmt.Fprint(os.Stderr, res.Warnings.Format())
 	}
-	encoded := assembler.EncInstructions(res)
-	if outfile != "" {
-		of, err := os.Create(outfile)
+	outputs := []struct {
+		flag  string
+		write func(io.Writer) error
+	}{
+		{"listing", res.WriteListing},
+		{"map", res.WriteMap},
+		{"source-map", res.DebugInfo().Write},
+	}
+	for _, out := range outputs {
+		if name := cmd.Flag(out.flag).Value.String(); name != "" {
+			if err := writeFile(name, out.write); err != nil {
+				return err
+			}
+		}
+	}
+	write := func(w io.Writer) error {
+		return assembler.WriteImage(w, res.Image().Flatten(), format) // output is the image from address 0
+	}
+	if object {
+		obj, err := res.Object()
 		if err != nil {
-			return fmt.Errorf("failed to create output file: %v", err)
+			return err
 		}
-		defer of.Close()
-		binary.Write(of, binary.LittleEndian, encoded)
+		write = obj.Write
+	}
+	if outfile != "" {
+		return writeFile(outfile, write)
+	}
+	return write(os.Stdout)
+}
 
-	} else {
-		binary.Write(os.Stdout, binary.LittleEndian, encoded)
+// Create a file and write to it with write
+func writeFile(name string, write func(io.Writer) error) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %v", err)
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write %s: %v", name, err)
 	}
-	return nil
+	return f.Close()
 }
 
 func init() {
 	assembleCmd.Flags().StringP("output", "o", "", "Output machine code file")
-	assembleCmd.Flags().StringP("format", "f", "bin", "Output format (bin, hex)")
+	assembleCmd.Flags().BoolP("object", "c", false, "Write a relocatable object file for r8 link instead of an image")
+	assembleCmd.Flags().String("listing", "", "Write a listing of addresses, machine words and source lines")
+	assembleCmd.Flags().String("map", "", "Write the symbol table")
+	assembleCmd.Flags().String("source-map", "", "Write a JSON source map that other r8 commands can load")
+	assembleCmd.Flags().StringP("format", "f", "bin", "Output format ("+strings.Join(assembler.Formats, ", ")+")")
 	assembleCmd.Flags().BoolP("verbose", "v", false, "Enable verbose output")
 	assembleCmd.Flags().MarkHidden("verbose") // Hide the verbose flag for now
-	assembleCmd.Flags().MarkHidden("format")  // Hide the format flag for now
 
 	rootCmd.AddCommand(assembleCmd)
 	// Add flags and configuration settings here if needed
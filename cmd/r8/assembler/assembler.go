@@ -2,49 +2,174 @@ package assembler
 
 import (
 	"fmt"
-	"reflect"
+	"io"
+	"maps"
+	"regexp"
 	"strconv"
+	"strings"
+
+	"github.com/alecthomas/participle/v2/lexer"
 
 	"github.com/leon332157/risc-y-8/cmd/r8/assembler/grammar"
 	. "github.com/leon332157/risc-y-8/pkg/types"
 )
 
-// parse 16 bit two's complement immediate value
-func parseImm(imm string) (int16, error) {
-	var i64 int64
-	//var u64 uint64
-	var ret int16
-	var err error
+// check if a name can refer to a label rather than a number
+func isLabelName(name string) bool {
+	name = strings.TrimPrefix(name, "-")
+	return name != "" && (name[0] == '_' || name[0] == '.' || (name[0] >= 'a' && name[0] <= 'z'))
+}
+
+// check if a name is a register that can be used as a base or operand
+func isRegisterName(name string) bool {
+	_, ok := IntegerRegisters[name]
+	_, float := FPRegisters[name]
+	_, vector := VectorRegisters[name]
+	return ok || float || vector || name == "pc"
+}
+
+// names that look like a register, an unknown one is an invalid register rather than an undefined label
+var registerPattern = regexp.MustCompile(`^[rfv][0-9]+$`)
+
+// describe an operand for error messages
+func operandKind(op grammar.Operand) string {
+	switch op := op.(type) {
+	case grammar.OperandRegister:
+		return "register or label " + op.Value
+	case grammar.OperandImmediate:
+		return "immediate " + op.Value
+	case grammar.OperandMemory:
+		return "memory operand"
+	case grammar.OperandString:
+		return "string " + op.Value
+	}
+	return fmt.Sprintf("%T", op)
+}
+
+// source text of an operand used to point at it in diagnostics
+func operandToken(op grammar.Operand) string {
+	switch op := op.(type) {
+	case grammar.OperandRegister:
+		return op.Value
+	case grammar.OperandImmediate:
+		return op.Value
+	case grammar.OperandMemory:
+		if op.Value.Expr != nil {
+			return op.Value.Expr.Text
+		}
+		return op.Value.Base
+	case grammar.OperandString:
+		return op.Value
+	}
+	return ""
+}
 
-	i64, err = strconv.ParseInt(imm, 0, 17) // attempt to parse as signed
+// look up the address of a label, the symbol table is filled by the first pass of assembleLines
+func (a *assembly) lookupLabel(name string) (uint32, error) {
+	v, err := a.lookup(name)
 	if err != nil {
 		return 0, err
 	}
+	n, err := a.absolute(name, v)
+	return uint32(n), err
+}
+
+// look up the value of a symbol, labels and external symbols are relocatable in an object file
+func (a *assembly) lookup(name string) (value, error) {
+	if _, ok := a.externs[name]; ok {
+		return value{extern: name}, nil
+	}
+	addr, ok := a.symbols[name]
+	if !ok {
+		return value{}, errorAt(name, "[lookupLabel] undefined label: %s", name)
+	}
+	v := value{n: int64(int32(addr))} // .equ constants may be negative
+	if a.relocatable {
+		v.section = a.labelSections[name]
+	}
+	return v, nil
+}
+
+// parse 16 bit two's complement immediate value, label names are replaced by their address
+func (a *assembly) parseImm(imm string) (int16, error) {
+	i64, err := a.parseImmValue(imm)
+	if err != nil {
+		return 0, err
+	}
+	return a.truncImm(imm, i64), nil
+}
+
+// parse an immediate value and return it before it is truncated to 16 bits
+func (a *assembly) parseImmValue(imm string) (int64, error) {
+	var i64 int64
+	var err error
+
+	if isLabelName(imm) {
+		addr, err := a.lookupLabel(strings.TrimPrefix(imm, "-"))
+		if err != nil {
+			return 0, err
+		}
+		i64 = int64(int32(addr)) // .equ constants may be negative
+		if imm[0] == '-' {
+			i64 = -i64
+		}
+	} else {
+		i64, err = strconv.ParseInt(imm, 0, 17) // attempt to parse as signed
+		if err != nil {
+			return 0, errorAt(imm, "[parseImm] invalid immediate value: %s", imm)
+		}
+	}
+	return checkImmRange(imm, i64)
+}
+
+// check that the value of imm fits in 16 bits, either signed or unsigned
+func checkImmRange(imm string, i64 int64) (int64, error) {
+	val := imm
+	if _, err := strconv.ParseInt(imm, 0, 64); err != nil {
+		val = fmt.Sprintf("%s = %d", imm, i64) // show the value of a symbol or expression
+	}
 	if i64 < -65536 {
-		return 0, fmt.Errorf("[parseImm] immediate value less than -65536 : %s", imm)
+		return 0, errorAt(imm, "[parseImm] immediate value less than -65536 : %s", val)
 	}
 	if i64 > 65535 {
-		return 0, fmt.Errorf("[parseImm] immediate value greater than 65535 : %s", imm)
+		return 0, errorAt(imm, "[parseImm] immediate value greater than 65535 : %s", val)
 	}
-	// if good then return signed value
-	ret = int16(i64)
-	//return int16(u64), nil
-	return ret, nil
+	return i64, nil
+}
+
+// truncate an immediate value to 16 bits, values from 0x8000 to 0xffff are kept as their bit pattern
+func (a *assembly) truncImm(imm string, i64 int64) int16 {
+	if i64 < -32768 {
+		a.warn(imm, "[parseImm] immediate value %s does not fit in 16 bits and is truncated to %d", imm, int16(i64))
+	}
+	return int16(i64)
 }
 
-// Parse a memory operand and return the base register and displacement as signed 16 bit integer
-func parseMemory(mem grammar.OperandMemory) (uint8, int16, error) {
+// Parse a memory operand and return the base register and displacement as signed 16 bit integer.
+// A label may be used in place of the base register, e.g. [loop] or [table + 2], which is encoded
+// with r0 as base. For control instructions (pcRelative) r0 refers to the address of the next
+// instruction, so the displacement is made relative to it, otherwise r0 reads as zero and the
+// label address is used as is.
+func (a *assembly) parseMemory(mem grammar.OperandMemory, pcRelative bool) (uint8, int16, error) {
+	if mem.Value.Expr != nil {
+		return a.parseMemoryExpr(mem.Value.Expr, pcRelative)
+	}
 	var rmem uint8 = 0
 	var disp int16 = 0
 
 	var err error
 	var ok bool
+	var label string
+	if !isRegisterName(mem.Value.Base) && isLabelName(mem.Value.Base) {
+		label = mem.Value.Base
+		mem.Value.Base = "r0"
+	}
 	if mem.Value.Base == "pc" {
 		mem.Value.Base = "r0" // pc is encoded as r0
 	}
 	rmem, ok = IntegerRegisters[mem.Value.Base] // register operand
 	if !ok {
-		err = fmt.Errorf("[parseMemory] invalid base register: %#v", mem.Value.Base)
+		err = errorAt(mem.Value.Base, "[parseMemory] invalid base register: %s", mem.Value.Base)
 		return 0, 0, err
 	}
 	// Handle empty operation
@@ -57,7 +182,7 @@ func parseMemory(mem grammar.OperandMemory) (uint8, int16, error) {
 	}
 	// check to make sure that not both operation and displacement are negative
 	if mem.Value.Displacement.Value[0] == '-' && mem.Value.Operation == "-" {
-		err = fmt.Errorf("[parseMemory] invalid displacement, both operation and displacement are negative: %+v", mem.Value)
+		err = errorAt(mem.Value.Displacement.Value, "[parseMemory] invalid displacement, both operation and displacement are negative: %s", mem.Value.Displacement.Value)
 		return 0, 0, err
 	}
 	// add the sign to the displacement
@@ -65,15 +190,32 @@ func parseMemory(mem grammar.OperandMemory) (uint8, int16, error) {
 		mem.Value.Displacement.Value = "-" + mem.Value.Displacement.Value
 	}
 	// parse the displacement
-	disp, err = parseImm(mem.Value.Displacement.Value)
+	disp, err = a.parseImm(mem.Value.Displacement.Value)
 	if err != nil {
-		err = fmt.Errorf("[parseMemory] invalid displacement: %v", err)
+		err = fmt.Errorf("[parseMemory] invalid displacement: %w", err)
 		return 0, 0, err
 	}
+	if label == "" && disp < 0 && mem.Value.Operation == "+" && mem.Value.Displacement.Value[0] != '-' {
+		a.warn(mem.Value.Displacement.Value, "[parseMemory] displacement %s is sign extended to %d", mem.Value.Displacement.Value, disp)
+	}
+	if label != "" {
+		addr, err := a.lookupLabel(label)
+		if err != nil {
+			return 0, 0, fmt.Errorf("[parseMemory] invalid base register or label: %w", err)
+		}
+		target := int64(addr) + int64(disp)
+		if pcRelative {
+			target -= int64(a.addr) + 4
+		}
+		if target < -32768 || target > 32767 {
+			return 0, 0, errorAt(label, "[parseMemory] label %s is out of range for a 16 bit displacement: %d", label, target)
+		}
+		disp = int16(target)
+	}
 	return rmem, disp, err
 }
 
-func parseInstNoOp(inst *grammar.Instruction) (BaseInstruction, error) {
+func (a *assembly) parseInstNoOp(inst *grammar.Instruction) (BaseInstruction, error) {
 	var ret BaseInstruction
 	var err error
 
@@ -87,7 +229,7 @@ func parseInstNoOp(inst *grammar.Instruction) (BaseInstruction, error) {
 			Rs:     0x00, // r0
 		}
 	case "hlt", "meow":
-		// encoded as "bunc [r0+0xFFFF]"
+		// encoded as "bunc [r0+0xFFFF]", a misaligned target the cpu takes as halt
 		ret = BaseInstruction{
 			OpType:   Control,
 			RMem:     0x00,
@@ -103,12 +245,13 @@ func parseInstNoOp(inst *grammar.Instruction) (BaseInstruction, error) {
 			CtrlFlag: Conditions["unc"].Flag,
 			CtrlMode:  Conditions["unc"].Mode,
 		}
-
+	default:
+		err = errorAt(inst.Mnemonic, "[parseInstNoOp] invalid instruction: %s", inst.Mnemonic)
 	}
 	return ret, err
 }
 
-func parseInstOneOp(inst *grammar.Instruction) (BaseInstruction, error) {
+func (a *assembly) parseInstOneOp(inst *grammar.Instruction) (BaseInstruction, error) {
 	var ret BaseInstruction
 	var err error
 
@@ -116,12 +259,12 @@ func parseInstOneOp(inst *grammar.Instruction) (BaseInstruction, error) {
 	case "not", "neg":
 		rdval, ok := inst.Operands[0].(grammar.OperandRegister)
 		if !ok {
-			err = fmt.Errorf("[parseInstOneOp] invalid operand type: %v", reflect.TypeOf(inst.Operands[0]))
+			err = errorAt(operandToken(inst.Operands[0]), "[parseInstOneOp] invalid operand type for %s: %s", inst.Mnemonic, operandKind(inst.Operands[0]))
 			return ret, err
 		}
 		rd, ok := IntegerRegisters[rdval.Value] // register operand
 		if !ok {
-			err = fmt.Errorf("[parseInstOneOp] invalid register: %#v", rdval.Value)
+			err = errorAt(rdval.Value, "[parseInstOneOp] invalid register: %s", rdval.Value)
 			return ret, err
 		}
 		ret = BaseInstruction{
@@ -132,12 +275,12 @@ func parseInstOneOp(inst *grammar.Instruction) (BaseInstruction, error) {
 	case "push":
 		rdval, ok := inst.Operands[0].(grammar.OperandRegister)
 		if !ok {
-			err = fmt.Errorf("[parseInstOneOp] invalid operand type: %v", reflect.TypeOf(inst.Operands[0]))
+			err = errorAt(operandToken(inst.Operands[0]), "[parseInstOneOp] invalid operand type for %s: %s", inst.Mnemonic, operandKind(inst.Operands[0]))
 			return ret, err
 		}
 		rd, ok := IntegerRegisters[rdval.Value] // register operand
 		if !ok {
-			err = fmt.Errorf("[parseInstOneOp] invalid register: %#v", rdval.Value)
+			err = errorAt(rdval.Value, "[parseInstOneOp] invalid register: %s", rdval.Value)
 			return ret, err
 		}
 		ret = BaseInstruction{
@@ -148,12 +291,12 @@ func parseInstOneOp(inst *grammar.Instruction) (BaseInstruction, error) {
 	case "pop":
 		rdval, ok := inst.Operands[0].(grammar.OperandRegister)
 		if !ok {
-			err = fmt.Errorf("[parseInstOneOp] invalid operand type: %v", reflect.TypeOf(inst.Operands[0]))
+			err = errorAt(operandToken(inst.Operands[0]), "[parseInstOneOp] invalid operand type for %s: %s", inst.Mnemonic, operandKind(inst.Operands[0]))
 			return ret, err
 		}
 		rd, ok := IntegerRegisters[rdval.Value] // register operand
 		if !ok {
-			err = fmt.Errorf("[parseInstOneOp] invalid register: %#v", rdval.Value)
+			err = errorAt(rdval.Value, "[parseInstOneOp] invalid register: %s", rdval.Value)
 			return ret, err
 		}
 		ret = BaseInstruction{
@@ -164,12 +307,12 @@ func parseInstOneOp(inst *grammar.Instruction) (BaseInstruction, error) {
 	case "call":
 		mem, ok := inst.Operands[0].(grammar.OperandMemory)
 		if !ok {
-			err = fmt.Errorf("[parseInstOneOp] invalid operand type: %v", reflect.TypeOf(inst.Operands[0]))
+			err = errorAt(operandToken(inst.Operands[0]), "[parseInstOneOp] invalid operand type for %s: %s", inst.Mnemonic, operandKind(inst.Operands[0]))
 			return ret, err
 		}
-		rmem, disp, err := parseMemory(mem)
+		rmem, disp, err := a.parseMemory(mem, true)
 		if err != nil {
-			err = fmt.Errorf("[parseInstOneOp] invalid memory operand: %v %s", mem.Value, err)
+			err = fmt.Errorf("[parseInstOneOp] invalid memory operand: %w", err)
 			return ret, err
 		}
 		ret = BaseInstruction{
@@ -182,12 +325,12 @@ func parseInstOneOp(inst *grammar.Instruction) (BaseInstruction, error) {
 	case "bunc", "beq", "bz", "bne", "bnz", "blt", "bge", "blu", "bae", "ba", "bof", "bnf":
 		mem, ok := inst.Operands[0].(grammar.OperandMemory)
 		if !ok {
-			err = fmt.Errorf("[parseInstOneOp] invalid operand type: %v", reflect.TypeOf(inst.Operands[0]))
+			err = errorAt(operandToken(inst.Operands[0]), "[parseInstOneOp] invalid operand type for %s: %s", inst.Mnemonic, operandKind(inst.Operands[0]))
 			return ret, err
 		}
-		rmem, disp, err := parseMemory(mem)
+		rmem, disp, err := a.parseMemory(mem, true)
 		if err != nil {
-			err = fmt.Errorf("[parseInstOneOp] invalid memory operand: %+v %s", mem.Value, err)
+			err = fmt.Errorf("[parseInstOneOp] invalid memory operand: %w", err)
 			return ret, err
 		}
 		if cond, ok := Conditions[inst.Mnemonic[1:]]; ok {
@@ -367,54 +510,66 @@ func parseInstOneOp(inst *grammar.Instruction) (BaseInstruction, error) {
 			}
 	*/
 	default:
-		err = fmt.Errorf("[parseInstOneOp] invalid instruction: %s at %v", inst.Mnemonic, inst.Pos)
+		err = errorAt(inst.Mnemonic, "[parseInstOneOp] invalid instruction: %s", inst.Mnemonic)
 		return ret, err
 	}
 	return ret, nil
 }
 
 // Parse instructions with two opernads
-func parseInstTwoOp(inst *grammar.Instruction) (BaseInstruction, error) {
+func (a *assembly) parseInstTwoOp(inst *grammar.Instruction) (BaseInstruction, error) {
 	var ret BaseInstruction
 	var err error
 
 	rdval, ok := inst.Operands[0].(grammar.OperandRegister)
 	if !ok {
-		err = fmt.Errorf("[parseInstTwoOp] invalid operand 1 type: %T", inst.Operands[0])
+		err = errorAt(operandToken(inst.Operands[0]), "[parseInstTwoOp] invalid operand 1 type for %s: %s", inst.Mnemonic, operandKind(inst.Operands[0]))
 		return ret, err
 	}
 	rd, ok := IntegerRegisters[rdval.Value] // register operand
 	if !ok {
-		err = fmt.Errorf("[parseInstTwoOp] invalid destination register: %#v", rdval.Value)
+		err = errorAt(rdval.Value, "[parseInstTwoOp] invalid destination register: %s", rdval.Value)
 		return ret, err
 	}
-	switch inst.Operands[1].(type) {
+	switch op := inst.Operands[1].(type) {
 	case grammar.OperandImmediate:
-		return parseRI(inst, rd)
+		return a.parseRI(inst, rd)
 	case grammar.OperandRegister:
-		return parseRR(inst, rd)
+		if !isRegisterName(op.Value) && !registerPattern.MatchString(op.Value) {
+			// label used as an immediate, e.g. ldi r1, loop
+			if _, err := a.lookup(op.Value); err != nil {
+				return ret, err
+			}
+			labelInst := *inst
+			labelInst.Operands = []grammar.Operand{inst.Operands[0], grammar.OperandImmediate{Value: op.Value}}
+			return a.parseRI(&labelInst, rd)
+		}
+		return a.parseRR(inst, rd)
 	case grammar.OperandMemory:
-		return parseRMem(inst, rd)
+		return a.parseRMem(inst, rd)
 	default:
-		err = fmt.Errorf("[parseInstTwoOp] invalid operand 2 type: %T", inst.Operands[1])
+		err = errorAt(operandToken(inst.Operands[1]), "[parseInstTwoOp] invalid operand 2 type for %s: %s", inst.Mnemonic, operandKind(inst.Operands[1]))
 	}
 	return ret, err
 }
 
 // Parse register and immediate instructions
-func parseRI(inst *grammar.Instruction, rd uint8) (BaseInstruction, error) {
+func (a *assembly) parseRI(inst *grammar.Instruction, rd uint8) (BaseInstruction, error) {
 	var ret BaseInstruction
 	var err error
 
 	alu, ok := ImmALU[inst.Mnemonic]
 	if !ok {
-		err = fmt.Errorf("[parserRI] invalid ALU operation %v", inst.Mnemonic)
+		err = errorAt(inst.Mnemonic, "[parserRI] invalid ALU operation %v", inst.Mnemonic)
 		return ret, err
 	}
-	imm, err := parseImm(inst.Operands[1].(grammar.OperandImmediate).Value)
+	op := inst.Operands[1].(grammar.OperandImmediate)
+	val := op.Value
+	full, err := a.immValue(op)
 	if err != nil {
 		return ret, err
 	}
+	imm := a.truncImm(val, full)
 
 	switch inst.Mnemonic {
 	case "add", "sub", "mul", "and", "xor", "or", "orr":
@@ -447,9 +602,16 @@ func parseRI(inst *grammar.Instruction, rd uint8) (BaseInstruction, error) {
 			return ret, err
 		}
 		imm = (32 - imm) // rotate right is 32 - imm
-	case "ldi", "ldx", "cmp":
+	case "ldi":
+		if full < 0 && !isLoCall(op.Expr) {
+			a.warn(val, "[parseRI] ldi zero extends its immediate, %s loads %#x, use ldx to load a negative value", val, uint16(imm))
+		}
+	case "ldx", "cmp":
 		break
 	}
+	if inst.Mnemonic != "ldi" && full > 32767 {
+		a.warn(val, "[parseRI] immediate value %s is sign extended to %d", val, imm)
+	}
 	ret = BaseInstruction{
 		OpType: RegImm,
 		Rd:     rd,
@@ -460,24 +622,24 @@ func parseRI(inst *grammar.Instruction, rd uint8) (BaseInstruction, error) {
 }
 
 // Parse register to register instructions
-func parseRR(inst *grammar.Instruction, rd uint8) (BaseInstruction, error) {
+func (a *assembly) parseRR(inst *grammar.Instruction, rd uint8) (BaseInstruction, error) {
 	var ret BaseInstruction
 	var err error
 
 	alu, ok := RegALU[inst.Mnemonic]
 	if !ok {
-		err = fmt.Errorf("[parserRR] invalid ALU operation %v", inst.Mnemonic)
+		err = errorAt(inst.Mnemonic, "[parserRR] invalid ALU operation %v", inst.Mnemonic)
 		return ret, err
 	}
 
 	rsval, ok := inst.Operands[1].(grammar.OperandRegister)
 	if !ok {
-		err = fmt.Errorf("[parserRR] invalid operand type: %T", inst.Operands[1])
+		err = errorAt(operandToken(inst.Operands[1]), "[parserRR] invalid operand type for %s: %s", inst.Mnemonic, operandKind(inst.Operands[1]))
 		return ret, err
 	}
 	rs, ok := IntegerRegisters[rsval.Value] // register operand
 	if !ok {
-		err = fmt.Errorf("[parserRR] invalid source register: %#v", rsval.Value)
+		err = errorAt(rsval.Value, "[parserRR] invalid source register: %s", rsval.Value)
 		return ret, err
 	}
 
@@ -491,7 +653,7 @@ func parseRR(inst *grammar.Instruction, rd uint8) (BaseInstruction, error) {
 	case "cmp", "cpy", "nsa","mov":
 		break
 	default:
-		err = fmt.Errorf("[parserRR] invalid instruction: %s", inst.Mnemonic)
+		err = errorAt(inst.Mnemonic, "[parserRR] invalid instruction: %s", inst.Mnemonic)
 	}
 	ret = BaseInstruction{
 		OpType: RegReg,
@@ -503,18 +665,18 @@ func parseRR(inst *grammar.Instruction, rd uint8) (BaseInstruction, error) {
 }
 
 // Parse memory to register instructions
-func parseRMem(inst *grammar.Instruction, rd uint8) (BaseInstruction, error) {
+func (a *assembly) parseRMem(inst *grammar.Instruction, rd uint8) (BaseInstruction, error) {
 	var ret BaseInstruction
 	var err error
 
 	memval, ok := inst.Operands[1].(grammar.OperandMemory)
 	if !ok {
-		err = fmt.Errorf("[parseRMem] invalid operand type: %T", inst.Operands[1])
+		err = errorAt(operandToken(inst.Operands[1]), "[parseRMem] invalid operand type for %s: %s", inst.Mnemonic, operandKind(inst.Operands[1]))
 		return ret, err
 	}
-	rmem, disp, err := parseMemory(memval)
+	rmem, disp, err := a.parseMemory(memval, false)
 	if err != nil {
-		err = fmt.Errorf("[parseRMem] invalid memory operand: %+v err: %s", memval.Value, err)
+		err = fmt.Errorf("[parseRMem] invalid memory operand: %w", err)
 		return ret, err
 	}
 
@@ -536,68 +698,360 @@ func parseRMem(inst *grammar.Instruction, rd uint8) (BaseInstruction, error) {
 			Imm:     disp,
 		}
 	default:
-		err = fmt.Errorf("[parseRMem] invalid instruction: %s", inst.Mnemonic)
+		err = errorAt(inst.Mnemonic, "[parseRMem] invalid instruction: %s", inst.Mnemonic)
 		return ret, err
 	}
 	return ret, err
 }
 
-func parseInst(inst *grammar.Instruction) (BaseInstruction, error) {
-	// Parse the instruction based on the grammar rules, and return a slice of BaseInstruction if pseudo instructions are found.
-	//var instSlice = make([]BaseInstruction, 0, 2)
+func (a *assembly) parseInst(inst *grammar.Instruction) (BaseInstruction, error) {
+	// Parse the instruction based on the grammar rules, pseudo instructions that expand to several words are handled by parseInsts
+	if isSystemMnemonic(inst.Mnemonic) {
+		return a.parseSystemInst(inst)
+	}
 	switch len(inst.Operands) {
 	case 0:
 		// no operands
-		return parseInstNoOp(inst)
+		return a.parseInstNoOp(inst)
 	case 1:
 		// one operand
-		return parseInstOneOp(inst)
+		return a.parseInstOneOp(inst)
 	case 2:
 		// two operands
-		return parseInstTwoOp(inst)
+		return a.parseInstTwoOp(inst)
 	default:
-		err := fmt.Errorf("[parseInst] invalid number of operands: %d", len(inst.Operands))
+		err := errorAt(inst.Mnemonic, "[parseInst] invalid number of operands for %s: %d", inst.Mnemonic, len(inst.Operands))
 		return BaseInstruction{}, err
 	}
 }
 
-var Instructions []BaseInstruction
-var Labels map[string]uint32
+// Options control how an Assembler assembles a program
+type Options struct {
+	// Symbols defined before the program is assembled, as if by .equ at the top of the program
+	Defines map[string]uint32
+	// Reads files named by .include, defaults to os.ReadFile
+	ReadFile func(name string) ([]byte, error)
+	// Assemble an object file for r8 link, see Result.Object
+	Relocatable bool
+}
+
+// Assembler turns source into machine words. It holds no state between calls,
+// so one Assembler can be used from many goroutines at once
+type Assembler struct {
+	Options Options
+}
+
+// Result of assembling a program
+type Result struct {
+	File          string // name of the file that was assembled
+	Words         []Word
+	Symbols       map[string]uint32              // labels and .equ constants
+	SourceMap     map[uint32]lexer.Position      // source position of the line that produced each address
+	Expansions    map[uint32][]grammar.Expansion // macro calls that produced the word at an address, innermost first
+	Definitions   map[string]lexer.Position      // where each symbol is defined, symbols from Options.Defines have none
+	Constants     map[string]bool                // symbols defined by .equ or Options.Defines rather than labels
+	Sources       map[string][]string            // lines of every source file, empty when assembling parsed lines
+	Sections      []Section                      // in address order
+	LabelSections map[string]string              // section of each label
+	Globals       map[string]bool                // symbols declared .global
+	Externs       []string                       // symbols declared .extern, sorted
+	Relocatable   bool                           // assembled with Options.Relocatable
+	Relocations   map[uint32]Relocation          // relocation of the word at an address, only in object files
+	Warnings      Diagnostics
+}
+
+// Image encodes the assembled words into a sparse memory image
+func (r *Result) Image() Image {
+	img := make(Image, len(r.Words))
+	for _, w := range r.Words {
+		img[w.Addr] = w.Encode()
+	}
+	return img
+}
+
+func New(opts Options) *Assembler {
+	return &Assembler{Options: opts}
+}
 
-// func parseLabel(label *grammar.Label) (uint32, error) {
+// Parse and assemble a program read from r, filename is used in diagnostics.
+// On failure the error is a Diagnostics holding every error and warning found
+func (asm *Assembler) Assemble(filename string, r io.Reader) (*Result, error) {
+	src, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("[Assemble] failed to read %s: %v", filename, err)
+	}
+	return asm.AssembleString(filename, string(src))
+}
 
-// 	var err error
-// 	Labels[label.Text] = label.Offset
-// 	return label.Offset, err
-	
-// }
+// Parse and assemble a program held in a string
+func (asm *Assembler) AssembleString(filename string, src string) (*Result, error) {
+	a := newAssembly(asm.Options)
+	a.file = filename
+	a.assembleLines(a.parseSource(a.preprocess(filename, src, asm.Options.ReadFile)))
+	return a.result()
+}
 
-func ParseLines(lines []grammar.Line) (*[]BaseInstruction,error) {
-	for _, line := range lines {
-		if line.Directive != nil {
-			// TODO: handle directives
-			continue
+// Assemble already parsed lines, the label offsets of the lines are filled in.
+// Diagnostics have no source excerpts as the source text is not known
+func (asm *Assembler) AssembleLines(lines []grammar.Line) (*Result, error) {
+	a := newAssembly(asm.Options)
+	a.assembleLines(lines)
+	return a.result()
+}
+
+// State of a single run of the assembler
+type assembly struct {
+	symbols   map[string]uint32
+	words     []Word
+	sourceMap map[uint32]lexer.Position
+	sources   map[string][]string // source lines of each file, for diagnostics
+	diags     Diagnostics
+	sizes     map[*grammar.Instruction]uint32 // words reserved for pseudo instructions, see relax
+	defined   map[string]lexer.Position
+	constants map[string]bool
+	expanded  map[uint32][]grammar.Expansion
+	line      *grammar.Line                   // line being assembled
+	addr      uint32                          // address of the line being assembled, used to make label references pc relative
+	file      string
+	usesAt    bool // the program has branch pseudo instructions, see checkAt
+
+	relocatable   bool
+	sections      []*section
+	section       *section          // section being assembled
+	labelSections map[string]string // section of each label
+	globals       map[string]lexer.Position
+	externs       map[string]lexer.Position
+	relocs        []reloc
+}
+
+func newAssembly(opts Options) *assembly {
+	a := &assembly{
+		symbols:   make(map[string]uint32, len(opts.Defines)),
+		sourceMap: make(map[uint32]lexer.Position),
+		sources:   make(map[string][]string),
+		sizes:     make(map[*grammar.Instruction]uint32),
+		defined:   make(map[string]lexer.Position),
+		constants: make(map[string]bool),
+		expanded:  make(map[uint32][]grammar.Expansion),
+
+		relocatable:   opts.Relocatable,
+		labelSections: make(map[string]string),
+		globals:       make(map[string]lexer.Position),
+		externs:       make(map[string]lexer.Position),
+	}
+	for name, val := range opts.Defines {
+		a.symbols[name] = val
+		a.constants[name] = true
+	}
+	return a
+}
+
+func (a *assembly) result() (*Result, error) {
+	a.diags = a.diags.sorted()
+	if a.diags.Errors() > 0 {
+		return nil, a.diags
+	}
+	res := &Result{
+		File:          a.file,
+		Words:         a.words,
+		Symbols:       a.symbols,
+		SourceMap:     a.sourceMap,
+		Expansions:    a.expanded,
+		Definitions:   a.defined,
+		Constants:     a.constants,
+		Sources:       a.sources,
+		LabelSections: a.labelSections,
+		Globals:       make(map[string]bool, len(a.globals)),
+		Externs:       sortedNames(a.externs),
+		Relocatable:   a.relocatable,
+		Relocations:   make(map[uint32]Relocation, len(a.relocs)),
+		Warnings:      a.diags,
+	}
+	for _, s := range a.sections {
+		res.Sections = append(res.Sections, Section{Name: s.name, Addr: s.base, Size: s.end - s.base, Align: s.align})
+	}
+	for name := range a.globals {
+		res.Globals[name] = true
+	}
+	for _, r := range a.relocs {
+		res.Relocations[r.addr] = r.rel
+	}
+	return res, nil
+}
+
+// Parse a single instruction with no symbols defined
+func parseInst(inst *grammar.Instruction) (BaseInstruction, error) {
+	return newAssembly(Options{}).parseInst(inst)
+}
+
+// First pass, assign an address to every line, label and .equ symbol and check for duplicate names.
+// The layout is repeated until the size of every pseudo instruction is known.
+// Returns the address of each line
+func (a *assembly) parseLabels(lines []grammar.Line) []uint32 {
+	symbols, ndiags := maps.Clone(a.symbols), len(a.diags)
+	for {
+		addrs := a.layoutLines(lines)
+		relaxed := a.relax(lines, addrs)
+		if !a.placeSections() && !relaxed {
+			return addrs
 		}
+		a.symbols, a.diags = maps.Clone(symbols), a.diags[:ndiags]
+	}
+}
+
+func (a *assembly) layoutLines(lines []grammar.Line) []uint32 {
+	defined := make(map[string]lexer.Position)
+	addrs := make([]uint32, len(lines))
+	for _, s := range a.sections {
+		s.addr, s.end = s.base, s.base
+	}
+	a.section = a.sectionNamed("text")
+	addr := a.section.base
+	for i := range lines {
+		line := &lines[i]
+		a.line = line
+		addrs[i] = addr
 		if line.Label != nil {
-			// TODO: handle labels
-			Labels[line.Label.Text] = line.Label.Offset
-			continue
+			name := line.Label.Name()
+			if isRegisterName(name) {
+				a.errorf(line.Pos, errorAt(name, "[parseLabels] label %s is a register name", name))
+			} else if pos, ok := defined[name]; ok {
+				a.errorf(line.Pos, errorAt(name, "[parseLabels] duplicate label %s, first defined at %v", name, pos))
+			} else if _, ok := a.symbols[name]; ok {
+				a.errorf(line.Pos, errorAt(name, "[parseLabels] label %s is already defined as a constant", name))
+			} else if _, ok := a.externs[name]; ok {
+				a.errorf(line.Pos, errorAt(name, "[parseLabels] label %s is declared .extern", name))
+			} else {
+				line.Label.Offset = addr
+				a.symbols[name] = addr
+				a.defined[name] = line.Pos
+				a.labelSections[name] = a.section.name
+				defined[name] = line.Pos
+			}
+		}
+		if line.Directive != nil {
+			next, err := a.layoutDirective(line.Directive, addr)
+			if err != nil {
+				a.errorf(line.Pos, err)
+			}
+			if line.Directive.Type == ".org" || line.Directive.Type == ".align" {
+				addrs[i] = next // .org and .align move the address of the line itself
+			}
+			addr = next
 		}
 		if line.Instruction != nil {
-			inst, err := parseInst(line.Instruction)
+			addr += 4 * a.instSize(line.Instruction)
+		}
+		a.section.end = max(a.section.end, addr)
+	}
+	a.section.addr = addr
+	a.line = nil
+	return addrs
+}
+
+// Assemble the lines in two passes, the first pass records label addresses so that
+// instructions in the second pass can refer to labels defined later in the program.
+// Errors are recorded and the line skipped so that all errors are reported at once
+func (a *assembly) assembleLines(lines []grammar.Line) {
+	addrs := a.parseLabels(lines)
+	place := func(line *grammar.Line, w Word) {
+		if pos, ok := a.sourceMap[w.Addr]; ok {
+			a.errorf(line.Pos, fmt.Errorf("[parseLines] address %#x overlaps with %v", w.Addr, pos))
+			return
+		}
+		a.sourceMap[w.Addr] = line.Pos
+		if len(line.Expansions) > 0 {
+			a.expanded[w.Addr] = line.Expansions
+		}
+		a.words = append(a.words, w)
+	}
+	for i := range lines {
+		if lines[i].Instruction != nil && isBranchPseudo(lines[i].Instruction) {
+			a.usesAt = true
+		}
+	}
+	a.section = a.sectionNamed("text")
+	for i := range lines {
+		line := &lines[i]
+		a.line = line
+		a.addr = addrs[i]
+		a.enterSection(line)
+		nrelocs := len(a.relocs)
+		if line.Directive != nil {
+			data, err := a.parseDirective(line.Directive)
 			if err != nil {
-				return nil,fmt.Errorf("[parseLines] invalid instruction at position %v: %v", line.Pos, err)
+				a.errorf(line.Pos, err)
+				a.relocs = a.relocs[:nrelocs]
+				continue
+			}
+			for j, d := range data {
+				place(line, Word{Addr: a.addr + 4*uint32(j), Data: d})
 			}
-			Instructions = append(Instructions, inst)
 		}
+		if line.Instruction != nil && isFloatMnemonic(line.Instruction.Mnemonic) {
+			inst, err := a.parseFloatInst(line.Instruction)
+			if err != nil {
+				a.errorf(line.Pos, err)
+				a.relocs = a.relocs[:nrelocs]
+				continue
+			}
+			a.checkFloat(line.Instruction, &inst)
+			place(line, Word{Addr: a.addr, Float: &inst})
+		} else if line.Instruction != nil && isVectorMnemonic(line.Instruction.Mnemonic) {
+			inst, err := a.parseVectorInst(line.Instruction)
+			if err != nil {
+				a.errorf(line.Pos, err)
+				a.relocs = a.relocs[:nrelocs]
+				continue
+			}
+			a.checkVector(line.Instruction, &inst)
+			place(line, Word{Addr: a.addr, Vector: &inst})
+		} else if line.Instruction != nil && isSubWordMnemonic(line.Instruction.Mnemonic) {
+			inst, err := a.parseSubWordInst(line.Instruction)
+			if err != nil {
+				a.errorf(line.Pos, err)
+				a.relocs = a.relocs[:nrelocs]
+				continue
+			}
+			a.checkSubWord(line.Instruction, &inst)
+			place(line, Word{Addr: a.addr, SubWord: &inst})
+		} else if line.Instruction != nil {
+			insts, err := a.parseInsts(line.Instruction)
+			if err != nil {
+				a.errorf(line.Pos, err)
+				a.relocs = a.relocs[:nrelocs]
+				continue
+			}
+			a.checkAt(line.Instruction, insts[0].Rd, writesRd(&insts[0]))
+			for j := range insts {
+				a.checkInst(line.Instruction, &insts[j])
+				place(line, Word{Addr: a.addr + 4*uint32(j), Inst: &insts[j]})
+			}
+		}
+	}
+	a.line = nil
+	a.checkGlobals()
+}
+
+// Warn about instructions that assemble but are likely mistakes
+func (a *assembly) checkInst(src *grammar.Instruction, inst *BaseInstruction) {
+	if inst.Rd != 0 || src.Mnemonic == "nop" || len(src.Operands) == 0 {
+		return
+	}
+	if writesRd(inst) {
+		a.warn(operandToken(src.Operands[0]), "%s writes to r0, the result is discarded", src.Mnemonic)
 	}
-	return &Instructions,nil
 }
 
-func EncInstructions(insts *[]BaseInstruction) []uint32 {
-	enc := make([]uint32, len(*insts))
-	for i, inst := range *insts {
-		enc[i] = inst.Encode()
+// Check if inst writes its Rd register
+func writesRd(inst *BaseInstruction) bool {
+	switch inst.OpType {
+	case RegImm:
+		return inst.ALU != IMM_CMP && !(inst.ALU == IMM_SR && inst.Imm&SR_WRITE != 0)
+	case RegReg:
+		return inst.ALU != REG_CMP
+	case LoadStore:
+		return inst.MemMode == LDW || inst.MemMode == POP
 	}
-	return enc
+	return false
 }
@@ -1,6 +1,10 @@
 package assembler
 
 import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/leon332157/risc-y-8/cmd/r8/assembler/grammar"
@@ -443,3 +447,565 @@ func TestRegReg(t *testing.T) {
 
 	runTests(t, &tests)
 }
+
+func assemble(t *testing.T, src string) (*Result, error) {
+	t.Helper()
+	prog, err := grammar.ParseString(t.Name(), src)
+	if err != nil {
+		t.Fatalf("failed to parse %q: %v", src, err)
+	}
+	return New(Options{}).AssembleLines(prog.Lines)
+}
+
+func assembleString(t *testing.T, src string) ([]BaseInstruction, error) {
+	t.Helper()
+	res, err := assemble(t, src)
+	if err != nil {
+		return nil, err
+	}
+	insts := []BaseInstruction{}
+	for _, w := range res.Words {
+		if w.Inst != nil {
+			insts = append(insts, *w.Inst)
+		}
+	}
+	return insts, nil
+}
+
+func assembleImage(t *testing.T, src string) (Image, error) {
+	t.Helper()
+	res, err := assemble(t, src)
+	if err != nil {
+		return nil, err
+	}
+	return res.Image(), nil
+}
+
+func TestLabels(t *testing.T) {
+	src := `
+start:
+	ldi r1, end
+	ldw r2, [table]
+	ldw r3, [r1 + table]
+loop: sub r1, 1
+	bne [loop]
+	call [start]
+	bunc [end]
+table:
+	nop
+end:
+	hlt
+`
+	res, err := assemble(t, src)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	insts, _ := assembleString(t, src)
+	expected := []BaseInstruction{
+		{OpType: RegImm, Rd: 1, ALU: ImmALU["ldi"], Imm: 32},
+		{OpType: LoadStore, Rd: 2, MemMode: LDW, RMem: 0, Imm: 28},
+		{OpType: LoadStore, Rd: 3, MemMode: LDW, RMem: 1, Imm: 28},
+		{OpType: RegImm, Rd: 1, ALU: ImmALU["sub"], Imm: 1},
+		{OpType: Control, CtrlMode: NE.Mode, CtrlFlag: NE.Flag, Imm: -8},
+		{OpType: Control, CtrlMode: CALL.Mode, CtrlFlag: CALL.Flag, Imm: -24},
+		{OpType: Control, CtrlMode: UNC.Mode, CtrlFlag: UNC.Flag, Imm: 4},
+		{OpType: RegReg, ALU: RegALU["cpy"]},
+		{OpType: Control, CtrlMode: UNC.Mode, CtrlFlag: UNC.Flag, Imm: -1},
+	}
+	if len(insts) != len(expected) {
+		t.Fatalf("expected %d instructions, got %d", len(expected), len(insts))
+	}
+	for i := range expected {
+		if insts[i] != expected[i] {
+			t.Errorf("Num: %v Expected %+v, got %+v", i, expected[i], insts[i])
+		}
+	}
+	if res.Symbols["table"] != 28 || res.Symbols["end"] != 32 || res.Symbols["loop"] != 12 {
+		t.Errorf("wrong label addresses: %v", res.Symbols)
+	}
+}
+
+func TestLabelErrors(t *testing.T) {
+	for _, src := range []string{
+		"bunc [nowhere]\n",
+		"ldw r1, [r2 + nowhere]\n",
+		"a:\nnop\na:\nnop\n",
+		"sp:\nnop\n",
+	} {
+		if _, err := assembleString(t, src); err == nil {
+			t.Errorf("expected error for %q", src)
+		} else {
+			t.Logf("got expected error for %q: %v", src, err)
+		}
+	}
+}
+
+func TestDirectives(t *testing.T) {
+	src := `
+.equ SIZE, 3
+.equ neg, -2
+	ldi r1, size
+	ldw r2, [r0 + table]
+	hlt
+.align 16
+table:
+	.word 0xdeadbeef, size, end, neg
+	.fill SIZE, 7
+msg: .string "Hi!\n"
+.org 0x40
+end:
+	.fill 1
+`
+	img, err := assembleImage(t, src)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[uint32]uint32{
+		16:   0xdeadbeef,
+		20:   3,
+		24:   0x40,
+		28:   0xfffffffe,
+		32:   7,
+		36:   7,
+		40:   7,
+		44:   0x0a216948, // "Hi!\n"
+		48:   0,          // NUL terminator
+		0x40: 0,
+	}
+	for addr, val := range expected {
+		if img[addr] != val {
+			t.Errorf("address %#x: expected %#08x, got %#08x", addr, val, img[addr])
+		}
+	}
+	ldi := BaseInstruction{OpType: RegImm, Rd: 1, ALU: ImmALU["ldi"], Imm: 3}
+	if img[0] != ldi.Encode() {
+		t.Errorf("expected ldi r1, 3 at address 0, got %#08x", img[0])
+	}
+	if len(img) != 3+len(expected) {
+		t.Errorf("expected %d words in image, got %d", 3+len(expected), len(img))
+	}
+	if img.Size() != 0x11 || len(img.Flatten()) != 0x11 {
+		t.Errorf("expected image size 0x11 words, got %#x", img.Size())
+	}
+}
+
+func TestDirectiveErrors(t *testing.T) {
+	for _, src := range []string{
+		"nop\n.org 0\nnop\n",
+		".org 2\nnop\n",
+		".align 2\nnop\n",
+		".equ a, 1\n.equ a, 2\n",
+		".equ r1, 1\n",
+		".fill later\nlater:\nnop\n",
+		".word 0x100000000\n",
+		".bogus 1\n",
+		".string 1\n",
+	} {
+		if _, err := assembleImage(t, src); err == nil {
+			t.Errorf("expected error for %q", src)
+		}
+	}
+}
+
+func TestExpressions(t *testing.T) {
+	src := `
+.equ BIG, 0x1234abcd
+.equ N, 4
+start:
+	ldi r1, hi(BIG)
+	shl r1, 16
+	add r1, lo(BIG)
+	ldi r2, (N*2+1) << 2
+	add r3, end - start
+	ldw r4, [r5 + N*2]
+	ldw r4, [r5 - (1|2)]
+	ldw r4, [table + 4]
+	bne [start]
+	and r3, ~0 & 0xf0 | 1 ^ 3
+end:
+table:
+	.word BIG >> 16, -N * 2, lo(0x18000), 7 % 4 - -1
+`
+	img, err := assembleImage(t, src)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []BaseInstruction{
+		{OpType: RegImm, Rd: 1, ALU: ImmALU["ldi"], Imm: 0x1235},
+		{OpType: RegImm, Rd: 1, ALU: ImmALU["shl"], Imm: 16},
+		{OpType: RegImm, Rd: 1, ALU: ImmALU["add"], Imm: -0x5433},
+		{OpType: RegImm, Rd: 2, ALU: ImmALU["ldi"], Imm: 36},
+		{OpType: RegImm, Rd: 3, ALU: ImmALU["add"], Imm: 40},
+		{OpType: LoadStore, Rd: 4, MemMode: LDW, RMem: 5, Imm: 8},
+		{OpType: LoadStore, Rd: 4, MemMode: LDW, RMem: 5, Imm: -3},
+		{OpType: LoadStore, Rd: 4, MemMode: LDW, RMem: 0, Imm: 44},
+		{OpType: Control, CtrlMode: NE.Mode, CtrlFlag: NE.Flag, Imm: -36},
+		{OpType: RegImm, Rd: 3, ALU: ImmALU["and"], Imm: 0xf0 | (1 ^ 3)},
+	}
+	for i, inst := range expected {
+		if img[4*uint32(i)] != inst.Encode() {
+			var got BaseInstruction
+			got.Decode(img[4*uint32(i)])
+			t.Errorf("Num: %v Expected %+v, got %+v", i, inst, got)
+		}
+	}
+	words := []uint32{0x1234, 0xfffffff8, 0xffff8000, 4}
+	for i, val := range words {
+		if addr := uint32(40 + 4*i); img[addr] != val {
+			t.Errorf("address %#x: expected %#08x, got %#08x", addr, val, img[addr])
+		}
+	}
+	for _, x := range []int64{0, 1, 0x7fff, 0x8000, 0xffff, 0x12345678, 0xdeadbeef, -1} {
+		hi := ((x + 0x8000) >> 16) & 0xffff
+		lo := int64(int16(x))
+		if uint32(hi<<16+lo) != uint32(x) {
+			t.Errorf("hi/lo do not recombine to %#x: hi %#x lo %d", x, hi, lo)
+		}
+	}
+}
+
+func TestExpressionErrors(t *testing.T) {
+	for _, src := range []string{
+		"add r1, 1/0\n",
+		"add r1, 1 % (2-2)\n",
+		"add r1, 1 << 64\n",
+		"add r1, r2 + 1\n",
+		"add r1, nowhere + 1\n",
+		"add r1, 0x10000 * 2\n",
+		"add r1, -(0x8000 * 4)\n",
+		"add r1, bogus(1)\n",
+		"ldw r1, [r2 * 2]\n",
+		"ldw r1, [r2 | 1]\n",
+		"ldw r1, [0x10000]\n",
+		"bunc [start + 0x8000]\nstart:\n",
+		".word 0x10000 << 16\n",
+	} {
+		if _, err := assembleImage(t, src); err == nil {
+			t.Errorf("expected error for %q", src)
+		}
+	}
+}
+
+func TestPseudoInstructions(t *testing.T) {
+	src := `
+	li r1, 0xdeadbeef
+	li r2, -5
+	li r3, 0x8000
+	li r4, 0x10000
+	la r5, data
+	inc r6
+	dec r6
+	clr r7
+loop:
+	jmp loop
+	beq data
+	call r9
+	jmp [lr]
+data:
+	.word 1
+`
+	img, err := assembleImage(t, src)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ri := func(rd uint8, alu string, imm int16) BaseInstruction {
+		return BaseInstruction{OpType: RegImm, Rd: rd, ALU: ImmALU[alu], Imm: imm}
+	}
+	expected := []BaseInstruction{
+		ri(1, "ldi", -0x2152), // 0xdeae
+		ri(1, "shl", 16),
+		ri(1, "add", -0x4111),
+		ri(2, "ldx", -5),
+		ri(3, "ldi", -0x8000),
+		ri(4, "ldi", 1),
+		ri(4, "shl", 16),
+		ri(5, "ldi", 60),
+		ri(6, "add", 1),
+		ri(6, "sub", 1),
+		{OpType: RegReg, Rd: 7, ALU: RegALU["xor"], Rs: 7},
+		{OpType: Control, CtrlMode: UNC.Mode, CtrlFlag: UNC.Flag, Imm: -4},
+		{OpType: Control, CtrlMode: EQ.Mode, CtrlFlag: EQ.Flag, Imm: 8},
+		{OpType: Control, CtrlMode: CALL.Mode, CtrlFlag: CALL.Flag, RMem: 9},
+		{OpType: Control, CtrlMode: UNC.Mode, CtrlFlag: UNC.Flag, RMem: IntegerRegisters["lr"]},
+	}
+	for i, inst := range expected {
+		if img[4*uint32(i)] != inst.Encode() {
+			var got BaseInstruction
+			got.Decode(img[4*uint32(i)])
+			t.Errorf("Num: %v Expected %+v, got %+v", i, inst, got)
+		}
+	}
+	if img[60] != 1 {
+		t.Errorf("expected data at address 60, got %#x", img[60])
+	}
+}
+
+func TestPseudoFarBranch(t *testing.T) {
+	src := `
+	beq far
+	jmp far
+	call far
+	hlt
+.org 0x12340
+far:
+	bne start
+	hlt
+.org 0x20000
+start:
+	nop
+`
+	res, err := assemble(t, src)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	img := res.Image()
+	at := IntegerRegisters["at"]
+	branch := func(cond ControlOp, rmem uint8, imm int16) BaseInstruction {
+		return BaseInstruction{OpType: Control, CtrlMode: cond.Mode, CtrlFlag: cond.Flag, RMem: rmem, Imm: imm}
+	}
+	load := []BaseInstruction{
+		{OpType: RegImm, Rd: at, ALU: ImmALU["ldi"], Imm: 1},
+		{OpType: RegImm, Rd: at, ALU: ImmALU["shl"], Imm: 16},
+		{OpType: RegImm, Rd: at, ALU: ImmALU["add"], Imm: 0x2340},
+	}
+	expected := []BaseInstruction{branch(EQ, 0, 4), branch(UNC, 0, 16)}
+	expected = append(expected, load...)
+	expected = append(expected, branch(UNC, at, 0))
+	expected = append(expected, load...)
+	expected = append(expected, branch(UNC, at, 0))
+	expected = append(expected, load...)
+	expected = append(expected, branch(CALL, at, 0))
+	for i, inst := range expected {
+		if img[4*uint32(i)] != inst.Encode() {
+			var got BaseInstruction
+			got.Decode(img[4*uint32(i)])
+			t.Errorf("Num: %v Expected %+v, got %+v", i, inst, got)
+		}
+	}
+	// labels after the expansions account for their size
+	if res.Symbols["far"] != 0x12340 || res.Symbols["start"] != 0x20000 {
+		t.Errorf("wrong label addresses: %v", res.Symbols)
+	}
+	// start is more than 32767 bytes after far, the branch to it is expanded as well and
+	// loading 0x20000 takes two instructions
+	bne, skip, back, hlt := branch(NE, 0, 4), branch(UNC, 0, 12), branch(UNC, at, 0), branch(UNC, 0, -1)
+	if img[0x12340] != bne.Encode() || img[0x12344] != skip.Encode() || img[0x12350] != back.Encode() {
+		t.Errorf("expected far conditional branch at %#x, got %#08x %#08x", 0x12340, img[0x12340], img[0x12344])
+	}
+	if img[0x12354] != hlt.Encode() {
+		t.Errorf("expected hlt after the far branch, got %#08x", img[0x12354])
+	}
+}
+
+func TestPseudoErrors(t *testing.T) {
+	for _, src := range []string{
+		"li r1\n",
+		"li r1, r2\n",
+		"li 5, 1\n",
+		"li r1, 0x100000000\n",
+		"la r1, nowhere\n",
+		"jmp nowhere\n",
+		"inc 1\n",
+		"clr r1, r2\n",
+	} {
+		if _, err := assembleImage(t, src); err == nil {
+			t.Errorf("expected error for %q", src)
+		}
+	}
+}
+
+func TestAssemblerConcurrent(t *testing.T) {
+	asm := New(Options{Defines: map[string]uint32{"base": 0x40}})
+	var wg sync.WaitGroup
+	for n := range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// every program has a different number of instructions before its label
+			src := strings.Repeat("nop\n", n) + "here:\n\tldi r1, here\n\tldw r2, [base]\n"
+			res, err := asm.AssembleString(fmt.Sprintf("prog%d.asm", n), src)
+			if err != nil {
+				t.Errorf("prog %d: unexpected error: %v", n, err)
+				return
+			}
+			if len(res.Words) != n+2 {
+				t.Errorf("prog %d: expected %d words, got %d", n, n+2, len(res.Words))
+			}
+			if res.Symbols["here"] != uint32(4*n) || res.Symbols["base"] != 0x40 {
+				t.Errorf("prog %d: wrong symbols: %v", n, res.Symbols)
+			}
+			img := res.Image()
+			expected := []BaseInstruction{
+				{OpType: RegImm, Rd: 1, ALU: ImmALU["ldi"], Imm: int16(4 * n)},
+				{OpType: LoadStore, Rd: 2, MemMode: LDW, Imm: 0x40},
+			}
+			for i, inst := range expected {
+				addr := uint32(4 * (n + i))
+				if img[addr] != inst.Encode() {
+					t.Errorf("prog %d: expected %08x at %d, got %08x", n, inst.Encode(), addr, img[addr])
+				}
+				if pos := res.SourceMap[addr]; pos.Filename != fmt.Sprintf("prog%d.asm", n) || pos.Line != n+2+i {
+					t.Errorf("prog %d: wrong source position for %d: %v", n, addr, pos)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestDiagnostics(t *testing.T) {
+	src := `start:
+	ldi r1, -1
+	ADD r2, r99
+	add r0, 1
+	bne [nowhere]
+start:
+	add r1 r2 ]
+	.word 1, sp
+	hlt
+`
+	_, err := New(Options{}).AssembleString("diag.asm", src)
+	diags, ok := err.(Diagnostics)
+	if !ok {
+		t.Fatalf("expected Diagnostics, got %v", err)
+	}
+	expected := []struct {
+		severity Severity
+		line     int
+		column   int
+		length   int
+		contains string
+	}{
+		{SeverityWarning, 2, 10, 2, "zero extends"},
+		{SeverityError, 3, 10, 3, "invalid source register: r99"},
+		{SeverityWarning, 4, 6, 2, "writes to r0"},
+		{SeverityError, 5, 7, 7, "undefined label: nowhere"},
+		{SeverityError, 6, 1, 5, "duplicate label start"},
+		{SeverityError, 7, 12, 1, "syntax error"},
+		{SeverityError, 8, 11, 2, "register sp can not be used as a value"},
+	}
+	if len(diags) != len(expected) {
+		t.Fatalf("expected %d diagnostics, got %d:\n%s", len(expected), len(diags), diags.Format())
+	}
+	if diags.Errors() != 5 {
+		t.Errorf("expected 5 errors, got %d", diags.Errors())
+	}
+	for i, e := range expected {
+		d := diags[i]
+		if d.Severity != e.severity || d.Pos.Line != e.line || d.Pos.Column != e.column || d.Length != e.length || !strings.Contains(d.Msg, e.contains) {
+			t.Errorf("diagnostic %d: expected %v %d:%d length %d containing %q, got %v length %d", i, e.severity, e.line, e.column, e.length, e.contains, d, d.Length)
+		}
+		if strings.Contains(d.Msg, "[parse") {
+			t.Errorf("diagnostic %d: internal tag in message %q", i, d.Msg)
+		}
+	}
+	caret := "diag.asm:3:10: error: invalid source register: r99\n    3 | \tADD r2, r99\n      | \t        ^~~"
+	if got := diags[1].Format(); got != caret {
+		t.Errorf("expected caret output\n%s\ngot\n%s", caret, got)
+	}
+}
+
+func TestUndefinedLabelOperand(t *testing.T) {
+	src := ".macro twice reg, v\n\tadd \\reg, \\v\n\tadd \\reg, \\v\n.endm\n" +
+		"\tldi r1, nolabel\n\tadd r2, missing\n\tadd r2, r99\n\ttwice r3, bogus\n\tldi r4, later\nlater:\n\thlt\n"
+	_, err := New(Options{}).AssembleString("labels.asm", src)
+	diags, ok := err.(Diagnostics)
+	if !ok {
+		t.Fatalf("expected Diagnostics, got %v", err)
+	}
+	expected := []struct {
+		line, column int
+		msg          string
+	}{
+		{2, 2, "undefined label: bogus"}, // in the expansion of twice
+		{3, 2, "undefined label: bogus"},
+		{5, 10, "undefined label: nolabel"},
+		{6, 10, "undefined label: missing"},
+		{7, 10, "invalid source register: r99"}, // looks like a register, not a label
+	}
+	if len(diags) != len(expected) {
+		t.Fatalf("expected %d diagnostics, got %d:\n%s", len(expected), len(diags), diags.Format())
+	}
+	for i, e := range expected {
+		d := diags[i]
+		if d.Pos.Line != e.line || d.Pos.Column != e.column || d.Msg != e.msg {
+			t.Errorf("diagnostic %d: expected %d:%d %q, got %v", i, e.line, e.column, e.msg, d)
+		}
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	res, err := New(Options{}).AssembleString("warn.asm", "add r1, 0x8000\nldw r1, [r2 + 0xffff]\nand r1, 0x7fff\nldi r1, 0xffff\ncmp r0, 1\nldi r2, lo(0x18000)\nldi r3, -1\n")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// lo(0x18000) is negative but ldi loads its low 16 bits as asked
+	if len(res.Warnings) != 3 || res.Warnings[0].Pos.Line != 1 || res.Warnings[1].Pos.Line != 2 || res.Warnings[2].Pos.Line != 7 {
+		t.Errorf("expected sign extension warnings on lines 1 and 2 and a zero extension warning on line 7, got:\n%s", res.Warnings.Format())
+	}
+}
+
+func TestAtWarning(t *testing.T) {
+	// at is only reserved once a branch pseudo instruction may expand through it
+	for _, tt := range []struct {
+		src   string
+		lines []int
+	}{
+		{"ldi at, 1\nadd r28, 2\nbunc [r1]\n", nil},
+		{"ldi at, 1\nli r28, 0x12345\ncmp at, 1\nstw at, [r1]\nldbu at, [r1]\nbne done\ndone: hlt\n", []int{1, 2, 5}},
+		{"jmp far\n.org 0x10000\nfar: inc r28\n", []int{3}},
+	} {
+		res, err := New(Options{}).AssembleString("at.asm", tt.src)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %v", tt.src, err)
+		}
+		var lines []int
+		for _, w := range res.Warnings {
+			lines = append(lines, w.Pos.Line)
+		}
+		if !slices.Equal(lines, tt.lines) {
+			t.Errorf("%q: expected warnings on lines %v, got:\n%s", tt.src, tt.lines, res.Warnings.Format())
+		}
+	}
+}
+
+func TestMacros(t *testing.T) {
+	files := map[string]string{
+		"lib/loop.asm": ".macro countdown reg, from\n\tli \\reg, \\from\n.loop:\n\tdec \\reg\n\tbne .loop\n.endm\n",
+	}
+	asm := New(Options{ReadFile: func(name string) ([]byte, error) {
+		if src, ok := files[name]; ok {
+			return []byte(src), nil
+		}
+		return nil, fmt.Errorf("no such file")
+	}})
+	res, err := asm.AssembleString("main.asm", ".include \"lib/loop.asm\"\nstart: countdown r1, 3\n\tcountdown r2, 4\n\thlt\n")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	img := res.Image()
+	bne := BaseInstruction{OpType: Control, CtrlMode: NE.Mode, CtrlFlag: NE.Flag, Imm: -8}
+	if len(img) != 7 || img[8] != bne.Encode() || img[20] != bne.Encode() {
+		t.Errorf("expected two countdown loops, got %v", img)
+	}
+	if res.Symbols["start"] != 0 || res.Symbols[".loop__1"] != 4 || res.Symbols[".loop__2"] != 16 {
+		t.Errorf("expected a local label per expansion, got %v", res.Symbols)
+	}
+
+	// errors inside a macro point at the definition and the call
+	_, err = asm.AssembleString("main.asm", ".include \"lib/loop.asm\"\n\tcountdown r1, nowhere\n.endm\n")
+	diags, ok := err.(Diagnostics)
+	if !ok || len(diags) != 2 {
+		t.Fatalf("expected 2 diagnostics, got %v", err)
+	}
+	d := diags[0]
+	if d.Pos.Filename != "lib/loop.asm" || d.Pos.Line != 2 || len(d.Notes) != 1 || d.Notes[0].Pos.Filename != "main.asm" || d.Notes[0].Pos.Line != 2 || d.Notes[0].Pos.Column != 2 {
+		t.Errorf("wrong position for error in macro: %+v", d)
+	}
+	if !strings.Contains(d.Format(), "note: in expansion of macro countdown") {
+		t.Errorf("expected a note in:\n%s", d.Format())
+	}
+	if diags[1].Pos.Filename != "main.asm" || diags[1].Pos.Line != 3 {
+		t.Errorf("expected an error for .endm without .macro, got %v", diags[1])
+	}
+}
@@ -0,0 +1,139 @@
+package assembler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// DebugInfo maps byte addresses of an assembled image back to the source, it is saved as
+// JSON next to the image with r8 assemble --source-map so other commands can load it
+type DebugInfo struct {
+	Version int          `json:"version"`
+	Lines   []LineInfo   `json:"lines"`   // one entry per assembled word, sorted by address
+	Symbols []SymbolInfo `json:"symbols"` // sorted by value, then name
+}
+
+const debugInfoVersion = 2
+
+// Source of an assembled word
+type LineInfo struct {
+	Addr  uint32     `json:"addr"`
+	File  string     `json:"file"`
+	Line  int        `json:"line"`
+	Text  string     `json:"text,omitempty"`  // source line, from the macro definition for expanded lines
+	Calls []CallInfo `json:"calls,omitempty"` // macro calls the line was expanded from, innermost first
+}
+
+type CallInfo struct {
+	Macro string `json:"macro"`
+	File  string `json:"file"`
+	Line  int    `json:"line"`
+}
+
+type SymbolInfo struct {
+	Name  string `json:"name"`
+	Value uint32 `json:"value"`
+	Kind  string `json:"kind"`           // "label" or "constant"
+	File  string `json:"file,omitempty"` // where the symbol is defined, empty for predefined symbols
+	Line  int    `json:"line,omitempty"`
+}
+
+// DebugInfo collects the source map and symbol table of the result
+func (r *Result) DebugInfo() *DebugInfo {
+	info := &DebugInfo{Version: debugInfoVersion, Lines: []LineInfo{}, Symbols: []SymbolInfo{}}
+	for _, w := range r.Words {
+		pos := r.SourceMap[w.Addr]
+		line := LineInfo{Addr: w.Addr, File: pos.Filename, Line: pos.Line}
+		if lines, ok := r.Sources[pos.Filename]; ok && pos.Line >= 1 && pos.Line <= len(lines) {
+			line.Text = strings.TrimRight(lines[pos.Line-1], "\r")
+		}
+		for _, exp := range r.Expansions[w.Addr] {
+			line.Calls = append(line.Calls, CallInfo{Macro: exp.Macro, File: exp.Pos.Filename, Line: exp.Pos.Line})
+		}
+		info.Lines = append(info.Lines, line)
+	}
+	sort.Slice(info.Lines, func(i, j int) bool { return info.Lines[i].Addr < info.Lines[j].Addr })
+	for name, val := range r.Symbols {
+		sym := SymbolInfo{Name: name, Value: val, Kind: "label"}
+		if r.Constants[name] {
+			sym.Kind = "constant"
+		}
+		if pos, ok := r.Definitions[name]; ok {
+			sym.File, sym.Line = pos.Filename, pos.Line
+		}
+		info.Symbols = append(info.Symbols, sym)
+	}
+	sort.Slice(info.Symbols, func(i, j int) bool {
+		a, b := info.Symbols[i], info.Symbols[j]
+		if a.Value != b.Value {
+			return a.Value < b.Value
+		}
+		return a.Name < b.Name
+	})
+	return info
+}
+
+// Write the debug info as indented JSON
+func (d *DebugInfo) Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(d)
+}
+
+// Read debug info written by DebugInfo.Write
+func ReadDebugInfo(r io.Reader) (*DebugInfo, error) {
+	var info DebugInfo
+	if err := json.NewDecoder(r).Decode(&info); err != nil {
+		return nil, fmt.Errorf("invalid source map: %v", err)
+	}
+	if info.Version != debugInfoVersion {
+		return nil, fmt.Errorf("unsupported source map version %d", info.Version)
+	}
+	sort.Slice(info.Lines, func(i, j int) bool { return info.Lines[i].Addr < info.Lines[j].Addr })
+	return &info, nil
+}
+
+// Returns the source of the word at addr, d may be nil
+func (d *DebugInfo) LineAt(addr uint32) (LineInfo, bool) {
+	if d == nil {
+		return LineInfo{}, false
+	}
+	i := sort.Search(len(d.Lines), func(i int) bool { return d.Lines[i].Addr >= addr })
+	if i < len(d.Lines) && d.Lines[i].Addr == addr {
+		return d.Lines[i], true
+	}
+	return LineInfo{}, false
+}
+
+// Returns the names of the labels at addr
+func (d *DebugInfo) LabelsAt(addr uint32) []string {
+	var names []string
+	for _, sym := range d.Symbols {
+		if sym.Kind == "label" && sym.Value == addr {
+			names = append(names, sym.Name)
+		}
+	}
+	return names
+}
+
+// Returns the closest label at or before addr and the distance from it
+func (d *DebugInfo) LabelBefore(addr uint32) (string, uint32, bool) {
+	best, found := SymbolInfo{}, false
+	for _, sym := range d.Symbols {
+		if sym.Kind == "label" && sym.Value <= addr && (!found || sym.Value > best.Value) {
+			best, found = sym, true
+		}
+	}
+	return best.Name, addr - best.Value, found
+}
+
+// Location of a line as file:line
+func (l LineInfo) Location() string {
+	if l.File == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d", l.File, l.Line)
+}
@@ -0,0 +1,102 @@
+package assembler
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const debugSource = `.equ SIZE, 4
+.macro twice reg
+	inc \reg
+	inc \reg
+.endm
+start:	li r1, SIZE
+loop:	twice r2
+	bne loop
+	hlt
+`
+
+func TestDebugInfo(t *testing.T) {
+	res, err := New(Options{Defines: map[string]uint32{"DEBUG": 1}}).AssembleString("main.asm", debugSource)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	info := res.DebugInfo()
+	expectedSymbols := []SymbolInfo{
+		{Name: "start", Value: 0, Kind: "label", File: "main.asm", Line: 6},
+		{Name: "DEBUG", Value: 1, Kind: "constant"},
+		{Name: "loop", Value: 4, Kind: "label", File: "main.asm", Line: 7},
+		{Name: "size", Value: 4, Kind: "constant", File: "main.asm", Line: 1},
+	}
+	if diff := cmp.Diff(expectedSymbols, info.Symbols); diff != "" {
+		t.Errorf("symbol mismatch (-want +got):\n%s", diff)
+	}
+	expectedLines := []LineInfo{
+		{Addr: 0, File: "main.asm", Line: 6, Text: "start:\tli r1, SIZE"},
+		{Addr: 4, File: "main.asm", Line: 3, Text: "\tinc \\reg", Calls: []CallInfo{{Macro: "twice", File: "main.asm", Line: 7}}},
+		{Addr: 8, File: "main.asm", Line: 4, Text: "\tinc \\reg", Calls: []CallInfo{{Macro: "twice", File: "main.asm", Line: 7}}},
+		{Addr: 12, File: "main.asm", Line: 8, Text: "\tbne loop"},
+		{Addr: 16, File: "main.asm", Line: 9, Text: "\thlt"},
+	}
+	if diff := cmp.Diff(expectedLines, info.Lines); diff != "" {
+		t.Errorf("line mismatch (-want +got):\n%s", diff)
+	}
+
+	var buf bytes.Buffer
+	if err := info.Write(&buf); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	read, err := ReadDebugInfo(&buf)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if diff := cmp.Diff(info, read); diff != "" {
+		t.Errorf("round trip mismatch (-want +got):\n%s", diff)
+	}
+	if _, err := ReadDebugInfo(strings.NewReader(`{"version": 1}`)); err == nil {
+		t.Errorf("expected an error for an unknown version")
+	}
+
+	if name, off, ok := read.LabelBefore(12); !ok || name != "loop" || off != 8 {
+		t.Errorf("expected loop+8, got %s+%d", name, off)
+	}
+	lines := DisassembleImageDebug(res.Image().Flatten(), read)
+	if lines[0] != "start:" || lines[2] != "loop:" || !strings.HasSuffix(lines[5], "(main.asm:8: bne loop)") {
+		t.Errorf("expected labels and source locations in:\n%s", strings.Join(lines, "\n"))
+	}
+}
+
+func TestListingAndMap(t *testing.T) {
+	res, err := New(Options{}).AssembleString("main.asm", debugSource)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var listing, symbols bytes.Buffer
+	if err := res.WriteListing(&listing); err != nil {
+		t.Fatalf("listing failed: %v", err)
+	}
+	if err := res.WriteMap(&symbols); err != nil {
+		t.Fatalf("map failed: %v", err)
+	}
+	for _, want := range []string{
+		"0000  00041811  main.asm:6  start:\tli r1, SIZE",
+		"main.asm:3  inc \\reg",
+		"; twice at main.asm:7",
+		"0010  ffffe00d  main.asm:9  hlt",
+	} {
+		if !strings.Contains(listing.String(), want) {
+			t.Errorf("expected %q in listing:\n%s", want, listing.String())
+		}
+	}
+	for _, want := range []string{
+		"00000004  label     loop   main.asm:7",
+		"00000004  constant  size   main.asm:1",
+	} {
+		if !strings.Contains(symbols.String(), want) {
+			t.Errorf("expected %q in map:\n%s", want, symbols.String())
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package assembler
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/alecthomas/participle/v2"
+	"github.com/alecthomas/participle/v2/lexer"
+
+	"github.com/leon332157/risc-y-8/cmd/r8/assembler/grammar"
+)
+
+type Severity int
+
+const (
+	SeverityError Severity = iota
+	SeverityWarning
+	SeverityNote // extra information attached to another diagnostic
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityWarning:
+		return "warning"
+	case SeverityNote:
+		return "note"
+	}
+	return "error"
+}
+
+// A Diagnostic is an error or warning tied to a position in the source
+type Diagnostic struct {
+	Severity Severity
+	Pos      lexer.Position
+	Msg      string
+	Source   string       // source line containing Pos, empty when the source is not known
+	Length   int          // number of characters to underline from Pos
+	Notes    []Diagnostic // macro calls the line was expanded from, innermost first
+}
+
+func (d Diagnostic) Error() string {
+	return fmt.Sprintf("%s: %s: %s", d.Pos, d.Severity, d.Msg)
+}
+
+// Format returns the message followed by the source line with a caret under the offending token,
+// and the same for every note
+func (d Diagnostic) Format() string {
+	text := d.format()
+	for _, note := range d.Notes {
+		text += "\n" + note.format()
+	}
+	return text
+}
+
+func (d Diagnostic) format() string {
+	if d.Source == "" || d.Pos.Column < 1 || d.Pos.Column > len(d.Source)+1 {
+		return d.Error()
+	}
+	// keep tabs so the caret lines up with the source
+	indent := []byte(d.Source[:d.Pos.Column-1])
+	for i, c := range indent {
+		if c != '\t' {
+			indent[i] = ' '
+		}
+	}
+	gutter := fmt.Sprintf("%5d | ", d.Pos.Line)
+	blank := strings.Repeat(" ", len(gutter)-2) + "| "
+	return fmt.Sprintf("%s\n%s%s\n%s%s^%s", d.Error(), gutter, d.Source, blank, indent, strings.Repeat("~", max(d.Length-1, 0)))
+}
+
+// Diagnostics collected while assembling, usable as an error
+type Diagnostics []Diagnostic
+
+func (ds Diagnostics) Error() string {
+	msgs := make([]string, len(ds))
+	for i, d := range ds {
+		msgs[i] = d.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Returns the number of errors, not counting warnings
+func (ds Diagnostics) Errors() int {
+	n := 0
+	for _, d := range ds {
+		if d.Severity == SeverityError {
+			n++
+		}
+	}
+	return n
+}
+
+// Format all diagnostics with source excerpts followed by a summary line
+func (ds Diagnostics) Format() string {
+	var sb strings.Builder
+	for _, d := range ds {
+		sb.WriteString(d.Format())
+		sb.WriteString("\n")
+	}
+	errs, warns := ds.Errors(), len(ds)-ds.Errors()
+	plural := func(n int, word string) string {
+		if n == 1 {
+			return fmt.Sprintf("%d %s", n, word)
+		}
+		return fmt.Sprintf("%d %ss", n, word)
+	}
+	sb.WriteString(plural(errs, "error") + ", " + plural(warns, "warning") + "\n")
+	return sb.String()
+}
+
+// Sort by position and drop duplicates, such as a directive error found in both passes
+func (ds Diagnostics) sorted() Diagnostics {
+	sort.SliceStable(ds, func(i, j int) bool {
+		a, b := ds[i].Pos, ds[j].Pos
+		if a.Filename != b.Filename {
+			return a.Filename < b.Filename
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+	out := Diagnostics{}
+	for i, d := range ds {
+		if i == 0 || d.Format() != ds[i-1].Format() {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// An error caused by a specific token of the line, used to place the caret
+type tokenError struct {
+	token string
+	err   error
+}
+
+func (e *tokenError) Error() string { return e.err.Error() }
+func (e *tokenError) Unwrap() error { return e.err }
+
+func errorAt(token string, format string, args ...any) error {
+	return &tokenError{token: token, err: fmt.Errorf(format, args...)}
+}
+
+// function name tags such as [parseImm] are useful when debugging but noise in diagnostics
+var tagPattern = regexp.MustCompile(`\[(parse|layout|lookup|eval|relocate|check|Assemble)\w*\] ?`)
+
+// Find a token on a source line, ignoring case and matching whole words only.
+// Returns the 1 based column or 0 if it is not found
+func findToken(line string, token string, from int) int {
+	lower, token := strings.ToLower(line), strings.ToLower(token)
+	isWord := func(c byte) bool {
+		return c == '_' || c == '.' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z'
+	}
+	for i := max(from, 0); i+len(token) <= len(lower); i++ {
+		j := strings.Index(lower[i:], token)
+		if j < 0 {
+			break
+		}
+		i += j
+		end := i + len(token)
+		if (i == 0 || !isWord(lower[i-1]) || !isWord(token[0])) && (end == len(lower) || !isWord(lower[end]) || !isWord(token[len(token)-1])) {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Record a diagnostic at pos, the caret is moved to the offending token when err carries one.
+// A note is added for every macro call in from
+func (a *assembly) report(sev Severity, pos lexer.Position, from []grammar.Expansion, err error) {
+	d := a.diagnostic(sev, pos, err)
+	for _, exp := range from {
+		d.Notes = append(d.Notes, a.diagnostic(SeverityNote, exp.Pos, errorAt(exp.Macro, "in expansion of macro %s", exp.Macro)))
+	}
+	a.diags = append(a.diags, d)
+}
+
+func (a *assembly) diagnostic(sev Severity, pos lexer.Position, err error) Diagnostic {
+	d := Diagnostic{Severity: sev, Pos: pos, Msg: tagPattern.ReplaceAllString(err.Error(), ""), Length: 1}
+	if lines, ok := a.sources[pos.Filename]; ok && pos.Line >= 1 && pos.Line <= len(lines) {
+		d.Source = strings.TrimRight(lines[pos.Line-1], "\r")
+		var te *tokenError
+		if errors.As(err, &te) && te.token != "" {
+			token := te.token
+			col := findToken(d.Source, token, pos.Column-1)
+			if col == 0 && strings.HasPrefix(token, "-") {
+				// sign added from the operation of a memory operand
+				token = token[1:]
+				col = findToken(d.Source, token, pos.Column-1)
+			}
+			if col > 0 {
+				d.Pos.Offset += col - pos.Column
+				d.Pos.Column = col
+				d.Length = len(token)
+			}
+		}
+	}
+	return d
+}
+
+// Record an error at pos, which is usually the line being assembled
+func (a *assembly) errorf(pos lexer.Position, err error) {
+	var from []grammar.Expansion
+	if a.line != nil && a.line.Pos == pos {
+		from = a.line.Expansions
+	}
+	a.report(SeverityError, pos, from, err)
+}
+
+// Record a warning on the line being assembled
+func (a *assembly) warn(token string, format string, args ...any) {
+	if a.line == nil {
+		return
+	}
+	a.report(SeverityWarning, a.line.Pos, a.line.Expansions, errorAt(token, format, args...))
+}
+
+// Parse preprocessed source one line at a time, lines do not depend on each other so
+// every syntax error is reported. Returns the lines that parsed so the rest of the
+// program can still be checked
+func (a *assembly) parseSource(src []grammar.SourceLine) []grammar.Line {
+	good := []grammar.Line{}
+	for _, text := range src {
+		prog, err := grammar.ParseString(text.Pos.Filename, text.Text)
+		if err == nil {
+			for _, line := range prog.Lines {
+				line.Pos.Line = text.Pos.Line
+				line.Pos.Offset += text.Pos.Offset
+				line.Expansions = text.Expansions
+				good = append(good, line)
+			}
+			continue
+		}
+		var perr participle.Error
+		pos := text.Pos
+		msg := err.Error()
+		token := ""
+		if errors.As(err, &perr) {
+			pos.Column = perr.Position().Column
+			pos.Offset = text.Pos.Offset + perr.Position().Offset
+			msg = perr.Message()
+		}
+		var uerr *participle.UnexpectedTokenError
+		if errors.As(err, &uerr) && !uerr.Unexpected.EOF() {
+			token = uerr.Unexpected.Value
+		}
+		a.report(SeverityError, pos, text.Expansions, &tokenError{token: token, err: errors.New("syntax error: " + msg)})
+	}
+	return good
+}
+
+// Expand includes and macros, preprocessor errors are reported and the lines they are on skipped
+func (a *assembly) preprocess(filename string, src string, readFile func(string) ([]byte, error)) []grammar.SourceLine {
+	pp := grammar.NewPreprocessor()
+	if readFile != nil {
+		pp.ReadFile = readFile
+	}
+	lines, errs := pp.Preprocess(filename, src)
+	for name, text := range pp.Sources {
+		a.sources[name] = text
+	}
+	for _, err := range errs {
+		a.report(SeverityError, err.Pos, err.Expansions, &tokenError{token: err.Token, err: errors.New(err.Msg)})
+	}
+	return lines
+}
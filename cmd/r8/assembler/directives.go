@@ -0,0 +1,233 @@
+package assembler
+
+import (
+	"strconv"
+
+	"github.com/leon332157/risc-y-8/cmd/r8/assembler/grammar"
+)
+
+/*
+Supported directives, addresses are in bytes and every word is at a multiple of 4:
+
+	.org addr           set the address of the next instruction or data word, relative to the start of the section
+	.word v1, v2, ...   emit 32 bit words, values may be numbers or symbols
+	.fill count, value  emit count words with value (default 0)
+	.equ name, value    define a constant symbol
+	.align n            advance the address to the next multiple of n bytes, n is a multiple of 4
+	.string "text"      emit the text packed 4 bytes per word, little endian, with a terminating NUL
+	.float v1, v2, ...  emit single precision floats, see float.go
+
+Section and symbol directives are described in object.go
+*/
+
+// Parse a 32 bit constant from a number, a symbol name or a constant expression
+func (a *assembly) parseWord(op grammar.Operand) (uint32, error) {
+	v, err := a.parseValue(op)
+	if err != nil {
+		return 0, err
+	}
+	n, err := a.absolute(operandToken(op), v)
+	return uint32(n), err
+}
+
+// Parse a 32 bit value that may be relocatable
+func (a *assembly) parseValue(op grammar.Operand) (value, error) {
+	var val string
+	switch op := op.(type) {
+	case grammar.OperandImmediate:
+		if op.Expr != nil {
+			return a.parseWordExpr(op)
+		}
+		val = op.Value
+	case grammar.OperandRegister:
+		val = op.Value
+	default:
+		return value{}, errorAt(operandToken(op), "[parseWord] invalid value: %s", operandKind(op))
+	}
+	if isLabelName(val) {
+		if isRegisterName(val) {
+			return value{}, errorAt(val, "[parseWord] register %s can not be used as a value", val)
+		}
+		return a.lookup(val)
+	}
+	i64, err := strconv.ParseInt(val, 0, 64)
+	if err != nil {
+		return value{}, errorAt(val, "[parseWord] invalid value: %s", val)
+	}
+	if i64 < -(1<<31) || i64 > (1<<32)-1 {
+		return value{}, errorAt(val, "[parseWord] value does not fit in 32 bits: %s", val)
+	}
+	return value{n: int64(uint32(i64))}, nil
+}
+
+func (a *assembly) parseWordExpr(op grammar.OperandImmediate) (value, error) {
+	v, err := a.evalValue(op.Expr)
+	if err != nil {
+		return value{}, err
+	}
+	if !v.relocatable() && (v.n < -(1<<31) || v.n > (1<<32)-1) {
+		return value{}, errorAt(op.Value, "[parseWord] value does not fit in 32 bits: %s = %d", op.Value, v.n)
+	}
+	return v, nil
+}
+
+// Pack a quoted string into words, 4 bytes per word little endian with a terminating NUL
+func parseString(op grammar.Operand) ([]uint32, error) {
+	str, ok := op.(grammar.OperandString)
+	if !ok {
+		return nil, errorAt(operandToken(op), "[parseString] expected a string, got %s", operandKind(op))
+	}
+	text, err := strconv.Unquote(str.Value)
+	if err != nil {
+		return nil, errorAt(str.Value, "[parseString] invalid string %s: %v", str.Value, err)
+	}
+	bytes := append([]byte(text), 0)
+	words := make([]uint32, (len(bytes)+3)/4)
+	for i, b := range bytes {
+		words[i/4] |= uint32(b) << (8 * (i % 4))
+	}
+	return words, nil
+}
+
+func checkOperandCount(dir *grammar.Directive, min, max int) error {
+	n := len(dir.Operands)
+	if n < min || n > max {
+		if min == max {
+			return errorAt(dir.Type, "[parseDirective] %s expects %d operands, got %d", dir.Type, min, n)
+		}
+		return errorAt(dir.Type, "[parseDirective] %s expects %d to %d operands, got %d", dir.Type, min, max, n)
+	}
+	return nil
+}
+
+// First pass of a directive, returns the address following the directive.
+// Symbols defined with .equ are added to the label table as a side effect,
+// so only symbols defined earlier in the program can be used in .org, .fill, .align and .equ
+func (a *assembly) layoutDirective(dir *grammar.Directive, addr uint32) (uint32, error) {
+	switch dir.Type {
+	case ".org":
+		if err := checkOperandCount(dir, 1, 1); err != nil {
+			return addr, err
+		}
+		offset, err := a.parseWord(dir.Operands[0])
+		if err != nil {
+			return addr, err
+		}
+		if offset%4 != 0 {
+			return addr, errorAt(operandToken(dir.Operands[0]), "[layoutDirective] .org address %#x is not a multiple of 4", offset)
+		}
+		return a.section.base + offset, nil
+	case ".word", ".float":
+		if err := checkOperandCount(dir, 1, len(dir.Operands)); err != nil {
+			return addr, err
+		}
+		return addr + 4*uint32(len(dir.Operands)), nil
+	case ".fill":
+		if err := checkOperandCount(dir, 1, 2); err != nil {
+			return addr, err
+		}
+		count, err := a.parseWord(dir.Operands[0])
+		if err != nil {
+			return addr, err
+		}
+		return addr + 4*count, nil
+	case ".align":
+		if err := checkOperandCount(dir, 1, 1); err != nil {
+			return addr, err
+		}
+		n, err := a.parseWord(dir.Operands[0])
+		if err != nil {
+			return addr, err
+		}
+		if n == 0 || n%4 != 0 {
+			return addr, errorAt(operandToken(dir.Operands[0]), "[layoutDirective] .align must be a multiple of 4 greater than 0")
+		}
+		// sections are aligned to their largest .align, so aligning the offset aligns the address
+		a.section.align = max(a.section.align, n)
+		offset := addr - a.section.base
+		return a.section.base + (offset+n-1)/n*n, nil
+	case ".string":
+		if err := checkOperandCount(dir, 1, 1); err != nil {
+			return addr, err
+		}
+		words, err := parseString(dir.Operands[0])
+		return addr + 4*uint32(len(words)), err
+	case ".equ":
+		if err := checkOperandCount(dir, 2, 2); err != nil {
+			return addr, err
+		}
+		name, ok := dir.Operands[0].(grammar.OperandRegister)
+		if !ok || !isLabelName(name.Value) || isRegisterName(name.Value) {
+			return addr, errorAt(operandToken(dir.Operands[0]), "[layoutDirective] invalid symbol name for .equ: %s", operandKind(dir.Operands[0]))
+		}
+		if _, ok := a.symbols[name.Value]; ok {
+			return addr, errorAt(name.Value, "[layoutDirective] duplicate symbol %s", name.Value)
+		}
+		val, err := a.parseWord(dir.Operands[1])
+		if err != nil {
+			return addr, err
+		}
+		a.symbols[name.Value] = val
+		a.constants[name.Value] = true
+		if a.line != nil {
+			a.defined[name.Value] = a.line.Pos
+		}
+		return addr, nil
+	case ".text", ".data", ".section":
+		return a.layoutSection(dir, addr)
+	case ".global", ".extern":
+		return addr, a.layoutSymbols(dir)
+	default:
+		return addr, errorAt(dir.Type, "[layoutDirective] unknown directive %s", dir.Type)
+	}
+}
+
+// Second pass of a directive, returns the data words emitted at the address of the directive
+func (a *assembly) parseDirective(dir *grammar.Directive) ([]uint32, error) {
+	switch dir.Type {
+	case ".word":
+		words := make([]uint32, len(dir.Operands))
+		for i, op := range dir.Operands {
+			v, err := a.parseValue(op)
+			if err != nil {
+				return nil, err
+			}
+			if err := a.relocate(4*uint32(i), RelocAbs32, v, operandToken(op)); err != nil {
+				return nil, err
+			}
+			words[i] = uint32(v.n)
+		}
+		return words, nil
+	case ".fill":
+		count, err := a.parseWord(dir.Operands[0])
+		if err != nil {
+			return nil, err
+		}
+		var val uint32
+		if len(dir.Operands) > 1 {
+			val, err = a.parseWord(dir.Operands[1])
+			if err != nil {
+				return nil, err
+			}
+		}
+		words := make([]uint32, count)
+		for i := range words {
+			words[i] = val
+		}
+		return words, nil
+	case ".float":
+		words := make([]uint32, len(dir.Operands))
+		for i, op := range dir.Operands {
+			w, err := a.parseFloatValue(op)
+			if err != nil {
+				return nil, err
+			}
+			words[i] = w
+		}
+		return words, nil
+	case ".string":
+		return parseString(dir.Operands[0])
+	}
+	// .org, .align, .equ and the section and symbol directives only take effect in the first pass
+	return nil, nil
+}
@@ -0,0 +1,201 @@
+package assembler
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/leon332157/risc-y-8/cmd/r8/assembler/grammar"
+	. "github.com/leon332157/risc-y-8/pkg/types"
+)
+
+// canonical condition name for each mode and flag combination, aliases such as "z" and "nz" are never printed
+var conditionNames = map[uint8]string{}
+
+func init() {
+	names := make([]string, 0, len(Conditions))
+	for name := range Conditions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		mf := GetModeFlag(Conditions[name])
+		if _, ok := conditionNames[mf]; !ok {
+			conditionNames[mf] = name
+		}
+	}
+}
+
+func regName(r uint8) string {
+	return fmt.Sprintf("r%d", r)
+}
+
+// Format a memory operand, r0 is printed as pc for control instructions
+func memOperand(base uint8, disp int16, control bool) string {
+	b := regName(base)
+	if control && base == 0 {
+		b = "pc"
+	}
+	switch {
+	case disp == 0:
+		return fmt.Sprintf("[%s]", b)
+	case disp < 0:
+		return fmt.Sprintf("[%s - %#x]", b, -int32(disp))
+	default:
+		return fmt.Sprintf("[%s + %#x]", b, disp)
+	}
+}
+
+// Returns the assembly text for a decoded base instruction, without checking that it reassembles
+func formatBaseInstruction(inst *BaseInstruction, addr uint32) (text string, comment string) {
+	switch inst.OpType {
+	case RegImm:
+		name := ImmALUInverse[inst.ALU]
+		switch inst.ALU {
+		case IMM_SR:
+			return formatSystemInstruction(inst), ""
+		case IMM_NOT, IMM_NEG:
+			return fmt.Sprintf("%s %s", name, regName(inst.Rd)), ""
+		case IMM_LDI:
+			return fmt.Sprintf("%s %s, %#x", name, regName(inst.Rd), uint16(inst.Imm)), ""
+		default:
+			return fmt.Sprintf("%s %s, %d", name, regName(inst.Rd), inst.Imm), ""
+		}
+	case RegReg:
+		if inst.ALU == REG_CPY && inst.Rd == 0 && inst.Rs == 0 {
+			return "nop", ""
+		}
+		return fmt.Sprintf("%s %s, %s", RegALUInverse[inst.ALU], regName(inst.Rd), regName(inst.Rs)), ""
+	case LoadStore:
+		switch inst.MemMode {
+		case LDW:
+			return fmt.Sprintf("ldw %s, %s", regName(inst.Rd), memOperand(inst.RMem, inst.Imm, false)), ""
+		case STW:
+			return fmt.Sprintf("stw %s, %s", regName(inst.Rd), memOperand(inst.RMem, inst.Imm, false)), ""
+		case PUSH:
+			return fmt.Sprintf("push %s", regName(inst.Rd)), ""
+		case POP:
+			return fmt.Sprintf("pop %s", regName(inst.Rd)), ""
+		}
+	case Control:
+		mf := GetModeFlag(ControlOp{Mode: inst.CtrlMode, Flag: inst.CtrlFlag})
+		if mf == GetModeFlag(IRET) {
+			return "iret", ""
+		}
+		if mf == GetModeFlag(ECALL) {
+			return "ecall", ""
+		}
+		cond, ok := conditionNames[mf]
+		if !ok {
+			return "", ""
+		}
+		if cond == "unc" && inst.RMem == 0 && inst.Imm == -1 {
+			return "hlt", ""
+		}
+		if cond == "unc" && inst.RMem == IntegerRegisters["lr"] && inst.Imm == 0 {
+			return "ret", ""
+		}
+		mnemonic := "b" + cond
+		if cond == "call" {
+			mnemonic = "call"
+		}
+		if inst.RMem == 0 {
+			// pc relative, show the target address
+			comment = fmt.Sprintf("-> %#06x", int64(addr)+4+int64(inst.Imm))
+		}
+		return fmt.Sprintf("%s %s", mnemonic, memOperand(inst.RMem, inst.Imm, true)), comment
+	}
+	return "", ""
+}
+
+// check that the text assembles back to the same machine word
+func reassembles(text string, word uint32) bool {
+	prog, err := grammar.ParseString("disasm", text)
+	if err != nil || len(prog.Lines) != 1 || prog.Lines[0].Instruction == nil {
+		return false
+	}
+	if isFloatMnemonic(prog.Lines[0].Instruction.Mnemonic) {
+		inst, err := newAssembly(Options{}).parseFloatInst(prog.Lines[0].Instruction)
+		return err == nil && inst.Encode() == word
+	}
+	if isVectorMnemonic(prog.Lines[0].Instruction.Mnemonic) {
+		inst, err := newAssembly(Options{}).parseVectorInst(prog.Lines[0].Instruction)
+		return err == nil && inst.Encode() == word
+	}
+	if isSubWordMnemonic(prog.Lines[0].Instruction.Mnemonic) {
+		inst, err := newAssembly(Options{}).parseSubWordInst(prog.Lines[0].Instruction)
+		return err == nil && inst.Encode() == word
+	}
+	inst, err := parseInst(prog.Lines[0].Instruction)
+	if err != nil {
+		return false
+	}
+	return inst.Encode() == word
+}
+
+// Disassemble a single machine word located at addr. Words that do not decode to a
+// canonical base, float, vector or sub-word instruction are returned as a .word directive, so the output always
+// assembles back to the same word. The comment holds extra information such as branch targets
+func Disassemble(word uint32, addr uint32) (text string, comment string) {
+	switch DataType(word & 0b11) {
+	case Integer:
+		var inst BaseInstruction
+		inst.Decode(word)
+		text, comment = formatBaseInstruction(&inst, addr)
+		if text != "" && reassembles(text, word) {
+			return text, comment
+		}
+	case Float:
+		var inst FloatInstruction
+		if inst.Decode(word) {
+			if text = formatFloatInstruction(&inst); reassembles(text, word) {
+				return text, ""
+			}
+		}
+	case Vector:
+		var inst VectorInstruction
+		if inst.Decode(word) {
+			if text = formatVectorInstruction(&inst); reassembles(text, word) {
+				return text, ""
+			}
+		}
+	case SubWord:
+		var inst SubWordInstruction
+		if inst.Decode(word) {
+			if text = formatSubWordInstruction(&inst); reassembles(text, word) {
+				return text, ""
+			}
+		}
+	}
+	return fmt.Sprintf(".word %#08x", word), ""
+}
+
+// Disassemble a flat image starting at address 0 into lines of assembly,
+// with the address and raw word of each line in a trailing comment
+func DisassembleImage(words []uint32) []string {
+	return DisassembleImageDebug(words, nil)
+}
+
+// Disassemble a flat image like DisassembleImage, with the labels and source locations
+// from the debug info of the program. info may be nil
+func DisassembleImageDebug(words []uint32, info *DebugInfo) []string {
+	lines := make([]string, 0, len(words))
+	for i, word := range words {
+		addr := 4 * uint32(i)
+		if info != nil {
+			for _, label := range info.LabelsAt(addr) {
+				lines = append(lines, label+":")
+			}
+		}
+		text, comment := Disassemble(word, addr)
+		line := fmt.Sprintf("%-28s # %04x: %08x", text, addr, word)
+		if comment != "" {
+			line += " " + comment
+		}
+		if src, ok := info.LineAt(addr); ok {
+			line += fmt.Sprintf(" (%s: %s)", src.Location(), strings.TrimSpace(src.Text))
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
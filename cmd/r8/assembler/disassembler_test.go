@@ -0,0 +1,84 @@
+package assembler
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestDisassemble(t *testing.T) {
+	var test = []struct {
+		word     uint32
+		expected string
+	}{
+		{0b00100011010001010001100010110001, "ldi r11, 0x2345"},
+		{0b00000000000100000000001001000001, "sub r4, 16"},
+		{0b00000000000000001010100001000101, "rem r4, r5"},
+		{0b00000000000000010101110010110101, "cpy r11, r10"},
+		{0b00000001000000000010000000111001, "ldw r3, [r4 + 0x100]"},
+		{0b00000000111111110001111000101001, "stw r2, [r3 + 0xff]"},
+		{0b00000000000000000000010001001001, "push r4"},
+		{0b00000010000000000000001001011101, "beq [r5 + 0x200]"},
+		{0b00000100000000001000100001101101, "bof [r6 + 0x400]"},
+		{0b00000000000000000001110000000101, "nop"},
+		{0b11111111111111111110000000001101, "hlt"},
+		{0b000000000000001110000111111101, "ret"},
+		{0x00003606, "itof f1, r1"},
+		{0x00007826, "ftoi r2, f4"},
+		{0x00002626, "fdiv f3, f2"},
+		{0x0014064a, "fstw f5, [r0 + 0x14]"},
+		{0x00000086, ".word 0x00000086"}, // f9 does not exist
+		{0x000c000b, "vldw v1, [r0 + 0xc]"},
+		{0x00002837, "vbcst v4, r1"},
+		{0x00046627, "vdot r2, v4, v2"},
+		{0x0014062b, "vstw v3, [r0 + 0x14]"},
+		{0x00002027, "vadd v3, v2"},
+		{0x00200027, ".word 0x00200027"}, // vt is only used by vdot
+		{0x00051a44, "ldbu r4, [r3 + 0x5]"},
+		{0xfffe0638, "sth r3, [r0 - 0x2]"},
+		{0x00000008, "ldh r0, [r0]"},
+		{0x0000041c, ".word 0x0000041c"}, // reserved sub-word size
+		{0x00000504, ".word 0x00000504"}, // reserved sub-word mode
+		{0x00001e31, "mfsr r3, epc"},
+		{0x01031e51, "mtsr tvec, r5"},
+		{0x0000c00d, "iret"},
+		{0x0000c20d, "ecall"},
+		{0x00061e11, "mfsr r1, ipend"},
+		{0x00201e31, ".word 0x00201e31"}, // no special register 0x20
+		{0x0000c40d, ".word 0x0000c40d"}, // reserved control mode and flag
+		{0, ".word 0x00000000"},
+		{0xdeadbeef, ".word 0xdeadbeef"},
+	}
+	for _, tt := range test {
+		if text, _ := Disassemble(tt.word, 0); text != tt.expected {
+			t.Errorf("%08x: expected %q, got %q", tt.word, tt.expected, text)
+		}
+	}
+}
+
+func TestDisassembleRoundTrip(t *testing.T) {
+	words := []uint32{0, 0xffffffff}
+	rng := rand.New(rand.NewSource(1))
+	for range 2000 {
+		w := rng.Uint32()
+		if rng.Intn(4) != 0 {
+			w = w&^0b11 | 0b01 // mostly integer instructions
+		}
+		words = append(words, w)
+	}
+	src := strings.Join(DisassembleImage(words), "\n")
+	img, err := assembleImage(t, src)
+	if err != nil {
+		t.Fatalf("failed to reassemble: %v", err)
+	}
+	out := img.Flatten()
+	if len(out) != len(words) {
+		t.Fatalf("expected %d words, got %d", len(words), len(out))
+	}
+	lines := strings.Split(src, "\n")
+	for i := range words {
+		if out[i] != words[i] {
+			t.Errorf("%s: reassembled to %08x", lines[i], out[i])
+		}
+	}
+}
@@ -0,0 +1,346 @@
+package assembler
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/leon332157/risc-y-8/cmd/r8/assembler/grammar"
+	. "github.com/leon332157/risc-y-8/pkg/types"
+)
+
+/*
+Constant expressions may be used for any immediate, displacement or directive value.
+Operators from lowest to highest precedence, as in C:
+
+	|
+	^
+	&
+	<< >>
+	+ -
+	* / %
+	unary - ~ +
+
+Symbols are labels and .equ constants. lo(x) and hi(x) split a 32 bit value for
+loading with "ldi rd, hi(x); shl rd, 16; add rd, lo(x)": lo is the low 16 bits sign
+extended like the immediate field and hi is adjusted for it, so (hi(x) << 16) + lo(x) == x.
+lo is meant for add, ldi rd, lo(x) still loads the low 16 bits of x as ldi zero extends its
+immediate, so it is not warned about like another negative ldi immediate
+
+In an object file the address of a label is not known until the program is linked,
+so an expression that uses one must be an address plus or minus a constant, optionally
+inside lo() or hi(), or the difference of two labels in the same section. The linker
+fills in the value with a relocation, see object.go
+*/
+
+var precedence = map[string]int{
+	"|":  0,
+	"^":  1,
+	"&":  2,
+	"<<": 3, ">>": 3,
+	"+": 4, "-": 4,
+	"*": 5, "/": 5, "%": 5,
+}
+
+// Value of an expression. A relocatable value is the address of a label in section
+// or of the external symbol extern plus n, n holds the address the label has in the
+// object file for a label
+type value struct {
+	n       int64
+	section string
+	extern  string
+	fn      string // lo or hi applied to a relocatable value
+}
+
+func (v value) relocatable() bool {
+	return v.section != "" || v.extern != ""
+}
+
+// The value as far as it is known by the assembler
+func (v value) resolve() int64 {
+	switch v.fn {
+	case "lo":
+		return int64(int16(v.n))
+	case "hi":
+		return ((v.n + 0x8000) >> 16) & 0xffff
+	}
+	return v.n
+}
+
+// Name of the section or symbol a relocatable value depends on
+func (v value) base() string {
+	if v.extern != "" {
+		return v.extern
+	}
+	return "section " + v.section
+}
+
+// Evaluate a constant expression
+func (a *assembly) eval(e *grammar.Expr) (int64, error) {
+	v, err := a.evalValue(e)
+	if err != nil {
+		return 0, err
+	}
+	return a.absolute(e.Text, v)
+}
+
+// Returns the value of a constant, or an error if it is relocatable
+func (a *assembly) absolute(text string, v value) (int64, error) {
+	if v.relocatable() {
+		return 0, errorAt(text, "[eval] %s is not a constant, it depends on the address of %s", text, v.base())
+	}
+	return v.n, nil
+}
+
+// Evaluate an expression that may be relocatable
+func (a *assembly) evalValue(e *grammar.Expr) (value, error) {
+	lhs, err := a.evalUnary(e.First)
+	if err != nil {
+		return value{}, err
+	}
+	return a.evalBinary(e, lhs, e.Rest)
+}
+
+// Apply the binary operators in ops to lhs with precedence climbing
+func (a *assembly) evalBinary(e *grammar.Expr, lhs value, ops []*grammar.BinaryOp) (value, error) {
+	i := 0
+	var climb func(lhs value, minPrec int) (value, error)
+	climb = func(lhs value, minPrec int) (value, error) {
+		for i < len(ops) && precedence[ops[i].Op] >= minPrec {
+			op := ops[i]
+			i++
+			rhs, err := a.evalUnary(op.Term)
+			if err != nil {
+				return value{}, err
+			}
+			for i < len(ops) && precedence[ops[i].Op] > precedence[op.Op] {
+				if rhs, err = climb(rhs, precedence[op.Op]+1); err != nil {
+					return value{}, err
+				}
+			}
+			if lhs, err = applyOp(e, op.Op, lhs, rhs); err != nil {
+				return value{}, err
+			}
+		}
+		return lhs, nil
+	}
+	return climb(lhs, 0)
+}
+
+func applyOp(e *grammar.Expr, op string, lhs, rhs value) (value, error) {
+	if lhs.relocatable() || rhs.relocatable() {
+		return applyRelocatable(e, op, lhs, rhs)
+	}
+	n, err := applyConst(e, op, lhs.n, rhs.n)
+	return value{n: n}, err
+}
+
+// Only a constant can be added to or subtracted from an address, the difference
+// of two labels in the same section is a constant
+func applyRelocatable(e *grammar.Expr, op string, lhs, rhs value) (value, error) {
+	switch {
+	case lhs.fn != "" || rhs.fn != "":
+	case op == "+" && !(lhs.relocatable() && rhs.relocatable()):
+		v := lhs
+		if rhs.relocatable() {
+			v = rhs
+		}
+		v.n = lhs.n + rhs.n
+		return v, nil
+	case op == "-" && !rhs.relocatable():
+		lhs.n -= rhs.n
+		return lhs, nil
+	case op == "-" && lhs.section == rhs.section && lhs.extern == rhs.extern:
+		return value{n: lhs.n - rhs.n}, nil
+	}
+	return value{}, errorAt(e.Text, "[eval] %s can not be relocated, only a constant can be added to or subtracted from an address in an object file", e.Text)
+}
+
+func applyConst(e *grammar.Expr, op string, lhs, rhs int64) (int64, error) {
+	switch op {
+	case "+":
+		return lhs + rhs, nil
+	case "-":
+		return lhs - rhs, nil
+	case "*":
+		return lhs * rhs, nil
+	case "/", "%":
+		if rhs == 0 {
+			return 0, errorAt(e.Text, "[eval] division by zero in %s", e.Text)
+		}
+		if op == "/" {
+			return lhs / rhs, nil
+		}
+		return lhs % rhs, nil
+	case "<<", ">>":
+		if rhs < 0 || rhs > 63 {
+			return 0, errorAt(e.Text, "[eval] invalid shift amount %d in %s", rhs, e.Text)
+		}
+		if op == "<<" {
+			return lhs << rhs, nil
+		}
+		return lhs >> rhs, nil
+	case "&":
+		return lhs & rhs, nil
+	case "|":
+		return lhs | rhs, nil
+	case "^":
+		return lhs ^ rhs, nil
+	}
+	return 0, errorAt(op, "[eval] unknown operator %s", op)
+}
+
+func (a *assembly) evalUnary(u *grammar.Unary) (value, error) {
+	v, err := a.evalPrimary(u.Primary)
+	if err != nil {
+		return value{}, err
+	}
+	for i := len(u.Ops) - 1; i >= 0; i-- {
+		if u.Ops[i] != "+" && v.relocatable() {
+			return value{}, errorAt(u.Ops[i], "[eval] %s can not be applied to the address of %s in an object file", u.Ops[i], v.base())
+		}
+		switch u.Ops[i] {
+		case "-":
+			v.n = -v.n
+		case "~":
+			v.n = ^v.n
+		}
+	}
+	return v, nil
+}
+
+func (a *assembly) evalPrimary(p *grammar.Primary) (value, error) {
+	switch {
+	case p.Number != "":
+		v, err := strconv.ParseInt(p.Number, 0, 64)
+		if err != nil {
+			return value{}, errorAt(p.Number, "[eval] invalid number %s", p.Number)
+		}
+		return value{n: v}, nil
+	case p.Float != "":
+		return value{}, errorAt(p.Float, "[eval] float %s can not be used in an integer expression", p.Float)
+	case p.Call != nil:
+		arg, err := a.evalValue(p.Call.Arg)
+		if err != nil {
+			return value{}, err
+		}
+		if p.Call.Func != "lo" && p.Call.Func != "hi" {
+			return value{}, errorAt(p.Call.Func, "[eval] unknown function %s", p.Call.Func)
+		}
+		if arg.fn != "" {
+			return value{}, errorAt(p.Call.Arg.Text, "[eval] %s can not be relocated, %s of %s(...) is not supported in an object file", p.Call.Arg.Text, p.Call.Func, arg.fn)
+		}
+		arg.fn = p.Call.Func
+		if !arg.relocatable() {
+			return value{n: arg.resolve()}, nil
+		}
+		return arg, nil
+	case p.Sub != nil:
+		return a.evalValue(p.Sub)
+	}
+	if isRegisterName(p.Ident) {
+		return value{}, errorAt(p.Ident, "[eval] register %s can not be used in an expression", p.Ident)
+	}
+	return a.lookup(p.Ident)
+}
+
+// Returns true if the expression is a call of lo(), whose value is negative when bit 15 is set
+func isLoCall(e *grammar.Expr) bool {
+	return e != nil && len(e.Rest) == 0 && len(e.First.Ops) == 0 && e.First.Primary.Call != nil && e.First.Primary.Call.Func == "lo"
+}
+
+// Value of an immediate operand, either an expression or a literal or symbol in Value
+func (a *assembly) immValue(op grammar.OperandImmediate) (int64, error) {
+	var v value
+	var err error
+	switch {
+	case op.Expr != nil:
+		v, err = a.evalValue(op.Expr)
+	case isLabelName(op.Value) && !strings.HasPrefix(op.Value, "-"):
+		v, err = a.lookup(op.Value)
+	default:
+		return a.parseImmValue(op.Value)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := a.relocate(0, RelocImm16, v, op.Value); err != nil {
+		return 0, err
+	}
+	return checkImmRange(op.Value, v.resolve())
+}
+
+// Parse a memory operand written as an expression, either [reg], [reg + expr], [reg - expr]
+// or [expr] for an absolute address, which is encoded with r0 as base. For control
+// instructions (pcRelative) r0 refers to the address of the next instruction, so an
+// absolute address is made relative to it
+func (a *assembly) parseMemoryExpr(e *grammar.Expr, pcRelative bool) (uint8, int16, error) {
+	base := e.First.Primary.Ident
+	if len(e.First.Ops) > 0 || !isRegisterName(base) {
+		target, err := a.evalValue(e)
+		if err != nil {
+			return 0, 0, err
+		}
+		switch {
+		case pcRelative && a.sameSection(target):
+			target = value{n: target.n - (int64(a.addr) + 4)}
+		case pcRelative:
+			err = a.relocate(0, RelocPC16, target, e.Text)
+			target.n -= int64(a.addr) + 4
+		default:
+			err = a.relocate(0, RelocDisp16, target, e.Text)
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		disp := target.resolve()
+		if !target.relocatable() && (disp < -32768 || disp > 32767) {
+			return 0, 0, errorAt(e.Text, "[parseMemory] address %s is out of range for a 16 bit displacement: %d", e.Text, disp)
+		}
+		return 0, int16(disp), nil
+	}
+	if base == "pc" {
+		base = "r0" // pc is encoded as r0
+	}
+	rmem, ok := IntegerRegisters[base]
+	if !ok {
+		return 0, 0, errorAt(base, "[parseMemory] invalid base register: %s", base)
+	}
+	if len(e.Rest) == 0 {
+		return rmem, 0, nil
+	}
+	for i, op := range e.Rest {
+		if (i == 0 && op.Op != "+" && op.Op != "-") || precedence[op.Op] < precedence["+"] {
+			return 0, 0, errorAt(op.Op, "[parseMemory] invalid operator %s after base register, use parentheses around the displacement", op.Op)
+		}
+	}
+	// text of the displacement without the base register, negated as in the legacy form
+	disp := strings.TrimSpace(strings.TrimSpace(e.Text[len(e.First.Primary.Ident):])[1:])
+	if e.Rest[0].Op == "-" {
+		disp = "-" + disp
+	}
+	var v value
+	var err error
+	if e.Rest[0].Op == "+" {
+		// evaluated on its own so that lo() of an address can be a displacement
+		v, err = a.evalUnary(e.Rest[0].Term)
+		if err == nil {
+			v, err = a.evalBinary(e, v, e.Rest[1:])
+		}
+	} else {
+		v, err = a.evalBinary(e, value{}, e.Rest)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := a.relocate(0, RelocDisp16, v, disp); err != nil {
+		return 0, 0, err
+	}
+	full, err := checkImmRange(disp, v.resolve())
+	if err != nil {
+		return 0, 0, err
+	}
+	if full > 32767 {
+		a.warn(disp, "[parseMemory] displacement %s is sign extended to %d", disp, int16(full))
+	}
+	return rmem, a.truncImm(disp, full), nil
+}
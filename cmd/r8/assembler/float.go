@@ -0,0 +1,160 @@
+package assembler
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/leon332157/risc-y-8/cmd/r8/assembler/grammar"
+	. "github.com/leon332157/risc-y-8/pkg/types"
+)
+
+/*
+Float instructions use the float registers f1-f8 and are encoded with DataType Float:
+
+	fadd fd, fs         fd = fd + fs, also fsub, fmul, fdiv, fmin and fmax
+	fsqrt fd, fs        fd = sqrt(fs), also fneg, fabs and fcpy (or fmov)
+	fcmp fd, fs         compare fd with fs and set the flags for the usual conditional branches
+	itof fd, rs         convert a signed integer to float, fmvi copies the bits instead
+	ftoi rd, fs         convert to a signed integer truncated towards zero, fmvf copies the bits instead
+	fldw fd, [mem]      load a float, memory operands are the same as for ldw
+	fstw fd, [mem]      store a float
+
+fcmp sets ZF when equal and CF and SF when less, so beq, bne, blt, bge, blu and bae
+all work after it. When either value is NaN only OVF is set.
+
+	.float v1, v2, ...  emit single precision floats, each value is a float literal
+	                    such as 1.5, -2.0 or 1e-3, or an integer constant expression
+*/
+
+// check if a mnemonic is a float instruction
+func isFloatMnemonic(mnemonic string) bool {
+	_, ok := FloatALU[mnemonic]
+	return ok || mnemonic == "fldw" || mnemonic == "fstw"
+}
+
+func floatRegister(op grammar.Operand) (uint8, error) {
+	if reg, ok := op.(grammar.OperandRegister); ok {
+		if r, ok := FPRegisters[reg.Value]; ok {
+			return r, nil
+		}
+	}
+	return 0, errorAt(operandToken(op), "[parseFloat] expected a float register f1-f8, got %s", operandKind(op))
+}
+
+func intRegister(op grammar.Operand) (uint8, error) {
+	if reg, ok := op.(grammar.OperandRegister); ok {
+		if r, ok := IntegerRegisters[reg.Value]; ok {
+			return r, nil
+		}
+	}
+	return 0, errorAt(operandToken(op), "[parseRegister] expected an integer register, got %s", operandKind(op))
+}
+
+// Parse a float instruction, every float instruction takes two operands
+func (a *assembly) parseFloatInst(inst *grammar.Instruction) (FloatInstruction, error) {
+	if len(inst.Operands) != 2 {
+		return FloatInstruction{}, errorAt(inst.Mnemonic, "[parseFloat] %s takes 2 operands, got %d", inst.Mnemonic, len(inst.Operands))
+	}
+	if inst.Mnemonic == "fldw" || inst.Mnemonic == "fstw" {
+		fd, err := floatRegister(inst.Operands[0])
+		if err != nil {
+			return FloatInstruction{}, err
+		}
+		mem, ok := inst.Operands[1].(grammar.OperandMemory)
+		if !ok {
+			return FloatInstruction{}, errorAt(operandToken(inst.Operands[1]), "[parseFloat] %s expects a memory operand, got %s", inst.Mnemonic, operandKind(inst.Operands[1]))
+		}
+		rmem, disp, err := a.parseMemory(mem, false)
+		if err != nil {
+			return FloatInstruction{}, err
+		}
+		var mode uint8 = LDW
+		if inst.Mnemonic == "fstw" {
+			mode = STW
+		}
+		return FloatInstruction{OpType: LoadStore, Fd: fd, RMem: rmem, MemMode: mode, Imm: disp}, nil
+	}
+
+	op := FloatALU[inst.Mnemonic]
+	dest, src := floatRegister, floatRegister
+	if FloatWritesInt(op) {
+		dest = intRegister
+	}
+	if FloatReadsInt(op) {
+		src = intRegister
+	}
+	fd, err := dest(inst.Operands[0])
+	if err != nil {
+		return FloatInstruction{}, err
+	}
+	fs, err := src(inst.Operands[1])
+	if err != nil {
+		return FloatInstruction{}, err
+	}
+	return FloatInstruction{OpType: RegReg, Fd: fd, FPU: op, Fs: fs}, nil
+}
+
+// Warn about float instructions that assemble but are likely mistakes
+func (a *assembly) checkFloat(src *grammar.Instruction, inst *FloatInstruction) {
+	if inst.OpType == RegReg && FloatWritesInt(inst.FPU) && inst.Fd == 0 {
+		a.warn(operandToken(src.Operands[0]), "%s writes to r0, the result is discarded", src.Mnemonic)
+	}
+	a.checkAt(src, inst.Fd, inst.OpType == RegReg && FloatWritesInt(inst.FPU))
+}
+
+// Parse a .float value, either a float literal with an optional sign or an integer constant expression
+func (a *assembly) parseFloatValue(op grammar.Operand) (uint32, error) {
+	imm, ok := op.(grammar.OperandImmediate)
+	if ok && imm.Expr != nil && len(imm.Expr.Rest) == 0 && imm.Expr.First.Primary.Float != "" {
+		lit := imm.Expr.First.Primary.Float
+		f, err := strconv.ParseFloat(lit, 32)
+		if err != nil {
+			return 0, errorAt(lit, "[parseFloat] invalid float %s", lit)
+		}
+		for _, u := range imm.Expr.First.Ops {
+			switch u {
+			case "-":
+				f = -f
+			case "~":
+				return 0, errorAt(u, "[parseFloat] ~ can not be applied to a float")
+			}
+		}
+		return math.Float32bits(float32(f)), nil
+	}
+	v, err := a.parseValue(op)
+	if err != nil {
+		return 0, err
+	}
+	n, err := a.absolute(operandToken(op), v)
+	if err != nil {
+		return 0, err
+	}
+	return math.Float32bits(float32(n)), nil
+}
+
+func floatRegName(r uint8) string {
+	return fmt.Sprintf("f%d", r+1)
+}
+
+// Returns the assembly text for a decoded float instruction
+func formatFloatInstruction(inst *FloatInstruction) string {
+	switch inst.OpType {
+	case RegReg:
+		dest, src := floatRegName(inst.Fd), floatRegName(inst.Fs)
+		if FloatWritesInt(inst.FPU) {
+			dest = regName(inst.Fd)
+		}
+		if FloatReadsInt(inst.FPU) {
+			src = regName(inst.Fs)
+		}
+		return fmt.Sprintf("%s %s, %s", FloatALUInverse[inst.FPU], dest, src)
+	case LoadStore:
+		mnemonic := "fldw"
+		if inst.MemMode == STW {
+			mnemonic = "fstw"
+		}
+		return fmt.Sprintf("%s %s, %s", mnemonic, floatRegName(inst.Fd), memOperand(inst.RMem, inst.Imm, false))
+	}
+	return ""
+}
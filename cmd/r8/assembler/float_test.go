@@ -0,0 +1,75 @@
+package assembler
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	. "github.com/leon332157/risc-y-8/pkg/types"
+)
+
+func TestFloat(t *testing.T) {
+	src := `	fadd f1, f2
+	fmov f8, f1
+	itof f3, r4
+	ftoi r5, f6
+	fldw f2, [value]
+	fstw f7, [sp - 8]
+	hlt
+value:	.float 1.5, -2, 1e-3, -0.25, 3 * 4
+`
+	img, err := assembleImage(t, src)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []FloatInstruction{
+		{OpType: RegReg, Fd: 0, FPU: FPU_ADD, Fs: 1},
+		{OpType: RegReg, Fd: 7, FPU: FPU_CPY, Fs: 0},
+		{OpType: RegReg, Fd: 2, FPU: FPU_ITOF, Fs: 4},
+		{OpType: RegReg, Fd: 5, FPU: FPU_FTOI, Fs: 5},
+		{OpType: LoadStore, Fd: 1, MemMode: LDW, Imm: 28},
+		{OpType: LoadStore, Fd: 6, MemMode: STW, RMem: IntegerRegisters["sp"], Imm: -8},
+	}
+	for i, want := range expected {
+		var got FloatInstruction
+		if !got.Decode(img[4*uint32(i)]) || got != want {
+			t.Errorf("word %d: expected %+v, got %+v (%08x)", i, want, got, img[4*uint32(i)])
+		}
+		if img[4*uint32(i)]&0b11 != uint32(Float) {
+			t.Errorf("word %d: expected DataType Float, got %08x", i, img[4*uint32(i)])
+		}
+	}
+	for i, f := range []float32{1.5, -2, 1e-3, -0.25, 12} {
+		if got := math.Float32frombits(img[uint32(28+4*i)]); got != f {
+			t.Errorf("expected .float %g, got %g", f, got)
+		}
+	}
+
+	for _, src := range []string{
+		"fadd f1, r2\n",
+		"fadd f1\n",
+		"fadd f9, f1\n",
+		"itof f1, f2\n",
+		"ftoi f1, f2\n",
+		"fldw r1, [r2]\n",
+		"fldw f1, f2\n",
+		"fstw f1, [f2]\n",
+		"ldi r1, 1.5\n",
+		".float r1\n",
+		".float ~1.5\n",
+		".float 1e60\n",
+		"f1: nop\n",
+	} {
+		if _, err := assembleImage(t, src); err == nil {
+			t.Errorf("expected error for %q", src)
+		}
+	}
+
+	res, err := assemble(t, "ftoi r0, f1\n")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(res.Warnings) != 1 || !strings.Contains(res.Warnings[0].Error(), "writes to r0") {
+		t.Errorf("expected a warning for writing r0, got %v", res.Warnings)
+	}
+}
@@ -0,0 +1,433 @@
+package assembler
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+/*
+Image file formats, all of them hold 32 bit words starting at address 0:
+
+	bin       little endian binary, the default
+	hex       one word per line in hex
+	readmemh  Verilog $readmemh text with an address line and 8 words per line
+	ihex      Intel HEX, word addressed with one big endian word per record as used by Quartus for 32 bit memories
+	logisim   Logisim v2.0 raw image with run length encoding
+	mif       Quartus memory initialization file
+*/
+
+var Formats = []string{"bin", "hex", "readmemh", "ihex", "logisim", "mif"}
+
+// Write the words in the given format
+func WriteImage(w io.Writer, words []uint32, format string) error {
+	bw := bufio.NewWriter(w)
+	switch format {
+	case "bin", "":
+		if err := binary.Write(bw, binary.LittleEndian, words); err != nil {
+			return err
+		}
+	case "hex":
+		for _, word := range words {
+			fmt.Fprintf(bw, "%08x\n", word)
+		}
+	case "readmemh":
+		fmt.Fprintf(bw, "// r8 image, %d words\n@00000000\n", len(words))
+		writeWordLines(bw, words, 8, func(word uint32) string { return fmt.Sprintf("%08x", word) })
+	case "ihex":
+		writeIntelHex(bw, words)
+	case "logisim":
+		fmt.Fprintln(bw, "v2.0 raw")
+		writeWordLines(bw, runLengthEncode(words), 8, func(s string) string { return s })
+	case "mif":
+		fmt.Fprintf(bw, "DEPTH = %d;\nWIDTH = 32;\nADDRESS_RADIX = HEX;\nDATA_RADIX = HEX;\nCONTENT\nBEGIN\n", max(len(words), 1))
+		for addr, word := range words {
+			fmt.Fprintf(bw, "%x : %08x;\n", addr, word)
+		}
+		fmt.Fprintln(bw, "END;")
+	default:
+		return fmt.Errorf("unknown image format %s, expected one of %s", format, strings.Join(Formats, ", "))
+	}
+	return bw.Flush()
+}
+
+func writeWordLines[T any](w io.Writer, items []T, perLine int, format func(T) string) {
+	for i, item := range items {
+		sep := " "
+		if i%perLine == perLine-1 || i == len(items)-1 {
+			sep = "\n"
+		}
+		fmt.Fprint(w, format(item), sep)
+	}
+}
+
+// Logisim runs are written as count*value, only worth it for 4 or more repeats
+func runLengthEncode(words []uint32) []string {
+	out := []string{}
+	for i := 0; i < len(words); {
+		j := i
+		for j < len(words) && words[j] == words[i] {
+			j++
+		}
+		if j-i >= 4 {
+			out = append(out, fmt.Sprintf("%d*%x", j-i, words[i]))
+		} else {
+			for k := i; k < j; k++ {
+				out = append(out, fmt.Sprintf("%x", words[k]))
+			}
+		}
+		i = j
+	}
+	return out
+}
+
+func writeIntelHex(w io.Writer, words []uint32) {
+	record := func(typ byte, addr uint16, data []byte) {
+		sum := byte(len(data)) + byte(addr>>8) + byte(addr) + typ
+		fmt.Fprintf(w, ":%02X%04X%02X", len(data), addr, typ)
+		for _, b := range data {
+			fmt.Fprintf(w, "%02X", b)
+			sum += b
+		}
+		fmt.Fprintf(w, "%02X\n", -sum)
+	}
+	for addr, word := range words {
+		if addr > 0 && addr&0xffff == 0 {
+			// extended linear address for images over 64k words
+			record(0x04, 0, []byte{byte(addr >> 24), byte(addr >> 16)})
+		}
+		data := make([]byte, 4)
+		binary.BigEndian.PutUint32(data, word)
+		record(0x00, uint16(addr), data)
+	}
+	record(0x01, 0, nil)
+}
+
+// Guess the format of an image file from its contents
+func DetectFormat(data []byte) string {
+	text := bytes.TrimSpace(data)
+	for _, b := range data {
+		if b >= 0x7f || b < 0x20 && b != '\n' && b != '\r' && b != '\t' {
+			return "bin"
+		}
+	}
+	upper := strings.ToUpper(string(text))
+	switch {
+	case len(text) == 0:
+		return "bin"
+	case text[0] == ':':
+		return "ihex"
+	case strings.HasPrefix(string(text), "v2.0 raw"):
+		return "logisim"
+	case strings.Contains(upper, "CONTENT") && strings.Contains(upper, "BEGIN"):
+		return "mif"
+	default:
+		// hex is a subset of readmemh
+		return "readmemh"
+	}
+}
+
+// Read an image in the given format, or detect the format when it is "auto" or empty
+func ReadImage(data []byte, format string) ([]uint32, error) {
+	if format == "auto" || format == "" {
+		format = DetectFormat(data)
+	}
+	mem := map[uint32]uint32{}
+	var err error
+	switch format {
+	case "bin":
+		if len(data)%4 != 0 {
+			return nil, fmt.Errorf("binary size %d is not a multiple of 4 bytes", len(data))
+		}
+		words := make([]uint32, len(data)/4)
+		for i := range words {
+			words[i] = binary.LittleEndian.Uint32(data[i*4:])
+		}
+		return words, nil
+	case "hex", "readmemh":
+		err = readMemh(data, mem)
+	case "ihex":
+		err = readIntelHex(data, mem)
+	case "logisim":
+		err = readLogisim(data, mem)
+	case "mif":
+		err = readMif(data, mem)
+	default:
+		return nil, fmt.Errorf("unknown image format %s, expected auto or one of %s", format, strings.Join(Formats, ", "))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("[%s] %v", format, err)
+	}
+	// mem is keyed by word address as in the file, unlike an Image
+	var size uint32
+	for addr := range mem {
+		size = max(size, addr+1)
+	}
+	words := make([]uint32, size)
+	for addr, word := range mem {
+		words[addr] = word
+	}
+	return words, nil
+}
+
+func parseHexWord(s string) (uint32, error) {
+	v, err := strconv.ParseUint(strings.ReplaceAll(s, "_", ""), 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid hex word %q", s)
+	}
+	return uint32(v), nil
+}
+
+func readMemh(data []byte, mem map[uint32]uint32) error {
+	var addr uint32
+	inComment := false
+	for num, line := range strings.Split(string(data), "\n") {
+		// strip block comments, which may span lines, then line comments
+		var sb strings.Builder
+		for i := 0; i < len(line); i++ {
+			switch {
+			case inComment && strings.HasPrefix(line[i:], "*/"):
+				inComment = false
+				i++
+			case inComment:
+			case strings.HasPrefix(line[i:], "/*"):
+				inComment = true
+				i++
+			case strings.HasPrefix(line[i:], "//"):
+				i = len(line)
+			default:
+				sb.WriteByte(line[i])
+			}
+		}
+		for _, field := range strings.Fields(sb.String()) {
+			if strings.HasPrefix(field, "@") {
+				a, err := parseHexWord(field[1:])
+				if err != nil {
+					return fmt.Errorf("line %d: invalid address: %v", num+1, err)
+				}
+				addr = a
+				continue
+			}
+			word, err := parseHexWord(field)
+			if err != nil {
+				return fmt.Errorf("line %d: %v", num+1, err)
+			}
+			mem[addr] = word
+			addr++
+		}
+	}
+	return nil
+}
+
+func readIntelHex(data []byte, mem map[uint32]uint32) error {
+	var base uint32
+	for num, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if line[0] != ':' || len(line) < 11 || len(line)%2 != 1 {
+			return fmt.Errorf("line %d: invalid record", num+1)
+		}
+		rec := make([]byte, (len(line)-1)/2)
+		var sum byte
+		for i := range rec {
+			b, err := strconv.ParseUint(line[1+2*i:3+2*i], 16, 8)
+			if err != nil {
+				return fmt.Errorf("line %d: invalid hex digits", num+1)
+			}
+			rec[i] = byte(b)
+			sum += byte(b)
+		}
+		if sum != 0 {
+			return fmt.Errorf("line %d: checksum mismatch", num+1)
+		}
+		count, addr, typ, payload := int(rec[0]), uint32(rec[1])<<8|uint32(rec[2]), rec[3], rec[4:len(rec)-1]
+		if len(payload) != count {
+			return fmt.Errorf("line %d: record length %d does not match data length %d", num+1, count, len(payload))
+		}
+		switch typ {
+		case 0x00:
+			if count%4 != 0 {
+				return fmt.Errorf("line %d: data length %d is not a multiple of 4 bytes", num+1, count)
+			}
+			for i := 0; i < count; i += 4 {
+				mem[base+addr+uint32(i/4)] = binary.BigEndian.Uint32(payload[i:])
+			}
+		case 0x01:
+			return nil
+		case 0x02:
+			if count != 2 {
+				return fmt.Errorf("line %d: invalid extended segment address", num+1)
+			}
+			base = (uint32(payload[0])<<8 | uint32(payload[1])) << 4
+		case 0x04:
+			if count != 2 {
+				return fmt.Errorf("line %d: invalid extended linear address", num+1)
+			}
+			base = (uint32(payload[0])<<8 | uint32(payload[1])) << 16
+		case 0x03, 0x05:
+			// start address, not used
+		default:
+			return fmt.Errorf("line %d: unknown record type %02x", num+1, typ)
+		}
+	}
+	return fmt.Errorf("missing end of file record")
+}
+
+func readLogisim(data []byte, mem map[uint32]uint32) error {
+	lines := strings.Split(string(data), "\n")
+	if strings.TrimSpace(lines[0]) != "v2.0 raw" {
+		return fmt.Errorf("missing v2.0 raw header")
+	}
+	var addr uint32
+	for num, line := range lines[1:] {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		for _, field := range strings.Fields(line) {
+			count := uint64(1)
+			if n, v, ok := strings.Cut(field, "*"); ok {
+				c, err := strconv.ParseUint(n, 10, 32)
+				if err != nil {
+					return fmt.Errorf("line %d: invalid run length %q", num+2, n)
+				}
+				count, field = c, v
+			}
+			word, err := parseHexWord(field)
+			if err != nil {
+				return fmt.Errorf("line %d: %v", num+2, err)
+			}
+			for range count {
+				mem[addr] = word
+				addr++
+			}
+		}
+	}
+	return nil
+}
+
+func parseMifNumber(s string, radix string) (uint32, error) {
+	base := 16
+	switch radix {
+	case "HEX":
+	case "DEC", "UNS":
+		base = 10
+	case "BIN":
+		base = 2
+	case "OCT":
+		base = 8
+	default:
+		return 0, fmt.Errorf("unsupported radix %s", radix)
+	}
+	v, err := strconv.ParseInt(s, base, 64)
+	if err != nil || v < -(1<<31) || v > (1<<32)-1 {
+		return 0, fmt.Errorf("invalid %s number %q", radix, s)
+	}
+	return uint32(v), nil
+}
+
+func readMif(data []byte, mem map[uint32]uint32) error {
+	// strip -- and % % comments
+	var sb strings.Builder
+	inComment := false
+	for _, line := range strings.Split(string(data), "\n") {
+		for i := 0; i < len(line); i++ {
+			switch {
+			case line[i] == '%':
+				inComment = !inComment
+			case inComment:
+			case strings.HasPrefix(line[i:], "--"):
+				i = len(line)
+			default:
+				sb.WriteByte(line[i])
+			}
+		}
+		sb.WriteByte('\n')
+	}
+	addrRadix, dataRadix := "HEX", "HEX"
+	header, content, ok := strings.Cut(strings.ToUpper(sb.String()), "CONTENT")
+	if !ok {
+		return fmt.Errorf("missing CONTENT section")
+	}
+	for _, stmt := range strings.Split(header, ";") {
+		key, val, ok := strings.Cut(stmt, "=")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "WIDTH":
+			if w := strings.TrimSpace(val); w != "32" {
+				return fmt.Errorf("unsupported WIDTH %s, only 32 bit words are supported", w)
+			}
+		case "ADDRESS_RADIX":
+			addrRadix = strings.TrimSpace(val)
+		case "DATA_RADIX":
+			dataRadix = strings.TrimSpace(val)
+		}
+	}
+	content, ok = strings.CutPrefix(strings.TrimSpace(content), "BEGIN")
+	if !ok {
+		return fmt.Errorf("missing BEGIN after CONTENT")
+	}
+	content, _, ok = strings.Cut(content, "END;")
+	if !ok {
+		return fmt.Errorf("missing END;")
+	}
+	for _, stmt := range strings.Split(content, ";") {
+		stmt = strings.TrimSpace(stmt)
+		if stmt == "" {
+			continue
+		}
+		addrs, values, ok := strings.Cut(stmt, ":")
+		if !ok {
+			return fmt.Errorf("invalid content entry %q", stmt)
+		}
+		addrs = strings.TrimSpace(addrs)
+		words := []uint32{}
+		for _, v := range strings.Fields(values) {
+			word, err := parseMifNumber(v, dataRadix)
+			if err != nil {
+				return err
+			}
+			words = append(words, word)
+		}
+		if len(words) == 0 {
+			return fmt.Errorf("missing data in content entry %q", stmt)
+		}
+		if strings.HasPrefix(addrs, "[") {
+			// [start..end] : value, repeated over the whole range
+			lo, hi, ok := strings.Cut(strings.Trim(addrs, "[]"), "..")
+			if !ok {
+				return fmt.Errorf("invalid address range %q", addrs)
+			}
+			start, err := parseMifNumber(strings.TrimSpace(lo), addrRadix)
+			if err != nil {
+				return err
+			}
+			end, err := parseMifNumber(strings.TrimSpace(hi), addrRadix)
+			if err != nil {
+				return err
+			}
+			if end < start {
+				return fmt.Errorf("invalid address range %q", addrs)
+			}
+			for a := uint64(start); a <= uint64(end); a++ {
+				mem[uint32(a)] = words[int(a-uint64(start))%len(words)]
+			}
+			continue
+		}
+		start, err := parseMifNumber(addrs, addrRadix)
+		if err != nil {
+			return err
+		}
+		for i, word := range words {
+			mem[start+uint32(i)] = word
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package assembler
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestImageFormatsRoundTrip(t *testing.T) {
+	images := map[string][]uint32{
+		"small": {0x00031851, 0x0000026d, 0, 0, 0, 0, 0, 0xffffe00d, 0xdeadbeef},
+		"large": make([]uint32, 0x10005), // needs extended addresses in Intel HEX
+	}
+	images["large"][0x10004] = 0x12345678
+	for name, words := range images {
+		for _, format := range Formats {
+			var buf bytes.Buffer
+			if err := WriteImage(&buf, words, format); err != nil {
+				t.Fatalf("%s %s: write failed: %v", name, format, err)
+			}
+			if detected := DetectFormat(buf.Bytes()); detected != format && !(format == "hex" && detected == "readmemh") {
+				t.Errorf("%s %s: detected as %s", name, format, detected)
+			}
+			got, err := ReadImage(buf.Bytes(), "auto")
+			if err != nil {
+				t.Fatalf("%s %s: read failed: %v", name, format, err)
+			}
+			if diff := cmp.Diff(words, got); diff != "" {
+				t.Errorf("%s %s: round trip mismatch (-want +got):\n%s", name, format, diff)
+			}
+		}
+	}
+}
+
+func TestReadImageFormats(t *testing.T) {
+	var test = []struct {
+		name     string
+		format   string
+		input    string
+		expected []uint32
+	}{
+		{"readmemh", "auto", "// comment\n@2 0000_0001 /* skipped\n 5 */ ff\n", []uint32{0, 0, 1, 0xff}},
+		{"logisim", "auto", "v2.0 raw\n1 3*2 # comment\nff\n", []uint32{1, 2, 2, 2, 0xff}},
+		{"ihex", "auto", ":0400010000A019E161\n:00000001FF\n", []uint32{0, 0x00a019e1}},
+		{"mif", "auto", `-- generated by hand
+WIDTH=32;
+DEPTH=8;
+ADDRESS_RADIX=DEC;
+DATA_RADIX=DEC;
+CONTENT BEGIN
+	[0..2] : 7;
+	4 : 1 2 % inline comment %;
+	6 : -1;
+END;
+`, []uint32{7, 7, 7, 0, 1, 2, 0xffffffff}},
+		{"bin", "bin", "\x51\x18\x03\x00", []uint32{0x00031851}},
+	}
+	for _, tt := range test {
+		got, err := ReadImage([]byte(tt.input), tt.format)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if diff := cmp.Diff(tt.expected, got); diff != "" {
+			t.Errorf("%s: mismatch (-want +got):\n%s", tt.name, diff)
+		}
+	}
+}
+
+func TestReadImageErrors(t *testing.T) {
+	var test = []struct {
+		format string
+		input  string
+		err    string
+	}{
+		{"ihex", ":0400010000A019E162\n:00000001FF\n", "checksum"},
+		{"ihex", ":0400010000A019E161\n", "end of file"},
+		{"readmemh", "0000001 xyz\n", "invalid hex word"},
+		{"mif", "WIDTH=16;\nCONTENT BEGIN\n0 : 1;\nEND;\n", "WIDTH"},
+		{"logisim", "v2.0 raw\nx*1\n", "run length"},
+		{"bin", "\x01\x02\x03", "multiple of 4"},
+		{"srec", "", "unknown image format"},
+	}
+	for _, tt := range test {
+		_, err := ReadImage([]byte(tt.input), tt.format)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s %q: expected error containing %q, got %v", tt.format, tt.input, tt.err, err)
+		}
+	}
+}
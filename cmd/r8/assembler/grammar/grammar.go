@@ -11,67 +11,68 @@ import (
 var asmLexerDyn = lexer.MustStateful(lexer.Rules{
 	"Root": {
 		{"Comment", `#.*`, nil},
-		{"Label", `\w{1,}:`, nil},
+		{"Label", `\.?\w+:`, nil},
 		{"Directive", `\.\w{2,}`, nil},
-		//{"String", `"(\\"|[^"])*"`, nil},
+		{"String", `"(\\.|[^"\\])*"`, nil},
 		//{"Punct", `[!@#$%^&*()_={}\|:;"'<,>.?/]`, nil},
 		{"Hex", `(?i)0x[0-9a-f]+`, nil},
-		{"Number", `[-]?\d+`, nil},
+		{"Float", `\d+\.\d*([eE][-+]?\d+)?|\d+[eE][-+]?\d+`, nil},
+		{"Number", `\d+`, nil},
 		//{"Number", `[-+]?(\d*\.)?\d+`, nil},
-		{"MemoryStart", `\[`, lexer.Push("Memory")},
+		{"MemoryStart", `\[`, nil},
+		{"MemoryEnd", `]`, nil},
+		{"Operator", `<<|>>|[-+*/%&|^~()]`, nil},
 		{"Comma", `,`, nil},
 		//{"Mnemonic", `[a-z]{1,}`, nil},
-		{"Ident", `[a-z0-9]\w*`, nil},
+		{"Ident", `[a-zA-Z0-9_]\w*`, nil},
 		{"EOL", `[\n\r]+`, nil},
 		{"Whitespace", `[ \t]+`, nil},
-	}, "Memory": {
-		{"Operation", `\+|-`, nil},
-		{"Hex", `(?i)0x[0-9a-f]+`, nil},
-		{"Decimal", `\d+`, nil},
-		{"Ident", `[a-z0-9]\w*`, nil},
-		{"whitespace", `[ \t]+`, nil},
-		{"MemoryEnd", `]`, lexer.Pop()},
-		//{"Displacement",`0x[0-9a-f]+|[-+]?\d+`,nil},
-		//{"Hex", `0x[0-9a-f]+`, nil},
-		//{"Decimal", `[-\+]?\d+`, nil},
 	},
 })
 
 type Program struct {
 	//Pos lexer.Position
 
-	Lines []Line `@@*`
+	Lines []Line `EOL* @@*`
 }
 
+// A line holds exactly one of a label, a directive or an instruction,
+// a label may be followed by an instruction on the same source line, which is parsed as the next Line
 type Line struct {
 	Pos lexer.Position
 
-	Index int
+	Index      int
+	Expansions []Expansion // macro calls that produced the line, filled in when parsing preprocessed source
 
-	Comment     string       `EOL? ( @Comment`
-	Directive   *Directive   `| @@`
-	Label       *Label       `| @@`
-	Instruction *Instruction `| @@) (EOL|EOF|Comment?)` // allow end of line comments
+	Comment     string       // comments are elided by the lexer
+	Label       *Label       `( @@ EOL*`
+	Directive   *Directive   `| @@ (EOL+|EOF)`
+	Instruction *Instruction `| @@ (EOL+|EOF) )`
 }
 
 type Directive struct {
 	//Pos lexer.Position
 
-	Type    string    `@Directive`
-	Operand Immediate `@@?`
+	Type     string    `@Directive`
+	Operands []Operand `@@*`
 }
 
 type Label struct {
 	//Pos lexer.Position
 
 	Text   string `@Label`
-	Offset uint32
+	Offset uint32 // address of the label, filled in by the assembler
+}
+
+// Name returns the label text without the trailing colon
+func (l *Label) Name() string {
+	return strings.TrimSuffix(l.Text, ":")
 }
 
 type Instruction struct {
 	Pos *lexer.Position
 
-	Mnemonic string    `@Ident " "?`
+	Mnemonic string    `@Ident`
 	Operands []Operand `@@*`
 }
 
@@ -79,22 +80,67 @@ type Immediate struct {
 	// Allows signed numbers and hex numbers
 	//Pos *lexer.Position
 
-	Value string ` @Number|@Hex`
+	Value string
 }
 
 type Displacement struct {
-	// Allows only positive numbers (as decimal representation) and hex numbers
+	// Allows only positive numbers (as decimal representation), hex numbers and label names
 	//Pos *lexer.Position
 
-	Value string `@Decimal|@Hex`
+	Value string
 }
 
+// Memory operand. The parser fills in Expr, the base register and displacement are
+// found by the assembler, Base, Operation and Displacement are only used when Expr is nil
 type Memory struct {
 	//Pos *lexer.Position
 
-	Base         string       `"[" @Ident " "? `
-	Operation    string       `@Operation? " "? `
-	Displacement Displacement `@@? " "? "]"`
+	Expr         *Expr `"[" @@ "]"`
+	Base         string
+	Operation    string
+	Displacement Displacement
+}
+
+// Constant expression, a list of terms joined by binary operators.
+// Operator precedence is applied by the assembler when the expression is evaluated
+type Expr struct {
+	Tokens []lexer.Token
+
+	First *Unary      `@@`
+	Rest  []*BinaryOp `@@*`
+	Text  string      // source text of the expression, filled in by ParseString
+}
+
+type BinaryOp struct {
+	Op   string `@("<<"|">>"|"+"|"-"|"*"|"/"|"%"|"&"|"|"|"^")`
+	Term *Unary `@@`
+}
+
+type Unary struct {
+	Ops     []string `@("-"|"~"|"+")*`
+	Primary *Primary `@@`
+}
+
+type Primary struct {
+	Number string `  @(Number|Hex)`
+	Float  string `| @Float` // only valid in .float
+	Call   *Call  `| @@`
+	Ident  string `| @(Ident|Directive)`
+	Sub    *Expr  `| "(" @@ ")"`
+}
+
+// Function call such as lo(label)
+type Call struct {
+	Func string `@Ident "("`
+	Arg  *Expr  `@@ ")"`
+}
+
+// Ident returns the name when the expression is a single identifier such as a register or label
+func (e *Expr) Ident() (string, bool) {
+	if e == nil || len(e.Rest) > 0 || len(e.First.Ops) > 0 || e.First.Primary.Ident == "" {
+		return "", false
+	}
+	return e.First.Primary.Ident, true
 }
 
 type Operand interface {
@@ -103,17 +149,26 @@ type Operand interface {
 type OperandRegister struct {
 	//Pos *lexer.Position
 
-	Value string `@Ident ","? " "?`
+	// Register name, or a label name when used as an immediate
+	Value string
 }
 type OperandImmediate struct {
 	//Pos *lexer.Position
 
-	Value string ` (@Number|@Hex) ","?" "? `
+	Expr  *Expr  `@@ ","?`
+	Value string // source text of the expression, only used when Expr is nil
 }
 type OperandMemory struct {
 	//Pos *lexer.Position
 
-	Value Memory `@@`
+	Value Memory `@@ ","?`
+}
+
+// Quoted string, only valid as a directive operand
+type OperandString struct {
+	//Pos *lexer.Position
+
+	Value string `@String ","? `
 }
 
 func toLower(token lexer.Token) (lexer.Token, error) {
@@ -123,15 +178,75 @@ func toLower(token lexer.Token) (lexer.Token, error) {
 
 var Parser = participle.MustBuild[Program](
 	participle.Lexer(asmLexerDyn),
-	participle.Elide("Comment"),
+	participle.Elide("Comment", "Whitespace"),
 	participle.UseLookahead(3),
-	participle.Union[Operand](OperandRegister{}, OperandImmediate{}, OperandMemory{}),
-	participle.Map(toLower, "Ident"), // lowercase all mnemonics and identifiers such as register names
+	participle.Union[Operand](OperandMemory{}, OperandString{}, OperandImmediate{}),
+	participle.Map(toLower, "Ident", "Label", "Directive"), // lowercase all mnemonics, identifiers such as register names, labels and directives
 )
 
+// Parse a program, operands that are a single identifier become an OperandRegister
+// and the source text of every expression is recorded
 func ParseString(name, input string) (*Program, error) {
 	if name == "" {
 		name = "<unknown>"
 	}
-	return Parser.ParseString(name, input)
+	prog, err := Parser.ParseString(name, input)
+	if err != nil {
+		return prog, err
+	}
+	for i := range prog.Lines {
+		line := &prog.Lines[i]
+		if line.Instruction != nil {
+			resolveOperands(line.Instruction.Operands, input)
+		}
+		if line.Directive != nil {
+			resolveOperands(line.Directive.Operands, input)
+		}
+	}
+	return prog, nil
+}
+
+func resolveOperands(ops []Operand, input string) {
+	for i, op := range ops {
+		switch op := op.(type) {
+		case OperandImmediate:
+			op.Expr.resolveText(input)
+			if name, ok := op.Expr.Ident(); ok {
+				ops[i] = OperandRegister{Value: name}
+				continue
+			}
+			op.Value = op.Expr.Text
+			ops[i] = op
+		case OperandMemory:
+			op.Value.Expr.resolveText(input)
+		}
+	}
+}
+
+// Fill in the source text of an expression and its sub expressions from the tokens it matched
+func (e *Expr) resolveText(input string) {
+	if e == nil || len(e.Tokens) == 0 {
+		return
+	}
+	first, last := e.Tokens[0], e.Tokens[len(e.Tokens)-1]
+	end := last.Pos.Offset + len(last.Value)
+	if first.Pos.Offset <= end && end <= len(input) {
+		e.Text = strings.TrimSpace(input[first.Pos.Offset:end]) // the tokens include elided whitespace
+	}
+	for _, u := range append([]*Unary{e.First}, rest(e.Rest)...) {
+		if u.Primary.Sub != nil {
+			u.Primary.Sub.resolveText(input)
+		}
+		if u.Primary.Call != nil {
+			u.Primary.Call.Arg.resolveText(input)
+		}
+	}
+}
+
+func rest(ops []*BinaryOp) []*Unary {
+	terms := make([]*Unary, len(ops))
+	for i, op := range ops {
+		terms[i] = op.Term
+	}
+	return terms
 }
@@ -0,0 +1,387 @@
+package grammar
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/participle/v2/lexer"
+)
+
+/*
+The preprocessor expands .include and macros before a program is parsed. Macro arguments
+are substituted as text, so it works on source lines rather than parsed Lines.
+
+	.include "file.asm"     insert a file, relative to the directory of the including file
+
+	.macro name a, b=1      define a macro with parameters a and b, b defaults to 1
+	    add \a, \b          parameters are referenced as \name
+	.loop:                  labels starting with a dot are local to each expansion
+	    bne .loop
+	.endm
+
+	name r1, 4              expand the macro
+
+\@ is replaced by the number of the expansion and \() by nothing, so a parameter can be
+followed by letters, e.g. \a\()_end. Macros must be defined before they are used, may call
+other macros and may define macros themselves, which are defined when the outer macro is expanded
+*/
+
+// maximum depth of nested macro expansions and includes, deeper nesting is most likely recursion
+const maxNesting = 64
+
+// A SourceLine is one line of source after includes and macros are expanded
+type SourceLine struct {
+	Text       string
+	Pos        lexer.Position // position of the start of the line in the file it came from
+	Expansions []Expansion    // macro calls that produced the line, innermost first
+}
+
+// A macro call that a line was expanded from
+type Expansion struct {
+	Macro string
+	Pos   lexer.Position // position of the call
+}
+
+type Macro struct {
+	Name   string
+	Params []MacroParam
+	Body   []SourceLine
+	Pos    lexer.Position
+}
+
+type MacroParam struct {
+	Name    string
+	Default string // empty if the argument is required
+}
+
+// Error is a preprocessor error, it implements participle.Error like syntax errors do
+type Error struct {
+	Pos        lexer.Position
+	Msg        string
+	Token      string // offending text on the line
+	Expansions []Expansion
+}
+
+func (e *Error) Error() string            { return fmt.Sprintf("%s: %s", e.Pos, e.Msg) }
+func (e *Error) Message() string          { return e.Msg }
+func (e *Error) Position() lexer.Position { return e.Pos }
+
+type Preprocessor struct {
+	// ReadFile reads the files named by .include
+	ReadFile func(name string) ([]byte, error)
+	// Sources holds the lines of every file read, for diagnostics
+	Sources map[string][]string
+
+	macros    map[string]*Macro
+	count     int      // number of expansions, used to make local labels unique
+	including []string // files being included, to detect include cycles
+	errs      []*Error
+}
+
+func NewPreprocessor() *Preprocessor {
+	return &Preprocessor{
+		ReadFile: os.ReadFile,
+		Sources:  make(map[string][]string),
+		macros:   make(map[string]*Macro),
+	}
+}
+
+// Preprocess returns the lines of src with includes and macros expanded
+func (p *Preprocessor) Preprocess(filename string, src string) ([]SourceLine, []*Error) {
+	p.including = []string{filepath.Clean(filename)}
+	lines := p.process(p.split(filename, src), nil, 0)
+	return lines, p.errs
+}
+
+// Split a file into lines and record it in Sources
+func (p *Preprocessor) split(filename string, src string) []SourceLine {
+	texts := strings.Split(src, "\n")
+	p.Sources[filename] = texts
+	lines := make([]SourceLine, len(texts))
+	offset := 0
+	for i, text := range texts {
+		lines[i] = SourceLine{
+			Text: strings.TrimRight(text, "\r"),
+			Pos:  lexer.Position{Filename: filename, Line: i + 1, Column: 1, Offset: offset},
+		}
+		offset += len(text) + 1
+	}
+	return lines
+}
+
+func (p *Preprocessor) errorf(line SourceLine, token string, format string, args ...any) {
+	p.errs = append(p.errs, &Error{Pos: line.Pos, Msg: fmt.Sprintf(format, args...), Token: token, Expansions: line.Expansions})
+}
+
+var labelPattern = regexp.MustCompile(`^\s*(\.?\w+:)`)
+
+// Split a line into its label, the first word in lower case and the rest without the comment
+func splitLine(text string) (label string, word string, rest string) {
+	if m := labelPattern.FindStringSubmatch(text); m != nil {
+		label = m[1]
+		text = text[len(m[0]):]
+	}
+	word = strings.TrimSpace(stripComment(text))
+	if i := strings.IndexAny(word, " \t"); i >= 0 {
+		word, rest = word[:i], word[i+1:]
+	}
+	return label, strings.ToLower(word), strings.TrimSpace(rest)
+}
+
+// Remove a comment that is not inside a string
+func stripComment(text string) string {
+	quoted := false
+	for i := 0; i < len(text); i++ {
+		switch {
+		case text[i] == '\\' && quoted:
+			i++
+		case text[i] == '"':
+			quoted = !quoted
+		case text[i] == '#' && !quoted:
+			return text[:i]
+		}
+	}
+	return text
+}
+
+// Split macro arguments on commas that are not inside brackets, parentheses or strings
+func splitArgs(text string) []string {
+	if strings.TrimSpace(text) == "" {
+		return nil
+	}
+	var args []string
+	depth, quoted, start := 0, false, 0
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case c == '\\' && quoted:
+			i++
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '(' || c == '[':
+			depth++
+		case c == ')' || c == ']':
+			depth--
+		case c == ',' && depth == 0:
+			args = append(args, strings.TrimSpace(text[start:i]))
+			start = i + 1
+		}
+	}
+	return append(args, strings.TrimSpace(text[start:]))
+}
+
+// Expand the includes, macro definitions and macro calls in lines
+func (p *Preprocessor) process(lines []SourceLine, out []SourceLine, depth int) []SourceLine {
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		label, word, rest := splitLine(line.Text)
+		labelOnly := SourceLine{Text: label, Pos: line.Pos, Expansions: line.Expansions}
+		switch {
+		case word == ".macro":
+			i = p.define(lines, i, rest)
+		case word == ".endm":
+			p.errorf(line, word, ".endm without .macro")
+		case word == ".include":
+			if label != "" {
+				out = append(out, labelOnly)
+			}
+			out = p.include(line, rest, out, depth)
+		case p.macros[word] != nil:
+			if label != "" {
+				out = append(out, labelOnly)
+			}
+			out = p.expand(p.macros[word], line, rest, out, depth)
+		default:
+			out = append(out, line)
+		}
+	}
+	return out
+}
+
+var (
+	namePattern  = regexp.MustCompile(`^\w+$`)
+	paramPattern = regexp.MustCompile(`^(\w+)(?:\s*=\s*(.*))?$`)
+)
+
+// Define the macro that starts at lines[start], returns the index of its .endm
+func (p *Preprocessor) define(lines []SourceLine, start int, header string) int {
+	line := lines[start]
+	name, params := header, ""
+	if i := strings.IndexAny(header, " \t"); i >= 0 {
+		name, params = header[:i], header[i+1:]
+	}
+	name = strings.ToLower(name)
+	m := &Macro{Name: name, Pos: line.Pos}
+	if !namePattern.MatchString(name) {
+		p.errorf(line, name, "invalid macro name %q", name)
+	}
+	for _, param := range splitArgs(params) {
+		match := paramPattern.FindStringSubmatch(param)
+		if match == nil {
+			p.errorf(line, param, "invalid macro parameter %q", param)
+			continue
+		}
+		m.Params = append(m.Params, MacroParam{Name: strings.ToLower(match[1]), Default: match[2]})
+	}
+	nested := 0
+	for end := start + 1; end < len(lines); end++ {
+		_, word, _ := splitLine(lines[end].Text)
+		switch {
+		case word == ".macro":
+			nested++
+		case word == ".endm" && nested > 0:
+			nested--
+		case word == ".endm":
+			if prev, ok := p.macros[name]; ok {
+				p.errorf(line, name, "macro %s is already defined at %v", name, prev.Pos)
+			} else {
+				m.Body = lines[start+1 : end]
+				p.macros[name] = m
+			}
+			return end
+		}
+	}
+	p.errorf(line, ".macro", "missing .endm for macro %s", name)
+	return len(lines)
+}
+
+// Substitute the arguments of a macro call into the body and expand the result
+func (p *Preprocessor) expand(m *Macro, call SourceLine, argText string, out []SourceLine, depth int) []SourceLine {
+	if depth >= maxNesting {
+		p.errorf(call, m.Name, "macro %s is nested too deeply, it may call itself", m.Name)
+		return out
+	}
+	args := splitArgs(argText)
+	if len(args) > len(m.Params) {
+		p.errorf(call, m.Name, "macro %s takes %d arguments, got %d", m.Name, len(m.Params), len(args))
+		return out
+	}
+	values := make(map[string]string, len(m.Params))
+	for i, param := range m.Params {
+		switch {
+		case i < len(args) && args[i] != "":
+			values[param.Name] = args[i]
+		case param.Default != "":
+			values[param.Name] = param.Default
+		default:
+			p.errorf(call, m.Name, "missing argument %s for macro %s", param.Name, m.Name)
+			return out
+		}
+	}
+	p.count++
+	values["@"] = strconv.Itoa(p.count)
+	values["()"] = ""
+
+	// labels starting with a dot are renamed in every expansion
+	locals := map[string]string{}
+	for _, line := range m.Body {
+		if label, _, _ := splitLine(line.Text); strings.HasPrefix(label, ".") {
+			name := strings.ToLower(strings.TrimSuffix(label, ":"))
+			locals[name] = fmt.Sprintf("%s__%d", name, p.count)
+		}
+	}
+	expansions := append([]Expansion{{Macro: m.Name, Pos: call.Pos}}, call.Expansions...)
+	body := make([]SourceLine, len(m.Body))
+	for i, line := range m.Body {
+		body[i] = SourceLine{
+			Text:       renameLocals(substitute(line.Text, values), locals),
+			Pos:        line.Pos,
+			Expansions: expansions,
+		}
+	}
+	return p.process(body, out, depth+1)
+}
+
+// Replace \name with the value of the parameter, unknown names are left alone
+// so escapes such as \n in strings keep working unless a parameter is named n
+func substitute(text string, values map[string]string) string {
+	var sb strings.Builder
+	for i := 0; i < len(text); i++ {
+		if text[i] != '\\' {
+			sb.WriteByte(text[i])
+			continue
+		}
+		j := i + 1
+		for j < len(text) && (text[j] == '_' || text[j] >= '0' && text[j] <= '9' || text[j]|0x20 >= 'a' && text[j]|0x20 <= 'z') {
+			j++
+		}
+		name := strings.ToLower(text[i+1 : j])
+		switch {
+		case strings.HasPrefix(text[i+1:], "@"):
+			name, j = "@", i+2
+		case strings.HasPrefix(text[i+1:], "()"):
+			name, j = "()", i+3
+		}
+		if value, ok := values[name]; ok {
+			sb.WriteString(value)
+			i = j - 1
+		} else {
+			sb.WriteByte(text[i])
+		}
+	}
+	return sb.String()
+}
+
+// Replace whole words that are local labels
+func renameLocals(text string, locals map[string]string) string {
+	if len(locals) == 0 {
+		return text
+	}
+	isWord := func(c byte) bool {
+		return c == '_' || c == '.' || c >= '0' && c <= '9' || c|0x20 >= 'a' && c|0x20 <= 'z'
+	}
+	var sb strings.Builder
+	for i := 0; i < len(text); {
+		j := i
+		for j < len(text) && isWord(text[j]) {
+			j++
+		}
+		if j == i {
+			sb.WriteByte(text[i])
+			i++
+			continue
+		}
+		word := text[i:j]
+		if renamed, ok := locals[strings.ToLower(word)]; ok {
+			word = renamed
+		}
+		sb.WriteString(word)
+		i = j
+	}
+	return sb.String()
+}
+
+// Insert the lines of an included file
+func (p *Preprocessor) include(line SourceLine, arg string, out []SourceLine, depth int) []SourceLine {
+	name, err := strconv.Unquote(arg)
+	if err != nil {
+		p.errorf(line, arg, ".include expects a quoted file name, got %s", arg)
+		return out
+	}
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(filepath.Dir(line.Pos.Filename), name)
+	}
+	for _, file := range p.including {
+		if file == name {
+			p.errorf(line, arg, "%s includes itself", name)
+			return out
+		}
+	}
+	if depth >= maxNesting {
+		p.errorf(line, arg, "includes are nested too deeply")
+		return out
+	}
+	data, err := p.ReadFile(name)
+	if err != nil {
+		p.errorf(line, arg, "cannot include %s: %v", name, err)
+		return out
+	}
+	p.including = append(p.including, name)
+	out = p.process(p.split(name, string(data)), out, depth+1)
+	p.including = p.including[:len(p.including)-1]
+	return out
+}
@@ -0,0 +1,118 @@
+package grammar
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func preprocess(t *testing.T, files map[string]string, main string) ([]SourceLine, []*Error) {
+	t.Helper()
+	p := NewPreprocessor()
+	p.ReadFile = func(name string) ([]byte, error) {
+		if src, ok := files[name]; ok {
+			return []byte(src), nil
+		}
+		return nil, fmt.Errorf("no such file")
+	}
+	return p.Preprocess("main.asm", main)
+}
+
+func texts(lines []SourceLine) []string {
+	out := []string{}
+	for _, line := range lines {
+		if text := strings.TrimSpace(line.Text); text != "" {
+			out = append(out, text)
+		}
+	}
+	return out
+}
+
+func TestMacroExpansion(t *testing.T) {
+	src := `
+.macro add3 rd, a, b=1   # comment
+	add \rd, \a
+	add \rd, \b
+.endm
+.macro wait count
+	li r1, \count
+.loop:	dec r1
+	bne .loop
+	.string "\n"
+.endm
+start: add3 r2, r3
+	add3 r2, [r4 + 1], (2, 3)
+	wait 5
+	wait 0x10
+`
+	lines, errs := preprocess(t, nil, src)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	expected := []string{
+		"start:",
+		"add r2, r3",
+		"add r2, 1",
+		"add r2, [r4 + 1]",
+		"add r2, (2, 3)",
+		"li r1, 5",
+		".loop__3:	dec r1",
+		"bne .loop__3",
+		`.string "\n"`,
+		"li r1, 0x10",
+		".loop__4:	dec r1",
+		"bne .loop__4",
+		`.string "\n"`,
+	}
+	if diff := cmp.Diff(expected, texts(lines)); diff != "" {
+		t.Errorf("expansion mismatch (-want +got):\n%s", diff)
+	}
+	// expanded lines point into the definition and record the call site
+	last := lines[len(lines)-2]
+	if last.Pos.Line != 10 || len(last.Expansions) != 1 || last.Expansions[0].Macro != "wait" || last.Expansions[0].Pos.Line != 15 {
+		t.Errorf("wrong position for expanded line: %+v", last)
+	}
+}
+
+func TestMacroNestingAndInclude(t *testing.T) {
+	files := map[string]string{
+		"lib/a.asm": ".include \"b.asm\"\n.macro inner x\n\tpush \\x\n.endm\n",
+		"lib/b.asm": ".macro outer x, y\n\tinner \\x\n\tinner \\y\n\t.macro made\n\tnop\n\t.endm\n.endm\n",
+	}
+	lines, errs := preprocess(t, files, ".include \"lib/a.asm\"\nouter r1, r2\nmade\n")
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if diff := cmp.Diff([]string{"push r1", "push r2", "nop"}, texts(lines)); diff != "" {
+		t.Errorf("expansion mismatch (-want +got):\n%s", diff)
+	}
+	push := lines[slices.IndexFunc(lines, func(l SourceLine) bool { return strings.Contains(l.Text, "push") })]
+	if push.Pos.Filename != "lib/a.asm" || len(push.Expansions) != 2 ||
+		push.Expansions[0].Macro != "inner" || push.Expansions[0].Pos.Filename != "lib/b.asm" ||
+		push.Expansions[1].Macro != "outer" || push.Expansions[1].Pos.Filename != "main.asm" {
+		t.Errorf("wrong expansion chain: %+v", push)
+	}
+}
+
+func TestMacroErrors(t *testing.T) {
+	files := map[string]string{"self.asm": ".include \"self.asm\"\n"}
+	for _, src := range []string{
+		".macro m\nnop\n",
+		".endm\n",
+		".macro m a\nnop\n.endm\nm\n",
+		".macro m\nnop\n.endm\nm 1\n",
+		".macro m\nnop\n.endm\n.macro m\nnop\n.endm\n",
+		".macro m\nm\n.endm\nm\n",
+		".include \"missing.asm\"\n",
+		".include missing.asm\n",
+		".include \"self.asm\"\n",
+		".macro 1+2\n.endm\n",
+	} {
+		if _, errs := preprocess(t, files, src); len(errs) == 0 {
+			t.Errorf("expected error for %q", src)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package assembler
+
+import (
+	. "github.com/leon332157/risc-y-8/pkg/types"
+)
+
+// An assembled word, either an instruction or a data word emitted by a directive
+type Word struct {
+	Addr    uint32
+	Inst    *BaseInstruction    // nil for data words, float, vector and sub-word instructions
+	Float   *FloatInstruction   // set for float instructions
+	Vector  *VectorInstruction  // set for vector instructions
+	SubWord *SubWordInstruction // set for byte and halfword loads and stores
+	Data    uint32
+}
+
+// Encode returns the machine word stored at the address of w
+func (w *Word) Encode() uint32 {
+	if w.Inst != nil {
+		return w.Inst.Encode()
+	}
+	if w.Float != nil {
+		return w.Float.Encode()
+	}
+	if w.Vector != nil {
+		return w.Vector.Encode()
+	}
+	if w.SubWord != nil {
+		return w.SubWord.Encode()
+	}
+	return w.Data
+}
+
+// Sparse memory image produced by the assembler, maps byte addresses, always multiples of 4,
+// to the words stored there
+type Image map[uint32]uint32
+
+// Returns the number of words needed to hold the image starting at address 0
+func (img Image) Size() uint32 {
+	var size uint32
+	for addr := range img {
+		if addr/4+1 > size {
+			size = addr/4 + 1
+		}
+	}
+	return size
+}
+
+// Returns the image as a contiguous slice of words starting at address 0, gaps are filled with zero
+func (img Image) Flatten() []uint32 {
+	flat := make([]uint32, img.Size())
+	for addr, val := range img {
+		flat[addr/4] = val
+	}
+	return flat
+}
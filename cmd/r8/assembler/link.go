@@ -0,0 +1,320 @@
+package assembler
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+r8 link combines object files into a program. A link script places the sections, one per line:
+
+	text 0          # the text sections of all object files, in the order they are given, from address 0
+	data align 16   # after the previous section, aligned to 16 bytes
+	stack 0x7c00    # at a fixed address
+
+Addresses and alignments are in bytes and must be multiples of 4.
+Sections that are not in the script are placed after the last one in the order they are first
+found, so without a script the text sections start at address 0 and everything else follows.
+Global symbols are visible to every object file, local symbols only to the file that defines them
+*/
+
+type LinkScript []ScriptSection
+
+type ScriptSection struct {
+	Name  string
+	Addr  uint32
+	Fixed bool // placed at Addr rather than after the previous section
+	Align uint32
+}
+
+var DefaultLinkScript = LinkScript{{Name: "text", Fixed: true}}
+
+// Parse a link script
+func ParseLinkScript(src string) (LinkScript, error) {
+	var script LinkScript
+	seen := map[string]int{}
+	for i, text := range strings.Split(src, "\n") {
+		if c := strings.IndexByte(text, '#'); c >= 0 {
+			text = text[:c]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		sec := ScriptSection{Name: strings.TrimPrefix(fields[0], "."), Align: 1}
+		if !isLabelName(sec.Name) {
+			return nil, fmt.Errorf("line %d: invalid section name %s", i+1, fields[0])
+		}
+		if prev, ok := seen[sec.Name]; ok {
+			return nil, fmt.Errorf("line %d: section %s is already placed on line %d", i+1, sec.Name, prev)
+		}
+		seen[sec.Name] = i + 1
+		for j := 1; j < len(fields); j++ {
+			align := fields[j] == "align"
+			if align {
+				if j++; j == len(fields) {
+					return nil, fmt.Errorf("line %d: align expects a number of bytes", i+1)
+				}
+			}
+			n, err := strconv.ParseUint(fields[j], 0, 32)
+			switch {
+			case err != nil:
+				return nil, fmt.Errorf("line %d: invalid number %s", i+1, fields[j])
+			case align && (n == 0 || n%4 != 0):
+				return nil, fmt.Errorf("line %d: align must be a multiple of 4 greater than 0", i+1)
+			case align:
+				sec.Align = uint32(n)
+			case sec.Fixed:
+				return nil, fmt.Errorf("line %d: section %s has more than one address", i+1, sec.Name)
+			case n%4 != 0:
+				return nil, fmt.Errorf("line %d: address %#x of section %s is not a multiple of 4", i+1, n, sec.Name)
+			default:
+				sec.Addr, sec.Fixed = uint32(n), true
+			}
+		}
+		script = append(script, sec)
+	}
+	return script, nil
+}
+
+// Placement of the section of an object file in the linked program
+type LinkedSection struct {
+	Name   string
+	Object string // source file of the object file
+	Addr   uint32
+	Size   uint32 // in bytes
+}
+
+type LinkedSymbol struct {
+	Name    string
+	Value   uint32
+	Kind    string // "label" or "constant"
+	Binding string // "local" or "global"
+	Object  string
+	File    string
+	Line    int
+}
+
+// A linked program
+type Linked struct {
+	Image    Image
+	Sections []LinkedSection // sorted by address
+	Symbols  []LinkedSymbol  // sorted by value, then name
+	Lines    []LineInfo      // source of every word, sorted by address
+}
+
+func alignUp(addr, align uint32) uint32 {
+	if align <= 1 {
+		return addr
+	}
+	return (addr + align - 1) / align * align
+}
+
+// Link object files into a program, on failure every error found is returned joined together
+func Link(objs []*Object, script LinkScript) (*Linked, error) {
+	var errs []error
+	seen := map[string]bool{} // li and la relocate two words of the same line
+	fail := func(format string, args ...any) {
+		if err := fmt.Errorf("[link] "+format, args...); !seen[err.Error()] {
+			errs = append(errs, err)
+			seen[err.Error()] = true
+		}
+	}
+
+	// sections not in the script follow in the order they are first found
+	order := append(LinkScript{}, script...)
+	placed := map[string]bool{}
+	for _, sec := range script {
+		placed[sec.Name] = true
+	}
+	for _, obj := range objs {
+		for _, sec := range obj.Sections {
+			if !placed[sec.Name] {
+				order = append(order, ScriptSection{Name: sec.Name, Align: 1})
+				placed[sec.Name] = true
+			}
+		}
+	}
+
+	l := &Linked{Image: Image{}, Sections: []LinkedSection{}, Symbols: []LinkedSymbol{}, Lines: []LineInfo{}}
+	bases := make([]map[string]uint32, len(objs)) // address of each section of each object file
+	for i := range bases {
+		bases[i] = map[string]uint32{}
+	}
+	type span struct {
+		name       string
+		start, end uint32
+	}
+	var spans []span
+	var addr uint32
+	for _, out := range order {
+		if out.Fixed {
+			addr = out.Addr
+		}
+		addr = alignUp(addr, out.Align)
+		start := addr
+		for i, obj := range objs {
+			for _, sec := range obj.Sections {
+				if sec.Name != out.Name {
+					continue
+				}
+				addr = alignUp(addr, sec.Align)
+				bases[i][sec.Name] = addr
+				l.Sections = append(l.Sections, LinkedSection{Name: sec.Name, Object: obj.Source, Addr: addr, Size: 4 * uint32(len(sec.Words))})
+				for j, word := range sec.Words {
+					l.Image[addr+4*uint32(j)] = word
+				}
+				for _, line := range sec.Lines {
+					line.Addr += addr
+					l.Lines = append(l.Lines, line)
+				}
+				addr += 4 * uint32(len(sec.Words))
+			}
+		}
+		for _, other := range spans {
+			if start < other.end && other.start < addr {
+				fail("section %s at %#x-%#x overlaps section %s at %#x-%#x", out.Name, start, addr-1, other.name, other.start, other.end-1)
+			}
+		}
+		if addr > start {
+			spans = append(spans, span{out.Name, start, addr})
+		}
+	}
+
+	globals := map[string]LinkedSymbol{}
+	for i, obj := range objs {
+		for _, sym := range obj.Symbols {
+			if sym.Binding == "extern" {
+				continue
+			}
+			ls := LinkedSymbol{Name: sym.Name, Value: sym.Value, Kind: sym.Kind, Binding: sym.Binding, Object: obj.Source, File: sym.File, Line: sym.Line}
+			if sym.Section != "" {
+				ls.Value += bases[i][sym.Section]
+			}
+			l.Symbols = append(l.Symbols, ls)
+			if sym.Binding != "global" {
+				continue
+			}
+			if prev, ok := globals[sym.Name]; ok {
+				fail("duplicate symbol %s defined in %s and %s", sym.Name, prev.Object, obj.Source)
+				continue
+			}
+			globals[sym.Name] = ls
+		}
+	}
+
+	for i, obj := range objs {
+		for _, sec := range obj.Sections {
+			lines := map[uint32]LineInfo{}
+			for _, line := range sec.Lines {
+				lines[line.Addr] = line
+			}
+			for _, rel := range sec.Relocations {
+				at := obj.Source
+				if line, ok := lines[rel.Offset]; ok {
+					at = line.Location()
+				}
+				var target int64
+				if rel.Symbol != "" {
+					sym, ok := globals[rel.Symbol]
+					if !ok {
+						fail("%s: undefined symbol %s", at, rel.Symbol)
+						continue
+					}
+					target = int64(sym.Value)
+				} else {
+					base, ok := bases[i][rel.Section]
+					if !ok {
+						fail("%s: relocation against unknown section %s", at, rel.Section)
+						continue
+					}
+					target = int64(base)
+				}
+				addr := bases[i][sec.Name] + rel.Offset
+				if err := applyRelocation(l.Image, addr, rel, target+int64(rel.Addend)); err != nil {
+					fail("%s: %v", at, err)
+				}
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	sort.SliceStable(l.Sections, func(i, j int) bool { return l.Sections[i].Addr < l.Sections[j].Addr })
+	sort.SliceStable(l.Lines, func(i, j int) bool { return l.Lines[i].Addr < l.Lines[j].Addr })
+	sort.SliceStable(l.Symbols, func(i, j int) bool {
+		a, b := l.Symbols[i], l.Symbols[j]
+		if a.Value != b.Value {
+			return a.Value < b.Value
+		}
+		return a.Name < b.Name
+	})
+	return l, nil
+}
+
+// Set the word at addr or its immediate field to the value of a relocation
+func applyRelocation(img Image, addr uint32, rel Relocation, val int64) error {
+	field := func(v int64, min, max int64) error {
+		if v < min || v > max {
+			return fmt.Errorf("%s relocation to %s is out of range: %d does not fit in 16 bits", rel.Type, rel.target(), v)
+		}
+		img[addr] = img[addr]&0xffff | uint32(uint16(v))<<16
+		return nil
+	}
+	switch rel.Type {
+	case RelocAbs32:
+		img[addr] = uint32(val)
+		return nil
+	case RelocImm16:
+		return field(val, -32768, 65535)
+	case RelocDisp16:
+		return field(val, -32768, 32767)
+	case RelocPC16:
+		return field(val-(int64(addr)+4), -32768, 32767)
+	case RelocLo16:
+		return field(int64(int16(val)), -32768, 32767)
+	case RelocHi16:
+		return field(((val+0x8000)>>16)&0xffff, 0, 65535)
+	}
+	return fmt.Errorf("unknown relocation type %s", rel.Type)
+}
+
+// DebugInfo returns the source map and symbol table of the linked program
+func (l *Linked) DebugInfo() *DebugInfo {
+	info := &DebugInfo{Version: debugInfoVersion, Lines: l.Lines, Symbols: []SymbolInfo{}}
+	for _, sym := range l.Symbols {
+		info.Symbols = append(info.Symbols, SymbolInfo{Name: sym.Name, Value: sym.Value, Kind: sym.Kind, File: sym.File, Line: sym.Line})
+	}
+	return info
+}
+
+// WriteMap writes where every section is placed and the symbol table
+func (l *Linked) WriteMap(w io.Writer) error {
+	nameWidth, objWidth := len("section"), len("object")
+	for _, sec := range l.Sections {
+		nameWidth, objWidth = max(nameWidth, len(sec.Name)), max(objWidth, len(sec.Object))
+	}
+	for _, sym := range l.Symbols {
+		nameWidth, objWidth = max(nameWidth, len(sym.Name)), max(objWidth, len(sym.Object))
+	}
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "%-*s  %-8s  %-8s  %s\n", nameWidth, "section", "addr", "size", "object")
+	for _, sec := range l.Sections {
+		fmt.Fprintf(bw, "%-*s  %08x  %08x  %s\n", nameWidth, sec.Name, sec.Addr, sec.Size, sec.Object)
+	}
+	fmt.Fprintf(bw, "\n%-8s  %-8s  %-7s  %-*s  %-*s  %s\n", "value", "kind", "binding", nameWidth, "name", objWidth, "object", "defined at")
+	for _, sym := range l.Symbols {
+		defined := "predefined"
+		if sym.File != "" {
+			defined = fmt.Sprintf("%s:%d", sym.File, sym.Line)
+		}
+		fmt.Fprintf(bw, "%08x  %-8s  %-7s  %-*s  %-*s  %s\n", sym.Value, sym.Kind, sym.Binding, nameWidth, sym.Name, objWidth, sym.Object, defined)
+	}
+	return bw.Flush()
+}
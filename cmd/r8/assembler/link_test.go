@@ -0,0 +1,266 @@
+package assembler
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	. "github.com/leon332157/risc-y-8/pkg/types"
+)
+
+const (
+	linkMain = `.extern double, table
+.global start
+start:	ldw r1, [count]
+	call double
+	li r3, table
+	ldw r4, [r3 + lo(table)]
+	stw r2, [result]
+	hlt
+.data
+count:	.word 21
+result:	.word start
+`
+	linkLib = `.global double, table
+double:	cpy r2, r1
+	add r2, r1
+	ret
+.section rodata
+table:	.word 100, 200, end - table
+end:
+`
+)
+
+func assembleObject(t *testing.T, name, src string) *Object {
+	t.Helper()
+	res, err := New(Options{Relocatable: true}).AssembleString(name, src)
+	if err != nil {
+		t.Fatalf("%s: unexpected error: %v", name, err)
+	}
+	obj, err := res.Object()
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	var buf bytes.Buffer
+	if err := obj.Write(&buf); err != nil {
+		t.Fatalf("%s: write failed: %v", name, err)
+	}
+	read, err := ReadObject(&buf)
+	if err != nil {
+		t.Fatalf("%s: read failed: %v", name, err)
+	}
+	if diff := cmp.Diff(obj, read); diff != "" {
+		t.Errorf("%s: round trip mismatch (-want +got):\n%s", name, diff)
+	}
+	return read
+}
+
+// immediate field of an instruction word
+func immField(word uint32) int16 {
+	return int16(word >> 16)
+}
+
+func TestObject(t *testing.T) {
+	obj := assembleObject(t, "main.asm", linkMain)
+	if len(obj.Sections) != 2 || obj.Sections[0].Name != "text" || obj.Sections[1].Name != "data" {
+		t.Fatalf("expected text and data sections, got %+v", obj.Sections)
+	}
+	expected := []Relocation{
+		{Offset: 0, Type: RelocDisp16, Section: "data"},
+		{Offset: 4, Type: RelocPC16, Symbol: "double"},
+		{Offset: 8, Type: RelocHi16, Symbol: "table"},
+		{Offset: 16, Type: RelocLo16, Symbol: "table"},
+		{Offset: 20, Type: RelocLo16, Symbol: "table"},
+		{Offset: 24, Type: RelocDisp16, Section: "data", Addend: 4},
+	}
+	if diff := cmp.Diff(expected, obj.Sections[0].Relocations); diff != "" {
+		t.Errorf("text relocation mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]Relocation{{Offset: 4, Type: RelocAbs32, Section: "text"}}, obj.Sections[1].Relocations); diff != "" {
+		t.Errorf("data relocation mismatch (-want +got):\n%s", diff)
+	}
+	symbols := map[string]ObjectSymbol{}
+	for _, sym := range obj.Symbols {
+		symbols[sym.Name] = sym
+	}
+	if sym := symbols["result"]; sym.Binding != "local" || sym.Section != "data" || sym.Value != 4 {
+		t.Errorf("wrong symbol result: %+v", sym)
+	}
+	if sym := symbols["start"]; sym.Binding != "global" || sym.Section != "text" || sym.Value != 0 {
+		t.Errorf("wrong symbol start: %+v", sym)
+	}
+	if sym := symbols["double"]; sym.Binding != "extern" {
+		t.Errorf("wrong symbol double: %+v", sym)
+	}
+
+	lib := assembleObject(t, "lib.asm", linkLib)
+	if words := lib.Sections[1].Words; len(words) != 3 || words[2] != 12 || len(lib.Sections[1].Relocations) != 0 {
+		t.Errorf("expected the difference of two labels to be a constant, got %v", lib.Sections[1])
+	}
+
+	if res, err := New(Options{}).AssembleString("main.asm", linkLib); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else if _, err := res.Object(); err == nil {
+		t.Errorf("expected an error for an object of an absolute program")
+	}
+}
+
+func TestLink(t *testing.T) {
+	objs := []*Object{assembleObject(t, "main.asm", linkMain), assembleObject(t, "lib.asm", linkLib)}
+	script, err := ParseLinkScript("text 0\n.data 0x40   # variables\nrodata align 8\n")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	linked, err := Link(objs, script)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []LinkedSection{
+		{Name: "text", Object: "main.asm", Addr: 0, Size: 32},
+		{Name: "text", Object: "lib.asm", Addr: 32, Size: 12},
+		{Name: "data", Object: "main.asm", Addr: 0x40, Size: 8},
+		{Name: "rodata", Object: "lib.asm", Addr: 0x48, Size: 12},
+	}
+	if diff := cmp.Diff(expected, linked.Sections); diff != "" {
+		t.Errorf("section mismatch (-want +got):\n%s", diff)
+	}
+	img := linked.Image
+	for addr, imm := range map[uint32]int16{0: 0x40, 4: 32 - 8, 8: 0, 16: 0x48, 20: 0x48, 24: 0x44} {
+		if got := immField(img[addr]); got != imm {
+			t.Errorf("expected immediate %#x at %#x, got %#x", imm, addr, got)
+		}
+	}
+	if img[0x44] != 0 || img[0x50] != 12 {
+		t.Errorf("wrong data words %#x, %#x", img[0x44], img[0x50])
+	}
+	info := linked.DebugInfo()
+	if line, ok := info.LineAt(36); !ok || line.File != "lib.asm" || line.Line != 3 {
+		t.Errorf("wrong source for address 36: %+v", line)
+	}
+	if names := info.LabelsAt(0x48); len(names) != 1 || names[0] != "table" {
+		t.Errorf("expected table at 0x48, got %v", names)
+	}
+	var buf bytes.Buffer
+	if err := linked.WriteMap(&buf); err != nil {
+		t.Fatalf("map failed: %v", err)
+	}
+	for _, want := range []string{"rodata   00000048  0000000c  lib.asm", "00000020  label     global   double   lib.asm   lib.asm:2"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("expected %q in map:\n%s", want, buf.String())
+		}
+	}
+
+	// without a script every section follows the previous one
+	linked, err = Link(objs, DefaultLinkScript)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if immField(linked.Image[0]) != 44 || immField(linked.Image[16]) != 52 || linked.Image[48] != 0 {
+		t.Errorf("wrong default layout: %v", linked.Image)
+	}
+}
+
+func TestLinkErrors(t *testing.T) {
+	main := assembleObject(t, "main.asm", linkMain)
+	lib := assembleObject(t, "lib.asm", linkLib)
+	far := assembleObject(t, "far.asm", ".global table, double\n.org 0x9000\ndouble: ret\n.data\ntable:\n")
+	tests := []struct {
+		objs   []*Object
+		script string
+		errors []string
+	}{
+		{[]*Object{main}, "", []string{"main.asm:4: undefined symbol double", "main.asm:5: undefined symbol table"}},
+		{[]*Object{main, lib, lib}, "", []string{"duplicate symbol double defined in lib.asm and lib.asm", "duplicate symbol table"}},
+		{[]*Object{main, lib}, "text 0\ndata 4\n", []string{"section data at 0x4-0xb overlaps section text at 0x0-0x2b"}},
+		{[]*Object{main, far}, "", []string{"main.asm:4: pc16 relocation to double is out of range"}},
+	}
+	for _, test := range tests {
+		script := DefaultLinkScript
+		if test.script != "" {
+			var err error
+			if script, err = ParseLinkScript(test.script); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		_, err := Link(test.objs, script)
+		if err == nil {
+			t.Errorf("expected errors %v", test.errors)
+			continue
+		}
+		for _, want := range test.errors {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("expected %q in:\n%v", want, err)
+			}
+		}
+	}
+
+	for _, src := range []string{"1text\n", "text 0\ntext 1\n", "text align\n", "text align 0\n", "text align 2\n", "text 2\n", "text 4 8\n", "text zero\n"} {
+		if _, err := ParseLinkScript(src); err == nil {
+			t.Errorf("expected error for script %q", src)
+		}
+	}
+	for _, src := range []string{
+		`{"format": "r8-object", "version": 1}`,
+		`{"version": 2, "lines": []}`,
+		`{"format": "r8-object", "version": 2, "sections": [{"name": "text", "words": [], "relocations": [{"offset": 4}]}]}`,
+		`{"format": "r8-object", "version": 2, "sections": [{"name": "text", "words": [0], "relocations": [{"offset": 2}]}]}`,
+	} {
+		if _, err := ReadObject(strings.NewReader(src)); err == nil {
+			t.Errorf("expected error for object %s", src)
+		}
+	}
+}
+
+func TestSections(t *testing.T) {
+	src := `	ldw r1, [value]
+	hlt
+.data
+.align 16
+value:	.word 7
+.text
+	nop
+.section bss
+	.fill 2
+`
+	res, err := New(Options{}).AssembleString("main.asm", src)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []Section{{Name: "text", Addr: 0, Size: 12, Align: 1}, {Name: "data", Addr: 16, Size: 4, Align: 16}, {Name: "bss", Addr: 20, Size: 8, Align: 1}}
+	if diff := cmp.Diff(expected, res.Sections); diff != "" {
+		t.Errorf("section mismatch (-want +got):\n%s", diff)
+	}
+	img := res.Image()
+	nop := BaseInstruction{OpType: RegReg, ALU: RegALU["cpy"]}
+	if immField(img[0]) != 16 || img[16] != 7 || img[8] != nop.Encode() {
+		t.Errorf("wrong image %v", img)
+	}
+
+	for _, src := range []string{
+		".extern x\n",
+		".global x\n",
+		".text 1\n",
+		".section\n",
+		".section r1\n",
+	} {
+		if _, err := New(Options{}).AssembleString("main.asm", src); err == nil {
+			t.Errorf("expected error for %q", src)
+		}
+	}
+	for _, src := range []string{
+		".extern x\nx: nop\n",
+		"x: nop\n.extern x\n",
+		".extern x\n.global x\n",
+		".extern x\n.equ y, x\n",
+		".extern x\n.word hi(x)\n",
+		".extern x\nldi r1, x * 2\n",
+		".extern x\nldi r1, -x\n",
+		".extern x\nldi r1, x - start\nstart:\n",
+		".extern x\nbeq [lo(x)]\n",
+	} {
+		if _, err := New(Options{Relocatable: true}).AssembleString("main.asm", src); err == nil {
+			t.Errorf("expected error for %q in an object file", src)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package assembler
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// WriteListing writes every assembled word in address order next to the source line
+// that produced it. The location and source are only printed for the first word of a line,
+// words expanded from a macro also show the call
+func (r *Result) WriteListing(w io.Writer) error {
+	info := r.DebugInfo()
+	img := r.Image()
+	addrWidth, locWidth := 4, len("source")
+	for _, line := range info.Lines {
+		addrWidth = max(addrWidth, len(fmt.Sprintf("%x", line.Addr)))
+		locWidth = max(locWidth, len(line.Location()))
+	}
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "%-*s  %-8s  %-*s  %s\n", addrWidth, "addr", "word", locWidth, "source", "text")
+	for i, line := range info.Lines {
+		loc, text := line.Location(), strings.TrimSpace(line.Text)
+		if i > 0 {
+			prev := info.Lines[i-1]
+			if prev.Addr+4 == line.Addr && prev.File == line.File && prev.Line == line.Line && slices.Equal(prev.Calls, line.Calls) {
+				loc, text = "", ""
+			}
+		}
+		if text != "" && len(line.Calls) > 0 {
+			call := line.Calls[len(line.Calls)-1] // outermost call, the line in the file being assembled
+			text = fmt.Sprintf("%-30s ; %s at %s:%d", text, call.Macro, call.File, call.Line)
+		}
+		fmt.Fprintf(bw, "%0*x  %08x  %-*s  %s\n", addrWidth, line.Addr, img[line.Addr], locWidth, loc, text)
+	}
+	return bw.Flush()
+}
+
+// WriteMap writes the symbol table sorted by value
+func (r *Result) WriteMap(w io.Writer) error {
+	info := r.DebugInfo()
+	nameWidth := len("name")
+	for _, sym := range info.Symbols {
+		nameWidth = max(nameWidth, len(sym.Name))
+	}
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "%-8s  %-8s  %-*s  %s\n", "value", "kind", nameWidth, "name", "defined at")
+	for _, sym := range info.Symbols {
+		defined := "predefined"
+		if sym.File != "" {
+			defined = fmt.Sprintf("%s:%d", sym.File, sym.Line)
+		}
+		fmt.Fprintf(bw, "%08x  %-8s  %-*s  %s\n", sym.Value, sym.Kind, nameWidth, sym.Name, defined)
+	}
+	return bw.Flush()
+}
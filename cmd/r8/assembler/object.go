@@ -0,0 +1,344 @@
+package assembler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/leon332157/risc-y-8/cmd/r8/assembler/grammar"
+)
+
+/*
+A program is made of sections, code and data placed one after another in the order the
+sections are first used. Lines before the first section directive are in the text section.
+
+	.text               continue the text section
+	.data               continue the data section
+	.section name       continue the section called name
+	.global a, b, ...   make symbols visible to other object files
+	.extern a, b, ...   declare symbols defined in other object files
+
+With Options.Relocatable the program is assembled into an object file for r8 link. Labels
+are then addresses relative to the start of their section, and every immediate,
+displacement or .word that uses one gets a relocation that tells the linker how to fill
+it in once the sections are placed:
+
+	abs32   the whole word, from .word
+	imm16   a 16 bit immediate, zero or sign extended
+	disp16  a signed 16 bit displacement from r0
+	pc16    a signed 16 bit displacement from the next instruction, for branches
+	lo16    lo() of an address in an immediate or displacement
+	hi16    hi() of an address in an immediate or displacement
+
+Branches to a label in the same section are not relocated as the distance stays the same,
+branches to other sections and external symbols must be within reach of 16 bits once linked.
+li and la always use three words for a relocatable value
+*/
+
+const (
+	RelocAbs32  = "abs32"
+	RelocImm16  = "imm16"
+	RelocDisp16 = "disp16"
+	RelocPC16   = "pc16"
+	RelocLo16   = "lo16"
+	RelocHi16   = "hi16"
+)
+
+// Relocation of a word, the linker sets its value or immediate field from the address of
+// an external symbol or of a section of the same object file, plus the addend
+type Relocation struct {
+	Offset  uint32 `json:"offset"` // byte offset of the word in its section, only set in object files
+	Type    string `json:"type"`
+	Symbol  string `json:"symbol,omitempty"`  // external symbol
+	Section string `json:"section,omitempty"` // or section of the same object file
+	Addend  int32  `json:"addend"`
+}
+
+// A section of the program being assembled
+type section struct {
+	name  string
+	base  uint32 // address of the start of the section
+	addr  uint32 // next address in the section during layout
+	end   uint32 // highest address used by the section during layout
+	align uint32 // largest .align in the section, in bytes
+}
+
+// Placement of a section in the assembled program
+type Section struct {
+	Name  string
+	Addr  uint32 // byte address
+	Size  uint32 // in bytes
+	Align uint32
+}
+
+// Returns the section called name, which is added after the other sections if it is new
+func (a *assembly) sectionNamed(name string) *section {
+	for _, s := range a.sections {
+		if s.name == name {
+			return s
+		}
+	}
+	var base uint32
+	if n := len(a.sections); n > 0 {
+		base = a.sections[n-1].end
+	}
+	s := &section{name: name, base: base, addr: base, end: base, align: 1}
+	a.sections = append(a.sections, s)
+	return s
+}
+
+// Returns the section a section directive switches to
+func sectionDirective(dir *grammar.Directive) (string, bool) {
+	switch dir.Type {
+	case ".text", ".data":
+		return dir.Type[1:], len(dir.Operands) == 0
+	case ".section":
+		if len(dir.Operands) != 1 {
+			return "", false
+		}
+		name, ok := dir.Operands[0].(grammar.OperandRegister)
+		return name.Value, ok && isLabelName(name.Value) && !isRegisterName(name.Value)
+	}
+	return "", false
+}
+
+// Switch sections during layout, returns the next address in the new section
+func (a *assembly) layoutSection(dir *grammar.Directive, addr uint32) (uint32, error) {
+	name, ok := sectionDirective(dir)
+	if !ok {
+		if dir.Type == ".section" {
+			return addr, errorAt(dir.Type, "[layoutDirective] .section expects a section name")
+		}
+		return addr, errorAt(dir.Type, "[layoutDirective] %s takes no operands", dir.Type)
+	}
+	a.section.addr = addr
+	a.section = a.sectionNamed(name)
+	return a.section.addr, nil
+}
+
+// Switch to the section of a section directive after layout
+func (a *assembly) enterSection(line *grammar.Line) {
+	if line.Directive == nil {
+		return
+	}
+	if name, ok := sectionDirective(line.Directive); ok {
+		a.section = a.sectionNamed(name)
+	}
+}
+
+// Place the sections one after another in the order they are first used, each aligned to
+// its largest .align. Returns true if any section moved, which needs another layout
+func (a *assembly) placeSections() bool {
+	moved := false
+	var base uint32
+	for _, s := range a.sections {
+		size := s.end - s.base
+		base = (base + s.align - 1) / s.align * s.align
+		if s.base != base {
+			s.base = base
+			moved = true
+		}
+		base += size
+	}
+	return moved
+}
+
+// Declare global or external symbols during layout
+func (a *assembly) layoutSymbols(dir *grammar.Directive) error {
+	if err := checkOperandCount(dir, 1, len(dir.Operands)); err != nil {
+		return err
+	}
+	if dir.Type == ".extern" && !a.relocatable {
+		return errorAt(dir.Type, "[layoutDirective] .extern is only allowed in object files, assemble with -c and link with r8 link")
+	}
+	for _, op := range dir.Operands {
+		name, ok := op.(grammar.OperandRegister)
+		if !ok || !isLabelName(name.Value) || isRegisterName(name.Value) {
+			return errorAt(operandToken(op), "[layoutDirective] invalid symbol name for %s: %s", dir.Type, operandKind(op))
+		}
+		if dir.Type == ".global" {
+			a.globals[name.Value] = a.line.Pos
+			continue
+		}
+		if _, ok := a.symbols[name.Value]; ok {
+			return errorAt(name.Value, "[layoutDirective] %s is defined in this file and can not be external", name.Value)
+		}
+		a.externs[name.Value] = a.line.Pos
+	}
+	return nil
+}
+
+// Check that every global symbol is defined
+func (a *assembly) checkGlobals() {
+	for name, pos := range a.globals {
+		if _, ok := a.externs[name]; ok {
+			a.errorf(pos, errorAt(name, "[checkGlobals] %s is declared both .global and .extern", name))
+		} else if _, ok := a.symbols[name]; !ok {
+			a.errorf(pos, errorAt(name, "[checkGlobals] global symbol %s is not defined", name))
+		}
+	}
+}
+
+// Check if a value is a label in the current section, whose distance from the current
+// address does not change when the program is linked
+func (a *assembly) sameSection(v value) bool {
+	return v.section != "" && v.section == a.section.name && v.extern == "" && v.fn == ""
+}
+
+// Record a relocation for the word at byte offset from the current address if v is relocatable.
+// kind is the relocation for the value itself, lo() and hi() of an address use lo16 and hi16
+func (a *assembly) relocate(offset uint32, kind string, v value, text string) error {
+	if !v.relocatable() {
+		return nil
+	}
+	switch {
+	case v.fn != "" && (kind == RelocImm16 || kind == RelocDisp16):
+		kind = v.fn + "16"
+	case v.fn != "":
+		return errorAt(text, "[relocate] %s can not be relocated, %s() of an address can only be an immediate or displacement", text, v.fn)
+	}
+	rel := Relocation{Type: kind, Symbol: v.extern, Addend: int32(v.n)}
+	if v.section != "" {
+		rel.Section = v.section
+		rel.Addend = int32(v.n - int64(a.sectionNamed(v.section).base))
+	}
+	a.relocs = append(a.relocs, reloc{addr: a.addr + offset, rel: rel})
+	return nil
+}
+
+type reloc struct {
+	addr uint32
+	rel  Relocation
+}
+
+// Object file produced by r8 assemble -c, saved as JSON
+type Object struct {
+	Format   string          `json:"format"` // always "r8-object"
+	Version  int             `json:"version"`
+	Source   string          `json:"source"`
+	Sections []ObjectSection `json:"sections"`
+	Symbols  []ObjectSymbol  `json:"symbols"`
+}
+
+const (
+	objectFormat  = "r8-object"
+	objectVersion = 2
+)
+
+type ObjectSection struct {
+	Name        string       `json:"name"`
+	Align       uint32       `json:"align"`
+	Words       []uint32     `json:"words"`
+	Relocations []Relocation `json:"relocations"`
+	Lines       []LineInfo   `json:"lines"` // source of each word, Addr is the byte offset in the section
+}
+
+type ObjectSymbol struct {
+	Name    string `json:"name"`
+	Binding string `json:"binding"`           // "local", "global" or "extern"
+	Kind    string `json:"kind,omitempty"`    // "label" or "constant", empty for external symbols
+	Section string `json:"section,omitempty"` // section of a label
+	Value   uint32 `json:"value"`             // byte offset of a label in its section
+	File    string `json:"file,omitempty"`
+	Line    int    `json:"line,omitempty"`
+}
+
+// Object returns the object file of a program assembled with Options.Relocatable
+func (r *Result) Object() (*Object, error) {
+	if !r.Relocatable {
+		return nil, fmt.Errorf("[Object] %s was not assembled as an object file", r.File)
+	}
+	obj := &Object{Format: objectFormat, Version: objectVersion, Source: r.File, Sections: []ObjectSection{}, Symbols: []ObjectSymbol{}}
+	img, info := r.Image(), r.DebugInfo()
+	bases := make(map[string]uint32, len(r.Sections))
+	for _, s := range r.Sections {
+		bases[s.Name] = s.Addr
+		sec := ObjectSection{Name: s.Name, Align: s.Align, Words: make([]uint32, s.Size/4), Relocations: []Relocation{}, Lines: []LineInfo{}}
+		for i := range sec.Words {
+			sec.Words[i] = img[s.Addr+4*uint32(i)]
+		}
+		for addr := s.Addr; addr < s.Addr+s.Size; addr += 4 {
+			if rel, ok := r.Relocations[addr]; ok {
+				rel.Offset = addr - s.Addr
+				sec.Relocations = append(sec.Relocations, rel)
+			}
+		}
+		for _, line := range info.Lines {
+			if line.Addr >= s.Addr && line.Addr < s.Addr+s.Size {
+				line.Addr -= s.Addr
+				sec.Lines = append(sec.Lines, line)
+			}
+		}
+		obj.Sections = append(obj.Sections, sec)
+	}
+	for _, sym := range info.Symbols {
+		o := ObjectSymbol{Name: sym.Name, Binding: "local", Kind: sym.Kind, Value: sym.Value, File: sym.File, Line: sym.Line}
+		if r.Globals[sym.Name] {
+			o.Binding = "global"
+		}
+		if sym.Kind == "label" {
+			o.Section = r.LabelSections[sym.Name]
+			o.Value -= bases[o.Section]
+		}
+		obj.Symbols = append(obj.Symbols, o)
+	}
+	for _, name := range r.Externs {
+		obj.Symbols = append(obj.Symbols, ObjectSymbol{Name: name, Binding: "extern"})
+	}
+	return obj, nil
+}
+
+// Write the object file as indented JSON
+func (o *Object) Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(o)
+}
+
+// Read an object file written by Object.Write
+func ReadObject(r io.Reader) (*Object, error) {
+	var obj Object
+	if err := json.NewDecoder(r).Decode(&obj); err != nil {
+		return nil, fmt.Errorf("invalid object file: %v", err)
+	}
+	if obj.Format != objectFormat {
+		return nil, fmt.Errorf("not an r8 object file")
+	}
+	if obj.Version != objectVersion {
+		return nil, fmt.Errorf("unsupported object file version %d", obj.Version)
+	}
+	for _, sec := range obj.Sections {
+		for _, rel := range sec.Relocations {
+			if rel.Offset%4 != 0 || rel.Offset >= 4*uint32(len(sec.Words)) {
+				return nil, fmt.Errorf("invalid object file: relocation at %#x is outside section %s", rel.Offset, sec.Name)
+			}
+		}
+	}
+	return &obj, nil
+}
+
+// Sorted names of a set of symbols
+func sortedNames[T any](m map[string]T) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Describe where a relocation points to, for error messages
+func (rel Relocation) target() string {
+	name := rel.Symbol
+	if name == "" {
+		name = "section " + rel.Section
+	}
+	switch {
+	case rel.Addend > 0:
+		return fmt.Sprintf("%s+%d", name, rel.Addend)
+	case rel.Addend < 0:
+		return fmt.Sprintf("%s%d", name, rel.Addend)
+	}
+	return name
+}
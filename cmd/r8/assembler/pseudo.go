@@ -0,0 +1,302 @@
+package assembler
+
+import (
+	"fmt"
+
+	"github.com/leon332157/risc-y-8/cmd/r8/assembler/grammar"
+	. "github.com/leon332157/risc-y-8/pkg/types"
+)
+
+/*
+Pseudo instructions expand to one or more machine instructions:
+
+	li rd, value        load any 32 bit value in 1 to 3 words
+	la rd, label        load the address of a label, same as li
+	jmp target          jump to a label, expression, register or memory operand
+	b<cond> target      branch to a label, expression or register instead of a memory operand
+	call target         call a label, expression or register
+	inc rd              add rd, 1
+	dec rd              sub rd, 1
+	clr rd              xor rd, rd
+
+li uses a single ldi or ldx when the value fits in 16 bits, otherwise
+
+	ldi rd, hi(value)
+	shl rd, 16
+	add rd, lo(value)    left out when lo(value) is 0
+
+A branch to a target within reach of the 16 bit displacement is a single instruction.
+Targets further away are loaded into the assembler temporary register at (r28) first,
+which clobbers at and the flags:
+
+	li at, target       jmp and call
+	bunc [at]
+
+	b<cond> [pc + 4]    conditional branches, the condition is tested before the flags change
+	bunc [pc + n]       skip to the end of the expansion when the branch is not taken
+	li at, target
+	bunc [at]
+
+at is reserved for these expansions, a program that uses branch pseudo instructions must not
+keep a value in it across a branch. Writing at in such a program is warned about.
+
+The size of an expansion can depend on labels defined after it, so parseLabels lays out
+the program until no expansion grows. An expansion that ends up shorter than its reserved
+size is padded with nop
+*/
+
+type pseudoOp struct {
+	operands int
+	// returns the shortest expansion for the operands at the current address
+	expand func(a *assembly, inst *grammar.Instruction) ([]BaseInstruction, error)
+}
+
+var pseudoOps = map[string]pseudoOp{
+	"li":  {2, expandLoad},
+	"la":  {2, expandLoad},
+	"jmp": {1, expandBranch},
+	"inc": {1, expandIncDec},
+	"dec": {1, expandIncDec},
+	"clr": {1, expandClear},
+}
+
+// Returns the pseudo instruction for inst, branches are only pseudo instructions
+// when the target is not a memory operand
+func pseudoFor(inst *grammar.Instruction) (pseudoOp, bool) {
+	if p, ok := pseudoOps[inst.Mnemonic]; ok {
+		return p, true
+	}
+	if _, ok := branchCondition(inst.Mnemonic); ok && len(inst.Operands) == 1 {
+		if _, ok := inst.Operands[0].(grammar.OperandMemory); !ok {
+			return pseudoOp{1, expandBranch}, true
+		}
+	}
+	return pseudoOp{}, false
+}
+
+// Check if inst is a branch pseudo instruction, which expands through at when its target is far
+func isBranchPseudo(inst *grammar.Instruction) bool {
+	_, pseudo := pseudoFor(inst)
+	_, branch := branchCondition(inst.Mnemonic)
+	return pseudo && branch
+}
+
+// Warn about an instruction that writes rd when rd is at and the program has branch pseudo
+// instructions, whose far expansions overwrite at
+func (a *assembly) checkAt(src *grammar.Instruction, rd uint8, writes bool) {
+	if !writes || rd != IntegerRegisters["at"] || !a.usesAt || isBranchPseudo(src) {
+		return
+	}
+	a.warn(operandToken(src.Operands[0]), "%s writes at, which is reserved for jmp, call and b<cond> to far targets", src.Mnemonic)
+}
+
+// Returns the condition of a branch mnemonic, jmp is an unconditional branch
+func branchCondition(mnemonic string) (ControlOp, bool) {
+	switch mnemonic {
+	case "jmp":
+		return UNC, true
+	case "call":
+		return CALL, true
+	}
+	if len(mnemonic) < 2 || mnemonic[0] != 'b' || mnemonic == "bcall" {
+		return ControlOp{}, false
+	}
+	cond, ok := Conditions[mnemonic[1:]]
+	return cond, ok
+}
+
+// Number of words reserved for an instruction
+func (a *assembly) instSize(inst *grammar.Instruction) uint32 {
+	if size, ok := a.sizes[inst]; ok {
+		return size
+	}
+	return 1
+}
+
+// Parse an instruction into the machine instructions it occupies, one unless it is a pseudo instruction
+func (a *assembly) parseInsts(inst *grammar.Instruction) ([]BaseInstruction, error) {
+	p, ok := pseudoFor(inst)
+	if !ok {
+		ret, err := a.parseInst(inst)
+		return []BaseInstruction{ret}, err
+	}
+	insts, err := a.expandPseudo(p, inst)
+	if err != nil {
+		return nil, err
+	}
+	size := int(a.instSize(inst))
+	if len(insts) > size {
+		return nil, errorAt(inst.Mnemonic, "[parsePseudo] %s expands to %d words but only %d were reserved", inst.Mnemonic, len(insts), size)
+	}
+	for len(insts) < size {
+		insts = append(insts, BaseInstruction{OpType: RegReg, ALU: RegALU["cpy"]}) // nop
+	}
+	return insts, nil
+}
+
+func (a *assembly) expandPseudo(p pseudoOp, inst *grammar.Instruction) ([]BaseInstruction, error) {
+	if len(inst.Operands) != p.operands {
+		return nil, errorAt(inst.Mnemonic, "[parsePseudo] %s takes %d operands, got %d", inst.Mnemonic, p.operands, len(inst.Operands))
+	}
+	return p.expand(a, inst)
+}
+
+// Grow the reserved size of pseudo instructions whose expansion no longer fits with the
+// addresses of the last layout. Returns true if any size changed
+func (a *assembly) relax(lines []grammar.Line, addrs []uint32) bool {
+	changed := false
+	ndiags, nrelocs := len(a.diags), len(a.relocs) // errors, warnings and relocations are recorded by the second pass
+	a.section = a.sectionNamed("text")
+	for i := range lines {
+		a.enterSection(&lines[i])
+		inst := lines[i].Instruction
+		if inst == nil {
+			continue
+		}
+		p, ok := pseudoFor(inst)
+		if !ok {
+			continue
+		}
+		a.line, a.addr = &lines[i], addrs[i]
+		insts, err := a.expandPseudo(p, inst)
+		if err == nil && uint32(len(insts)) > a.instSize(inst) {
+			a.sizes[inst] = uint32(len(insts))
+			changed = true
+		}
+	}
+	a.diags, a.relocs = a.diags[:ndiags], a.relocs[:nrelocs]
+	a.line = nil
+	return changed
+}
+
+// Parse the destination register of a pseudo instruction
+func pseudoRegister(inst *grammar.Instruction) (uint8, error) {
+	reg, ok := inst.Operands[0].(grammar.OperandRegister)
+	if !ok {
+		return 0, errorAt(operandToken(inst.Operands[0]), "[parsePseudo] invalid operand type for %s: %s", inst.Mnemonic, operandKind(inst.Operands[0]))
+	}
+	rd, ok := IntegerRegisters[reg.Value]
+	if !ok {
+		return 0, errorAt(reg.Value, "[parsePseudo] invalid register: %s", reg.Value)
+	}
+	return rd, nil
+}
+
+// Shortest sequence that loads a 32 bit value into rd
+func loadConst(rd uint8, val uint32) []BaseInstruction {
+	ri := func(alu uint8, imm int16) BaseInstruction {
+		return BaseInstruction{OpType: RegImm, Rd: rd, ALU: alu, Imm: imm}
+	}
+	switch {
+	case val <= 0xffff:
+		return []BaseInstruction{ri(IMM_LDI, int16(val))}
+	case int32(val) >= -32768 && int32(val) < 0:
+		return []BaseInstruction{ri(IMM_LDX, int16(val))}
+	}
+	hi, lo := uint16((val+0x8000)>>16), int16(val)
+	insts := []BaseInstruction{ri(IMM_LDI, int16(hi)), ri(IMM_SHL, 16)}
+	if lo != 0 {
+		insts = append(insts, ri(IMM_ADD, lo))
+	}
+	return insts
+}
+
+// Sequence that loads v into rd, from byte offset in the expansion onwards.
+// A relocatable address always takes three words as its value is not known yet
+func (a *assembly) loadValue(rd uint8, v value, offset uint32, text string) ([]BaseInstruction, error) {
+	if !v.relocatable() {
+		return loadConst(rd, uint32(v.n)), nil
+	}
+	ri := func(alu uint8, imm int64) BaseInstruction {
+		return BaseInstruction{OpType: RegImm, Rd: rd, ALU: alu, Imm: int16(imm)}
+	}
+	switch v.fn {
+	case "lo":
+		return []BaseInstruction{ri(IMM_LDX, v.resolve())}, a.relocate(offset, RelocImm16, v, text)
+	case "hi":
+		return []BaseInstruction{ri(IMM_LDI, v.resolve())}, a.relocate(offset, RelocImm16, v, text)
+	}
+	hi, lo := v, v
+	hi.fn, lo.fn = "hi", "lo"
+	if err := a.relocate(offset, RelocImm16, hi, text); err != nil {
+		return nil, err
+	}
+	if err := a.relocate(offset+8, RelocImm16, lo, text); err != nil {
+		return nil, err
+	}
+	return []BaseInstruction{ri(IMM_LDI, hi.resolve()), ri(IMM_SHL, 16), ri(IMM_ADD, lo.resolve())}, nil
+}
+
+func expandLoad(a *assembly, inst *grammar.Instruction) ([]BaseInstruction, error) {
+	rd, err := pseudoRegister(inst)
+	if err != nil {
+		return nil, err
+	}
+	v, err := a.parseValue(inst.Operands[1])
+	if err != nil {
+		return nil, fmt.Errorf("[parsePseudo] invalid value for %s: %w", inst.Mnemonic, err)
+	}
+	return a.loadValue(rd, v, 0, operandToken(inst.Operands[1]))
+}
+
+func expandBranch(a *assembly, inst *grammar.Instruction) ([]BaseInstruction, error) {
+	cond, _ := branchCondition(inst.Mnemonic)
+	branch := func(cond ControlOp, rmem uint8, disp int16) BaseInstruction {
+		return BaseInstruction{OpType: Control, RMem: rmem, CtrlFlag: cond.Flag, CtrlMode: cond.Mode, Imm: disp}
+	}
+	switch op := inst.Operands[0].(type) {
+	case grammar.OperandMemory:
+		// only jmp gets here, the other branches take a memory operand directly
+		rmem, disp, err := a.parseMemory(op, true)
+		if err != nil {
+			return nil, fmt.Errorf("[parsePseudo] invalid memory operand: %w", err)
+		}
+		return []BaseInstruction{branch(cond, rmem, disp)}, nil
+	case grammar.OperandRegister:
+		if rmem, ok := IntegerRegisters[op.Value]; ok && rmem != 0 {
+			return []BaseInstruction{branch(cond, rmem, 0)}, nil
+		}
+	}
+	text := operandToken(inst.Operands[0])
+	target, err := a.parseValue(inst.Operands[0])
+	if err != nil {
+		return nil, fmt.Errorf("[parsePseudo] invalid target for %s: %w", inst.Mnemonic, err)
+	}
+	disp := target.n - (int64(a.addr) + 4)
+	if target.relocatable() && !a.sameSection(target) {
+		// the distance to another section or an external symbol is only known once linked
+		return []BaseInstruction{branch(cond, 0, int16(disp))}, a.relocate(0, RelocPC16, target, text)
+	}
+	if disp >= -32768 && disp <= 32767 {
+		return []BaseInstruction{branch(cond, 0, int16(disp))}, nil
+	}
+	at := IntegerRegisters["at"]
+	if cond == UNC || cond == CALL {
+		load, err := a.loadValue(at, target, 0, text)
+		return append(load, branch(cond, at, 0)), err
+	}
+	load, err := a.loadValue(at, target, 8, text)
+	insts := []BaseInstruction{branch(cond, 0, 4), branch(UNC, 0, int16(4*(len(load)+1)))}
+	insts = append(insts, load...)
+	return append(insts, branch(UNC, at, 0)), err
+}
+
+func expandIncDec(a *assembly, inst *grammar.Instruction) ([]BaseInstruction, error) {
+	rd, err := pseudoRegister(inst)
+	if err != nil {
+		return nil, err
+	}
+	alu := uint8(IMM_ADD)
+	if inst.Mnemonic == "dec" {
+		alu = IMM_SUB
+	}
+	return []BaseInstruction{{OpType: RegImm, Rd: rd, ALU: alu, Imm: 1}}, nil
+}
+
+func expandClear(a *assembly, inst *grammar.Instruction) ([]BaseInstruction, error) {
+	rd, err := pseudoRegister(inst)
+	if err != nil {
+		return nil, err
+	}
+	return []BaseInstruction{{OpType: RegReg, Rd: rd, ALU: REG_XOR, Rs: rd}}, nil
+}
@@ -0,0 +1,71 @@
+package assembler
+
+import (
+	"fmt"
+
+	"github.com/leon332157/risc-y-8/cmd/r8/assembler/grammar"
+	. "github.com/leon332157/risc-y-8/pkg/types"
+)
+
+/*
+Byte and halfword loads and stores are encoded with DataType SubWord:
+
+	ldb rd, [mem]       load the byte at mem and sign extend it, ldbu zero extends
+	ldh rd, [mem]       load the halfword at mem and sign extend it, ldhu zero extends
+	stb rd, [mem]       store the low byte of rd, sth stores the low halfword
+
+Memory is byte addressed and little endian, byte b of the word at address w is at w + b, so the
+characters of a .string are at consecutive addresses, for example
+
+	la r1, msg          address of msg
+	ldbu r2, [r1 + 1]   second character of msg
+
+Labels, displacements and every other access, ldw, stw, push, pop and the vector loads and
+stores, use the same byte addresses. A halfword at an odd address or a word at an address that
+is not a multiple of 4 is split into byte accesses by the simulator, or raises a misaligned
+access exception with r8 simulate --trap-misaligned
+*/
+
+// check if a mnemonic is a byte or halfword load or store
+func isSubWordMnemonic(mnemonic string) bool {
+	_, ok := SubWordOps[mnemonic]
+	return ok
+}
+
+// Parse a byte or halfword load or store, they all take a register and a memory operand
+func (a *assembly) parseSubWordInst(inst *grammar.Instruction) (SubWordInstruction, error) {
+	if len(inst.Operands) != 2 {
+		return SubWordInstruction{}, errorAt(inst.Mnemonic, "[parseSubWord] %s takes 2 operands, got %d", inst.Mnemonic, len(inst.Operands))
+	}
+	rd, err := intRegister(inst.Operands[0])
+	if err != nil {
+		return SubWordInstruction{}, err
+	}
+	mem, ok := inst.Operands[1].(grammar.OperandMemory)
+	if !ok {
+		return SubWordInstruction{}, errorAt(operandToken(inst.Operands[1]), "[parseSubWord] %s expects a memory operand, got %s", inst.Mnemonic, operandKind(inst.Operands[1]))
+	}
+	rmem, disp, err := a.parseMemory(mem, false)
+	if err != nil {
+		return SubWordInstruction{}, err
+	}
+	op := SubWordOps[inst.Mnemonic]
+	return SubWordInstruction{Size: op.Size, Rd: rd, MemMode: op.MemMode, RMem: rmem, Imm: disp}, nil
+}
+
+// Warn about byte and halfword instructions that assemble but are likely mistakes
+func (a *assembly) checkSubWord(src *grammar.Instruction, inst *SubWordInstruction) {
+	if inst.MemMode != SUB_STORE && inst.Rd == 0 {
+		a.warn(operandToken(src.Operands[0]), "%s writes to r0, the result is discarded", src.Mnemonic)
+	}
+	a.checkAt(src, inst.Rd, inst.MemMode != SUB_STORE)
+	if inst.Size == SIZE_HALF && inst.RMem == 0 && inst.Imm%2 != 0 {
+		a.warn(operandToken(src.Operands[1]), "%s of the odd address %#x is not aligned", src.Mnemonic, uint16(inst.Imm))
+	}
+}
+
+// Returns the assembly text for a decoded byte or halfword instruction
+func formatSubWordInstruction(inst *SubWordInstruction) string {
+	name := SubWordOpsInverse[SubWordOp{Size: inst.Size, MemMode: inst.MemMode}]
+	return fmt.Sprintf("%s %s, %s", name, regName(inst.Rd), memOperand(inst.RMem, inst.Imm, false))
+}
@@ -0,0 +1,73 @@
+package assembler
+
+import (
+	"testing"
+
+	. "github.com/leon332157/risc-y-8/pkg/types"
+)
+
+func TestSubWord(t *testing.T) {
+	src := `	ldb r1, [r2]
+	ldbu r3, [r4 + 5]
+	ldh r5, [sp - 2]
+	ldhu r6, [msg + 2]
+	stb r7, [r8 + 1]
+	sth r9, [0x10]
+	hlt
+msg:	.string "hi"
+`
+	img, err := assembleImage(t, src)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []SubWordInstruction{
+		{Size: SIZE_BYTE, Rd: 1, MemMode: SUB_LOAD, RMem: 2},
+		{Size: SIZE_BYTE, Rd: 3, MemMode: SUB_LOADU, RMem: 4, Imm: 5},
+		{Size: SIZE_HALF, Rd: 5, MemMode: SUB_LOAD, RMem: IntegerRegisters["sp"], Imm: -2},
+		{Size: SIZE_HALF, Rd: 6, MemMode: SUB_LOADU, Imm: 28 + 2},
+		{Size: SIZE_BYTE, Rd: 7, MemMode: SUB_STORE, RMem: 8, Imm: 1},
+		{Size: SIZE_HALF, Rd: 9, MemMode: SUB_STORE, Imm: 0x10},
+	}
+	for i, want := range expected {
+		var got SubWordInstruction
+		if !got.Decode(img[4*uint32(i)]) || got != want {
+			t.Errorf("word %d: expected %+v, got %+v (%08x)", i, want, got, img[4*uint32(i)])
+		}
+		if img[4*uint32(i)]&0b11 != uint32(SubWord) {
+			t.Errorf("word %d: expected DataType SubWord, got %08x", i, img[4*uint32(i)])
+		}
+	}
+
+	for _, src := range []string{
+		"ldb r1\n",
+		"ldb f1, [r2]\n",
+		"stb r1, r2\n",
+		"ldh r1, [r2], r3\n",
+	} {
+		if _, err := assembleImage(t, src); err == nil {
+			t.Errorf("expected error for %q", src)
+		}
+	}
+}
+
+func TestSubWordExtend(t *testing.T) {
+	var test = []struct {
+		op       string
+		loaded   uint32
+		expected uint32
+	}{
+		{"ldb", 0x80, 0xFFFFFF80},
+		{"ldb", 0x7F, 0x7F},
+		{"ldbu", 0x80, 0x80},
+		{"ldh", 0x8001, 0xFFFF8001},
+		{"ldhu", 0x8001, 0x8001},
+		{"ldbu", 0x1234, 0x34},
+	}
+	for _, tt := range test {
+		op := SubWordOps[tt.op]
+		inst := SubWordInstruction{Size: op.Size, MemMode: op.MemMode}
+		if got := inst.Extend(tt.loaded); got != tt.expected {
+			t.Errorf("%s of %#x: expected %#x, got %#x", tt.op, tt.loaded, tt.expected, got)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package assembler
+
+import (
+	"fmt"
+
+	"github.com/leon332157/risc-y-8/cmd/r8/assembler/grammar"
+	. "github.com/leon332157/risc-y-8/pkg/types"
+)
+
+/*
+Special registers hold the state of the last trap, the address of the trap vector table and the
+registers of the interrupt controller and timer:
+
+	mfsr rd, sr         rd = sr
+	mtsr sr, rs         sr = rs
+	iret                return from a trap handler to the address in epc
+	ecall               system call, the number is in r1 and its arguments in r2 to r4
+
+	epc, cause, tval    address, cause and faulting address or word of the last trap
+	eflags              the flags when the last trap was taken
+	tvec                address of the trap vector table
+	status              bit 0 enables interrupts, bit 1 holds bit 0 before the last trap
+	imask, ipend        bit n enables and is set while interrupt line n is pending
+	time                clock cycles since reset, read only
+	tcmp, tperiod       the timer interrupts when time reaches tcmp, then adds tperiod to tcmp
+
+An exception such as division by zero, a negative address or an illegal instruction sets epc to
+the address of the faulting instruction, cause to the exception cause and tval to the faulting
+address or instruction word, then continues at tvec + 4*cause, the entry for cause in the trap vector table:
+
+	.equ EXC_ILLEGAL_INSTRUCTION, 1
+	.equ EXC_DIVIDE_BY_ZERO, 2
+	.equ EXC_BAD_ADDRESS, 3
+	.equ EXC_MISALIGNED, 4
+	.equ EXC_ECALL, 5           ecall when the simulator does not service system calls
+	.equ EXC_TIMER, 8           interrupt line 0, lines 1 to 7 follow as causes 9 to 15
+
+An interrupt is taken between two instructions, epc is the address of the next instruction.
+Taking a trap saves the flags in eflags and disables interrupts, iret restores both.
+
+Each entry of the table is usually a branch to the handler. A handler that skips the faulting
+instruction adds 4 to epc before iret. tvec is 0 after reset, an exception then halts the simulator
+
+r8 simulate and r8 tui service ecall on the host and continue after it, the result is in r1 and is
+negative on failure. Buffers and paths are at byte addresses, paths end with a 0 byte:
+
+	.equ SYS_EXIT, 1            r2 = exit code
+	.equ SYS_WRITE, 2           r2 = fd, r3 = buffer, r4 = length, returns the bytes written
+	.equ SYS_READ, 3            r2 = fd, r3 = buffer, r4 = length, returns the bytes read, 0 at the end
+	.equ SYS_OPEN, 4            r2 = path, r3 = 0 to read, 1 to write, 2 to append, returns the fd
+	.equ SYS_CLOSE, 5           r2 = fd
+	.equ SYS_CYCLES, 6          returns the clock
+
+fd 0, 1 and 2 are stdin, stdout and stderr. Paths are relative to the directory given with --sandbox,
+open fails without it
+*/
+
+// check if a mnemonic moves a special register, returns from a trap or makes a system call
+func isSystemMnemonic(mnemonic string) bool {
+	return mnemonic == "mfsr" || mnemonic == "mtsr" || mnemonic == "iret" || mnemonic == "ecall"
+}
+
+func specialRegister(op grammar.Operand) (uint8, error) {
+	if reg, ok := op.(grammar.OperandRegister); ok {
+		if r, ok := SpecialRegisters[reg.Value]; ok {
+			return r, nil
+		}
+	}
+	return 0, errorAt(operandToken(op), "[parseSystem] expected a special register such as epc, tvec or status, got %s", operandKind(op))
+}
+
+// Parse mfsr, mtsr, iret and ecall
+func (a *assembly) parseSystemInst(inst *grammar.Instruction) (BaseInstruction, error) {
+	want := 2
+	if inst.Mnemonic == "iret" || inst.Mnemonic == "ecall" {
+		want = 0
+	}
+	if len(inst.Operands) != want {
+		return BaseInstruction{}, errorAt(inst.Mnemonic, "[parseSystem] %s takes %d operands, got %d", inst.Mnemonic, want, len(inst.Operands))
+	}
+	switch inst.Mnemonic {
+	case "iret":
+		return BaseInstruction{OpType: Control, CtrlMode: IRET.Mode, CtrlFlag: IRET.Flag}, nil
+	case "ecall":
+		return BaseInstruction{OpType: Control, CtrlMode: ECALL.Mode, CtrlFlag: ECALL.Flag}, nil
+	case "mfsr":
+		rd, err := intRegister(inst.Operands[0])
+		if err != nil {
+			return BaseInstruction{}, err
+		}
+		sr, err := specialRegister(inst.Operands[1])
+		if err != nil {
+			return BaseInstruction{}, err
+		}
+		return BaseInstruction{OpType: RegImm, Rd: rd, ALU: IMM_SR, Imm: int16(sr)}, nil
+	}
+	sr, err := specialRegister(inst.Operands[0])
+	if err != nil {
+		return BaseInstruction{}, err
+	}
+	if sr == SR_TIME {
+		return BaseInstruction{}, errorAt(operandToken(inst.Operands[0]), "[parseSystem] time is read only")
+	}
+	rs, err := intRegister(inst.Operands[1])
+	if err != nil {
+		return BaseInstruction{}, err
+	}
+	return BaseInstruction{OpType: RegImm, Rd: rs, ALU: IMM_SR, Imm: int16(sr) | SR_WRITE}, nil
+}
+
+// Returns the assembly text for a decoded mfsr or mtsr
+func formatSystemInstruction(inst *BaseInstruction) string {
+	sr := SpecialRegistersInverse[uint8(inst.Imm)]
+	if inst.Imm&SR_WRITE != 0 {
+		return fmt.Sprintf("mtsr %s, %s", sr, regName(inst.Rd))
+	}
+	return fmt.Sprintf("mfsr %s, %s", regName(inst.Rd), sr)
+}
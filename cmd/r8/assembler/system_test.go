@@ -0,0 +1,79 @@
+package assembler
+
+import (
+	"testing"
+
+	. "github.com/leon332157/risc-y-8/pkg/types"
+)
+
+func TestSystem(t *testing.T) {
+	src := `	mfsr r1, epc
+	mfsr r2, cause
+	mtsr tvec, r3
+	mtsr epc, r0
+	mtsr status, r4
+	mfsr r5, time
+	mtsr tcmp, r6
+	iret
+	ecall
+`
+	img, err := assembleImage(t, src)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []BaseInstruction{
+		{OpType: RegImm, Rd: 1, ALU: IMM_SR, Imm: SR_EPC},
+		{OpType: RegImm, Rd: 2, ALU: IMM_SR, Imm: SR_CAUSE},
+		{OpType: RegImm, Rd: 3, ALU: IMM_SR, Imm: SR_TVEC | SR_WRITE},
+		{OpType: RegImm, Rd: 0, ALU: IMM_SR, Imm: SR_EPC | SR_WRITE},
+		{OpType: RegImm, Rd: 4, ALU: IMM_SR, Imm: SR_STATUS | SR_WRITE},
+		{OpType: RegImm, Rd: 5, ALU: IMM_SR, Imm: SR_TIME},
+		{OpType: RegImm, Rd: 6, ALU: IMM_SR, Imm: SR_TCMP | SR_WRITE},
+		{OpType: Control, CtrlMode: IRET.Mode, CtrlFlag: IRET.Flag},
+		{OpType: Control, CtrlMode: ECALL.Mode, CtrlFlag: ECALL.Flag},
+	}
+	for i, want := range expected {
+		var got BaseInstruction
+		if !got.Decode(img[4*uint32(i)]) || got != want {
+			t.Errorf("word %d: expected %+v, got %+v (%08x)", i, want, got, img[4*uint32(i)])
+		}
+	}
+
+	for _, src := range []string{
+		"mfsr r1\n",
+		"mfsr r1, r2\n",
+		"mfsr epc, r1\n",
+		"mtsr r1, epc\n",
+		"mtsr flags, r1\n",
+		"mtsr time, r1\n",
+		"iret r1\n",
+		"ecall 1\n",
+	} {
+		if _, err := assembleImage(t, src); err == nil {
+			t.Errorf("expected error for %q", src)
+		}
+	}
+}
+
+func TestDecodeReserved(t *testing.T) {
+	var test = []struct {
+		inst  BaseInstruction
+		valid bool
+	}{
+		{BaseInstruction{OpType: RegImm, ALU: IMM_CMP}, true},
+		{BaseInstruction{OpType: RegImm, ALU: IMM_SR, Imm: SR_TVAL}, true},
+		{BaseInstruction{OpType: RegImm, ALU: IMM_SR, Imm: 0x20}, false},
+		{BaseInstruction{OpType: RegImm, ALU: IMM_SR, Imm: 0x200 | SR_EPC}, false},
+		{BaseInstruction{OpType: Control, CtrlMode: CALL.Mode, CtrlFlag: CALL.Flag}, true},
+		{BaseInstruction{OpType: Control, CtrlMode: IRET.Mode, CtrlFlag: IRET.Flag}, true},
+		{BaseInstruction{OpType: Control, CtrlMode: ECALL.Mode, CtrlFlag: ECALL.Flag}, true},
+		{BaseInstruction{OpType: Control, CtrlMode: 0b110, CtrlFlag: 0b0010}, false},
+		{BaseInstruction{OpType: Control, CtrlMode: 0b101, CtrlFlag: 0b0011}, false},
+	}
+	for _, tt := range test {
+		var got BaseInstruction
+		if valid := got.Decode(tt.inst.Encode()); valid != tt.valid {
+			t.Errorf("%+v: expected valid %v, got %v", tt.inst, tt.valid, valid)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package assembler
+
+import (
+	"fmt"
+
+	"github.com/leon332157/risc-y-8/cmd/r8/assembler/grammar"
+	. "github.com/leon332157/risc-y-8/pkg/types"
+)
+
+/*
+Vector instructions use the vector registers v1-v8, each holding four 32 bit integer
+lanes, and are encoded with DataType Vector:
+
+	vadd vd, vs         vd[i] = vd[i] + vs[i], also vsub and vmul
+	vcpy vd, vs         vd = vs, also vmov
+	vbcst vd, rs        every lane of vd = rs
+	vdot rd, vs, vt     rd = vs[0]*vt[0] + vs[1]*vt[1] + vs[2]*vt[2] + vs[3]*vt[3]
+	vldw vd, [mem]      load four consecutive words, memory operands are the same as for ldw
+	vstw vd, [mem]      store four consecutive words
+
+The address of vldw and vstw is rounded down to a multiple of 16 bytes, so a vector
+is one line of the default cache and is loaded or stored with a single access
+*/
+
+// check if a mnemonic is a vector instruction
+func isVectorMnemonic(mnemonic string) bool {
+	_, ok := VectorALU[mnemonic]
+	return ok || mnemonic == "vldw" || mnemonic == "vstw"
+}
+
+func vectorRegister(op grammar.Operand) (uint8, error) {
+	if reg, ok := op.(grammar.OperandRegister); ok {
+		if r, ok := VectorRegisters[reg.Value]; ok {
+			return r, nil
+		}
+	}
+	return 0, errorAt(operandToken(op), "[parseVector] expected a vector register v1-v8, got %s", operandKind(op))
+}
+
+// Parse a vector instruction, vdot takes three operands and the others two
+func (a *assembly) parseVectorInst(inst *grammar.Instruction) (VectorInstruction, error) {
+	want := 2
+	if inst.Mnemonic == "vdot" {
+		want = 3
+	}
+	if len(inst.Operands) != want {
+		return VectorInstruction{}, errorAt(inst.Mnemonic, "[parseVector] %s takes %d operands, got %d", inst.Mnemonic, want, len(inst.Operands))
+	}
+	if inst.Mnemonic == "vldw" || inst.Mnemonic == "vstw" {
+		vd, err := vectorRegister(inst.Operands[0])
+		if err != nil {
+			return VectorInstruction{}, err
+		}
+		mem, ok := inst.Operands[1].(grammar.OperandMemory)
+		if !ok {
+			return VectorInstruction{}, errorAt(operandToken(inst.Operands[1]), "[parseVector] %s expects a memory operand, got %s", inst.Mnemonic, operandKind(inst.Operands[1]))
+		}
+		rmem, disp, err := a.parseMemory(mem, false)
+		if err != nil {
+			return VectorInstruction{}, err
+		}
+		var mode uint8 = LDW
+		if inst.Mnemonic == "vstw" {
+			mode = STW
+		}
+		return VectorInstruction{OpType: LoadStore, Vd: vd, RMem: rmem, MemMode: mode, Imm: disp}, nil
+	}
+
+	op := VectorALU[inst.Mnemonic]
+	dest, src := vectorRegister, vectorRegister
+	if VectorWritesInt(op) {
+		dest = intRegister
+	}
+	if VectorReadsInt(op) {
+		src = intRegister
+	}
+	vd, err := dest(inst.Operands[0])
+	if err != nil {
+		return VectorInstruction{}, err
+	}
+	vs, err := src(inst.Operands[1])
+	if err != nil {
+		return VectorInstruction{}, err
+	}
+	ret := VectorInstruction{OpType: RegReg, Vd: vd, VPU: op, Vs: vs}
+	if op == VPU_DOT {
+		if ret.Vt, err = vectorRegister(inst.Operands[2]); err != nil {
+			return VectorInstruction{}, err
+		}
+	}
+	return ret, nil
+}
+
+// Warn about vector instructions that assemble but are likely mistakes
+func (a *assembly) checkVector(src *grammar.Instruction, inst *VectorInstruction) {
+	if inst.OpType == RegReg && VectorWritesInt(inst.VPU) && inst.Vd == 0 {
+		a.warn(operandToken(src.Operands[0]), "%s writes to r0, the result is discarded", src.Mnemonic)
+	}
+	a.checkAt(src, inst.Vd, inst.OpType == RegReg && VectorWritesInt(inst.VPU))
+}
+
+func vectorRegName(r uint8) string {
+	return fmt.Sprintf("v%d", r+1)
+}
+
+// Returns the assembly text for a decoded vector instruction
+func formatVectorInstruction(inst *VectorInstruction) string {
+	switch inst.OpType {
+	case RegReg:
+		name := VectorALUInverse[inst.VPU]
+		switch {
+		case inst.VPU == VPU_DOT:
+			return fmt.Sprintf("%s %s, %s, %s", name, regName(inst.Vd), vectorRegName(inst.Vs), vectorRegName(inst.Vt))
+		case VectorReadsInt(inst.VPU):
+			return fmt.Sprintf("%s %s, %s", name, vectorRegName(inst.Vd), regName(inst.Vs))
+		}
+		return fmt.Sprintf("%s %s, %s", name, vectorRegName(inst.Vd), vectorRegName(inst.Vs))
+	case LoadStore:
+		mnemonic := "vldw"
+		if inst.MemMode == STW {
+			mnemonic = "vstw"
+		}
+		return fmt.Sprintf("%s %s, %s", mnemonic, vectorRegName(inst.Vd), memOperand(inst.RMem, inst.Imm, false))
+	}
+	return ""
+}
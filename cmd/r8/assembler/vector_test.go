@@ -0,0 +1,58 @@
+package assembler
+
+import (
+	"testing"
+
+	. "github.com/leon332157/risc-y-8/pkg/types"
+)
+
+func TestVector(t *testing.T) {
+	src := `	vadd v1, v2
+	vmov v8, v1
+	vbcst v3, r4
+	vdot r5, v6, v7
+	vldw v2, [table]
+	vstw v7, [sp - 16]
+	hlt
+.align 16
+table:	.word 1, 2, 3, 4
+`
+	img, err := assembleImage(t, src)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []VectorInstruction{
+		{OpType: RegReg, Vd: 0, VPU: VPU_ADD, Vs: 1},
+		{OpType: RegReg, Vd: 7, VPU: VPU_CPY, Vs: 0},
+		{OpType: RegReg, Vd: 2, VPU: VPU_BCST, Vs: 4},
+		{OpType: RegReg, Vd: 5, VPU: VPU_DOT, Vs: 5, Vt: 6},
+		{OpType: LoadStore, Vd: 1, MemMode: LDW, Imm: 32},
+		{OpType: LoadStore, Vd: 6, MemMode: STW, RMem: IntegerRegisters["sp"], Imm: -16},
+	}
+	for i, want := range expected {
+		var got VectorInstruction
+		if !got.Decode(img[4*uint32(i)]) || got != want {
+			t.Errorf("word %d: expected %+v, got %+v (%08x)", i, want, got, img[4*uint32(i)])
+		}
+		if img[4*uint32(i)]&0b11 != uint32(Vector) {
+			t.Errorf("word %d: expected DataType Vector, got %08x", i, img[4*uint32(i)])
+		}
+	}
+
+	for _, src := range []string{
+		"vadd v1, f2\n",
+		"vadd v1, v2, v3\n",
+		"vdot r1, v2\n",
+		"vdot v1, v2, v3\n",
+		"vdot r1, v2, r3\n",
+		"vbcst v1, v2\n",
+		"vldw v9, [r2]\n",
+		"vstw v1, r2\n",
+		"ldi r1, v1\n",
+		"v1: nop\n",
+	} {
+		if _, err := assembleImage(t, src); err == nil {
+			t.Errorf("expected error for %q", src)
+		}
+	}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"github.com/leon332157/risc-y-8/cmd/r8/assembler"
-	"github.com/leon332157/risc-y-8/cmd/r8/assembler/grammar"
 	"github.com/leon332157/risc-y-8/cmd/r8/simulator"
 )
 
@@ -23,16 +22,12 @@ func main() {
 	nop
 	nop
 	`
-	prog, err := grammar.ParseString("DemoCode", inststr)
+	res, err := assembler.New(assembler.Options{}).AssembleString("DemoCode", inststr)
 	if err != nil {
 		panic(err)
 	}
-	res, err := assembler.ParseLines(prog.Lines) // changes state in assembler package
-	if err != nil {
-		panic(err)
-	}
-	instructions := assembler.EncInstructions(res)
-	system := simulator.NewSystem(instructions,false,false)
+	instructions := res.Image()
+	system := simulator.NewSystem(instructions.Flatten(), false, false)
 	system.RunToEnd(nil)
 }
 
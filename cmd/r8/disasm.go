@@ -0,0 +1,70 @@
+package r8
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/leon332157/risc-y-8/cmd/r8/assembler"
+	"github.com/spf13/cobra"
+)
+
+var (
+	disasmCmd = &cobra.Command{
+		Use:     "disasm <flags> [input file]",
+		Aliases: []string{"dis"},
+		Short:   "Disassemble RISC-Y-8 machine code",
+		Long:    "Disassemble a RISC-Y-8 binary produced by assemble, the output assembles back to the same binary",
+		RunE:    runDisasm,
+		Args:    cobra.ExactArgs(1),
+		Example: "r8 disasm -o out.asm a.out",
+	}
+)
+
+func runDisasm(cmd *cobra.Command, args []string) error {
+	infile := args[0]
+	outfile := cmd.Flag("output").Value.String()
+	f, err := os.Open(infile)
+	if err != nil {
+		return fmt.Errorf("failed to open input file: %v", err)
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return fmt.Errorf("failed to read input file: %v", err)
+	}
+	words, err := assembler.ReadImage(data, cmd.Flag("format").Value.String())
+	if err != nil {
+		return fmt.Errorf("failed to read input file: %v", err)
+	}
+	var info *assembler.DebugInfo
+	if name := cmd.Flag("source-map").Value.String(); name != "" {
+		sf, err := os.Open(name)
+		if err != nil {
+			return fmt.Errorf("failed to open source map: %v", err)
+		}
+		defer sf.Close()
+		if info, err = assembler.ReadDebugInfo(sf); err != nil {
+			return err
+		}
+	}
+	text := strings.Join(assembler.DisassembleImageDebug(words, info), "\n") + "\n"
+	if outfile != "" {
+		if err := os.WriteFile(outfile, []byte(text), 0644); err != nil {
+			return fmt.Errorf("failed to write output file: %v", err)
+		}
+	} else {
+		fmt.Print(text)
+	}
+	return nil
+}
+
+func init() {
+	disasmCmd.Flags().StringP("output", "o", "", "Output assembly file")
+	disasmCmd.Flags().StringP("format", "f", "auto", "Input format (auto, "+strings.Join(assembler.Formats, ", ")+")")
+	disasmCmd.Flags().String("source-map", "", "JSON source map written by assemble --source-map, adds labels and source lines")
+
+	rootCmd.AddCommand(disasmCmd)
+}
@@ -0,0 +1,89 @@
+package r8
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/leon332157/risc-y-8/cmd/r8/assembler"
+	"github.com/spf13/cobra"
+)
+
+var (
+	linkCmd = &cobra.Command{
+		Use:     "link <flags> [object files]",
+		Aliases: []string{"ld"},
+		Short:   "Link RISC-Y-8 object files",
+		Long:    "Link object files produced by r8 assemble -c into a machine code image",
+		RunE:    runLink,
+		Args:    cobra.MinimumNArgs(1),
+		Example: "r8 assemble -c -o main.o main.asm\nr8 assemble -c -o lib.o lib.asm\nr8 link -o a.out -T link.ld --map a.map main.o lib.o",
+		// link errors list every problem found, the usage text would hide them
+		SilenceUsage: true,
+	}
+)
+
+func runLink(cmd *cobra.Command, args []string) error {
+	outfile := cmd.Flag("output").Value.String()
+	format := cmd.Flag("format").Value.String()
+	script := assembler.DefaultLinkScript
+	if name := cmd.Flag("script").Value.String(); name != "" {
+		src, err := os.ReadFile(name)
+		if err != nil {
+			return fmt.Errorf("failed to read link script: %v", err)
+		}
+		if script, err = assembler.ParseLinkScript(string(src)); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	var objs []*assembler.Object
+	for _, name := range args {
+		f, err := os.Open(name)
+		if err != nil {
+			return fmt.Errorf("failed to open object file: %v", err)
+		}
+		obj, err := assembler.ReadObject(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		objs = append(objs, obj)
+	}
+
+	linked, err := assembler.Link(objs, script)
+	if err != nil {
+		return err
+	}
+	outputs := []struct {
+		flag  string
+		write func(io.Writer) error
+	}{
+		{"map", linked.WriteMap},
+		{"source-map", linked.DebugInfo().Write},
+	}
+	for _, out := range outputs {
+		if name := cmd.Flag(out.flag).Value.String(); name != "" {
+			if err := writeFile(name, out.write); err != nil {
+				return err
+			}
+		}
+	}
+	write := func(w io.Writer) error {
+		return assembler.WriteImage(w, linked.Image.Flatten(), format)
+	}
+	if outfile != "" {
+		return writeFile(outfile, write)
+	}
+	return write(os.Stdout)
+}
+
+func init() {
+	linkCmd.Flags().StringP("output", "o", "", "Output machine code file")
+	linkCmd.Flags().StringP("script", "T", "", "Link script that places the sections, text starts at address 0 by default")
+	linkCmd.Flags().String("map", "", "Write the placement of every section and the symbol table")
+	linkCmd.Flags().String("source-map", "", "Write a JSON source map that other r8 commands can load")
+	linkCmd.Flags().StringP("format", "f", "bin", "Output format ("+strings.Join(assembler.Formats, ", ")+")")
+
+	rootCmd.AddCommand(linkCmd)
+}
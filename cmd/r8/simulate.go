@@ -1,12 +1,15 @@
 package r8
 
 import (
-	"bytes"
-	"encoding/binary"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 
+	"github.com/leon332157/risc-y-8/cmd/r8/assembler"
 	"github.com/leon332157/risc-y-8/cmd/r8/simulator"
+	"github.com/leon332157/risc-y-8/pkg/cpu"
+	"github.com/leon332157/risc-y-8/pkg/memory"
 	"github.com/rs/zerolog"
 	"github.com/spf13/cobra"
 )
@@ -25,7 +28,27 @@ var (
 
 func init() {
 	simulateCmd.Flags().BoolVar(&disableCache, "disable-cache", false, "Disable cache")
+	simulateCmd.Flags().BoolVar(&splitCache, "split-cache", false, "Split the cache into an instruction cache and a data cache sharing RAM")
+	simulateCmd.Flags().StringVar(&icacheGeometry, "icache", "8:2:4:1", "Geometry of the instruction cache with --split-cache as sets:ways:words[:delay]")
+	simulateCmd.Flags().StringVar(&dcacheGeometry, "dcache", "8:2:4:1", "Geometry of the data cache with --split-cache as sets:ways:words[:delay]")
+	simulateCmd.Flags().BoolVar(&dataFirst, "data-first", false, "With --split-cache a data access takes RAM from an instruction refill that has not completed")
+	simulateCmd.Flags().StringVar(&l2Geometry, "l2", "", "Add an L2 cache below the L1 as sets:ways:words[:delay]")
+	simulateCmd.Flags().StringVar(&l3Geometry, "l3", "", "Add an L3 cache below the L2 as sets:ways:words[:delay]")
+	simulateCmd.Flags().StringVar(&inclusion, "inclusion", "non-inclusive", "Inclusion policy of the L2 and L3 ("+strings.Join(memory.InclusionPolicies, ", ")+"), an exclusive level needs lines at least as long as the level above")
+	simulateCmd.Flags().StringVar(&writePolicy, "write-policy", "write-through", "Write policy of the data caches ("+strings.Join(memory.WritePolicies, ", ")+")")
+	simulateCmd.Flags().BoolVar(&noWriteAllocate, "no-write-allocate", false, "Write a store that misses around the data caches instead of allocating a line for it")
+	simulateCmd.Flags().UintVar(&writeBuffer, "write-buffer", 0, "Number of entries of the write buffer of the L1 data cache, 0 has none and stores wait for the level below")
+	simulateCmd.Flags().StringVar(&replacement, "replacement", "lru", "Replacement policy of the caches ("+strings.Join(memory.ReplacementPolicies, ", ")+")")
+	simulateCmd.Flags().Int64Var(&replacementSeed, "replacement-seed", 1, "Seed of the random and brrip replacement policies, the same seed replaces the same lines")
 	simulateCmd.Flags().BoolVar(&disablePipeline, "disable-pipeline", false, "Disable pipeline")
+	simulateCmd.Flags().BoolVar(&forwarding, "forwarding", false, "Forward results from execute and memory to dependent instructions instead of waiting for writeback")
+	simulateCmd.Flags().StringVar(&predictor, "predictor", "", "Predict branches with a branch predictor ("+strings.Join(cpu.Predictors, ", ")+"), without it taken branches redirect fetch in writeback")
+	simulateCmd.Flags().UintVar(&predictorEntries, "predictor-entries", 256, "Number of counters of the bimodal and gshare predictors")
+	simulateCmd.Flags().UintVar(&btbEntries, "btb", 0, "Number of entries of the branch target buffer, 0 has none and redirects fetch from decode")
+	simulateCmd.Flags().BoolVar(&trapMisaligned, "trap-misaligned", false, "Raise a misaligned access exception at a word access to an address that is not a multiple of 4 or a halfword access to an odd address instead of splitting it into byte accesses")
+	simulateCmd.Flags().StringSliceVar(&interrupts, "irq", nil, "Raise an external interrupt as cycle:line, line is 1 to 7, for example --irq 500:1")
+	simulateCmd.Flags().StringVar(&sandboxDir, "sandbox", "", "Directory the program may open files in with ecall, files are disabled without it")
+	simulateCmd.Flags().StringVarP(&imageFormat, "format", "f", "auto", "Input format (auto, "+strings.Join(assembler.Formats, ", ")+")")
 	rootCmd.AddCommand(simulateCmd)
 }
 
@@ -36,13 +59,108 @@ func runSimulate(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return fmt.Errorf("failed to open input file: %v", err)
 	}
-	program := make([]uint32, len(f)/4)
-	bytesReader := bytes.NewReader(f)
-	err = binary.Read(bytesReader, binary.LittleEndian, &program)
+	program, err := assembler.ReadImage(f, imageFormat)
 	if err != nil {
 		return fmt.Errorf("failed to read input file: %v", err)
 	}
 	sys := simulator.NewSystem(program, disableCache, disablePipeline)
+	if err := configureCaches(sys); err != nil {
+		return err
+	}
+	sys.TrapMisaligned(trapMisaligned)
+	sys.EnableForwarding(forwarding)
+	if err := sys.SetPredictor(predictor, predictorEntries, btbEntries); err != nil {
+		return err
+	}
+	if err := scheduleInterrupts(sys, interrupts); err != nil {
+		return err
+	}
+	if sandboxDir != "" {
+		if err := sys.Host.Sandbox(sandboxDir); err != nil {
+			return err
+		}
+	}
+	sys.Console.In = os.Stdin
+	sys.Host.Stdin = os.Stdin
 	sys.RunToEnd(nil)
+	sys.Host.Close()
+	if sys.Exit.Exited && sys.Exit.Code != 0 {
+		os.Exit(int(int32(sys.Exit.Code)))
+	}
+	return nil
+}
+
+// Splits the cache as given with --split-cache, --icache, --dcache and --data-first, adds the
+// levels given with --l2, --l3 and --inclusion below it, then sets the write policy given with
+// --write-policy, --no-write-allocate and --write-buffer and the replacement policy given with
+// --replacement and --replacement-seed
+func configureCaches(sys *simulator.System) error {
+	if disableCache && (splitCache || l2Geometry != "" || l3Geometry != "") {
+		return fmt.Errorf("--disable-cache can not be used with --split-cache, --l2 or --l3, give 0 sets to a cache to disable it")
+	}
+	if disableCache && (writePolicy != memory.WRITE_THROUGH.String() || noWriteAllocate || writeBuffer > 0 || replacement != "lru") {
+		return fmt.Errorf("--disable-cache can not be used with --write-policy, --no-write-allocate, --write-buffer or --replacement")
+	}
+	if l3Geometry != "" && l2Geometry == "" {
+		return fmt.Errorf("--l3 needs an --l2")
+	}
+	if splitCache {
+		i, err := simulator.ParseCacheGeometry(icacheGeometry)
+		if err != nil {
+			return err
+		}
+		d, err := simulator.ParseCacheGeometry(dcacheGeometry)
+		if err != nil {
+			return err
+		}
+		if err := sys.SplitCache(i, d, dataFirst); err != nil {
+			return err
+		}
+	}
+	p, err := memory.ParseInclusion(inclusion)
+	if err != nil {
+		return err
+	}
+	for _, level := range []string{l2Geometry, l3Geometry} {
+		if level == "" {
+			break
+		}
+		g, err := simulator.ParseCacheGeometry(level)
+		if err != nil {
+			return err
+		}
+		if err := sys.AddCacheLevel(g, p); err != nil {
+			return err
+		}
+	}
+	w, err := memory.ParseWritePolicy(writePolicy)
+	if err != nil {
+		return err
+	}
+	if err := sys.SetWritePolicy(w, noWriteAllocate, writeBuffer); err != nil {
+		return err
+	}
+	return sys.SetReplacement(replacement, replacementSeed)
+}
+
+// Schedule the external interrupts given with --irq as cycle:line
+func scheduleInterrupts(sys *simulator.System, specs []string) error {
+	for _, spec := range specs {
+		cycle, line, ok := strings.Cut(spec, ":")
+		if !ok {
+			return fmt.Errorf("invalid interrupt %q, expected cycle:line", spec)
+		}
+		c, err := strconv.ParseUint(cycle, 0, 32)
+		if err != nil {
+			return fmt.Errorf("invalid interrupt cycle %q: %v", cycle, err)
+		}
+		l, err := strconv.ParseUint(line, 0, 8)
+		if err != nil {
+			return fmt.Errorf("invalid interrupt line %q: %v", line, err)
+		}
+		if err := sys.ScheduleInterrupt(uint32(c), uint(l)); err != nil {
+			return err
+		}
+	}
 	return nil
 }
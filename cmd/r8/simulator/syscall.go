@@ -0,0 +1,258 @@
+package simulator
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	CPUpkg "github.com/leon332157/risc-y-8/pkg/cpu"
+)
+
+// System calls serviced on the host for ecall, the number is in r1 and the arguments in r2 to
+// r4. Buffers and paths are at byte addresses in RAM, paths end with a 0 byte
+const (
+	SYS_EXIT   = iota + 1 // exit(code), stops the program as a store to the exit port
+	SYS_WRITE             // write(fd, buffer, length) returns the bytes written
+	SYS_READ              // read(fd, buffer, length) returns the bytes read, 0 at the end
+	SYS_OPEN              // open(path, flags) returns the fd
+	SYS_CLOSE             // close(fd)
+	SYS_CYCLES            // cycles() returns the clock
+)
+
+// Flags of SYS_OPEN
+const (
+	OPEN_READ   = iota
+	OPEN_WRITE  // create or truncate
+	OPEN_APPEND // create or append
+)
+
+// Result of a system call that failed or is unknown, -1
+const SYS_FAIL = 0xFFFFFFFF
+
+const (
+	FD_STDIN    = 0
+	FD_STDOUT   = 1
+	FD_STDERR   = 2
+	firstFileFd = 3
+	maxPathLen  = 256
+)
+
+// Host holds the files of the system calls. Files are opened in the sandbox directory only,
+// open fails when no sandbox is set
+type Host struct {
+	Stdin  io.Reader // nil reads as the end of input
+	Stdout io.Writer // nil discards
+	Stderr io.Writer // nil discards
+
+	root   *os.Root
+	files  map[uint32]*os.File
+	nextFd uint32
+}
+
+// Confine the files of the program to dir
+func (h *Host) Sandbox(dir string) error {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open sandbox directory: %v", err)
+	}
+	h.root = root
+	return nil
+}
+
+// Close the files the program left open and the sandbox
+func (h *Host) Close() {
+	for _, f := range h.files {
+		f.Close()
+	}
+	h.files = nil
+	if h.root != nil {
+		h.root.Close()
+		h.root = nil
+	}
+}
+
+func (h *Host) reader(fd uint32) io.Reader {
+	if fd == FD_STDIN {
+		if h.Stdin == nil {
+			return eofReader{}
+		}
+		return h.Stdin
+	}
+	if f, ok := h.files[fd]; ok {
+		return f
+	}
+	return nil
+}
+
+func (h *Host) writer(fd uint32) io.Writer {
+	var w io.Writer
+	switch fd {
+	case FD_STDOUT:
+		w = h.Stdout
+	case FD_STDERR:
+		w = h.Stderr
+	default:
+		if f, ok := h.files[fd]; ok {
+			return f
+		}
+		return nil
+	}
+	if w == nil {
+		return io.Discard
+	}
+	return w
+}
+
+func (h *Host) open(path string, flags uint32) uint32 {
+	if h.root == nil {
+		return SYS_FAIL
+	}
+	var mode int
+	switch flags {
+	case OPEN_READ:
+		mode = os.O_RDONLY
+	case OPEN_WRITE:
+		mode = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	case OPEN_APPEND:
+		mode = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	default:
+		return SYS_FAIL
+	}
+	f, err := h.root.OpenFile(path, mode, 0644)
+	if err != nil {
+		return SYS_FAIL
+	}
+	if h.files == nil {
+		h.files = make(map[uint32]*os.File)
+		h.nextFd = firstFileFd
+	}
+	fd := h.nextFd
+	h.nextFd++
+	h.files[fd] = f
+	return fd
+}
+
+func (h *Host) close(fd uint32) uint32 {
+	f, ok := h.files[fd]
+	if !ok {
+		return SYS_FAIL
+	}
+	delete(h.files, fd)
+	if f.Close() != nil {
+		return SYS_FAIL
+	}
+	return 0
+}
+
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
+
+// Services an ecall, see SYS_EXIT
+func (s *System) syscall(c *CPUpkg.CPU, number uint32, args [CPUpkg.SYSCALL_ARGS]uint32) uint32 {
+	h := s.Host
+	switch number {
+	case SYS_EXIT:
+		s.Exit.Exited = true
+		s.Exit.Code = args[0]
+		return 0
+	case SYS_WRITE:
+		w := h.writer(args[0])
+		buf, ok := s.readRAM(args[1], args[2])
+		if w == nil || !ok {
+			return SYS_FAIL
+		}
+		n, err := w.Write(buf)
+		if err != nil && n == 0 {
+			return SYS_FAIL
+		}
+		return uint32(n)
+	case SYS_READ:
+		r := h.reader(args[0])
+		if r == nil || !s.inRAM(args[1], args[2]) {
+			return SYS_FAIL
+		}
+		buf := make([]byte, args[2])
+		n, err := r.Read(buf)
+		if err != nil && !errors.Is(err, io.EOF) && n == 0 {
+			return SYS_FAIL
+		}
+		s.writeRAM(args[1], buf[:n])
+		return uint32(n)
+	case SYS_OPEN:
+		path, ok := s.readString(args[0])
+		if !ok {
+			return SYS_FAIL
+		}
+		return h.open(path, args[1])
+	case SYS_CLOSE:
+		return h.close(args[0])
+	case SYS_CYCLES:
+		return c.Clock
+	}
+	return SYS_FAIL
+}
+
+// Returns true if the n bytes at byte address addr are in RAM
+func (s *System) inRAM(addr, n uint32) bool {
+	return uint64(addr)+uint64(n) <= uint64(s.RAM.SizeBytes())
+}
+
+// Returns the word at byte address addr as the cpu sees it, without delay. The caches are looked
+// at from the lowest up, a dirty line or a waiting write of an upper one is younger
+func (s *System) peekWord(addr uint) uint32 {
+	word := s.RAM.Contents[addr/4]
+	caches := s.dataCaches()
+	for i := len(caches) - 1; i >= 0; i-- {
+		if caches[i].Buffer != nil {
+			word = caches[i].Buffer.Peek(addr, word)
+		}
+		if w, ok := caches[i].Peek(addr &^ 3); ok {
+			word = w
+		}
+	}
+	return word
+}
+
+// Returns the n bytes at byte address addr as the cpu sees them, without delay
+func (s *System) readRAM(addr, n uint32) ([]byte, bool) {
+	if !s.inRAM(addr, n) {
+		return nil, false
+	}
+	buf := make([]byte, n)
+	for i := range buf {
+		a := uint(addr) + uint(i)
+		buf[i] = byte(s.peekWord(a) >> (8 * (a % 4)))
+	}
+	return buf, true
+}
+
+// Returns the string ending with a 0 byte at byte address addr
+func (s *System) readString(addr uint32) (string, bool) {
+	var str []byte
+	for n := uint32(0); n < maxPathLen && s.inRAM(addr, n+1); n++ {
+		a := uint(addr + n)
+		b := byte(s.peekWord(a) >> (8 * (a % 4)))
+		if b == 0 {
+			return string(str), true
+		}
+		str = append(str, b)
+	}
+	return "", false
+}
+
+// Writes buf at byte address addr in RAM, in the caches that hold the words and in the waiting
+// writes of the write buffer, without delay. The instruction cache of a split L1 drops them,
+// ecall refetches the instructions after it
+func (s *System) writeRAM(addr uint32, buf []byte) {
+	for i, b := range buf {
+		a := uint(addr) + uint(i)
+		s.Cache.Sync(a, uint32(b), 1)
+		if s.ICache != nil {
+			s.ICache.Invalidate(a &^ 3)
+		}
+	}
+}
@@ -2,6 +2,9 @@ package simulator
 
 import (
 	"fmt"
+	"os"
+	"strconv"
+	"strings"
 
 	CPUpkg "github.com/leon332157/risc-y-8/pkg/cpu"
 	"github.com/leon332157/risc-y-8/pkg/memory"
@@ -10,24 +13,56 @@ import (
 type System struct {
 	CPU   *CPUpkg.CPU
 	RAM   *memory.RAM
-	Cache *memory.CacheType
+	Cache *memory.CacheType // the data cache when the L1 is split
+	Bus   *memory.Bus
+
+	// instruction cache and the arbiter sharing the bus with Cache, nil unless SplitCache was called
+	ICache  *memory.CacheType
+	Arbiter *memory.Arbiter
+	Levels  []*memory.CacheType // L2, L3 and so on below the L1, see AddCacheLevel
+
+	// devices on the bus, at memory.CONSOLE_ADDR, memory.EXIT_ADDR and memory.RANDOM_ADDR
+	Console *memory.Console
+	Exit    *memory.ExitPort
+	Random  *memory.Random
+
+	Host *Host // files of the system calls of ecall
+
+	interrupts []scheduledInterrupt // external interrupts that are not raised yet
+}
+
+// An external interrupt raised when the clock reaches clock
+type scheduledInterrupt struct {
+	clock uint32
+	line  uint
 }
 
 type readStateHook func(sys *System) bool
 
-func NewSystem(initRamContent []uint32, disableCache, disablePipeline bool) System {
-	sys := System{}
+// Returns a system running the program initRamContent. It is returned by pointer as the cpu
+// calls back into it for ecall, which sees the caches as they are configured later
+func NewSystem(initRamContent []uint32, disableCache, disablePipeline bool) *System {
+	sys := &System{}
 	ram := memory.CreateRAM(1000, 8, 100)
 	sys.RAM = &ram
 	sys.CPU = new(CPUpkg.CPU)
 	copy(sys.RAM.Contents, initRamContent)
-	cache := memory.CreateCache(8, 2, 4, 1, sys.RAM)
+	sys.Bus = memory.NewBus(sys.RAM)
+	sys.Console = &memory.Console{Out: os.Stdout}
+	sys.Exit = new(memory.ExitPort)
+	sys.Random = new(memory.Random)
+	sys.Bus.Map(memory.CONSOLE_ADDR, sys.Console)
+	sys.Bus.Map(memory.EXIT_ADDR, sys.Exit)
+	sys.Bus.Map(memory.RANDOM_ADDR, sys.Random)
+	sys.Cache = DefaultCacheGeometry.create(sys.Bus)
 	if disableCache {
-		cache = memory.CreateCache(0, 0, 0, 0, sys.RAM)
+		sys.Cache = CacheGeometry{}.create(sys.Bus)
 	}
-	sys.Cache = &cache
 	pipeline := CPUpkg.NewPipeline(sys.CPU, disablePipeline) // scalar is false
 	sys.CPU.Init(sys.Cache, sys.RAM, pipeline, nil)          // Initialize the CPU with the cache and no pipeline yet
+	sys.CPU.Bus = sys.Bus
+	sys.Host = &Host{Stdout: os.Stdout, Stderr: os.Stderr}
+	sys.CPU.Syscall = sys.syscall
 	fs := new(CPUpkg.FetchStage)
 	ds := new(CPUpkg.DecodeStage)
 	es := new(CPUpkg.ExecuteStage)
@@ -42,11 +77,322 @@ func NewSystem(initRamContent []uint32, disableCache, disablePipeline bool) Syst
 	return sys
 }
 
+// Geometry of a cache, the sets and the words per line are powers of two, 0 sets disable it
+type CacheGeometry struct {
+	Sets, Ways, WordsPerLine, Delay uint
+}
+
+// Geometry of the cache of NewSystem
+var DefaultCacheGeometry = CacheGeometry{Sets: 8, Ways: 2, WordsPerLine: 4, Delay: 1}
+
+// Parses a cache geometry given as sets:ways:words[:delay], the delay is 1 if it is left out
+func ParseCacheGeometry(spec string) (CacheGeometry, error) {
+	fields := strings.Split(spec, ":")
+	if len(fields) < 3 || len(fields) > 4 {
+		return CacheGeometry{}, fmt.Errorf("invalid cache geometry %q, expected sets:ways:words[:delay]", spec)
+	}
+	vals := []uint{0, 0, 0, 1}
+	for i, f := range fields {
+		v, err := strconv.ParseUint(f, 0, 16)
+		if err != nil {
+			return CacheGeometry{}, fmt.Errorf("invalid cache geometry %q: %v", spec, err)
+		}
+		vals[i] = uint(v)
+	}
+	g := CacheGeometry{Sets: vals[0], Ways: vals[1], WordsPerLine: vals[2], Delay: vals[3]}
+	return g, g.check()
+}
+
+func (g CacheGeometry) check() error {
+	if g.Sets == 0 {
+		return nil
+	}
+	if g.Sets&(g.Sets-1) != 0 || g.WordsPerLine == 0 || g.WordsPerLine&(g.WordsPerLine-1) != 0 || g.Ways == 0 {
+		return fmt.Errorf("invalid cache geometry %d:%d:%d, sets and words per line must be powers of two and ways at least 1", g.Sets, g.Ways, g.WordsPerLine)
+	}
+	return nil
+}
+
+func (g CacheGeometry) create(lower memory.Memory) *memory.CacheType {
+	c := memory.CreateCache(g.Sets, g.Ways, g.WordsPerLine, g.Delay, lower)
+	if g.Sets == 0 {
+		c = memory.CreateCache(0, 0, 0, 0, lower)
+	}
+	return &c
+}
+
+// Replaces the cache with a split L1, an instruction cache for fetch and a data cache for the
+// memory stage, each of its own geometry, that share the bus through an arbiter. With dataFirst
+// a data access takes RAM from an instruction refill that has not completed. A store keeps fetch
+// coherent by invalidating the lines of the instruction cache it writes, see CPUpkg.MemoryStage,
+// and a refill of the instruction cache cleans the data cache of the line first. The L1 is split
+// before levels are added below it and before the write policy is set
+func (s *System) SplitCache(i, d CacheGeometry, dataFirst bool) error {
+	if len(s.Levels) > 0 {
+		return fmt.Errorf("the L1 must be split before cache levels are added below it")
+	}
+	if err := i.check(); err != nil {
+		return err
+	}
+	if err := d.check(); err != nil {
+		return err
+	}
+	s.Arbiter = memory.NewArbiter(s.Bus, dataFirst)
+	s.ICache = i.create(s.Arbiter)
+	s.Cache = d.create(s.Arbiter)
+	s.ICache.Snoop = s.Cache
+	s.CPU.ICache = s.ICache
+	s.CPU.Cache = s.Cache
+	return nil
+}
+
+// Adds a cache of geometry g below the lowest cache, between it and the bus, with inclusion
+// policy p with respect to the caches right above it
+func (s *System) AddCacheLevel(g CacheGeometry, p memory.InclusionPolicy) error {
+	if err := g.check(); err != nil {
+		return err
+	}
+	c := g.create(s.Bus)
+	uppers := []*memory.CacheType{s.Cache}
+	if n := len(s.Levels); n > 0 {
+		uppers = s.Levels[n-1:]
+	} else if s.ICache != nil {
+		uppers = []*memory.CacheType{s.ICache, s.Cache}
+	}
+	if err := c.SetInclusion(p, uppers...); err != nil {
+		return err
+	}
+	if len(s.Levels) == 0 && s.Arbiter != nil {
+		s.Arbiter.Lower = c
+	} else {
+		uppers[0].LowerLevel = c
+	}
+	s.Levels = append(s.Levels, c)
+	return nil
+}
+
+// Sets the write policy of the data caches, see memory.WritePolicy, and gives the data cache of
+// the L1 a write buffer of bufferEntries writes, 0 has none. The instruction cache of a split L1
+// is never written
+func (s *System) SetWritePolicy(p memory.WritePolicy, noAllocate bool, bufferEntries uint) error {
+	if bufferEntries > 0 && s.Cache.WordsPerLine == 0 {
+		return fmt.Errorf("a write buffer needs the cache enabled")
+	}
+	for _, c := range s.dataCaches() {
+		c.WritePolicy = p
+		c.NoWriteAllocate = noAllocate
+	}
+	s.Cache.Buffer = nil
+	if bufferEntries > 0 {
+		s.Cache.Buffer = memory.NewWriteBuffer(bufferEntries, s.Cache.WordsPerLine)
+	}
+	return nil
+}
+
+// Replaces the lines of every cache with the replacement policy called name, see
+// memory.NewReplacement, seed seeds the policies that pick at random. Each cache keeps its own
+// state. It is called once the caches are built
+func (s *System) SetReplacement(name string, seed int64) error {
+	for _, c := range s.Caches() {
+		if c.Cache.Sets == 0 {
+			continue
+		}
+		if err := c.Cache.SetReplacement(name, seed); err != nil {
+			return fmt.Errorf("%s: %v", c.Name, err)
+		}
+	}
+	return nil
+}
+
+// A cache of the system and the name of its level
+type NamedCache struct {
+	Name  string
+	Cache *memory.CacheType
+}
+
+// Returns the caches from the L1 down, the instruction cache of a split L1 comes first
+func (s *System) Caches() []NamedCache {
+	caches := []NamedCache{{"L1", s.Cache}}
+	if s.ICache != nil {
+		caches = []NamedCache{{"L1I", s.ICache}, {"L1D", s.Cache}}
+	}
+	for i, c := range s.Levels {
+		caches = append(caches, NamedCache{fmt.Sprintf("L%d", i+2), c})
+	}
+	return caches
+}
+
+// Returns the caches a load may find a word in, from the L1 down
+func (s *System) dataCaches() []*memory.CacheType {
+	return append([]*memory.CacheType{s.Cache}, s.Levels...)
+}
+
+// Writes the write buffer and the dirty lines of the data caches to RAM, from the L1 down
+func (s *System) FlushCaches() {
+	for _, c := range s.dataCaches() {
+		c.Flush()
+	}
+}
+
+// Prints the contents and the statistics of the caches, and how often each cache of a split L1
+// waited for the other
+func (s *System) PrintCaches() {
+	caches := s.Caches()
+	for _, c := range caches {
+		if len(caches) > 1 {
+			fmt.Printf("%s cache\n", c.Name)
+		}
+		c.Cache.PrintCache()
+	}
+	for _, c := range caches {
+		st := c.Cache.Stats
+		fmt.Printf("%s read hits: %d misses: %d write hits: %d misses: %d evictions: %d hit rate: %.1f%%", c.Name, st.ReadHits, st.ReadMisses, st.WriteHits, st.WriteMisses, st.Evictions, st.HitRate()*100)
+		if c.Cache.Inclusion != memory.NON_INCLUSIVE {
+			fmt.Printf(" %s", c.Cache.Inclusion)
+		}
+		if st.BackInvalidations > 0 {
+			fmt.Printf(" back invalidations: %d", st.BackInvalidations)
+		}
+		if c.Cache.WritePolicy == memory.WRITE_BACK {
+			fmt.Printf(" write-back writebacks: %d", st.Writebacks)
+		}
+		if c.Cache.NoWriteAllocate {
+			fmt.Print(" no-write-allocate")
+		}
+		if name := c.Cache.Replacement.Name(); name != "lru" {
+			fmt.Printf(" %s replacement", name)
+		}
+		fmt.Println()
+	}
+	requesters := []struct {
+		name string
+		who  memory.Requester
+	}{{"Instruction", memory.FETCH_STAGE}, {"Data", memory.MEMORY_STAGE}}
+	if b := s.Cache.Buffer; b != nil {
+		fmt.Printf("Write buffer entries: %d writes: %d combined: %d full: %d drained: %d\n", b.Entries, b.Stats.Writes, b.Stats.Combined, b.Stats.Full, b.Stats.Drained)
+		requesters = append(requesters, struct {
+			name string
+			who  memory.Requester
+		}{"Write buffer", memory.WRITE_BUFFER})
+	}
+	if s.Arbiter == nil {
+		return
+	}
+	for _, c := range requesters {
+		var st memory.ArbiterStats
+		if p := s.Arbiter.Stats[c.who]; p != nil {
+			st = *p
+		}
+		fmt.Printf("%s accesses below L1: %d Conflicts: %d Preempted: %d\n", c.name, st.Accesses, st.Conflicts, st.Preempted)
+	}
+}
+
+// Sets the alignment policy of the cpu, a word access at an address that is not a multiple of 4
+// or a halfword access at an odd address raises an exception when trap is true and is split into
+// byte accesses otherwise
+func (s *System) TrapMisaligned(trap bool) {
+	s.CPU.Alignment = CPUpkg.ALIGN_SPLIT
+	if trap {
+		s.CPU.Alignment = CPUpkg.ALIGN_TRAP
+	}
+}
+
+// Turns operand forwarding on or off, without it an instruction waits in decode until the
+// instructions it depends on complete writeback
+func (s *System) EnableForwarding(on bool) {
+	s.CPU.Pipeline.Forwarding = on
+}
+
+// Predicts branches with the predictor called name, see CPUpkg.Predictors, with entries
+// counters for bimodal and gshare and a BTB of btb entries, 0 has no BTB. An empty name
+// resolves branches in writeback
+func (s *System) SetPredictor(name string, entries, btb uint) error {
+	if name == "" {
+		s.CPU.Pipeline.Branch = nil
+		return nil
+	}
+	p, err := CPUpkg.NewPredictor(name, entries)
+	if err != nil {
+		return err
+	}
+	var b *CPUpkg.BTB
+	if btb > 0 {
+		b = CPUpkg.NewBTB(btb)
+	}
+	s.CPU.Pipeline.Branch = CPUpkg.NewBranchUnit(p, b)
+	return nil
+}
+
+// Prints the accuracy of the branch predictor for each branch and in total
+func (s *System) PrintBranchStats() {
+	u := s.CPU.Pipeline.Branch
+	if u == nil {
+		return
+	}
+	fmt.Printf("Branch predictor: %s\n", u.Predictor.Name())
+	fmt.Printf("%-8s %-8s %-8s %-12s %s\n", "PC", "Executed", "Taken", "Mispredicted", "Accuracy")
+	for _, pc := range u.Branches() {
+		st := u.Stats[pc]
+		fmt.Printf("%-8d %-8d %-8d %-12d %.1f%%\n", pc, st.Executed, st.Taken, st.Mispredicted, st.Accuracy()*100)
+	}
+	total := u.Total()
+	fmt.Printf("Branches: %d Mispredicted: %d Accuracy: %.1f%%\n", total.Executed, total.Mispredicted, total.Accuracy()*100)
+	if u.BTB != nil {
+		fmt.Printf("BTB hits: %d misses: %d\n", u.BTB.Hits, u.BTB.Misses)
+	}
+}
+
+// Returns the average clocks per retired instruction
+func (s *System) CPI() float64 {
+	if s.CPU.Retired == 0 {
+		return 0
+	}
+	return float64(s.CPU.Clock) / float64(s.CPU.Retired)
+}
+
+// lines 1 to 7 are external, line 0 is the timer
+func checkExternalLine(line uint) error {
+	if line == CPUpkg.IRQ_TIMER || line >= CPUpkg.IRQ_COUNT {
+		return fmt.Errorf("interrupt line %d is not an external line, use 1 to %d", line, CPUpkg.IRQ_COUNT-1)
+	}
+	return nil
+}
+
+// Raises external interrupt line
+func (s *System) Interrupt(line uint) error {
+	if err := checkExternalLine(line); err != nil {
+		return err
+	}
+	s.CPU.RaiseInterrupt(line)
+	return nil
+}
+
+// Raises external interrupt line when the clock reaches clock
+func (s *System) ScheduleInterrupt(clock uint32, line uint) error {
+	if err := checkExternalLine(line); err != nil {
+		return err
+	}
+	s.interrupts = append(s.interrupts, scheduledInterrupt{clock, line})
+	return nil
+}
+
 func (s *System) RunOneClock(rHook *readStateHook) {
 	cpu := s.CPU
+	for i := 0; i < len(s.interrupts); {
+		if irq := s.interrupts[i]; irq.clock <= cpu.Clock {
+			cpu.RaiseInterrupt(irq.line)
+			s.interrupts = append(s.interrupts[:i], s.interrupts[i+1:]...)
+		} else {
+			i++
+		}
+	}
 	if !cpu.Halted {
 		cpu.Pipeline.RunOneClock()
+		s.Cache.Drain() // the write buffer takes the lower level when the pipeline left it free
 		//time.Sleep(time.Millisecond * 100) // Sleep for 100 milliseconds to simulate clock cycles
+		if s.Exit.Exited {
+			cpu.Halt() // the store to the exit port has completed, younger instructions are dropped
+		}
 	}
 	if rHook != nil {
 		(*rHook)(s)
@@ -61,9 +407,20 @@ func (s *System) RunToEnd(rHook *readStateHook) {
 		s.RunOneClock(rHook)
 	}
 	s.CPU.PrintReg()
+	s.CPU.PrintFloatReg()
+	s.CPU.PrintVectorReg()
+	s.FlushCaches()
 	s.CPU.RAM.PrintMem()
-	s.CPU.Cache.PrintCache()
+	s.PrintCaches()
 	fmt.Printf("PC: %d Cycles: %d\n", s.CPU.ProgramCounter, s.CPU.Clock)
+	fmt.Printf("Instructions: %d CPI: %.3f\n", s.CPU.Retired, s.CPI())
+	s.PrintBranchStats()
+	if fault := s.CPU.DescribeFault(); fault != "" {
+		fmt.Println("CPU stopped by an", fault)
+	}
+	if s.Exit.Exited {
+		fmt.Println("Program exited with code", int32(s.Exit.Code))
+	}
 	if rHook != nil {
 		(*rHook)(s)
 	}
@@ -0,0 +1,509 @@
+package simulator
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/leon332157/risc-y-8/cmd/r8/assembler"
+	"github.com/leon332157/risc-y-8/pkg/cpu"
+	"github.com/leon332157/risc-y-8/pkg/memory"
+	"github.com/leon332157/risc-y-8/pkg/types"
+)
+
+// Returns a system running test-programs/name.asm
+func loadProgram(t *testing.T, name string) *System {
+	src, err := os.ReadFile("../../../test-programs/" + name + ".asm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return assemble(t, name+".asm", string(src))
+}
+
+// Returns a system running the program src
+func assemble(t *testing.T, name, src string) *System {
+	res, err := assembler.New(assembler.Options{}).AssembleString(name, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewSystem(res.Image().Flatten(), false, false)
+}
+
+// Runs the system until the cpu halts, failing if it takes more than limit clocks
+func runUntilHalt(t *testing.T, s *System, limit uint32) {
+	for !s.CPU.Halted {
+		if s.CPU.Clock > limit {
+			t.Fatalf("expected the cpu to halt within %d clocks, PC is %d", limit, s.CPU.ProgramCounter)
+		}
+		s.RunOneClock(nil)
+	}
+}
+
+func TestSyscallsThroughCaches(t *testing.T) {
+	l1 := CacheGeometry{Sets: 8, Ways: 2, WordsPerLine: 4, Delay: 1}
+	var test = []struct {
+		name      string
+		configure func(s *System) error
+	}{
+		{"unified", func(s *System) error { return nil }},
+		{"split write-back", func(s *System) error {
+			if err := s.SplitCache(l1, l1, false); err != nil {
+				return err
+			}
+			return s.SetWritePolicy(memory.WRITE_BACK, false, 0)
+		}},
+		{"split write buffer", func(s *System) error {
+			if err := s.SplitCache(l1, l1, false); err != nil {
+				return err
+			}
+			return s.SetWritePolicy(memory.WRITE_THROUGH, false, 4)
+		}},
+		{"split write-back L2", func(s *System) error {
+			if err := s.SplitCache(l1, l1, false); err != nil {
+				return err
+			}
+			if err := s.AddCacheLevel(CacheGeometry{Sets: 16, Ways: 4, WordsPerLine: 4, Delay: 10}, memory.INCLUSIVE); err != nil {
+				return err
+			}
+			return s.SetWritePolicy(memory.WRITE_BACK, false, 4)
+		}},
+		{"split exclusive L2 with longer lines", func(s *System) error {
+			if err := s.SplitCache(l1, l1, false); err != nil {
+				return err
+			}
+			return s.AddCacheLevel(CacheGeometry{Sets: 4, Ways: 2, WordsPerLine: 8, Delay: 10}, memory.EXCLUSIVE)
+		}},
+	}
+	for _, tt := range test {
+		s := loadProgram(t, "syscall")
+		if err := tt.configure(s); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var stdout, stderr bytes.Buffer
+		s.Host.Stdin = strings.NewReader("hello\n")
+		s.Host.Stdout, s.Host.Stderr = &stdout, &stderr
+		if err := s.Host.Sandbox(t.TempDir()); err != nil {
+			t.Fatal(err)
+		}
+		for !s.CPU.Halted {
+			s.RunOneClock(nil)
+		}
+		s.Host.Close()
+		if !s.Exit.Exited || s.Exit.Code != 0 {
+			t.Errorf("%s: expected exit code 0, got %v %d", tt.name, s.Exit.Exited, s.Exit.Code)
+		}
+		if got := stdout.String(); got != "Hello, copied: hello\n" {
+			t.Errorf("%s: expected the greeting and the copy, got %q", tt.name, got)
+		}
+		if got := stderr.String(); !regexp.MustCompile(`^[0-9]+ cycles\n$`).MatchString(got) {
+			t.Errorf("%s: expected the cycles, got %q", tt.name, got)
+		}
+	}
+}
+
+func TestAddExclusiveCacheLevel(t *testing.T) {
+	s := loadProgram(t, "single")
+	if err := s.AddCacheLevel(CacheGeometry{Sets: 4, Ways: 2, WordsPerLine: 2, Delay: 10}, memory.EXCLUSIVE); err == nil {
+		t.Errorf("expected an error for an exclusive L2 with lines shorter than the L1")
+	}
+	if len(s.Levels) != 0 {
+		t.Errorf("expected the rejected level not to be added")
+	}
+	if err := s.AddCacheLevel(CacheGeometry{Sets: 4, Ways: 2, WordsPerLine: 8, Delay: 10}, memory.EXCLUSIVE); err != nil {
+		t.Errorf("expected an exclusive L2 with lines longer than the L1, got %v", err)
+	}
+}
+
+func TestBTBCountsBranches(t *testing.T) {
+	s := loadProgram(t, "long")
+	if err := s.SetPredictor("bimodal", 16, 8); err != nil {
+		t.Fatal(err)
+	}
+	for !s.CPU.Halted {
+		s.RunOneClock(nil)
+	}
+	btb, total := s.CPU.Pipeline.Branch.BTB, s.CPU.Pipeline.Branch.Total()
+	if btb.Hits+btb.Misses != total.Executed {
+		t.Errorf("expected a lookup for each of the %d branches, got %d hits and %d misses", total.Executed, btb.Hits, btb.Misses)
+	}
+	if btb.Hits == 0 {
+		t.Errorf("expected the loop branch to hit")
+	}
+}
+
+func TestWriteRAMInvalidatesICache(t *testing.T) {
+	s := loadProgram(t, "single")
+	l1 := CacheGeometry{Sets: 8, Ways: 2, WordsPerLine: 4, Delay: 1}
+	if err := s.SplitCache(l1, l1, false); err != nil {
+		t.Fatal(err)
+	}
+	for !s.CPU.Halted {
+		s.RunOneClock(nil)
+	}
+	if _, ok := s.ICache.Peek(0); !ok {
+		t.Fatalf("expected the instruction cache to hold the first instruction")
+	}
+	s.writeRAM(0, []byte{1, 2, 3, 4})
+	if _, ok := s.ICache.Peek(0); ok {
+		t.Errorf("expected the write to drop the instruction from the instruction cache")
+	}
+	if s.RAM.Contents[0] != 0x04030201 {
+		t.Errorf("expected the write in RAM, got %08x", s.RAM.Contents[0])
+	}
+}
+
+func TestHaltAfterOlderInstructions(t *testing.T) {
+	// no hlt, the zero word after the program halts once the store ahead of it has completed,
+	// the zero word skipped by the branch is fetched on the wrong path and must not halt
+	src := `
+	ldi r1, 5
+	bunc skip
+	.word 0
+skip:
+	add r1, 7
+	ldi r2, 64
+	stw r1, [r2]
+	`
+	for _, predictor := range []string{"", "bimodal"} {
+		s := assemble(t, "halt.asm", src)
+		if err := s.SetPredictor(predictor, 16, 0); err != nil {
+			t.Fatal(err)
+		}
+		runUntilHalt(t, s, 1000)
+		s.FlushCaches()
+		if got := s.CPU.ReadIntRNoBlock(1); got != 12 {
+			t.Errorf("predictor %q: expected r1 = 12, got %d", predictor, got)
+		}
+		if got := s.RAM.Contents[64/4]; got != 12 {
+			t.Errorf("predictor %q: expected the store to complete before the halt, got %d", predictor, got)
+		}
+		if s.CPU.Retired != 6 {
+			t.Errorf("predictor %q: expected 5 instructions and the halt to retire, got %d", predictor, s.CPU.Retired)
+		}
+	}
+}
+
+func TestCallWritesLinkRegister(t *testing.T) {
+	src := `
+	call double
+	add r1, 1
+	hlt
+double:
+	ldi r1, 21
+	add r1, r1
+	ret
+	`
+	for _, predictor := range []string{"", "bimodal"} {
+		s := assemble(t, "call.asm", src)
+		if err := s.SetPredictor(predictor, 16, 8); err != nil {
+			t.Fatal(err)
+		}
+		runUntilHalt(t, s, 1000)
+		if got := s.CPU.ReadIntRNoBlock(types.IntegerRegisters["lr"]); got != 4 {
+			t.Errorf("predictor %q: expected lr to hold the address after the call, got %d", predictor, got)
+		}
+		if got := s.CPU.ReadIntRNoBlock(1); got != 43 {
+			t.Errorf("predictor %q: expected ret to return after the call, r1 = 43, got %d", predictor, got)
+		}
+	}
+}
+
+func TestTrapIsPrecise(t *testing.T) {
+	// the div traps to tvec + 4 * cause, the handler records epc and cause and returns past it,
+	// so the add after the div runs once, the branch not taken to a misaligned target must not trap
+	src := `
+	li r1, vectors
+	mtsr tvec, r1
+	ldi r2, 7
+	xor r3, r3
+	ldi r5, 2
+	div r2, r3
+	add r14, 1
+	cmp r5, r5
+	bne [r5]
+	add r14, 10
+	hlt
+vectors:
+	hlt
+	hlt
+	jmp on_divide
+	hlt
+	hlt
+on_divide:
+	inc r10
+	mfsr r8, epc
+	mfsr r9, cause
+	mov r1, r8
+	add r1, 4
+	mtsr epc, r1
+	iret
+	`
+	for _, forwarding := range []bool{false, true} {
+		for _, predictor := range []string{"", "bimodal"} {
+			s := assemble(t, "trap.asm", src)
+			s.EnableForwarding(forwarding)
+			if err := s.SetPredictor(predictor, 16, 8); err != nil {
+				t.Fatal(err)
+			}
+			runUntilHalt(t, s, 1000)
+			name := fmt.Sprintf("forwarding %v predictor %q", forwarding, predictor)
+			if s.CPU.Fault != cpu.EXC_NONE {
+				t.Errorf("%s: expected no fault, got %s", name, cpu.LookUpException(s.CPU.Fault))
+			}
+			if got := s.CPU.ReadIntRNoBlock(10); got != 1 {
+				t.Errorf("%s: expected the divide handler to run once, ran %d times", name, got)
+			}
+			if got := s.CPU.ReadIntRNoBlock(8); got != 20 {
+				t.Errorf("%s: expected epc to be the address of the div, got %d", name, got)
+			}
+			if got := s.CPU.ReadIntRNoBlock(9); got != uint32(cpu.EXC_DIVIDE_BY_ZERO) {
+				t.Errorf("%s: expected the divide by zero cause, got %d", name, got)
+			}
+			if got := s.CPU.ReadIntRNoBlock(2); got != 7 {
+				t.Errorf("%s: expected the div not to write r2, got %d", name, got)
+			}
+			if got := s.CPU.ReadIntRNoBlock(14); got != 11 {
+				t.Errorf("%s: expected the instructions after the div to run once, r14 = 11, got %d", name, got)
+			}
+		}
+	}
+}
+
+func TestUnknownSpecialRegister(t *testing.T) {
+	for _, imm := range []int16{0xff, 0xff | types.SR_WRITE} {
+		word := (&types.BaseInstruction{OpType: types.RegImm, ALU: types.IMM_SR, Rd: 1, Imm: imm}).Encode()
+		s := assemble(t, "sr.asm", fmt.Sprintf("\t.word %#x\n\thlt\n", word))
+		runUntilHalt(t, s, 1000)
+		if s.CPU.Fault != cpu.EXC_ILLEGAL_INSTRUCTION || s.CPU.TVal != word {
+			t.Errorf("imm %#x: expected an illegal instruction with tval %08x, got %s %08x", imm, word, cpu.LookUpException(s.CPU.Fault), s.CPU.TVal)
+		}
+	}
+}
+
+func TestTimerInterruptDuringLoop(t *testing.T) {
+	// the loop sums 100 down to 1 while the timer fires every 100 cycles, the handler counts the
+	// interrupts in r10 and changes the flags, which iret restores before the loop's bne. r12 counts
+	// the handlers running, r13 is set if one starts while another runs
+	src := `
+	li r1, vectors
+	mtsr tvec, r1
+	ldi r1, 100
+	mtsr tperiod, r1
+	mfsr r2, time
+	add r2, r1
+	mtsr tcmp, r2           # first tick 100 cycles from now
+	ldi r1, 1
+	mtsr imask, r1          # only the timer, line 1 stays masked
+	li r15, loop
+	li r16, done
+	mtsr status, r1
+	xor r1, r1
+	ldi r2, 100
+loop:
+	add r1, r2
+	sub r2, 1
+	cmp r2, 0
+	bne loop
+done:
+	mtsr status, r0
+	hlt
+
+vectors:
+	hlt
+	hlt
+	hlt
+	hlt
+	hlt
+	hlt
+	hlt
+	hlt
+	jmp on_timer
+	hlt
+
+on_timer:
+	inc r12
+	cmp r12, 1
+	beq alone
+	ldi r13, 1
+alone:
+	inc r10
+	mfsr r8, epc
+	mfsr r9, cause
+	mfsr r11, status
+	mov r14, r8
+	sub r14, r15
+	sub r12, 1
+	iret
+	`
+	for _, predictor := range []string{"", "bimodal"} {
+		s := assemble(t, "timer.asm", src)
+		if err := s.SetPredictor(predictor, 16, 8); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.ScheduleInterrupt(500, 1); err != nil {
+			t.Fatal(err)
+		}
+		runUntilHalt(t, s, 20000)
+		reg := s.CPU.ReadIntRNoBlock
+		if s.CPU.Fault != cpu.EXC_NONE {
+			t.Fatalf("predictor %q: expected no fault, got %s", predictor, cpu.LookUpException(s.CPU.Fault))
+		}
+		if got := reg(1); got != 100*101/2 {
+			t.Errorf("predictor %q: expected the loop to sum to %d, got %d", predictor, 100*101/2, got)
+		}
+		// the timer fires every 100 cycles until the loop ends and disables interrupts
+		if got, most := reg(10), s.CPU.Clock/100; got < 3 || got > most {
+			t.Errorf("predictor %q: expected between 3 and %d timer interrupts, got %d", predictor, most, got)
+		}
+		if got := reg(9); got != uint32(cpu.EXC_INTERRUPT+cpu.IRQ_TIMER) {
+			t.Errorf("predictor %q: expected the timer interrupt cause, got %d", predictor, got)
+		}
+		if epc := reg(8); epc < reg(15) || epc > reg(16) {
+			t.Errorf("predictor %q: expected epc in the loop at %d-%d, got %d", predictor, reg(15), reg(16), epc)
+		}
+		if got := reg(14); got%4 != 0 {
+			t.Errorf("predictor %q: expected epc at an instruction, %d bytes into the loop", predictor, got)
+		}
+		if got := reg(11); got != types.STATUS_PIE {
+			t.Errorf("predictor %q: expected interrupts disabled in the handler, status %b", predictor, got)
+		}
+		if reg(13) != 0 || reg(12) != 0 {
+			t.Errorf("predictor %q: expected no nested handler, got %d running and nested %d", predictor, reg(12), reg(13))
+		}
+		if s.CPU.IPend&(1<<1) == 0 {
+			t.Errorf("predictor %q: expected the masked line 1 to stay pending", predictor)
+		}
+	}
+}
+
+func TestForwardingLowersCPI(t *testing.T) {
+	// the loop of long.asm is a chain of dependent instructions, forwarding lets each one enter
+	// execute without waiting for the one before it to reach writeback
+	var cpi [2]float64
+	for i, forwarding := range []bool{false, true} {
+		s := loadProgram(t, "long")
+		s.EnableForwarding(forwarding)
+		runUntilHalt(t, s, 5000)
+		cpi[i] = s.CPI()
+	}
+	if cpi[1] >= cpi[0] {
+		t.Errorf("expected forwarding to lower the CPI, got %.3f with it and %.3f without", cpi[1], cpi[0])
+	}
+}
+
+func TestForwardingKeepsResults(t *testing.T) {
+	chain := `
+	ldi r5, 0x200
+	ldi sp, 0x300
+	ldi r2, 8
+loop:
+	ldw r3, [r5]
+	add r3, r2
+	stw r3, [r5]
+	add r1, r3
+	shl r1, 1
+	xor r1, r2
+	push r1
+	pop r4
+	sub r2, 1
+	cmp r2, 0
+	bne loop
+	hlt
+	`
+	programs := map[string]func() *System{
+		"long":  func() *System { return loadProgram(t, "long") },
+		"chain": func() *System { return assemble(t, "chain.asm", chain) },
+	}
+	for name, load := range programs {
+		var systems [2]*System
+		for i, forwarding := range []bool{false, true} {
+			s := load()
+			s.EnableForwarding(forwarding)
+			runUntilHalt(t, s, 20000)
+			if s.CPU.Fault != cpu.EXC_NONE {
+				t.Fatalf("%s: expected no fault, got %s", name, cpu.LookUpException(s.CPU.Fault))
+			}
+			s.FlushCaches()
+			systems[i] = s
+		}
+		off, on := systems[0], systems[1]
+		if off.CPU.Retired != on.CPU.Retired {
+			t.Errorf("%s: expected %d instructions to retire with forwarding, got %d", name, off.CPU.Retired, on.CPU.Retired)
+		}
+		for r := uint8(0); r < cpu.INT_REG_COUNT; r++ {
+			if a, b := off.CPU.ReadIntRNoBlock(r), on.CPU.ReadIntRNoBlock(r); a != b {
+				t.Errorf("%s: expected r%d = %d with forwarding, got %d", name, r, a, b)
+			}
+		}
+		for i := range off.RAM.Contents {
+			if a, b := off.RAM.Contents[i], on.RAM.Contents[i]; a != b {
+				t.Errorf("%s: expected the word at %d = %d with forwarding, got %d", name, 4*i, a, b)
+			}
+		}
+	}
+}
+
+func TestMispredictionSquashesWrongPath(t *testing.T) {
+	// execute resolves each branch against the address fetch continued at, the instructions
+	// fetched on the wrong path are squashed in decode and fetch and must not change any state
+	var test = []struct {
+		name      string
+		predictor string
+		src       string
+		check     func(s *System) error
+	}{
+		{"taken predicted not taken", "not-taken", `
+	ldi r1, 3
+	cmp r1, 3
+	beq over
+	add r9, 100
+	ldi r2, 64
+	stw r9, [r2]
+over:
+	add r10, 1
+	hlt
+	`, func(s *System) error {
+			if r9, r10 := s.CPU.ReadIntRNoBlock(9), s.CPU.ReadIntRNoBlock(10); r9 != 0 || r10 != 1 {
+				return fmt.Errorf("expected r9 = 0 and r10 = 1, got %d and %d", r9, r10)
+			}
+			if got := s.RAM.Contents[64/4]; got != 0 {
+				return fmt.Errorf("expected the store on the wrong path not to write, got %d", got)
+			}
+			return nil
+		}},
+		{"not taken predicted taken", "btfn", `
+	ldi r2, 3
+loop:
+	add r11, 1
+	sub r2, 1
+	cmp r2, 0
+	bne loop
+	add r12, 1
+	hlt
+	`, func(s *System) error {
+			if r11, r12 := s.CPU.ReadIntRNoBlock(11), s.CPU.ReadIntRNoBlock(12); r11 != 3 || r12 != 1 {
+				return fmt.Errorf("expected r11 = 3 and r12 = 1, got %d and %d", r11, r12)
+			}
+			return nil
+		}},
+	}
+	for _, tt := range test {
+		for _, btb := range []uint{0, 8} {
+			s := assemble(t, "mispredict.asm", tt.src)
+			if err := s.SetPredictor(tt.predictor, 16, btb); err != nil {
+				t.Fatal(err)
+			}
+			runUntilHalt(t, s, 1000)
+			s.FlushCaches()
+			if err := tt.check(s); err != nil {
+				t.Errorf("%s, btb %d: %v", tt.name, btb, err)
+			}
+			if total := s.CPU.Pipeline.Branch.Total(); total.Mispredicted == 0 {
+				t.Errorf("%s, btb %d: expected a misprediction, got %+v", tt.name, btb, total)
+			}
+		}
+	}
+}
@@ -2,15 +2,16 @@ package r8
 
 import (
 	"bytes"
-	"encoding/binary"
 	"fmt"
 	"io"
 	"math"
 	"math/bits"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 
+	"github.com/leon332157/risc-y-8/cmd/r8/assembler"
 	"github.com/leon332157/risc-y-8/cmd/r8/simulator"
 	"github.com/rs/zerolog"
 	"github.com/spf13/cobra"
@@ -34,16 +35,58 @@ var (
 		Short:   "Simulate with TUI RISC-Y-8 binary",
 		RunE:    runTui,
 		Args:    cobra.ExactArgs(1),
-		Example: "r8 tui input.bin",
+		Example: "r8 tui input.bin\nr8 tui --source-map input.json input.bin",
 	}
-	disableCache    bool
-	disablePipeline bool
-	NumInstructions = 0
+	disableCache     bool
+	splitCache       bool
+	icacheGeometry   string
+	dcacheGeometry   string
+	dataFirst        bool
+	l2Geometry       string
+	l3Geometry       string
+	inclusion        string
+	writePolicy      string
+	noWriteAllocate  bool
+	writeBuffer      uint
+	replacement      string
+	replacementSeed  int64
+	disablePipeline  bool
+	forwarding       bool
+	predictor        string
+	predictorEntries uint
+	btbEntries       uint
+	trapMisaligned   bool
+	interrupts       []string
+	imageFormat      string
+	sourceMapFile    string
+	sandboxDir       string
+	NumInstructions  = 0
 )
 
 func init() {
 	tuiCmd.Flags().BoolVar(&disableCache, "disable-cache", false, "Disable cache")
+	tuiCmd.Flags().BoolVar(&splitCache, "split-cache", false, "Split the cache into an instruction cache and a data cache sharing RAM")
+	tuiCmd.Flags().StringVar(&icacheGeometry, "icache", "8:2:4:1", "Geometry of the instruction cache with --split-cache as sets:ways:words[:delay]")
+	tuiCmd.Flags().StringVar(&dcacheGeometry, "dcache", "8:2:4:1", "Geometry of the data cache with --split-cache as sets:ways:words[:delay]")
+	tuiCmd.Flags().BoolVar(&dataFirst, "data-first", false, "With --split-cache a data access takes RAM from an instruction refill that has not completed")
+	tuiCmd.Flags().StringVar(&l2Geometry, "l2", "", "Add an L2 cache below the L1 as sets:ways:words[:delay]")
+	tuiCmd.Flags().StringVar(&l3Geometry, "l3", "", "Add an L3 cache below the L2 as sets:ways:words[:delay]")
+	tuiCmd.Flags().StringVar(&inclusion, "inclusion", "non-inclusive", "Inclusion policy of the L2 and L3 ("+strings.Join(memory.InclusionPolicies, ", ")+"), an exclusive level needs lines at least as long as the level above")
+	tuiCmd.Flags().StringVar(&writePolicy, "write-policy", "write-through", "Write policy of the data caches ("+strings.Join(memory.WritePolicies, ", ")+")")
+	tuiCmd.Flags().BoolVar(&noWriteAllocate, "no-write-allocate", false, "Write a store that misses around the data caches instead of allocating a line for it")
+	tuiCmd.Flags().UintVar(&writeBuffer, "write-buffer", 0, "Number of entries of the write buffer of the L1 data cache, 0 has none and stores wait for the level below")
+	tuiCmd.Flags().StringVar(&replacement, "replacement", "lru", "Replacement policy of the caches ("+strings.Join(memory.ReplacementPolicies, ", ")+")")
+	tuiCmd.Flags().Int64Var(&replacementSeed, "replacement-seed", 1, "Seed of the random and brrip replacement policies, the same seed replaces the same lines")
 	tuiCmd.Flags().BoolVar(&disablePipeline, "disable-pipeline", false, "Disable pipeline")
+	tuiCmd.Flags().BoolVar(&forwarding, "forwarding", false, "Forward results from execute and memory to dependent instructions instead of waiting for writeback")
+	tuiCmd.Flags().StringVar(&predictor, "predictor", "", "Predict branches with a branch predictor ("+strings.Join(cpu.Predictors, ", ")+"), without it taken branches redirect fetch in writeback")
+	tuiCmd.Flags().UintVar(&predictorEntries, "predictor-entries", 256, "Number of counters of the bimodal and gshare predictors")
+	tuiCmd.Flags().UintVar(&btbEntries, "btb", 0, "Number of entries of the branch target buffer, 0 has none and redirects fetch from decode")
+	tuiCmd.Flags().BoolVar(&trapMisaligned, "trap-misaligned", false, "Raise a misaligned access exception at a word access to an address that is not a multiple of 4 or a halfword access to an odd address instead of splitting it into byte accesses")
+	tuiCmd.Flags().StringSliceVar(&interrupts, "irq", nil, "Raise an external interrupt as cycle:line, line is 1 to 7, for example --irq 500:1")
+	tuiCmd.Flags().StringVarP(&imageFormat, "format", "f", "auto", "Input format (auto, "+strings.Join(assembler.Formats, ", ")+")")
+	tuiCmd.Flags().StringVar(&sourceMapFile, "source-map", "", "JSON source map written by assemble or link --source-map, shows the source of each stage")
+	tuiCmd.Flags().StringVar(&sandboxDir, "sandbox", "", "Directory the program may open files in with ecall, files are disabled without it")
 	rootCmd.AddCommand(tuiCmd)
 }
 
@@ -62,14 +105,46 @@ func runTui(cmd *cobra.Command, args []string) error {
 	if len(buffer) == 0 {
 		return fmt.Errorf("input file is empty: %v", err)
 	}
-	program := make([]uint32, len(buffer)/4)
-	NumInstructions = len(buffer) / 4
-	err = binary.Read(bytes.NewReader(buffer), binary.LittleEndian, &program)
+	program, err := assembler.ReadImage(buffer, imageFormat)
 	if err != nil {
 		return fmt.Errorf("failed to read input file: %v", err)
 	}
+	var info *assembler.DebugInfo
+	if sourceMapFile != "" {
+		sf, err := os.Open(sourceMapFile)
+		if err != nil {
+			return fmt.Errorf("failed to open source map: %v", err)
+		}
+		defer sf.Close()
+		if info, err = assembler.ReadDebugInfo(sf); err != nil {
+			return err
+		}
+	}
+	NumInstructions = len(program)
 	system := simulator.NewSystem(program, disableCache, disablePipeline)
-	model := initialModel(&system)
+	if err := configureCaches(system); err != nil {
+		return err
+	}
+	system.TrapMisaligned(trapMisaligned)
+	system.EnableForwarding(forwarding)
+	if err := system.SetPredictor(predictor, predictorEntries, btbEntries); err != nil {
+		return err
+	}
+	if err := scheduleInterrupts(system, interrupts); err != nil {
+		return err
+	}
+	if sandboxDir != "" {
+		if err := system.Host.Sandbox(sandboxDir); err != nil {
+			return err
+		}
+	}
+	defer system.Host.Close()
+	if info != nil {
+		system.CPU.Pipeline.Symbolize = func(addr uint32) string {
+			return symbolize(info, addr)
+		}
+	}
+	model := initialModel(system, info)
 	// model.system = &system
 	p := tea.NewProgram(model)
 	if _, err := p.Run(); err != nil {
@@ -87,9 +162,17 @@ type model struct {
 	ramViewport         viewport.Model
 	cacheViewport       viewport.Model
 	cacheHeaderViewport viewport.Model
+	shownCache          int // index in system.Caches() of the cache the cache view shows
+
+	info           *assembler.DebugInfo // source map, nil if none was given
+	sourceRows     []sourceRow
+	sourceViewport viewport.Model
+
+	consoleOut *bytes.Buffer // output of the console device and of ecall, which would garble the TUI on stdout
+	consoleIn  *bytes.Buffer // input given with the input command
 }
 
-func initialModel(s *simulator.System) model {
+func initialModel(s *simulator.System, info *assembler.DebugInfo) model {
 	ti := textinput.New()
 	ti.Placeholder = "type a command . . ."
 	ti.Focus()
@@ -107,21 +190,19 @@ func initialModel(s *simulator.System) model {
 	ramVPWidth := ramDataSize + ramLinesSize
 	ramVP := viewport.New(int(ramVPWidth), tableHeight)
 
-	offsetBits := bits.Len32(uint32(s.Cache.WordsPerLine)) - 1
-	indexBits := bits.Len32(uint32(s.Cache.Sets)) - 1
-	// memSize := s.RAM.SizeWords()
-	totalBits := 32
-
-	sizeTag := max(uint(totalBits-indexBits-int(offsetBits)), 3) + 2
-	sizeIndex := max(uint(indexBits), 3) + 1
-	sizeData := (s.Cache.WordsPerLine * 8) + (s.Cache.WordsPerLine - 1) + 2 + 1
-	sizeValid := uint(5 + 1)
-	sizeLRU := uint(max(math.Log2(float64(s.Cache.Ways)), 3)) + 1
-
-	cacheVPWidth := sizeTag + sizeIndex + sizeData + sizeValid + sizeLRU + 5
+	cacheVPWidth := uint(0)
+	for _, c := range s.Caches() {
+		cacheVPWidth = max(cacheVPWidth, cacheViewWidth(c.Cache))
+	}
 
 	cacheHeaderVP := viewport.New(int(cacheVPWidth), headerSize)
 	cacheVP := viewport.New(int(cacheVPWidth), tableHeight-headerSize)
+
+	consoleOut, consoleIn := new(bytes.Buffer), new(bytes.Buffer)
+	s.Console.Out = consoleOut
+	s.Console.In = consoleIn
+	s.Host.Stdout, s.Host.Stderr = consoleOut, consoleOut
+	s.Host.Stdin = consoleIn
 	return model{
 		instr:               ti,
 		lastInstr:           "",
@@ -129,9 +210,31 @@ func initialModel(s *simulator.System) model {
 		ramViewport:         ramVP,
 		cacheViewport:       cacheVP,
 		cacheHeaderViewport: cacheHeaderVP,
+		info:                info,
+		sourceRows:          getSourceRows(info),
+		sourceViewport:      viewport.New(sourceWidth, desiredHeight+6),
+		consoleOut:          consoleOut,
+		consoleIn:           consoleIn,
 	}
 }
 
+// Returns the width of the table of the lines of cache ca
+func cacheViewWidth(ca *memory.CacheType) uint {
+	offsetBits := bits.Len32(uint32(ca.WordsPerLine*4)) - 1 // line offsets are in bytes
+	indexBits := bits.Len32(uint32(ca.Sets)) - 1
+	// memSize := s.RAM.SizeWords()
+	totalBits := 32
+
+	sizeTag := max(uint(totalBits-indexBits-int(offsetBits)), 3) + 2
+	sizeIndex := max(uint(indexBits), 3) + 1
+	sizeData := (ca.WordsPerLine * 8) + (ca.WordsPerLine - 1) + 2 + 1
+	sizeValid := uint(5 + 1)
+	sizeMeta := uint(max(math.Log2(float64(ca.Ways)), float64(len(ca.Replacement.MetaName())), 5)) + 1
+	sizeDirty := uint(5 + 1)
+
+	return sizeTag + sizeIndex + sizeData + sizeValid + sizeMeta + sizeDirty + 6
+}
+
 func (m model) Init() tea.Cmd {
 	return nil
 }
@@ -139,7 +242,7 @@ func (m model) Init() tea.Cmd {
 func getCacheRows(ca *memory.CacheType) [][]string {
 	cRows := [][]string{}
 
-	offsetBits := bits.Len32(uint32(ca.WordsPerLine)) - 1
+	offsetBits := bits.Len32(uint32(ca.WordsPerLine*4)) - 1 // line offsets are in bytes
 	indexBits := bits.Len32(uint32(ca.Sets)) - 1
 	//memSize := ca.LowerLevel.SizeWords()
 	//totalBits := int(math.Log2(float64(memSize)))
@@ -150,6 +253,8 @@ func getCacheRows(ca *memory.CacheType) [][]string {
 	tagStr := fmt.Sprintf("%%0%db", sizeTag)
 	idxStr := fmt.Sprintf("%%0%db", sizeIndex)
 
+	metaWidth := len(ca.Replacement.MetaName()) // the metadata of the replacement policy lines up with its header
+
 	//waysSize := max(math.Log2(float64(ca.Ways)), 3)
 	//waysStr := fmt.Sprintf("%%%db", int(waysSize))
 
@@ -161,13 +266,18 @@ func getCacheRows(ca *memory.CacheType) [][]string {
 			if data.Valid {
 				validStr = validStr + strings.Repeat(" ", 1)
 			}
+			dirtyStr := "%t"
+			if data.Dirty {
+				dirtyStr = dirtyStr + strings.Repeat(" ", 1)
+			}
 
 			row := []string{
 				fmt.Sprintf(tagStr, data.Tag),
 				fmt.Sprintf(idxStr, i),
 				fmt.Sprintf("%08X", data.Data),
 				fmt.Sprintf(validStr, data.Valid),
-				fmt.Sprintf(" %d", data.LRU)}
+				fmt.Sprintf("%-*s", metaWidth, " "+ca.Replacement.Meta(ca.Contents[i], uint(i), j)),
+				fmt.Sprintf(dirtyStr, data.Dirty)}
 			cRows = append(cRows, row)
 		}
 	}
@@ -179,7 +289,7 @@ func getRAMRows(ram *memory.RAM) [][]string {
 	addr := 0
 	for i := range int(ram.NumLines) {
 		row := []string{}
-		row = append(row, fmt.Sprintf("0x%X", i*int(ram.WordsPerLine)))
+		row = append(row, fmt.Sprintf("0x%X", 4*i*int(ram.WordsPerLine)))
 		for range ram.WordsPerLine {
 			row = append(row, fmt.Sprintf("0x%08X", ram.Contents[addr]))
 			addr++
@@ -223,17 +333,51 @@ func getRegVals(control *cpu.CPU) [][]string {
 	return regVals
 }
 
+func getFloatRegVals(control *cpu.CPU) [][]string {
+	regVals := [][]string{}
+
+	for i := range len(control.FloatRegisters) {
+		var style = lipgloss.NewStyle()
+		if !control.FloatRegisters[i].ReadEnable {
+			style = style.Foreground(lipgloss.Color("#FF0000"))
+		} else {
+			style = style.Foreground(lipgloss.Color("#04B575"))
+		}
+		regVals = append(regVals, []string{style.Render(fmt.Sprintf("F%d", i+1)), fmt.Sprintf("%g", control.ReadFloatRNoBlock(uint8(i)))})
+	}
+	return regVals
+}
+
+func getVectorRegVals(control *cpu.CPU) [][]string {
+	regVals := [][]string{}
+
+	for i := range len(control.VectorRegisters) {
+		var style = lipgloss.NewStyle()
+		if !control.VectorRegisters[i].ReadEnable {
+			style = style.Foreground(lipgloss.Color("#FF0000"))
+		} else {
+			style = style.Foreground(lipgloss.Color("#04B575"))
+		}
+		lanes := control.ReadVectorRNoBlock(uint8(i))
+		regVals = append(regVals, []string{style.Render(fmt.Sprintf("V%d", i+1)), fmt.Sprintf("%08X %08X %08X %08X", lanes[0], lanes[1], lanes[2], lanes[3])})
+	}
+	return regVals
+}
+
 func (m *model) ExecuteCommand() {
 	args := strings.Split(m.lastInstr, " ")
 
 	switch args[0] {
 	case "step", "s", "next", "n":
-		if m.system.CPU.ProgramCounter >= uint32(NumInstructions)+6 {
+		if m.system.CPU.ProgramCounter >= 4*(uint32(NumInstructions)+6) {
 			m.system.CPU.Halted = true
 			Message = "Program finished"
 			return
 		}
 		m.system.RunOneClock(nil)
+		if fault := m.system.CPU.DescribeFault(); fault != "" {
+			Message = fault
+		}
 		/*if !m.system.CPU.Halted {
 			m.system.CPU.Pipeline.RunOneClock()
 		} else {
@@ -246,6 +390,9 @@ func (m *model) ExecuteCommand() {
 				m.system.RunToEndTUI(nil)
 				m.system.CPU.Halted = true
 				Message = "Program finished"
+				if fault := m.system.CPU.DescribeFault(); fault != "" {
+					Message = fault
+				}
 				return
 			}
 			cycles, err := strconv.Atoi(args[1])
@@ -255,13 +402,17 @@ func (m *model) ExecuteCommand() {
 			}
 			Message = fmt.Sprintf("Running for %d cycles", cycles)
 			for _ = range cycles {
-				if m.system.CPU.ProgramCounter >= uint32(NumInstructions)+6 {
+				if m.system.CPU.ProgramCounter >= 4*(uint32(NumInstructions)+6) {
 					m.system.CPU.Halted = true
 					Message = "Program finished"
 					return
 				}
+				if fault := m.system.CPU.DescribeFault(); fault != "" {
+					Message = fault
+					return
+				}
 				if !m.system.CPU.Halted {
-					m.system.CPU.Pipeline.RunOneClock()
+					m.system.RunOneClock(nil)
 				} else {
 					m.system.CPU.Halted = false
 				}
@@ -269,6 +420,34 @@ func (m *model) ExecuteCommand() {
 		} else {
 			Message = "Invalid command, please use 'run <cycles>' or run complete"
 		}
+	case "irq", "i":
+		if len(args) != 2 {
+			Message = "Invalid command, please use 'irq <line>'"
+			return
+		}
+		line, err := strconv.ParseUint(args[1], 0, 8)
+		if err != nil {
+			Message = fmt.Sprintf("Invalid interrupt line %v", err)
+			return
+		}
+		if err := m.system.Interrupt(uint(line)); err != nil {
+			Message = err.Error()
+			return
+		}
+		Message = fmt.Sprintf("Raised interrupt line %d", line)
+	case "cache", "c":
+		caches := m.system.Caches()
+		if len(caches) == 1 {
+			Message = "There is only one cache, start with --split-cache, --l2 or --l3"
+			return
+		}
+		m.shownCache = (m.shownCache + 1) % len(caches)
+		Message = "Showing the " + caches[m.shownCache].Name + " cache"
+	case "input":
+		// the rest of the line is queued for the console followed by a newline
+		text := strings.TrimPrefix(m.lastInstr, "input")
+		m.consoleIn.WriteString(strings.TrimPrefix(text, " ") + "\n")
+		Message = fmt.Sprintf("%d bytes of console input queued", m.consoleIn.Len())
 	}
 }
 
@@ -286,6 +465,8 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			m.ExecuteCommand()
 			m.ramViewport.SetContent(m.drawRAMTable())
 			m.cacheViewport.SetContent(m.drawCacheBodyTable())
+			m.cacheHeaderViewport.SetContent(m.drawCacheHeaderTable())
+			m.updateSource()
 			// Send instruction to be computed
 			//cache.Write(0x0, memory.FETCH_STAGE, 0xdeadbeef)
 			m.instr.Reset()
@@ -302,12 +483,17 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		case "k":
 			m.cacheViewport.ScrollUp(8)
 			m.instr.Reset()
+		case "pgdown":
+			m.sourceViewport.ScrollDown(8)
+		case "pgup":
+			m.sourceViewport.ScrollUp(8)
 		}
 	case tea.WindowSizeMsg:
 		// handle resize if needed
 		m.ramViewport.SetContent(m.drawRAMTable())
 		m.cacheViewport.SetContent(m.drawCacheBodyTable())
 		m.cacheHeaderViewport.SetContent(m.drawCacheHeaderTable())
+		m.updateSource()
 	}
 	var cmd tea.Cmd
 	m.instr, cmd = m.instr.Update(msg)
@@ -326,7 +512,11 @@ func (m model) View() string {
 	cmdLine := m.instr.View() + "\n"
 	whitespace := lipgloss.Place(3, 3, lipgloss.Right, lipgloss.Bottom, "")
 	SimAndCPU := lipgloss.JoinHorizontal(lipgloss.Center, clock, pc, whitespace, lastInstr, msg)
+	SimAndCPU = lipgloss.JoinVertical(lipgloss.Left, SimAndCPU, m.drawConsole())
 	pipelineAndCPU := lipgloss.JoinHorizontal(lipgloss.Top, pipeline, whitespace, SimAndCPU)
+	if m.info != nil {
+		pipelineAndCPU = lipgloss.JoinHorizontal(lipgloss.Top, pipelineAndCPU, whitespace, m.drawSource())
+	}
 	regsCol := lipgloss.JoinHorizontal(lipgloss.Left, registerView, whitespace, ram, whitespace, cache)
 	together := lipgloss.JoinVertical(lipgloss.Top, pipelineAndCPU, regsCol)
 	ui := lipgloss.JoinVertical(lipgloss.Left, together, cmdLine)
@@ -362,15 +552,39 @@ func (m model) drawRAMTable() string {
 	return ramTable.Render()
 }
 
+// Returns the cache the cache view shows
+func (m model) cache() *memory.CacheType {
+	return m.system.Caches()[m.shownCache].Cache
+}
+
+func (m model) cacheName() string {
+	caches := m.system.Caches()
+	if len(caches) == 1 {
+		return "Cache"
+	}
+	return caches[m.shownCache].Name + " Cache"
+}
+
+// Returns the name of the level below the cache the cache view shows
+func (m model) lowerName() string {
+	caches := m.system.Caches()
+	for _, c := range caches[m.shownCache+1:] {
+		if c.Cache != m.system.Cache { // the data cache of a split L1 is not below the instruction cache
+			return c.Name
+		}
+	}
+	return "RAM"
+}
+
 func (m model) getCacheSize() []uint {
 
-	offsetBits := bits.Len32(uint32(m.system.Cache.WordsPerLine)) - 1
-	indexBits := bits.Len32(uint32(m.system.Cache.Sets)) - 1
+	offsetBits := bits.Len32(uint32(m.cache().WordsPerLine*4)) - 1 // line offsets are in bytes
+	indexBits := bits.Len32(uint32(m.cache().Sets)) - 1
 	totalBits := 32
 
 	sizeTag := max(uint(totalBits-indexBits-int(offsetBits)), 3)
 	sizeIndex := max(uint(indexBits), 3)
-	sizeData := (m.system.Cache.WordsPerLine * 8) + (m.system.Cache.WordsPerLine - 1) + 2
+	sizeData := (m.cache().WordsPerLine * 8) + (m.cache().WordsPerLine - 1) + 2
 
 	return []uint{
 		sizeTag,
@@ -383,19 +597,27 @@ func (m model) drawCache() string {
 	headerStr := m.cacheHeaderViewport.View()
 	content := m.cacheViewport.View()
 	style := lipgloss.NewStyle()
-	title := "Cache"
+	name := m.cacheName()
+	title := name
 
-	if m.system.Cache.Requester() == memory.NONE {
-		title = "Cache - FREE"
+	if m.cache().Requester() == memory.NONE {
+		title = name + " - FREE"
 		style = style.Foreground(lipgloss.Color("#04B575"))
-	} else if m.system.Cache.MemoryRequestState.WaitNext {
-		title = "Cache - WAITING ON RAM"
+	} else if m.cache().MemoryRequestState.WaitNext {
+		title = name + " - WAITING ON " + m.lowerName()
 		style = style.Foreground(lipgloss.Color("#FFA500"))
 	} else {
-		title = "Cache - BUSY " + fmt.Sprintf("%d cycles left", m.system.Cache.CyclesLeft)
+		title = name + " - BUSY " + fmt.Sprintf("%d cycles left", m.cache().CyclesLeft)
 		style = style.Foreground(lipgloss.Color("#FF0000"))
 	}
 
+	if st := m.cache().Stats; st.Accesses() > 0 {
+		title += fmt.Sprintf(" - %.1f%% hits", st.HitRate()*100)
+	}
+	if b := m.cache().Buffer; b != nil {
+		title += fmt.Sprintf(" - write buffer %d/%d", b.Len(), b.Entries)
+	}
+
 	return lipgloss.JoinVertical(
 		lipgloss.Left,
 		style.Render(title),
@@ -405,8 +627,8 @@ func (m model) drawCache() string {
 }
 
 func (m model) drawCacheHeaderTable() string {
-	if m.system.Cache.Sets == 0 {
-		return "Cache Disabled"
+	if m.cache().Sets == 0 {
+		return m.cacheName() + " Disabled"
 	}
 	sizeInfo := m.getCacheSize()
 	tagSize := sizeInfo[0]
@@ -418,7 +640,7 @@ func (m model) drawCacheHeaderTable() string {
 	dataHeader := "Data" + strings.Repeat(" ", int(dataSize)-4)
 
 	header := table.New().
-		Headers(tagHeader, indexHeader, dataHeader, "Valid", "LRU").
+		Headers(tagHeader, indexHeader, dataHeader, "Valid", m.cache().Replacement.MetaName(), "Dirty").
 		Border(lipgloss.NormalBorder())
 
 	return header.Render()
@@ -427,7 +649,7 @@ func (m model) drawCacheHeaderTable() string {
 
 func (m model) drawCacheBodyTable() string {
 
-	rows := getCacheRows(m.system.Cache)
+	rows := getCacheRows(m.cache())
 
 	cacheTable := table.New().
 		Border(lipgloss.NormalBorder()).
@@ -450,11 +672,11 @@ func (m model) drawCacheBodyTable() string {
 
 func (m model) checkNewlines(instr string, height int, i int) int {
 
-	if strings.Count(m.system.CPU.Pipeline.Stages[i].FormatInstruction(), "\n") > height {
+	if strings.Count(instr, "\n") > height {
 		return 0
 	}
 
-	return height - strings.Count(m.system.CPU.Pipeline.Stages[i].FormatInstruction(), "\n")
+	return height - strings.Count(instr, "\n")
 
 }
 
@@ -464,7 +686,8 @@ func (m model) drawPipeline() string {
 	row := make([]string, 0)
 
 	for i := range m.system.CPU.Pipeline.Stages {
-		row = append(row, m.system.CPU.Pipeline.Stages[i].FormatInstruction()+strings.Repeat("\n", m.checkNewlines(m.system.CPU.Pipeline.Stages[i].FormatInstruction(), desiredHeight, i)))
+		instr := m.stageSource(i) + m.system.CPU.Pipeline.Stages[i].FormatInstruction()
+		row = append(row, instr+strings.Repeat("\n", m.checkNewlines(instr, desiredHeight, i)))
 	}
 
 	// TODO: show stage result in row?? SUCCESS, STALL, FAILURE, NOOP, etc.
@@ -487,9 +710,27 @@ func (m model) drawRegisters() string {
 		Border(lipgloss.NormalBorder()).
 		Rows(rows...)
 
-	return lipgloss.NewStyle().
-		BorderForeground(lipgloss.Color("207")).
-		Render("IntRegisters\n" + regTable.Render() + "\n")
+	floatTable := table.New().
+		Border(lipgloss.NormalBorder()).
+		Rows(getFloatRegVals(m.system.CPU)...)
+
+	vectorTable := table.New().
+		Border(lipgloss.NormalBorder()).
+		Rows(getVectorRegVals(m.system.CPU)...)
+
+	whitespace := lipgloss.Place(1, 1, lipgloss.Right, lipgloss.Bottom, "")
+	return lipgloss.JoinHorizontal(lipgloss.Top,
+		lipgloss.NewStyle().
+			BorderForeground(lipgloss.Color("207")).
+			Render("IntRegisters\n"+regTable.Render()+"\n"),
+		whitespace,
+		lipgloss.JoinVertical(lipgloss.Left,
+			lipgloss.NewStyle().
+				BorderForeground(lipgloss.Color("207")).
+				Render("FloatRegisters\n"+floatTable.Render()+"\n"),
+			lipgloss.NewStyle().
+				BorderForeground(lipgloss.Color("207")).
+				Render("VectorRegisters\n"+vectorTable.Render()+"\n")))
 }
 
 func (m model) drawLastInstruction() string {
@@ -525,9 +766,36 @@ func (m *model) drawMsg() string {
 		Render(msgTable.Render())
 }
 
+// consoleLines is how many of the last lines of console output are shown
+const consoleLines = 3
+
+func (m model) drawConsole() string {
+	lines := strings.Split(m.consoleOut.String(), "\n")
+	lines = lines[max(len(lines)-consoleLines, 0):]
+	for len(lines) < consoleLines {
+		lines = append(lines, "")
+	}
+	header := "Console"
+	if m.system.Exit.Exited {
+		header = fmt.Sprintf("Console - exited with code %d", int32(m.system.Exit.Code))
+	}
+
+	consoleTable := table.New().
+		Border(lipgloss.NormalBorder()).
+		Headers(header).
+		Rows([]string{strings.Join(lines, "\n")})
+
+	return consoleTable.Render()
+}
+
 func (m model) drawClock() string {
-	header := []string{"Clock"}
-	row := []string{fmt.Sprintf("%d", m.system.CPU.Clock)}
+	header := []string{"Clock", "Retired", "CPI"}
+	row := []string{fmt.Sprintf("%d", m.system.CPU.Clock), fmt.Sprintf("%d", m.system.CPU.Retired), fmt.Sprintf("%.2f", m.system.CPI())}
+	if u := m.system.CPU.Pipeline.Branch; u != nil {
+		total := u.Total()
+		header = append(header, "Mispredicted", "Accuracy")
+		row = append(row, fmt.Sprintf("%d/%d", total.Mispredicted, total.Executed), fmt.Sprintf("%.1f%%", total.Accuracy()*100))
+	}
 
 	clockTable := table.New().
 		Border(lipgloss.NormalBorder()).
@@ -542,8 +810,8 @@ func (m model) drawClock() string {
 
 func (m model) drawPC() string {
 
-	header := []string{"PC", "Total"}
-	row := []string{fmt.Sprintf("%d", m.system.CPU.ProgramCounter), fmt.Sprintf("%d", NumInstructions)}
+	header := []string{"PC", "Total", "EPC", "Cause", "IPend"}
+	row := []string{fmt.Sprintf("%d", m.system.CPU.ProgramCounter), fmt.Sprintf("%d", NumInstructions), fmt.Sprintf("%d", m.system.CPU.EPC), fmt.Sprintf("%d", m.system.CPU.Cause), fmt.Sprintf("%02x", m.system.CPU.IPend)}
 
 	clockTable := table.New().
 		Border(lipgloss.NormalBorder()).
@@ -554,3 +822,122 @@ func (m model) drawPC() string {
 		BorderForeground(lipgloss.Color("207")).
 		Render(clockTable.Render())
 }
+
+// Width of the source pane and of the source text in a pipeline stage
+const (
+	sourceWidth      = 60
+	stageSourceWidth = 18
+)
+
+// A line of the source pane, either a label or a source line assembled to the words
+// from start to end
+type sourceRow struct {
+	start, end uint32
+	label      bool
+	text       string
+}
+
+// Rows of the source pane in address order, consecutive words from the same source line
+// share a row
+func getSourceRows(info *assembler.DebugInfo) []sourceRow {
+	if info == nil {
+		return nil
+	}
+	rows := []sourceRow{}
+	var prev assembler.LineInfo
+	for _, line := range info.Lines {
+		last := len(rows) - 1
+		if last >= 0 && !rows[last].label && line.Addr == rows[last].end && line.File == prev.File && line.Line == prev.Line {
+			rows[last].end += 4
+			continue
+		}
+		for _, name := range info.LabelsAt(line.Addr) {
+			if strings.HasPrefix(strings.ToLower(strings.TrimSpace(line.Text)), name+":") {
+				continue // defined on the line itself
+			}
+			rows = append(rows, sourceRow{start: line.Addr, end: line.Addr, label: true, text: name + ":"})
+		}
+		loc := fmt.Sprintf("%s:%d", filepath.Base(line.File), line.Line)
+		text := strings.ReplaceAll(strings.TrimSpace(line.Text), "\t", " ")
+		rows = append(rows, sourceRow{start: line.Addr, end: line.Addr + 4, text: fmt.Sprintf("%04x  %-12s  %s", line.Addr, loc, text)})
+		prev = line
+	}
+	return rows
+}
+
+// Name an address after the closest label before it
+func symbolize(info *assembler.DebugInfo, addr uint32) string {
+	name, off, ok := info.LabelBefore(addr)
+	switch {
+	case !ok:
+		return fmt.Sprintf("%x", addr)
+	case off == 0:
+		return fmt.Sprintf("%s (%x)", name, addr)
+	}
+	return fmt.Sprintf("%s+%d (%x)", name, off, addr)
+}
+
+// Source line of the instruction in pipeline stage i, the fetch stage shows the line
+// at the program counter while it is fetching
+func (m model) stageSource(i int) string {
+	if m.info == nil {
+		return ""
+	}
+	addr := m.system.CPU.ProgramCounter
+	if inst := m.system.CPU.Pipeline.StageInstruction(i); inst != nil {
+		addr = inst.PC
+	} else if _, ok := m.system.CPU.Pipeline.Stages[i].(*cpu.FetchStage); !ok {
+		return ""
+	}
+	line, ok := m.info.LineAt(addr)
+	if !ok {
+		return ""
+	}
+	text := strings.Join(strings.Fields(line.Text), " ")
+	if len(text) > stageSourceWidth {
+		text = text[:stageSourceWidth-1] + "~"
+	}
+	style := lipgloss.NewStyle().Foreground(lipgloss.Color("#CC6CE7"))
+	return style.Render(fmt.Sprintf("%s:%d", filepath.Base(line.File), line.Line)) + "\n" + style.Render(text) + "\n"
+}
+
+// Redraw the source pane with the line at the program counter highlighted and in view
+func (m *model) updateSource() {
+	if m.info == nil {
+		return
+	}
+	pc := m.system.CPU.ProgramCounter
+	current := -1
+	lines := make([]string, len(m.sourceRows))
+	for i, row := range m.sourceRows {
+		text := row.text
+		if len(text) > sourceWidth {
+			text = text[:sourceWidth]
+		}
+		switch {
+		case row.label:
+			lines[i] = lipgloss.NewStyle().Foreground(lipgloss.Color("#04B575")).Render(text)
+		case pc >= row.start && pc < row.end:
+			lines[i] = lipgloss.NewStyle().Reverse(true).Render(text)
+			current = i
+		default:
+			lines[i] = text
+		}
+	}
+	m.sourceViewport.SetContent(strings.Join(lines, "\n"))
+	if current >= 0 {
+		m.sourceViewport.SetYOffset(current - m.sourceViewport.Height/2)
+	}
+}
+
+func (m model) drawSource() string {
+	title := "Source"
+	if line, ok := m.info.LineAt(m.system.CPU.ProgramCounter); ok {
+		title += " - fetching " + line.Location()
+	}
+	return lipgloss.JoinVertical(
+		lipgloss.Left,
+		title,
+		lipgloss.NewStyle().Border(lipgloss.NormalBorder()).Render(m.sourceViewport.View()),
+	)
+}
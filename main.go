@@ -1,9 +1,13 @@
 package main
 
 import (
+	"os"
+
 	"github.com/leon332157/risc-y-8/cmd/r8"
 )
 
 func main() {
-	r8.Execute()
+	if err := r8.Execute(); err != nil {
+		os.Exit(1)
+	}
 }
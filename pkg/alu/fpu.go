@@ -0,0 +1,76 @@
+package alu
+
+import (
+	"math"
+)
+
+// Single precision floating point unit, it shares the flag register of the integer ALU
+// so that fcmp can be followed by the usual conditional branches
+type FPU struct {
+	ALU *ALU
+}
+
+func NewFPU(alu *ALU) *FPU {
+	return &FPU{ALU: alu}
+}
+
+func (fpu *FPU) Add(a, b float32) float32 {
+	return a + b
+}
+
+func (fpu *FPU) Sub(a, b float32) float32 {
+	return a - b
+}
+
+func (fpu *FPU) Mul(a, b float32) float32 {
+	return a * b
+}
+
+// Division by zero gives an infinity or NaN as in IEEE 754
+func (fpu *FPU) Div(a, b float32) float32 {
+	return a / b
+}
+
+func (fpu *FPU) Sqrt(a float32) float32 {
+	return float32(math.Sqrt(float64(a)))
+}
+
+func (fpu *FPU) Min(a, b float32) float32 {
+	return float32(math.Min(float64(a), float64(b)))
+}
+
+func (fpu *FPU) Max(a, b float32) float32 {
+	return float32(math.Max(float64(a), float64(b)))
+}
+
+// Compare a with b. Equal sets ZF, less sets CF and SF so both beq/blu/ba/bae and
+// blt/bge work, unordered (either is NaN) sets only OVF
+func (fpu *FPU) Cmp(a, b float32) {
+	fpu.ALU.ResetFlags()
+	switch {
+	case math.IsNaN(float64(a)) || math.IsNaN(float64(b)):
+		fpu.ALU.SetFlag(OVF)
+	case a == b:
+		fpu.ALU.SetFlag(ZF)
+	case a < b:
+		fpu.ALU.SetFlag(CF | SF)
+	}
+}
+
+// Convert a signed integer to float
+func (fpu *FPU) FromInt(v uint32) float32 {
+	return float32(int32(v))
+}
+
+// Convert to a signed integer truncated towards zero, out of range values saturate and NaN is 0
+func (fpu *FPU) ToInt(a float32) uint32 {
+	switch {
+	case math.IsNaN(float64(a)):
+		return 0
+	case a >= math.MaxInt32:
+		return math.MaxInt32
+	case a <= math.MinInt32:
+		return 1 << 31
+	}
+	return uint32(int32(a))
+}
@@ -0,0 +1,47 @@
+package alu
+
+// Four lane integer vector unit, every lane is a 32 bit integer that wraps around
+// like the integer ALU. The vector unit does not change the flags
+type VPU struct{}
+
+type Vector = [4]uint32
+
+func NewVPU() *VPU {
+	return &VPU{}
+}
+
+func (vpu *VPU) Add(a, b Vector) Vector {
+	for i := range a {
+		a[i] += b[i]
+	}
+	return a
+}
+
+func (vpu *VPU) Sub(a, b Vector) Vector {
+	for i := range a {
+		a[i] -= b[i]
+	}
+	return a
+}
+
+// Lane-wise product, each lane keeps the low 32 bits
+func (vpu *VPU) Mul(a, b Vector) Vector {
+	for i := range a {
+		a[i] *= b[i]
+	}
+	return a
+}
+
+// Sum of the lane-wise products, the low 32 bits
+func (vpu *VPU) Dot(a, b Vector) uint32 {
+	var sum uint32
+	for i := range a {
+		sum += a[i] * b[i]
+	}
+	return sum
+}
+
+// Vector with v in every lane
+func (vpu *VPU) Broadcast(v uint32) Vector {
+	return Vector{v, v, v, v}
+}
@@ -11,8 +11,8 @@ import (
 
 const (
 	INT_REG_COUNT    = 32
-	FLOAT_REG_COUNT  = 16
-	VECTOR_REG_COUNT = 8
+	FLOAT_REG_COUNT  = 8 // f1-f8
+	VECTOR_REG_COUNT = 8 // v1-v8
 )
 
 const (
@@ -38,21 +38,79 @@ type VectorRegister struct {
 	WriteEnable bool      // Write enable flag
 }
 
+// Memory is byte addressed and little endian, every address the cpu computes, the program
+// counter included, is a byte address. Instructions are words at multiples of 4.
+//
+// What the memory stage does with a word or halfword access at an address that is not a
+// multiple of its size, such as ldw from 0x102 or ldh from 0x101. Vector loads and stores are
+// aligned to their size by execute, and a branch to or fetch from an address that is not a
+// multiple of 4 always raises EXC_MISALIGNED
+type AlignPolicy int
+
+const (
+	ALIGN_SPLIT AlignPolicy = iota // split the access into byte accesses, one per clock
+	ALIGN_TRAP                     // raise EXC_MISALIGNED
+)
+
+// Returns the size of the address space in bytes, which addresses wrap around at
+func (c *CPU) addressSpace() uint {
+	if c.Bus != nil {
+		return c.Bus.SizeBytes()
+	}
+	return c.RAM.SizeBytes()
+}
+
+// Returns true if byte address addr is in RAM or a device
+func (c *CPU) mapped(addr uint) bool {
+	if c.Bus != nil {
+		return c.Bus.Mapped(addr)
+	}
+	return addr < c.RAM.SizeBytes()
+}
+
+// Returns the cache fetch reads, the instruction cache of a split L1 or the unified cache
+func (c *CPU) fetchCache() *memory.CacheType {
+	if c.ICache != nil {
+		return c.ICache
+	}
+	return c.Cache
+}
+
 type CPU struct {
 	Clock          uint32
+	Retired        uint32 // instructions that completed writeback, Clock / Retired is the CPI
 	ProgramCounter uint32
 	Halted         bool
 	ALU            *alu.ALU
-	//FPU            *FPU
-	//VPU            *VPU
-	Cache        *memory.CacheType
-	RAM          *memory.RAM // Reference to RAM, if needed for direct access (optional)
-	Pipeline     *Pipeline
-	IntRegisters [INT_REG_COUNT]IntRegister
-
-	//FloatRegisters  []FloatRegister
-	//VectorRegisters []VectorRegister
-	log *zerolog.Logger
+	FPU            *alu.FPU
+	VPU            *alu.VPU
+	Cache          *memory.CacheType
+	ICache         *memory.CacheType // instruction cache of a split L1, nil if fetch reads Cache
+	RAM            *memory.RAM // Reference to RAM, if needed for direct access (optional)
+	Bus            *memory.Bus // RAM and the devices above it, nil if the cache reads RAM directly
+	Pipeline       *Pipeline
+	Alignment      AlignPolicy
+	IntRegisters   [INT_REG_COUNT]IntRegister
+
+	// special registers, see ExceptionCause
+	EPC    uint32
+	Cause  ExceptionCause
+	TVal   uint32
+	TVec   uint32
+	EFlags uint32
+	Fault  ExceptionCause // exception that halted the cpu as no trap vector table was set
+
+	// interrupt controller and timer, see IRQ_TIMER
+	Status uint32
+	IMask  uint32
+	IPend  uint32
+	Timer  Timer
+
+	Syscall SyscallHandler // services ecall, nil makes ecall raise EXC_ECALL
+
+	FloatRegisters  [FLOAT_REG_COUNT]FloatRegister
+	VectorRegisters [VECTOR_REG_COUNT]VectorRegister
+	log             *zerolog.Logger
 }
 
 func (cpu *CPU) blockIntR(r uint8) {
@@ -135,19 +193,120 @@ func (c *CPU) WriteIntR(r uint8, value uint32) (v uint32, status int32) {
 	return c.IntRegisters[r].value, SUCCESS
 }
 
+func (cpu *CPU) blockFloatR(r uint8) {
+	if r >= uint8(len(cpu.FloatRegisters)) {
+		cpu.log.Panic().Msgf("attempted to block an out of bounds float register: %v", r)
+	}
+	cpu.log.Trace().Msgf("Blocking register f%v for reading and writing", r+1)
+	cpu.FloatRegisters[r].ReadEnable = false
+	cpu.FloatRegisters[r].WriteEnable = false
+}
+
+func (cpu *CPU) unblockFloatR(r uint8) {
+	if r >= uint8(len(cpu.FloatRegisters)) {
+		cpu.log.Panic().Msgf("attempted to unblock an out of bounds float register: %v", r)
+	}
+	cpu.log.Trace().Msgf("Unblocking register f%v for reading and writing", r+1)
+	cpu.FloatRegisters[r].ReadEnable = true
+	cpu.FloatRegisters[r].WriteEnable = true
+}
+
+func (c *CPU) ReadFloatR(r uint8) (v float32, status int32) {
+	if r >= uint8(len(c.FloatRegisters)) {
+		c.log.Panic().Msgf("attempted to read an out of bounds float register: %v", r)
+	}
+	if !c.FloatRegisters[r].ReadEnable {
+		return 0, READ_BLOCKED
+	}
+	return c.FloatRegisters[r].value, SUCCESS
+}
+
+func (c *CPU) ReadFloatRNoBlock(r uint8) float32 {
+	if r >= uint8(len(c.FloatRegisters)) {
+		c.log.Panic().Msgf("attempted to read an out of bounds float register: %v", r)
+	}
+	return c.FloatRegisters[r].value
+}
+
+func (c *CPU) WriteFloatR(r uint8, value float32) (v float32, status int32) {
+	if r >= uint8(len(c.FloatRegisters)) {
+		c.log.Panic().Msgf("attempted to write an out of bounds float register: %v", r)
+	}
+	if !c.FloatRegisters[r].WriteEnable {
+		return 0, WRITE_BLOCKED
+	}
+	c.FloatRegisters[r].value = value
+	return c.FloatRegisters[r].value, SUCCESS
+}
+
+func (cpu *CPU) blockVectorR(r uint8) {
+	if r >= uint8(len(cpu.VectorRegisters)) {
+		cpu.log.Panic().Msgf("attempted to block an out of bounds vector register: %v", r)
+	}
+	cpu.log.Trace().Msgf("Blocking register v%v for reading and writing", r+1)
+	cpu.VectorRegisters[r].ReadEnable = false
+	cpu.VectorRegisters[r].WriteEnable = false
+}
+
+func (cpu *CPU) unblockVectorR(r uint8) {
+	if r >= uint8(len(cpu.VectorRegisters)) {
+		cpu.log.Panic().Msgf("attempted to unblock an out of bounds vector register: %v", r)
+	}
+	cpu.log.Trace().Msgf("Unblocking register v%v for reading and writing", r+1)
+	cpu.VectorRegisters[r].ReadEnable = true
+	cpu.VectorRegisters[r].WriteEnable = true
+}
+
+func (c *CPU) ReadVectorR(r uint8) (v [4]uint32, status int32) {
+	if r >= uint8(len(c.VectorRegisters)) {
+		c.log.Panic().Msgf("attempted to read an out of bounds vector register: %v", r)
+	}
+	if !c.VectorRegisters[r].ReadEnable {
+		return v, READ_BLOCKED
+	}
+	return c.VectorRegisters[r].value, SUCCESS
+}
+
+func (c *CPU) ReadVectorRNoBlock(r uint8) [4]uint32 {
+	if r >= uint8(len(c.VectorRegisters)) {
+		c.log.Panic().Msgf("attempted to read an out of bounds vector register: %v", r)
+	}
+	return c.VectorRegisters[r].value
+}
+
+func (c *CPU) WriteVectorR(r uint8, value [4]uint32) (v [4]uint32, status int32) {
+	if r >= uint8(len(c.VectorRegisters)) {
+		c.log.Panic().Msgf("attempted to write an out of bounds vector register: %v", r)
+	}
+	if !c.VectorRegisters[r].WriteEnable {
+		return v, WRITE_BLOCKED
+	}
+	c.VectorRegisters[r].value = value
+	return c.VectorRegisters[r].value, SUCCESS
+}
+
 func (cpu *CPU) Init(cache *memory.CacheType, ram *memory.RAM, p *Pipeline, logger *zerolog.Logger) {
 	cpu.Clock = 0
+	cpu.Retired = 0
 	cpu.ProgramCounter = INIT_VECTOR
 	cpu.ALU = alu.NewALU() // Create a new ALU instance
 	cpu.Pipeline = p       // Set the pipeline reference
 	cpu.Cache = cache
 	cpu.RAM = ram
+	cpu.FPU = alu.NewFPU(cpu.ALU) // shares the flags of the ALU
+	cpu.VPU = alu.NewVPU()
 	for i := 0; i < INT_REG_COUNT; i++ {
 		reg := &cpu.IntRegisters[i] // Get the pointer to the integer register
 		reg.value = 0               // Initialize all integer registers to 0
 		reg.ReadEnable = true       // Allow reading by default
 		reg.WriteEnable = true      // Allow writing by default
 	}
+	for i := range cpu.FloatRegisters {
+		cpu.FloatRegisters[i] = FloatRegister{ReadEnable: true, WriteEnable: true}
+	}
+	for i := range cpu.VectorRegisters {
+		cpu.VectorRegisters[i] = VectorRegister{ReadEnable: true, WriteEnable: true}
+	}
 	if logger == nil {
 		log, err := os.OpenFile("cpu.log", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
 		if err != nil {
@@ -173,6 +332,23 @@ func (cpu *CPU) PrintReg() {
 	fmt.Println()
 }
 
+func (cpu *CPU) PrintFloatReg() {
+	for i, reg := range cpu.FloatRegisters {
+		fmt.Printf("f%d: %g\t", i+1, reg.value)
+	}
+	fmt.Println()
+}
+
+func (cpu *CPU) PrintVectorReg() {
+	for i, reg := range cpu.VectorRegisters {
+		if i%4 == 0 && i != 0 {
+			fmt.Println()
+		}
+		fmt.Printf("v%d: %08x\t", i+1, reg.value)
+	}
+	fmt.Println()
+}
+
 func (cpu *CPU) Halt() {
 	cpu.Halted = true
 	cpu.log.Info().Msg("CPU halted")
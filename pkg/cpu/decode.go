@@ -2,6 +2,7 @@ package cpu
 
 import (
 	"fmt"
+	"math"
 
 	"github.com/leon332157/risc-y-8/pkg/types"
 )
@@ -85,9 +86,47 @@ func (d *DecodeStage) Execute() {
 		d.instStr = "<bubble>"
 		return
 	}
+	if d.state < DEC_base_decoded && d.currInst.Exception != EXC_NONE {
+		// fetch raised the exception, there is no instruction to decode, as for an illegal one
+		d.pipe.sTracef(d, "Fetch raised %s", LookUpException(d.currInst.Exception))
+		d.currInst.BaseInstruction = new(types.BaseInstruction)
+		d.instStr = fmt.Sprintf("pc: 0x%x\n%s", d.currInst.PC, LookUpException(d.currInst.Exception))
+		d.state = DEC_decoded
+		return
+	}
 	if d.state < DEC_base_decoded {
-		d.currInst.BaseInstruction = new(types.BaseInstruction)      // Create a new BaseInstruction to decode the instruction
-		d.currInst.BaseInstruction.Decode(d.currInst.rawInstruction) // Decode the raw instruction into a BaseInstruction
+		raw := d.currInst.rawInstruction
+		valid := true
+		switch types.DataType(raw & 0b11) {
+		case types.Float:
+			d.currInst.FloatInstruction = new(types.FloatInstruction)
+			if valid = d.currInst.FloatInstruction.Decode(raw); valid {
+				d.currInst.BaseInstruction = floatBase(d.currInst.FloatInstruction)
+			}
+		case types.Vector:
+			d.currInst.VectorInstruction = new(types.VectorInstruction)
+			if valid = d.currInst.VectorInstruction.Decode(raw); valid {
+				d.currInst.BaseInstruction = vectorBase(d.currInst.VectorInstruction)
+			}
+		case types.SubWord:
+			d.currInst.SubWordInstruction = new(types.SubWordInstruction)
+			if valid = d.currInst.SubWordInstruction.Decode(raw); valid {
+				d.currInst.BaseInstruction = subWordBase(d.currInst.SubWordInstruction)
+			}
+		default:
+			d.currInst.BaseInstruction = new(types.BaseInstruction) // Create a new BaseInstruction to decode the instruction
+			valid = d.currInst.BaseInstruction.Decode(raw)          // Decode the raw instruction into a BaseInstruction
+		}
+		if !valid {
+			// an illegal instruction reads and blocks no registers, it only carries its exception to writeback
+			d.pipe.sTracef(d, "Illegal instruction 0x%08x", raw)
+			d.currInst.FloatInstruction, d.currInst.VectorInstruction, d.currInst.SubWordInstruction = nil, nil, nil
+			d.currInst.BaseInstruction = new(types.BaseInstruction)
+			d.currInst.raise(EXC_ILLEGAL_INSTRUCTION, raw)
+			d.instStr = fmt.Sprintf("raw: 0x%08x\nillegal instruction", raw)
+			d.state = DEC_decoded
+			return
+		}
 		d.state = DEC_base_decoded
 	} else {
 		d.pipe.sTrace(d, "Already decoded base instruction, skipping decode")
@@ -108,10 +147,18 @@ func (d *DecodeStage) Execute() {
 		d.pipe.sTracef(d, "Already decoded instruction, skipping decode")
 		return
 	}
+	if d.currInst.FloatInstruction != nil {
+		d.decodeFloat()
+		return
+	}
+	if d.currInst.VectorInstruction != nil {
+		d.decodeVector()
+		return
+	}
 	switch baseInstruction.OpType {
 	case types.RegImm:
 
-		v, st := d.pipe.cpu.ReadIntR(baseInstruction.Rd)
+		v, st := d.readIntR(baseInstruction.Rd)
 		if st != SUCCESS {
 			d.pipe.sTracef(d, "Failed to read register r%v %v", baseInstruction.Rd, st)
 			d.state = DEC_reg_read
@@ -124,13 +171,13 @@ func (d *DecodeStage) Execute() {
 
 	case types.RegReg:
 
-		rdv, st := d.pipe.cpu.ReadIntR(baseInstruction.Rd)
+		rdv, st := d.readIntR(baseInstruction.Rd)
 		if st != SUCCESS {
 			d.pipe.sTracef(d, "Failed to read dest register r%v %v", baseInstruction.Rs, st)
 			d.state = DEC_reg_read
 			return
 		}
-		rsv, st := d.pipe.cpu.ReadIntR(baseInstruction.Rs)
+		rsv, st := d.readIntR(baseInstruction.Rs)
 		if st != SUCCESS {
 			d.pipe.sTracef(d, "Failed to read source register r%v %v", baseInstruction.Rs, st)
 			d.state = DEC_reg_read
@@ -143,12 +190,11 @@ func (d *DecodeStage) Execute() {
 
 	case types.Control:
 
-		if baseInstruction.RMem == 0 && baseInstruction.Imm == -1 {
-			d.pipe.log.Error().Msg("[DecodeStage Execute] Bruh, why are branching to -1? Are you trying to halt?")
-			d.pipe.cpu.Halt()
-			return
+		if d.currInst.IsHalt() {
+			// halt is only taken when it reaches writeback, an older branch may still squash it
+			d.pipe.sTrace(d, "Decoded halt instruction")
 		}
-		rmemv, st := d.pipe.cpu.ReadIntR(baseInstruction.RMem)
+		rmemv, st := d.readIntR(baseInstruction.RMem)
 		if st != SUCCESS {
 			d.pipe.sTracef(d, "Failed to read control instruction memory source r%v %v", baseInstruction.RMem, st)
 			d.state = DEC_reg_read
@@ -156,9 +202,14 @@ func (d *DecodeStage) Execute() {
 		}
 		d.currInst.DestMemAddr = rmemv
 		if baseInstruction.RMem == 0 {
-			d.currInst.DestMemAddr = d.pipe.cpu.ProgramCounter // use PC as destination address if RMem is 0
+			d.currInst.DestMemAddr = d.currInst.PC + 4 // use the address of the next instruction as base if RMem is 0
 		}
 		d.currInst.Operand = signExtend(baseInstruction.Imm) // sign extend immediate value
+		if combineFlags(baseInstruction.CtrlMode, baseInstruction.CtrlFlag) == types.GetModeFlag(types.CALL) {
+			// instructions at the target may run before the call writes the return address
+			d.currInst.RDestAux = types.IntegerRegisters["lr"]
+			d.pipe.cpu.blockIntR(d.currInst.RDestAux)
+		}
 		d.state = DEC_decoded
 
 	case types.LoadStore:
@@ -170,7 +221,7 @@ func (d *DecodeStage) Execute() {
 			d.pipe.sTracef(d, "PUSH/POP instruction detected, setting RMem to SP (r%v)", SP)
 		}
 		// set memory source to be stack pointer so squash can work properlyq
-		rmemv, st := d.pipe.cpu.ReadIntR(baseInstruction.RMem) // rmemv should be zero for push pop
+		rmemv, st := d.readIntR(baseInstruction.RMem) // rmemv should be zero for push pop
 		if st != SUCCESS {
 			d.pipe.sTracef(d, "Failed to read load/store instruction memory source r%v %v", baseInstruction.RMem, st)
 			d.state = DEC_reg_read
@@ -181,7 +232,7 @@ func (d *DecodeStage) Execute() {
 
 		d.currInst.Operand = signExtend(d.currInst.BaseInstruction.Imm)
 
-		v, st := d.pipe.cpu.ReadIntR(baseInstruction.Rd)
+		v, st := d.readIntR(baseInstruction.Rd)
 		if st != SUCCESS {
 			d.pipe.sTracef(d, "Failed to read load/store instruction destination register r%v %v", baseInstruction.Rd, st)
 			d.state = DEC_reg_read
@@ -193,6 +244,7 @@ func (d *DecodeStage) Execute() {
 		d.state = DEC_decoded
 	}
 	d.pipe.sTracef(d, "Decoded filled instruction: %+v %+v\n", d.currInst, *d.currInst.BaseInstruction)
+	d.predict()
 	//go func() {
 	switch baseInstruction.OpType {
 	case types.RegReg:
@@ -213,6 +265,153 @@ func (d *DecodeStage) Execute() {
 	//}()
 }
 
+// Read the registers of a float instruction, Result holds the bits of the destination or of
+// the value stored by fstw and Operand the bits of the source
+func (d *DecodeStage) decodeFloat() {
+	inst := d.currInst
+	f := inst.FloatInstruction
+	cpu := d.pipe.cpu
+	readFloat := func(r uint8) (uint32, bool) {
+		v, st := cpu.ReadFloatR(r)
+		if st != SUCCESS {
+			d.pipe.sTracef(d, "Failed to read float register f%v %v", r+1, st)
+			d.state = DEC_reg_read
+			return 0, false
+		}
+		return math.Float32bits(v), true
+	}
+	switch f.OpType {
+	case types.RegReg:
+		if types.FloatReadsInt(f.FPU) {
+			v, st := d.readIntR(f.Fs)
+			if st != SUCCESS {
+				d.pipe.sTracef(d, "Failed to read source register r%v %v", f.Fs, st)
+				d.state = DEC_reg_read
+				return
+			}
+			inst.Operand = v
+		} else {
+			v, ok := readFloat(f.Fs)
+			if !ok {
+				return
+			}
+			inst.Operand = v
+		}
+		if !types.FloatUnary(f.FPU) {
+			v, ok := readFloat(f.Fd)
+			if !ok {
+				return
+			}
+			inst.Result = v
+		}
+		if types.FloatWritesInt(f.FPU) {
+			cpu.blockIntR(f.Fd)
+		} else if f.FPU != types.FPU_CMP {
+			cpu.blockFloatR(f.Fd)
+		}
+		d.instStr += fmt.Sprintf("FPU: %s\nFd: %x\nFs: %x\n", types.FloatALUInverse[f.FPU], f.Fd, f.Fs)
+
+	case types.LoadStore:
+		rmemv, st := d.readIntR(f.RMem)
+		if st != SUCCESS {
+			d.pipe.sTracef(d, "Failed to read float load/store memory source r%v %v", f.RMem, st)
+			d.state = DEC_reg_read
+			return
+		}
+		if f.MemMode == types.STW {
+			v, ok := readFloat(f.Fd)
+			if !ok {
+				return
+			}
+			inst.Result = v
+		} else {
+			cpu.blockFloatR(f.Fd)
+		}
+		inst.DestMemAddr = rmemv
+		inst.Operand = signExtend(f.Imm)
+		cpu.blockIntR(f.RMem)
+		d.instStr += fmt.Sprintf("MemMode: %v\nFd: %x\nDestMem: %v\n", f.MemMode, f.Fd, inst.DestMemAddr)
+	}
+	d.state = DEC_decoded
+	d.instStr += fmt.Sprintf("state after dec: %v", LookUpStateDec(d.state))
+}
+
+// Read the registers of a vector instruction, VectorResult holds the destination or the value
+// stored by vstw and VectorOperand the source. vdot reads vs into VectorResult and vt into VectorOperand
+func (d *DecodeStage) decodeVector() {
+	inst := d.currInst
+	v := inst.VectorInstruction
+	cpu := d.pipe.cpu
+	readVector := func(r uint8) ([4]uint32, bool) {
+		val, st := cpu.ReadVectorR(r)
+		if st != SUCCESS {
+			d.pipe.sTracef(d, "Failed to read vector register v%v %v", r+1, st)
+			d.state = DEC_reg_read
+			return val, false
+		}
+		return val, true
+	}
+	switch v.OpType {
+	case types.RegReg:
+		var ok bool
+		switch {
+		case types.VectorReadsInt(v.VPU):
+			val, st := d.readIntR(v.Vs)
+			if st != SUCCESS {
+				d.pipe.sTracef(d, "Failed to read source register r%v %v", v.Vs, st)
+				d.state = DEC_reg_read
+				return
+			}
+			inst.Operand = val
+		case v.VPU == types.VPU_DOT:
+			if inst.VectorResult, ok = readVector(v.Vs); !ok {
+				return
+			}
+			if inst.VectorOperand, ok = readVector(v.Vt); !ok {
+				return
+			}
+		default:
+			if inst.VectorOperand, ok = readVector(v.Vs); !ok {
+				return
+			}
+		}
+		if !types.VectorUnary(v.VPU) {
+			if inst.VectorResult, ok = readVector(v.Vd); !ok {
+				return
+			}
+		}
+		if types.VectorWritesInt(v.VPU) {
+			cpu.blockIntR(v.Vd)
+		} else {
+			cpu.blockVectorR(v.Vd)
+		}
+		d.instStr += fmt.Sprintf("VPU: %s\nVd: %x\nVs: %x\n", types.VectorALUInverse[v.VPU], v.Vd, v.Vs)
+
+	case types.LoadStore:
+		rmemv, st := d.readIntR(v.RMem)
+		if st != SUCCESS {
+			d.pipe.sTracef(d, "Failed to read vector load/store memory source r%v %v", v.RMem, st)
+			d.state = DEC_reg_read
+			return
+		}
+		if v.MemMode == types.STW {
+			val, ok := readVector(v.Vd)
+			if !ok {
+				return
+			}
+			inst.VectorResult = val
+		} else {
+			cpu.blockVectorR(v.Vd)
+		}
+		inst.DestMemAddr = rmemv
+		inst.Operand = signExtend(v.Imm)
+		cpu.blockIntR(v.RMem)
+		d.instStr += fmt.Sprintf("MemMode: %v\nVd: %x\nDestMem: %v\n", v.MemMode, v.Vd, inst.DestMemAddr)
+	}
+	d.state = DEC_decoded
+	d.instStr += fmt.Sprintf("state after dec: %v", LookUpStateDec(d.state))
+}
+
 // Returns if this stage passed the instruction to the next stage
 func (d *DecodeStage) Advance(i *InstructionIR, prevstalled bool) bool {
 	if prevstalled {
@@ -230,6 +429,13 @@ func (d *DecodeStage) Advance(i *InstructionIR, prevstalled bool) bool {
 		d.state = DEC_free
 		d.currInst = i // take in our next instruction
 		return true
+	} else if d.currInst == nil {
+		// empty, take in the next instruction while execute is busy so it does not wait in fetch
+		d.pipe.sTracef(d, "Can not advance to %v, taking in the next instruction", d.next.Name())
+		d.next.Advance(nil, false) // pass bubble and say we are not stalled
+		d.state = DEC_free
+		d.currInst = i
+		return true
 	} else {
 		d.pipe.sTracef(d, "Can not advance to %v, CanAdvance returned false", d.next.Name())
 		d.next.Advance(nil, false) // pass bubble and say we are not stalled
@@ -239,21 +445,35 @@ func (d *DecodeStage) Advance(i *InstructionIR, prevstalled bool) bool {
 
 func (d *DecodeStage) Squash() bool {
 	d.pipe.sTracef(d, "Squashing instruction: %+v\n", d.currInst) // For debugging purposes
-	if d.currInst != nil && d.currInst.BaseInstruction != nil {
+	// registers are only blocked once they are all read, a register an instruction waits for
+	// belongs to an older one, which execute may not squash with this one
+	if d.currInst != nil && d.currInst.BaseInstruction != nil && d.state == DEC_decoded {
 		d.pipe.cpu.unblockIntR(d.currInst.BaseInstruction.Rd)
-		d.pipe.cpu.unblockIntR(d.currInst.BaseInstruction.Rs)
-		d.pipe.cpu.unblockIntR(d.currInst.BaseInstruction.RMem)
+		if d.currInst.BaseInstruction.OpType != types.Control {
+			d.pipe.cpu.unblockIntR(d.currInst.BaseInstruction.RMem)
+		}
+		d.pipe.cpu.unblockIntR(d.currInst.RDestAux)
+		if f, ok := d.currInst.FloatDest(); ok {
+			d.pipe.cpu.unblockFloatR(f)
+		}
+		if v, ok := d.currInst.VectorDest(); ok {
+			d.pipe.cpu.unblockVectorR(v)
+		}
 	}
 	d.currInst = nil
 	d.state = DEC_free
 	return true
 }
 
-// Returns returns if this stage can take in a new instruction
+// Returns returns if this stage can take in a new instruction, an empty stage always can
 func (d *DecodeStage) CanAdvance() bool {
-	return d.state < DEC_reg_read && d.next.CanAdvance()
+	return d.currInst == nil || d.state < DEC_reg_read && d.next.CanAdvance()
 }
 
 func (d *DecodeStage) FormatInstruction() string {
 	return d.instStr
 }
+
+func (d *DecodeStage) Instruction() *InstructionIR {
+	return d.currInst
+}
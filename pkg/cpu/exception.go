@@ -0,0 +1,155 @@
+package cpu
+
+import (
+	"fmt"
+
+	"github.com/leon332157/risc-y-8/pkg/types"
+)
+
+// Cause of an exception, held in the cause register after the cpu takes a trap. An exception
+// is raised by the stage that detects it and taken when the instruction reaches writeback, so
+// every older instruction has completed and no younger one has changed any state.
+//
+// The trap vector table holds one instruction per cause, usually a branch to the handler, at
+// tvec + 4*cause. Taking a trap sets epc to the address of the faulting instruction,
+// cause and tval, saves the flags in eflags, disables interrupts, squashes the pipeline and
+// continues at the table entry. iret returns to epc and restores the flags and the interrupt
+// enable, a handler that skips the faulting instruction adds 4 to epc first. When tvec is 0, as
+// after reset, an exception halts the cpu instead. Interrupts and system calls are taken as
+// traps too, see IRQ_TIMER and EXC_ECALL
+type ExceptionCause uint32
+
+const (
+	EXC_NONE                ExceptionCause = iota
+	EXC_ILLEGAL_INSTRUCTION                // the word does not decode, tval holds it
+	EXC_DIVIDE_BY_ZERO                     // div or rem by zero
+	EXC_BAD_ADDRESS                        // a load, store or branch address is negative or not mapped, tval holds it
+	EXC_MISALIGNED                         // word or halfword access with ALIGN_TRAP, or branch or fetch, at a misaligned address, tval holds it
+)
+
+func LookUpException(c ExceptionCause) string {
+	switch c {
+	case EXC_NONE:
+		return "none"
+	case EXC_ILLEGAL_INSTRUCTION:
+		return "illegal instruction"
+	case EXC_DIVIDE_BY_ZERO:
+		return "division by zero"
+	case EXC_BAD_ADDRESS:
+		return "bad address"
+	case EXC_MISALIGNED:
+		return "misaligned access"
+	case EXC_ECALL:
+		return "system call"
+	}
+	if c >= EXC_INTERRUPT && c < EXC_INTERRUPT+IRQ_COUNT {
+		return LookUpInterrupt(uint(c - EXC_INTERRUPT))
+	}
+	return "unknown exception"
+}
+
+// Record an exception on the instruction, only the first exception an instruction raises is kept
+func (i *InstructionIR) raise(cause ExceptionCause, value uint32) {
+	if i.Exception != EXC_NONE {
+		return
+	}
+	i.Exception = cause
+	i.TrapValue = value
+}
+
+func (c *CPU) ReadSR(sr uint8) uint32 {
+	switch sr {
+	case types.SR_EPC:
+		return c.EPC
+	case types.SR_CAUSE:
+		return uint32(c.Cause)
+	case types.SR_TVAL:
+		return c.TVal
+	case types.SR_TVEC:
+		return c.TVec
+	case types.SR_STATUS:
+		return c.Status
+	case types.SR_IMASK:
+		return c.IMask
+	case types.SR_IPEND:
+		return c.IPend
+	case types.SR_TIME:
+		return c.Clock
+	case types.SR_TCMP:
+		return c.Timer.Compare
+	case types.SR_TPERIOD:
+		return c.Timer.Period
+	case types.SR_EFLAGS:
+		return c.EFlags
+	}
+	return 0 // decode raises an illegal instruction for an unknown special register
+}
+
+func (c *CPU) WriteSR(sr uint8, v uint32) {
+	switch sr {
+	case types.SR_EPC:
+		c.EPC = v
+	case types.SR_CAUSE:
+		c.Cause = ExceptionCause(v)
+	case types.SR_TVAL:
+		c.TVal = v
+	case types.SR_TVEC:
+		c.TVec = v
+	case types.SR_STATUS:
+		c.Status = v & (types.STATUS_IE | types.STATUS_PIE)
+	case types.SR_IMASK:
+		c.IMask = v & (1<<IRQ_COUNT - 1)
+	case types.SR_IPEND:
+		c.IPend = v & (1<<IRQ_COUNT - 1)
+	case types.SR_TIME:
+		c.log.Info().Msg("attempted to write time, which is read only, ignoring")
+	case types.SR_TCMP:
+		c.Timer.Compare = v
+	case types.SR_TPERIOD:
+		c.Timer.Period = v
+	case types.SR_EFLAGS:
+		c.EFlags = v
+	default:
+		c.log.Info().Msgf("attempted to write an unknown special register %v, ignoring", sr) // decode raises an illegal instruction for it
+	}
+}
+
+// Take the trap for the exception of an instruction in writeback
+func (c *CPU) takeTrap(inst *InstructionIR) {
+	c.trap(inst.PC, inst.Exception, inst.TrapValue)
+}
+
+// Continue at the vector table entry of the cause with interrupts disabled, or halt if no trap
+// vector table is set
+func (c *CPU) trap(epc uint32, cause ExceptionCause, tval uint32) {
+	c.EPC, c.Cause, c.TVal = epc, cause, tval
+	c.log.Info().Msgf("%s at 0x%x, tval 0x%x", LookUpException(cause), epc, tval)
+	c.Status = (c.Status & types.STATUS_IE) << 1 // save IE in PIE and clear IE
+	c.EFlags = c.ALU.FlagRegister
+	if c.TVec == 0 {
+		c.Fault = cause
+		c.Halt()
+	} else {
+		c.ProgramCounter = c.TVec + 4*uint32(cause)
+	}
+	c.Pipeline.SquashALL()
+}
+
+// Return from a trap, restores the flags and interrupt enable saved by the trap and returns epc
+func (c *CPU) returnFromTrap() uint32 {
+	c.ALU.FlagRegister = c.EFlags
+	if c.Status&types.STATUS_PIE != 0 {
+		c.Status |= types.STATUS_IE
+	} else {
+		c.Status &^= types.STATUS_IE
+	}
+	return c.EPC
+}
+
+// Describes the exception that halted the cpu, empty if it halted normally
+func (c *CPU) DescribeFault() string {
+	if c.Fault == EXC_NONE {
+		return ""
+	}
+	return fmt.Sprintf("unhandled %s at 0x%x, tval 0x%x", LookUpException(c.Fault), c.EPC, c.TVal)
+}
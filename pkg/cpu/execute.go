@@ -2,6 +2,7 @@ package cpu
 
 import (
 	"fmt"
+	"math"
 	"math/bits"
 
 	"github.com/leon332157/risc-y-8/pkg/types"
@@ -27,6 +28,7 @@ const (
 	EXEC_busy_int    // busy waiting for integer alu to finish
 	EXEC_busy_float  // busy waiting for fpu to finish
 	EXEC_busy_vector // busy waiting for vector unit to finish
+	EXEC_wait_trap   // waiting for an older instruction to take its trap
 )
 
 func lookUpStateExec(s ExecState) string {
@@ -41,6 +43,8 @@ func lookUpStateExec(s ExecState) string {
 		return "busy_float"
 	case EXEC_busy_vector:
 		return "busy_vector"
+	case EXEC_wait_trap:
+		return "wait_trap"
 	default:
 		return "unknown state"
 	}
@@ -48,6 +52,50 @@ func lookUpStateExec(s ExecState) string {
 
 const DIV_DELAY = 4
 
+// FPU latencies in cycles, copies, negation, abs and bit moves take one cycle
+const (
+	FADD_DELAY  = 3 // fadd, fsub
+	FMUL_DELAY  = 4
+	FDIV_DELAY  = 12
+	FSQRT_DELAY = 16
+	FCMP_DELAY  = 2 // fcmp, fmin, fmax, itof, ftoi
+)
+
+func floatDelay(op uint8) uint {
+	switch op {
+	case types.FPU_ADD, types.FPU_SUB:
+		return FADD_DELAY
+	case types.FPU_MUL:
+		return FMUL_DELAY
+	case types.FPU_DIV:
+		return FDIV_DELAY
+	case types.FPU_SQRT:
+		return FSQRT_DELAY
+	case types.FPU_CMP, types.FPU_MIN, types.FPU_MAX, types.FPU_ITOF, types.FPU_FTOI:
+		return FCMP_DELAY
+	}
+	return 1
+}
+
+// VPU latencies in cycles, broadcast and copy take one cycle
+const (
+	VADD_DELAY = 2 // vadd, vsub
+	VMUL_DELAY = 4
+	VDOT_DELAY = 6
+)
+
+func vectorDelay(op uint8) uint {
+	switch op {
+	case types.VPU_ADD, types.VPU_SUB:
+		return VADD_DELAY
+	case types.VPU_MUL:
+		return VMUL_DELAY
+	case types.VPU_DOT:
+		return VDOT_DELAY
+	}
+	return 1
+}
+
 func (e *ExecuteStage) Init(pipeline *Pipeline, next Stage, prev Stage) error {
 	if pipeline == nil {
 		e.pipeline.log.Fatal().Msg("[Execute Init] pipeline is null")
@@ -133,8 +181,11 @@ func (e *ExecuteStage) ALURI() {
 			e.pipeline.cpu.unblockIntR(inst.BaseInstruction.Rd)
 			inst.BaseInstruction.Rd = 0 // Set Rd to 0 for comparison operations
 			e.pipeline.cpu.ALU.Sub(op1, op2)
+		case types.IMM_SR:
+			// special registers are read and written in writeback, mtsr writes its source back unchanged
+			break
 		default:
-			e.pipeline.log.Panic().Msg("unsupported ALU operation for RegImm type instruction") // Handle unsupported ALU operations
+			inst.raise(EXC_ILLEGAL_INSTRUCTION, inst.rawInstruction)
 		}
 
 		e.pipeline.sTracef(e, "ALURI operation result: %v", inst.Result) // For debugging purposes, log the result of the ALU operation
@@ -175,7 +226,8 @@ func (e *ExecuteStage) ALURR() {
 			inst.Result = e.pipeline.cpu.ALU.Mul(op1, op2)
 		case types.REG_DIV:
 			if op2 == 0 {
-				panic("division by zero")
+				inst.raise(EXC_DIVIDE_BY_ZERO, 0)
+				break
 			}
 			if e.state == EXEC_free && e.cyclesLeft == 1 {
 				e.cyclesLeft = DIV_DELAY
@@ -186,7 +238,8 @@ func (e *ExecuteStage) ALURR() {
 			}
 		case types.REG_REM:
 			if op2 == 0 {
-				panic("division by zero on remainder")
+				inst.raise(EXC_DIVIDE_BY_ZERO, 0)
+				break
 			}
 			if e.state == EXEC_free && e.cyclesLeft == 1 {
 				e.cyclesLeft = DIV_DELAY
@@ -220,7 +273,7 @@ func (e *ExecuteStage) ALURR() {
 		case types.REG_NSA:
 			inst.Result = uint32(bits.OnesCount32(op2))
 		default:
-			e.pipeline.log.Panic().Msg("unsupported ALU operation for RegReg type instruction") // Handle unsupported ALU operations
+			inst.raise(EXC_ILLEGAL_INSTRUCTION, inst.rawInstruction)
 		}
 
 		e.pipeline.sTracef(e, "ALURR operation result: %v", inst.Result) // For debugging purposes, log the result of the ALU operation
@@ -231,12 +284,130 @@ func (e *ExecuteStage) ALURR() {
 	panic("invalid state RR")
 }
 
+func (e *ExecuteStage) FPU() {
+	if e.state == EXEC_free && e.cyclesLeft == 0 {
+		e.cyclesLeft = floatDelay(e.currInst.FloatInstruction.FPU)
+		e.pipeline.sTracef(e, "adding %v cycle fpu delay", e.cyclesLeft)
+		e.state = EXEC_busy_float
+		return
+	}
+	if e.state == EXEC_busy_float && e.cyclesLeft > 0 {
+		e.pipeline.sTrace(e, "busy waiting for fpu to finish")
+		e.cyclesLeft--
+		if e.cyclesLeft > 0 {
+			return
+		}
+	}
+	if e.state == EXEC_busy_float && e.cyclesLeft == 0 {
+		inst := e.currInst
+		fpu := e.pipeline.cpu.FPU
+		op1 := math.Float32frombits(inst.Result)  // Fd
+		op2 := math.Float32frombits(inst.Operand) // Fs
+		result := op1
+		switch inst.FloatInstruction.FPU {
+		case types.FPU_ADD:
+			result = fpu.Add(op1, op2)
+		case types.FPU_SUB:
+			result = fpu.Sub(op1, op2)
+		case types.FPU_MUL:
+			result = fpu.Mul(op1, op2)
+		case types.FPU_DIV:
+			result = fpu.Div(op1, op2)
+		case types.FPU_SQRT:
+			result = fpu.Sqrt(op2)
+		case types.FPU_CMP:
+			fpu.Cmp(op1, op2) // only sets the flags
+		case types.FPU_CPY:
+			result = op2
+		case types.FPU_NEG:
+			result = -op2
+		case types.FPU_ABS:
+			result = float32(math.Abs(float64(op2)))
+		case types.FPU_MIN:
+			result = fpu.Min(op1, op2)
+		case types.FPU_MAX:
+			result = fpu.Max(op1, op2)
+		case types.FPU_ITOF:
+			result = fpu.FromInt(inst.Operand)
+		case types.FPU_FTOI, types.FPU_MVI, types.FPU_MVF:
+			break // the result is not a float, set below without converting it
+		default:
+			inst.raise(EXC_ILLEGAL_INSTRUCTION, inst.rawInstruction)
+		}
+		switch inst.FloatInstruction.FPU {
+		case types.FPU_FTOI:
+			inst.Result = fpu.ToInt(op2)
+		case types.FPU_MVI, types.FPU_MVF:
+			inst.Result = inst.Operand
+		default:
+			inst.Result = math.Float32bits(result)
+		}
+
+		e.pipeline.sTracef(e, "FPU operation result: %v", result) // For debugging purposes, log the result of the FPU operation
+		e.instStr += fmt.Sprintf("FPU: %v\nFd: %x\nResult: %x (%g)", types.FloatALUInverse[inst.FloatInstruction.FPU], inst.FloatInstruction.Fd, inst.Result, result)
+		e.state = EXEC_done
+		return
+	}
+	panic("invalid state FPU")
+}
+
+func (e *ExecuteStage) VPU() {
+	if e.state == EXEC_free && e.cyclesLeft == 0 {
+		e.cyclesLeft = vectorDelay(e.currInst.VectorInstruction.VPU)
+		e.pipeline.sTracef(e, "adding %v cycle vpu delay", e.cyclesLeft)
+		e.state = EXEC_busy_vector
+		return
+	}
+	if e.state == EXEC_busy_vector && e.cyclesLeft > 0 {
+		e.pipeline.sTrace(e, "busy waiting for vpu to finish")
+		e.cyclesLeft--
+		if e.cyclesLeft > 0 {
+			return
+		}
+	}
+	if e.state == EXEC_busy_vector && e.cyclesLeft == 0 {
+		inst := e.currInst
+		vpu := e.pipeline.cpu.VPU
+		switch inst.VectorInstruction.VPU {
+		case types.VPU_ADD:
+			inst.VectorResult = vpu.Add(inst.VectorResult, inst.VectorOperand)
+		case types.VPU_SUB:
+			inst.VectorResult = vpu.Sub(inst.VectorResult, inst.VectorOperand)
+		case types.VPU_MUL:
+			inst.VectorResult = vpu.Mul(inst.VectorResult, inst.VectorOperand)
+		case types.VPU_DOT:
+			inst.Result = vpu.Dot(inst.VectorResult, inst.VectorOperand)
+		case types.VPU_BCST:
+			inst.VectorResult = vpu.Broadcast(inst.Operand)
+		case types.VPU_CPY:
+			inst.VectorResult = inst.VectorOperand
+		default:
+			inst.raise(EXC_ILLEGAL_INSTRUCTION, inst.rawInstruction)
+		}
+
+		e.pipeline.sTracef(e, "VPU operation result: %x %x", inst.VectorResult, inst.Result) // For debugging purposes, log the result of the VPU operation
+		e.instStr += fmt.Sprintf("VPU: %v\nVd: %x\n", types.VectorALUInverse[inst.VectorInstruction.VPU], inst.VectorInstruction.Vd)
+		if types.VectorWritesInt(inst.VectorInstruction.VPU) {
+			e.instStr += fmt.Sprintf("Result: %x", inst.Result)
+		} else {
+			e.instStr += fmt.Sprintf("Result: %x", inst.VectorResult)
+		}
+		e.state = EXEC_done
+		return
+	}
+	panic("invalid state VPU")
+}
+
+// Addresses wrap around at the size of the address space. A negative address, or one between
+// the end of RAM and the devices, raises EXC_BAD_ADDRESS on the current instruction
 func (e *ExecuteStage) calculateMemAddr(base uint32, displacement int32) uint32 {
-	res := (int32(base) + displacement) % int32(e.pipeline.cpu.RAM.SizeWords()) // Calculate the memory address for load/store instructions based on the operands
-	e.pipeline.sTracef(e, "calculating addr with base %v, displacement %v, ram size %v", int32(base), displacement, int32(e.pipeline.cpu.RAM.SizeWords()))
+	size := e.pipeline.cpu.addressSpace()
+	res := (int32(base) + displacement) % int32(size) // Calculate the memory address for load/store instructions based on the operands
+	e.pipeline.sTracef(e, "calculating addr with base %v, displacement %v, ram size %v", int32(base), displacement, int32(size))
 	e.pipeline.sTracef(e, "calculated memory address: %v", res)                 // For debugging purposes, log the calculated memory address
-	if res < 0 {
-		panic("negative memory address")
+	if res < 0 || !e.pipeline.cpu.mapped(uint(res)) {
+		e.currInst.raise(EXC_BAD_ADDRESS, base+uint32(displacement))
+		return 0
 	}
 	return uint32(res)
 }
@@ -270,11 +441,14 @@ func (e *ExecuteStage) LoadStore() {
 		default:
 			e.pipeline.log.Panic().Msg("unsupported memory operation for LoadStore type instruction")
 		}
+		if inst.VectorInstruction != nil {
+			inst.DestMemAddr &^= 4*types.VectorLanes - 1 // vectors are aligned to their size
+		}
 		if inst.BaseInstruction.MemMode == types.PUSH {
-			inst.ResultAux = inst.DestMemAddr + 1
+			inst.ResultAux = inst.DestMemAddr + 4
 		}
 		if inst.BaseInstruction.MemMode == types.POP {
-			inst.DestMemAddr--
+			inst.DestMemAddr -= 4
 			inst.ResultAux = inst.DestMemAddr
 		}
 		e.instStr += fmt.Sprintf("MemMode: %v\nRd: %x\nRMem: %x\nDestMemAddr: %x\nRdAux %x\nAuxVal: %x", inst.BaseInstruction.MemMode, inst.BaseInstruction.Rd, inst.BaseInstruction.RMem, inst.DestMemAddr, inst.RDestAux, inst.ResultAux)
@@ -305,7 +479,6 @@ func (e *ExecuteStage) Control() {
 	if e.state == EXEC_busy_int && e.cyclesLeft == 0 {
 		inst := e.currInst
 		combiFlag := combineFlags(inst.BaseInstruction.CtrlMode, inst.BaseInstruction.CtrlFlag)
-		inst.DestMemAddr = e.calculateMemAddr(inst.DestMemAddr, int32(inst.Operand))
 		alu := e.pipeline.cpu.ALU
 		switch combiFlag {
 		case types.GetModeFlag(types.UNC): // unconditional branch
@@ -313,7 +486,13 @@ func (e *ExecuteStage) Control() {
 		case types.GetModeFlag(types.CALL): // call
 			inst.BranchTaken = true
 			inst.RDestAux = types.IntegerRegisters["lr"]
-			inst.ResultAux = e.pipeline.cpu.ProgramCounter
+			inst.ResultAux = inst.PC + 4 // return to the instruction after the call
+		case types.GetModeFlag(types.IRET): // the target is epc, read in writeback
+			inst.BranchTaken = true
+		case types.GetModeFlag(types.ECALL): // serviced in writeback, or trapped without a handler
+			if e.pipeline.cpu.Syscall == nil {
+				inst.raise(EXC_ECALL, e.pipeline.cpu.ReadIntRNoBlock(SYSCALL_NUMBER))
+			}
 		case types.GetModeFlag(types.NE):
 			if false == alu.GetZF() {
 				// if zero flag is zero, branch
@@ -359,7 +538,14 @@ func (e *ExecuteStage) Control() {
 				inst.BranchTaken = true
 			}
 		}
-		e.instStr += fmt.Sprintf("CtrlMode: %x\nCtrlFlag: %x\nDestMemAddr: %x\nRDestAux: %x\nAuxVal: %x\nBranchTaken: %v", inst.BaseInstruction.CtrlMode, inst.BaseInstruction.CtrlFlag, inst.DestMemAddr, inst.RDestAux, inst.ResultAux, inst.BranchTaken)
+		if inst.BranchTaken && !inst.IsIret() {
+			// only a taken branch goes to its target, a bad target of a branch not taken does not trap
+			inst.DestMemAddr = e.calculateMemAddr(inst.DestMemAddr, int32(inst.Operand))
+			if inst.DestMemAddr%4 != 0 && !inst.IsHalt() {
+				inst.raise(EXC_MISALIGNED, inst.DestMemAddr) // instructions are at multiples of 4
+			}
+		}
+		e.instStr += fmt.Sprintf("CtrlMode: %x\nCtrlFlag: %x\nDestMemAddr: %s\nRDestAux: %x\nAuxVal: %x\nBranchTaken: %v", inst.BaseInstruction.CtrlMode, inst.BaseInstruction.CtrlFlag, e.pipeline.formatTarget(inst.DestMemAddr), inst.RDestAux, inst.ResultAux, inst.BranchTaken)
 		e.state = EXEC_done
 		return
 	}
@@ -373,7 +559,25 @@ func (e *ExecuteStage) Execute() {
 		e.instStr = "<bubble>"
 		return
 	}
+	if older := e.next.currInst; older != nil && (older.Exception != EXC_NONE || older.IsEcall()) {
+		// the older instruction traps or makes a system call in writeback next clock, this one must not change the flags before
+		e.pipeline.sTrace(e, "Older instruction raised an exception or is ecall, not executing")
+		if e.state == EXEC_free {
+			e.state = EXEC_wait_trap
+		}
+		e.instStr = fmt.Sprintf("State: %v\n", lookUpStateExec(e.state))
+		return
+	}
+	if e.state == EXEC_wait_trap {
+		e.state = EXEC_free
+	}
 	e.instStr = fmt.Sprintf("State: %v\n", lookUpStateExec(e.state))
+	if e.currInst.Exception != EXC_NONE {
+		e.pipeline.sTracef(e, "Instruction raised %s, not executing", LookUpException(e.currInst.Exception))
+		e.instStr += fmt.Sprintf("Exception: %s", LookUpException(e.currInst.Exception))
+		e.state = EXEC_done
+		return
+	}
 	e.pipeline.sTracef(e, "Executing instruction: %+v\n", e.currInst)
 	e.pipeline.sTracef(e, "Executing instruction base: %+v\n", *e.currInst.BaseInstruction)
 	e.instStr += fmt.Sprintf("OpType: %s\n", types.LookUpOpType(e.currInst.BaseInstruction.OpType))
@@ -384,7 +588,13 @@ func (e *ExecuteStage) Execute() {
 		case types.RegImm:
 			e.ALURI()
 		case types.RegReg:
-			e.ALURR()
+			if e.currInst.FloatInstruction != nil {
+				e.FPU()
+			} else if e.currInst.VectorInstruction != nil {
+				e.VPU()
+			} else {
+				e.ALURR()
+			}
 		case types.LoadStore:
 			e.LoadStore()
 		case types.Control:
@@ -392,6 +602,9 @@ func (e *ExecuteStage) Execute() {
 		default:
 			panic("unsupported instruction type in Execute stage") // Handle unsupported instruction types
 		}
+		if e.state == EXEC_done {
+			e.resolve() // finished this clock
+		}
 		//e.instStr += fmt.Sprintf("\nCyl Left after: %v\n", e.cyclesLeft)
 	} else {
 		e.pipeline.sTrace(e, "Already executed instruction, not executing")
@@ -425,6 +638,13 @@ func (e *ExecuteStage) Squash() bool {
 	if e.currInst != nil {
 		e.pipeline.cpu.unblockIntR(e.currInst.BaseInstruction.Rd)
 		e.pipeline.cpu.unblockIntR(e.currInst.BaseInstruction.RMem)
+		e.pipeline.cpu.unblockIntR(e.currInst.RDestAux)
+		if f, ok := e.currInst.FloatDest(); ok {
+			e.pipeline.cpu.unblockFloatR(f)
+		}
+		if v, ok := e.currInst.VectorDest(); ok {
+			e.pipeline.cpu.unblockVectorR(v)
+		}
 		e.currInst = nil
 	}
 	e.state = EXEC_free
@@ -440,3 +660,7 @@ func (e *ExecuteStage) CanAdvance() bool {
 func (e *ExecuteStage) FormatInstruction() string {
 	return e.instStr
 }
+
+func (e *ExecuteStage) Instruction() *InstructionIR {
+	return e.currInst
+}
@@ -0,0 +1,182 @@
+package cpu
+
+import (
+	"math"
+	"testing"
+
+	"github.com/leon332157/risc-y-8/pkg/alu"
+	"github.com/leon332157/risc-y-8/pkg/types"
+	"github.com/rs/zerolog"
+)
+
+// Returns an execute stage with its own ALU, FPU and VPU and no other stages
+func newTestExecute() *ExecuteStage {
+	cpu := &CPU{ALU: alu.NewALU(), VPU: alu.NewVPU()}
+	cpu.FPU = alu.NewFPU(cpu.ALU)
+	log := zerolog.Nop()
+	return &ExecuteStage{pipeline: &Pipeline{cpu: cpu, log: &log}}
+}
+
+// Runs unit until the instruction is done, failing if it takes more than the longest latency
+func runUnit(t *testing.T, e *ExecuteStage, inst *InstructionIR, unit func()) {
+	e.currInst, e.state, e.cyclesLeft = inst, EXEC_free, 0
+	for i := 0; e.state != EXEC_done; i++ {
+		if i > FSQRT_DELAY+1 {
+			t.Fatalf("expected the instruction to finish within %d cycles", FSQRT_DELAY+1)
+		}
+		unit()
+	}
+}
+
+func TestExecuteFPU(t *testing.T) {
+	f := math.Float32bits
+	inf, nan := float32(math.Inf(1)), float32(math.NaN())
+	var test = []struct {
+		name   string
+		op     uint8
+		fd, fs uint32 // Result and Operand as decode leaves them
+		result uint32
+	}{
+		{"fadd", types.FPU_ADD, f(1.5), f(2.25), f(3.75)},
+		{"fsub", types.FPU_SUB, f(1.5), f(2.25), f(-0.75)},
+		{"fmul", types.FPU_MUL, f(-3), f(0.5), f(-1.5)},
+		{"fdiv", types.FPU_DIV, f(1), f(4), f(0.25)},
+		{"fdiv by zero", types.FPU_DIV, f(1), f(0), f(inf)},
+		{"fdiv negative by zero", types.FPU_DIV, f(-1), f(0), f(-inf)},
+		{"fsqrt", types.FPU_SQRT, 0, f(2.25), f(1.5)},
+		{"fcpy", types.FPU_CPY, f(1), f(-2), f(-2)},
+		{"fneg", types.FPU_NEG, 0, f(2), f(-2)},
+		{"fabs", types.FPU_ABS, 0, f(-2), f(2)},
+		{"fmin", types.FPU_MIN, f(1), f(-2), f(-2)},
+		{"fmax", types.FPU_MAX, f(1), f(-2), f(1)},
+		{"itof", types.FPU_ITOF, 0, 0xfffffffd, f(-3)},
+		{"ftoi", types.FPU_FTOI, 0, f(-3.75), 0xfffffffd},
+		{"ftoi saturates", types.FPU_FTOI, 0, f(inf), math.MaxInt32},
+		{"ftoi saturates negative", types.FPU_FTOI, 0, f(-inf), 1 << 31},
+		{"ftoi nan", types.FPU_FTOI, 0, f(nan), 0},
+		{"fmvi", types.FPU_MVI, 0, 0x3fc00000, 0x3fc00000},
+		{"fmvf", types.FPU_MVF, 0, 0x3fc00000, 0x3fc00000},
+	}
+	for _, tt := range test {
+		e := newTestExecute()
+		inst := &InstructionIR{FloatInstruction: &types.FloatInstruction{FPU: tt.op}, Result: tt.fd, Operand: tt.fs}
+		runUnit(t, e, inst, e.FPU)
+		if inst.Exception != EXC_NONE {
+			t.Errorf("%s: expected no exception, got %s", tt.name, LookUpException(inst.Exception))
+		}
+		if inst.Result != tt.result {
+			t.Errorf("%s: expected %08x (%g), got %08x (%g)", tt.name, tt.result, math.Float32frombits(tt.result), inst.Result, math.Float32frombits(inst.Result))
+		}
+	}
+
+	// 0/0 and the square root of a negative number give a NaN rather than an exception
+	for _, tt := range []struct {
+		name   string
+		op     uint8
+		fd, fs float32
+	}{
+		{"fdiv zero by zero", types.FPU_DIV, 0, 0},
+		{"fsqrt negative", types.FPU_SQRT, 0, -1},
+	} {
+		e := newTestExecute()
+		inst := &InstructionIR{FloatInstruction: &types.FloatInstruction{FPU: tt.op}, Result: f(tt.fd), Operand: f(tt.fs)}
+		runUnit(t, e, inst, e.FPU)
+		if inst.Exception != EXC_NONE || !math.IsNaN(float64(math.Float32frombits(inst.Result))) {
+			t.Errorf("%s: expected a NaN and no exception, got %08x %s", tt.name, inst.Result, LookUpException(inst.Exception))
+		}
+	}
+}
+
+func TestExecuteFPUFlags(t *testing.T) {
+	f := math.Float32bits
+	nan := float32(math.NaN())
+	var test = []struct {
+		name   string
+		fd, fs float32
+		flags  uint32
+	}{
+		{"equal", 1.5, 1.5, alu.ZF},
+		{"less", -1, 1.5, alu.CF | alu.SF},
+		{"greater", 2, 1.5, 0},
+		{"negative zero", float32(math.Copysign(0, -1)), 0, alu.ZF},
+		{"unordered", nan, 1.5, alu.OVF},
+		{"unordered operand", 1.5, nan, alu.OVF},
+	}
+	for _, tt := range test {
+		e := newTestExecute()
+		e.pipeline.cpu.ALU.FlagRegister = alu.CF | alu.ZF | alu.SF | alu.OVF // fcmp replaces older flags
+		inst := &InstructionIR{FloatInstruction: &types.FloatInstruction{FPU: types.FPU_CMP}, Result: f(tt.fd), Operand: f(tt.fs)}
+		runUnit(t, e, inst, e.FPU)
+		if got := e.pipeline.cpu.ALU.FlagRegister; got != tt.flags {
+			t.Errorf("%s: expected flags %04b, got %04b", tt.name, tt.flags, got)
+		}
+	}
+
+	// the other operations leave the flags alone
+	e := newTestExecute()
+	e.pipeline.cpu.ALU.FlagRegister = alu.ZF
+	inst := &InstructionIR{FloatInstruction: &types.FloatInstruction{FPU: types.FPU_SUB}, Result: f(1), Operand: f(1)}
+	runUnit(t, e, inst, e.FPU)
+	if got := e.pipeline.cpu.ALU.FlagRegister; got != alu.ZF {
+		t.Errorf("expected fsub not to change the flags, got %04b", got)
+	}
+}
+
+func TestExecuteVPU(t *testing.T) {
+	var test = []struct {
+		name      string
+		op        uint8
+		vd, vs    [4]uint32 // VectorResult and VectorOperand as decode leaves them
+		rs        uint32    // Operand of vbcst
+		result    [4]uint32
+		resultInt uint32 // Result of vdot
+	}{
+		{"vadd", types.VPU_ADD, [4]uint32{1, 2, 3, 4}, [4]uint32{10, 20, 30, 40}, 0, [4]uint32{11, 22, 33, 44}, 0},
+		{"vadd wraps", types.VPU_ADD, [4]uint32{math.MaxUint32, 1, 0, 0}, [4]uint32{1, math.MaxUint32, 0, 0}, 0, [4]uint32{0, 0, 0, 0}, 0},
+		{"vsub", types.VPU_SUB, [4]uint32{10, 20, 30, 40}, [4]uint32{1, 2, 3, 50}, 0, [4]uint32{9, 18, 27, 0xfffffff6}, 0},
+		{"vmul", types.VPU_MUL, [4]uint32{1, 2, 3, 4}, [4]uint32{5, 6, 7, 8}, 0, [4]uint32{5, 12, 21, 32}, 0},
+		{"vmul keeps the low bits", types.VPU_MUL, [4]uint32{1 << 16, 3, 0, 0}, [4]uint32{1 << 16, 0x80000000, 0, 0}, 0, [4]uint32{0, 0x80000000, 0, 0}, 0},
+		// there is no mask register, a program masks lanes by multiplying with 0 or 1
+		{"vmul by a lane mask", types.VPU_MUL, [4]uint32{7, 8, 9, 10}, [4]uint32{1, 0, 1, 0}, 0, [4]uint32{7, 0, 9, 0}, 0},
+		{"vdot", types.VPU_DOT, [4]uint32{1, 2, 3, 4}, [4]uint32{5, 6, 7, 8}, 0, [4]uint32{1, 2, 3, 4}, 70},
+		// a vector shorter than four lanes keeps zeros in the unused lanes
+		{"vdot of two lanes", types.VPU_DOT, [4]uint32{3, 4, 0, 0}, [4]uint32{5, 6, 0, 0}, 0, [4]uint32{3, 4, 0, 0}, 39},
+		{"vbcst", types.VPU_BCST, [4]uint32{}, [4]uint32{}, 0xfffffffe, [4]uint32{0xfffffffe, 0xfffffffe, 0xfffffffe, 0xfffffffe}, 0},
+		{"vcpy", types.VPU_CPY, [4]uint32{1, 2, 3, 4}, [4]uint32{5, 6, 7, 8}, 0, [4]uint32{5, 6, 7, 8}, 0},
+	}
+	for _, tt := range test {
+		e := newTestExecute()
+		e.pipeline.cpu.ALU.FlagRegister = alu.ZF
+		inst := &InstructionIR{VectorInstruction: &types.VectorInstruction{VPU: tt.op}, VectorResult: tt.vd, VectorOperand: tt.vs, Operand: tt.rs}
+		runUnit(t, e, inst, e.VPU)
+		if inst.Exception != EXC_NONE {
+			t.Errorf("%s: expected no exception, got %s", tt.name, LookUpException(inst.Exception))
+		}
+		if inst.VectorResult != tt.result {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.result, inst.VectorResult)
+		}
+		if inst.Result != tt.resultInt {
+			t.Errorf("%s: expected the integer result %d, got %d", tt.name, tt.resultInt, inst.Result)
+		}
+		if got := e.pipeline.cpu.ALU.FlagRegister; got != alu.ZF {
+			t.Errorf("%s: expected the flags unchanged, got %04b", tt.name, got)
+		}
+	}
+}
+
+func TestExecuteUnsupportedOperation(t *testing.T) {
+	const raw = 0xdeadbeef
+	e := newTestExecute()
+	inst := &InstructionIR{FloatInstruction: &types.FloatInstruction{FPU: types.FPU_MVF + 1}, rawInstruction: raw}
+	runUnit(t, e, inst, e.FPU)
+	if inst.Exception != EXC_ILLEGAL_INSTRUCTION || inst.TrapValue != raw {
+		t.Errorf("fpu: expected an illegal instruction with tval %08x, got %s %08x", raw, LookUpException(inst.Exception), inst.TrapValue)
+	}
+
+	e = newTestExecute()
+	inst = &InstructionIR{VectorInstruction: &types.VectorInstruction{VPU: types.VPU_CPY + 1}, rawInstruction: raw}
+	runUnit(t, e, inst, e.VPU)
+	if inst.Exception != EXC_ILLEGAL_INSTRUCTION || inst.TrapValue != raw {
+		t.Errorf("vpu: expected an illegal instruction with tval %08x, got %s %08x", raw, LookUpException(inst.Exception), inst.TrapValue)
+	}
+}
@@ -51,7 +51,18 @@ func (f *FetchStage) Execute() {
 		return
 	}
 	f.InstStr = "Fetching \ninstruction . . ."
-	cache := f.pipe.cpu.Cache
+	if pc := f.pipe.cpu.ProgramCounter; pc%4 != 0 {
+		// only a trap vector or an epc that is not a multiple of 4 gets here, execute checks branch targets
+		f.pipe.sTracef(f, "Misaligned program counter: %v", pc)
+		f.InstStr = fmt.Sprintf("misaligned pc: 0x%x\n", pc)
+		f.currInst = &InstructionIR{PC: pc, NextPC: pc}
+		f.currInst.raise(EXC_MISALIGNED, pc)
+		if f.pipe.scalarMode {
+			f.pipe.canFetch = false
+		}
+		return
+	}
+	cache := f.pipe.cpu.fetchCache()
 	read := cache.Read(uint(f.pipe.cpu.ProgramCounter), memory.FETCH_STAGE)
 	if read.State != memory.SUCCESS {
 		f.pipe.sTracef(f, "Fetch failed: %v", memory.LookUpMemoryResult(read.State)) // Memory fetch failed
@@ -63,17 +74,30 @@ func (f *FetchStage) Execute() {
 		f.InstStr = fmt.Sprintf("Fetched instruction: 0x%08x\n", read.Value)
 		f.currInst = new(InstructionIR) // Store the fetched instruction
 		f.currInst.rawInstruction = read.Value
+		f.currInst.PC = f.pipe.cpu.ProgramCounter
 		f.InstStr = fmt.Sprintf("raw: 0x%08x\n", f.currInst.rawInstruction)
-		f.pipe.cpu.ProgramCounter++
+		f.pipe.cpu.ProgramCounter += 4
+		if f.pipe.Branch != nil {
+			f.pipe.cpu.ProgramCounter = f.pipe.Branch.fetchNext(f.currInst)
+		}
+		f.currInst.NextPC = f.pipe.cpu.ProgramCounter
 		f.pipe.sTracef(f, "Increasing ProgramCounter to: %v", f.pipe.cpu.ProgramCounter)
 		if f.pipe.scalarMode {
 			// if in scalar mode, we can only fetch one instruction at a time
 			f.pipe.canFetch = false
 		}
 	} else {
-		f.pipe.sTrace(f, "Fetched instruction is zero, no valid instruction found")
+		// running off the end of the program halts the cpu once the zero word reaches writeback
+		f.pipe.sTrace(f, "Fetched instruction is zero, no valid instruction found, treating as halt")
 		f.InstStr = "raw: 0x0\n"
-		f.pipe.cpu.Halt()
+		f.currInst = new(InstructionIR)
+		f.currInst.rawInstruction = haltInstruction
+		f.currInst.PC = f.pipe.cpu.ProgramCounter
+		f.pipe.cpu.ProgramCounter += 4
+		f.currInst.NextPC = f.pipe.cpu.ProgramCounter
+		if f.pipe.scalarMode {
+			f.pipe.canFetch = false
+		}
 		return
 	}
 }
@@ -105,13 +129,13 @@ func (f *FetchStage) Squash() bool {
 	f.currInst = nil
 
 	// Cancel request to memory/cache if necessary
-	cache := f.pipe.cpu.Cache
+	cache := f.pipe.cpu.fetchCache()
 	ram := f.pipe.cpu.RAM
-	// Check if cache/ram currently serving FETCH
+	// Check if cache/ram currently serving FETCH, the cache also cancels the levels below it
 	if cache.Requester() == memory.FETCH_STAGE {
 		f.pipe.sTrace(f, "Cancelling Cache Fetch Request") // for debugging
-		f.pipe.cpu.Cache.CancelRequest()
 	}
+	cache.Cancel(memory.FETCH_STAGE)
 	if ram.Requester() == memory.FETCH_STAGE {
 		f.pipe.sTrace(f, "Cancelling RAM Fetch Request") // for debugging
 		f.pipe.cpu.RAM.CancelRequest()
@@ -129,3 +153,7 @@ func (f *FetchStage) CanAdvance() bool {
 func (f *FetchStage) FormatInstruction() string {
 	return f.InstStr
 }
+
+func (f *FetchStage) Instruction() *InstructionIR {
+	return f.currInst
+}
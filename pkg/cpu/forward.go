@@ -0,0 +1,97 @@
+package cpu
+
+import (
+	"github.com/leon332157/risc-y-8/pkg/types"
+)
+
+// Operand forwarding. Without it decode waits for an integer source register until the
+// instruction that writes it unblocks it in writeback. With Pipeline.Forwarding decode takes
+// the value from the youngest older instruction that writes the register as soon as it is
+// computed, from execute once an ALU result is done and from memory once a load has completed,
+// so the dependent instruction enters execute in the next clock. Decode still waits for a load
+// in execute or waiting for the cache, the load-use interlock, for an operation that has not
+// finished, and for mfsr, which reads its special register in writeback. Float and vector
+// registers are not forwarded.
+//
+// The stages run from writeback to fetch, so by the time decode runs the instruction in
+// writeback has written its registers and only execute and memory hold older instructions
+
+// Returns true if the instruction writes integer register r, and aux if the value is
+// ResultAux rather than Result. Only the encoding is used, as execute fills in RDestAux and
+// clears Rd of cmp when it finishes
+func (i *InstructionIR) writesIntR(r uint8) (writes, aux bool) {
+	if r == 0 || i.BaseInstruction == nil {
+		return false, false
+	}
+	b := i.BaseInstruction
+	sp, lr := types.IntegerRegisters["sp"], types.IntegerRegisters["lr"]
+	switch b.OpType {
+	case types.LoadStore:
+		if (b.MemMode == types.PUSH || b.MemMode == types.POP) && r == sp {
+			return true, true // writeback writes RDestAux after Rd
+		}
+		return b.Rd == r && i.isLoad(), false
+	case types.Control:
+		return b.CtrlMode == types.CALL.Mode && b.CtrlFlag == types.CALL.Flag && r == lr, true
+	case types.RegImm:
+		if b.ALU == types.IMM_CMP || b.ALU == types.IMM_SR && b.Imm&types.SR_WRITE != 0 {
+			return false, false // mtsr writes its source back unchanged
+		}
+	case types.RegReg:
+		if b.ALU == types.REG_CMP && i.FloatInstruction == nil && i.VectorInstruction == nil {
+			return false, false
+		}
+	}
+	return b.Rd == r, false
+}
+
+// Returns true if the instruction loads an integer register from memory
+func (i *InstructionIR) isLoad() bool {
+	b := i.BaseInstruction
+	return b.OpType == types.LoadStore && (b.MemMode == types.LDW || b.MemMode == types.POP) &&
+		i.FloatInstruction == nil && i.VectorInstruction == nil
+}
+
+// Returns true if the instruction is mfsr, whose result is only known in writeback
+func (i *InstructionIR) isMfsr() bool {
+	b := i.BaseInstruction
+	return b.OpType == types.RegImm && b.ALU == types.IMM_SR && b.Imm&types.SR_WRITE == 0
+}
+
+// Reads integer register r for the instruction in decode. With forwarding the value comes from
+// an older instruction that has computed it, or from the register file if none writes it
+func (d *DecodeStage) readIntR(r uint8) (uint32, int32) {
+	cpu := d.pipe.cpu
+	if !d.pipe.Forwarding || r == 0 {
+		return cpu.ReadIntR(r)
+	}
+	ex, mem := d.next, d.next.next
+	older := []struct {
+		inst *InstructionIR
+		done bool // the stage has finished its work on the instruction
+	}{
+		{ex.currInst, ex.state == EXEC_done},
+		{mem.currInst, !mem.waiting},
+	}
+	for _, o := range older {
+		if o.inst == nil {
+			continue
+		}
+		writes, aux := o.inst.writesIntR(r)
+		if !writes {
+			continue
+		}
+		ready := o.done && o.inst.Exception == EXC_NONE
+		if !aux {
+			ready = ready && !o.inst.isMfsr() && !(o.inst == ex.currInst && o.inst.isLoad())
+		}
+		if !ready {
+			return 0, READ_BLOCKED
+		}
+		if aux {
+			return o.inst.ResultAux, SUCCESS
+		}
+		return o.inst.Result, SUCCESS
+	}
+	return cpu.ReadIntRNoBlock(r), SUCCESS
+}
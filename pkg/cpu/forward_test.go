@@ -0,0 +1,39 @@
+package cpu
+
+import (
+	"testing"
+
+	"github.com/leon332157/risc-y-8/pkg/types"
+)
+
+func TestWritesIntR(t *testing.T) {
+	sp, lr := types.IntegerRegisters["sp"], types.IntegerRegisters["lr"]
+	var test = []struct {
+		name   string
+		inst   InstructionIR
+		r      uint8
+		writes bool
+		aux    bool
+	}{
+		{"add", InstructionIR{BaseInstruction: &types.BaseInstruction{OpType: types.RegImm, ALU: types.IMM_ADD, Rd: 3}}, 3, true, false},
+		{"add other", InstructionIR{BaseInstruction: &types.BaseInstruction{OpType: types.RegImm, ALU: types.IMM_ADD, Rd: 3}}, 4, false, false},
+		{"cmp", InstructionIR{BaseInstruction: &types.BaseInstruction{OpType: types.RegImm, ALU: types.IMM_CMP, Rd: 3}}, 3, false, false},
+		{"cmp reg", InstructionIR{BaseInstruction: &types.BaseInstruction{OpType: types.RegReg, ALU: types.REG_CMP, Rd: 3, Rs: 4}}, 3, false, false},
+		{"mtsr", InstructionIR{BaseInstruction: &types.BaseInstruction{OpType: types.RegImm, ALU: types.IMM_SR, Rd: 3, Imm: types.SR_EPC | types.SR_WRITE}}, 3, false, false},
+		{"mfsr", InstructionIR{BaseInstruction: &types.BaseInstruction{OpType: types.RegImm, ALU: types.IMM_SR, Rd: 3, Imm: types.SR_EPC}}, 3, true, false},
+		{"ldw", InstructionIR{BaseInstruction: &types.BaseInstruction{OpType: types.LoadStore, MemMode: types.LDW, Rd: 3, RMem: 4}}, 3, true, false},
+		{"ldw base", InstructionIR{BaseInstruction: &types.BaseInstruction{OpType: types.LoadStore, MemMode: types.LDW, Rd: 3, RMem: 4}}, 4, false, false},
+		{"stw", InstructionIR{BaseInstruction: &types.BaseInstruction{OpType: types.LoadStore, MemMode: types.STW, Rd: 3, RMem: 4}}, 3, false, false},
+		{"push sp", InstructionIR{BaseInstruction: &types.BaseInstruction{OpType: types.LoadStore, MemMode: types.PUSH, Rd: 3}}, sp, true, true},
+		{"pop", InstructionIR{BaseInstruction: &types.BaseInstruction{OpType: types.LoadStore, MemMode: types.POP, Rd: 3}}, 3, true, false},
+		{"call", InstructionIR{BaseInstruction: &types.BaseInstruction{OpType: types.Control, CtrlMode: types.CALL.Mode, CtrlFlag: types.CALL.Flag}}, lr, true, true},
+		{"branch", InstructionIR{BaseInstruction: &types.BaseInstruction{OpType: types.Control, CtrlMode: types.UNC.Mode, CtrlFlag: types.UNC.Flag}}, lr, false, true},
+		{"r0", InstructionIR{BaseInstruction: &types.BaseInstruction{OpType: types.RegImm, ALU: types.IMM_ADD}}, 0, false, false},
+	}
+	for _, tt := range test {
+		writes, aux := tt.inst.writesIntR(tt.r)
+		if writes != tt.writes || writes && aux != tt.aux {
+			t.Errorf("%s: expected writes %v aux %v, got %v %v", tt.name, tt.writes, tt.aux, writes, aux)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package cpu
+
+import (
+	"fmt"
+	"math/bits"
+
+	"github.com/leon332157/risc-y-8/pkg/types"
+)
+
+// Interrupt lines of the interrupt controller. A device raises its line by setting its bit in
+// ipend, the cpu takes the lowest pending line whose bit is set in imask while STATUS_IE is set.
+// Interrupts are taken between two instructions when an instruction completes writeback, epc
+// is the address of the instruction that would have run next, so a handler returns with iret
+// without adjusting epc. Taking an interrupt clears its bit in ipend, and the handler runs at
+// the vector table entry tvec + 4*(EXC_INTERRUPT + line) with interrupts disabled
+const (
+	IRQ_TIMER = 0 // the timer device, lines 1 to 7 are raised by RaiseInterrupt
+	IRQ_COUNT = 8
+)
+
+// Cause of interrupt line n is EXC_INTERRUPT + n
+const EXC_INTERRUPT ExceptionCause = 8
+
+func LookUpInterrupt(line uint) string {
+	if line == IRQ_TIMER {
+		return "timer interrupt"
+	}
+	return fmt.Sprintf("external interrupt %d", line)
+}
+
+// The timer counts clock cycles and raises IRQ_TIMER when the clock reaches Compare. A
+// periodic timer, such as the tick of a preemptive scheduler, sets Period to the cycles
+// between interrupts
+type Timer struct {
+	Compare uint32 // tcmp, 0 stops the timer
+	Period  uint32 // tperiod, 0 stops the timer after it fires once
+}
+
+// Returns true if the timer fires at the clock
+func (t *Timer) Tick(clock uint32) bool {
+	if t.Compare == 0 || clock < t.Compare {
+		return false
+	}
+	if t.Period == 0 {
+		t.Compare = 0
+		return true
+	}
+	for t.Compare <= clock {
+		t.Compare += t.Period
+	}
+	return true
+}
+
+// Sets interrupt line to pending, it is taken once it is enabled
+func (c *CPU) RaiseInterrupt(line uint) {
+	if line >= IRQ_COUNT {
+		c.log.Panic().Msgf("attempted to raise an out of bounds interrupt line: %v", line)
+	}
+	c.IPend |= 1 << line
+}
+
+// Advance the devices of the cpu by one clock
+func (c *CPU) tick() {
+	if c.Timer.Tick(c.Clock) {
+		c.log.Info().Msgf("timer fired at clock %v", c.Clock)
+		c.RaiseInterrupt(IRQ_TIMER)
+	}
+}
+
+// Take the lowest pending interrupt if interrupts are enabled, called after an instruction
+// completes writeback. next is the address of the instruction that would run next
+func (c *CPU) pollInterrupt(next uint32) bool {
+	if c.Halted || c.Status&types.STATUS_IE == 0 {
+		return false
+	}
+	pending := c.IPend & c.IMask
+	if pending == 0 {
+		return false
+	}
+	line := uint(bits.TrailingZeros32(pending))
+	c.IPend &^= 1 << line
+	c.trap(next, EXC_INTERRUPT+ExceptionCause(line), 0)
+	return true
+}
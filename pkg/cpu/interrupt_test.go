@@ -0,0 +1,41 @@
+package cpu
+
+import (
+	"testing"
+)
+
+func TestTimerTick(t *testing.T) {
+	var test = []struct {
+		name  string
+		timer Timer
+		fires []uint32 // clocks in 0-20 at which the timer fires
+	}{
+		{"stopped", Timer{}, nil},
+		{"one shot", Timer{Compare: 5}, []uint32{5}},
+		{"periodic", Timer{Compare: 5, Period: 6}, []uint32{5, 11, 17}},
+	}
+	for _, tt := range test {
+		var fires []uint32
+		for clock := uint32(0); clock <= 20; clock++ {
+			if tt.timer.Tick(clock) {
+				fires = append(fires, clock)
+			}
+		}
+		if len(fires) != len(tt.fires) {
+			t.Errorf("%s: expected to fire at %v, fired at %v", tt.name, tt.fires, fires)
+			continue
+		}
+		for i := range fires {
+			if fires[i] != tt.fires[i] {
+				t.Errorf("%s: expected to fire at %v, fired at %v", tt.name, tt.fires, fires)
+				break
+			}
+		}
+	}
+
+	// a compare value in the past fires once and catches up with the clock
+	timer := Timer{Compare: 3, Period: 4}
+	if !timer.Tick(20) || timer.Compare != 23 {
+		t.Errorf("expected to fire and set compare to 23, got %v", timer.Compare)
+	}
+}
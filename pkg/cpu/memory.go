@@ -10,6 +10,8 @@ import (
 type MemoryStage struct {
 	currInst *InstructionIR  // Pointer to the InstructionIR being processed in this stage
 	waiting            bool
+	splitDone          uint   // bytes of a split access that are done
+	splitValue         uint32 // bytes loaded so far
 
 	pipeline           *Pipeline       // Reference to the pipeline instance
 	next               *WriteBackStage // Next stage in the pipeline
@@ -57,60 +59,219 @@ func (m *MemoryStage) Execute() {
 		m.instStr = "<bubble>"
 		return
 	}
-	m.instStr = fmt.Sprintf("OpType: %x\nMem Mode: %x\nRd: %x\nRMem: %x\nDestMemAddr: %x", inst.BaseInstruction.OpType, inst.BaseInstruction.MemMode, inst.BaseInstruction.Rd, inst.BaseInstruction.RMem, inst.DestMemAddr)
+	dest := fmt.Sprintf("%x", inst.DestMemAddr)
+	if inst.BaseInstruction.OpType == types.Control {
+		dest = m.pipeline.formatTarget(inst.DestMemAddr)
+	}
+	m.instStr = fmt.Sprintf("OpType: %x\nMem Mode: %x\nRd: %x\nRMem: %x\nDestMemAddr: %s", inst.BaseInstruction.OpType, inst.BaseInstruction.MemMode, inst.BaseInstruction.Rd, inst.BaseInstruction.RMem, dest)
+	if inst.Exception != EXC_NONE {
+		m.pipeline.sTracef(m, "Instruction raised %s, skipping memory access", LookUpException(inst.Exception))
+		m.instStr += fmt.Sprintf("\nException: %s", LookUpException(inst.Exception))
+		return
+	}
 	if inst.BaseInstruction.OpType != types.LoadStore {
 		m.pipeline.sTracef(m, "Current instruction is not a load/store type, skipping memory stage execution %+v\n", inst) // For debugging purposes, skip if not a load/store instruction
 		return
 	} else {
 		m.pipeline.sTracef(m, "[MemoryStage Execute] Processing instruction: %+v\n", inst) // For debugging purposes
 	}
-	cache := m.pipeline.cpu.Cache
-	destAddr := uint(inst.DestMemAddr)
+	if inst.VectorInstruction != nil {
+		m.vector()
+		return
+	}
+	if inst.SubWordInstruction != nil {
+		m.subWord()
+		return
+	}
 	switch inst.BaseInstruction.MemMode {
 	case types.LDW, types.POP:
-		attempt := cache.Read(destAddr, memory.MEMORY_STAGE) // Attempt to read from cache
-		if attempt.State != memory.SUCCESS {
-			m.pipeline.sTracef(m, "Failed to load from cache at address 0x%X, state: %s\n", inst.DestMemAddr, memory.LookUpMemoryResult(attempt.State))
-		}
-		if attempt.State == memory.WAIT || attempt.State == memory.WAIT_NEXT_LEVEL {
-			// Handle waiting or next level cache logic here if needed
-			m.pipeline.sTracef(m, "Waiting for cache read at address 0x%X\n", inst.DestMemAddr)
-			m.waiting = true
-			return // Do not proceed further until the cache read is successful
-		} else {
-			// Successfully read from cache, set the result in the current instruction
-			m.currInst.Result = uint32(attempt.Value) // Set the result to the value read from cache
-			m.waiting = false
-			m.pipeline.sTracef(m, "Successfully loaded from cache at address 0x%X, value: %d\n", inst.DestMemAddr, inst.Result)
-			if m.currInst.BaseInstruction.MemMode == types.POP {
-				m.currInst.DestMemAddr--
-			}
+		value, done := m.access(uint(inst.DestMemAddr), 4, false, 0)
+		if !done {
+			return // Do not proceed further until the load has completed
 		}
+		m.currInst.Result = value
+		m.pipeline.sTracef(m, "Successfully loaded from cache at address 0x%X, value: %d\n", inst.DestMemAddr, inst.Result)
 
 	case types.STW, types.PUSH:
 		m.pipeline.sTracef(m, "Attempting to store value %d to cache at address 0x%X\n", m.currInst.Result, inst.DestMemAddr) // For debugging purposes
-		writeResult := cache.Write(destAddr, memory.MEMORY_STAGE, m.currInst.Result)                                          // Attempt to write to cache
-		if writeResult.State != memory.SUCCESS {
-			// Handle failure to write to cache
-			m.pipeline.sTracef(m, "Failed to store to cache at address 0x%X, state: %s\n", m.currInst.DestMemAddr, memory.LookUpMemoryResult(writeResult.State))
+		if _, done := m.access(uint(inst.DestMemAddr), 4, true, inst.Result); !done {
+			return
 		}
+		m.pipeline.sTracef(m, "Successfully stored to cache at address 0x%X\n", m.currInst.DestMemAddr)
+		m.pipeline.cpu.unblockIntR(m.currInst.BaseInstruction.Rd) // Unblock the register after successful write
+		m.currInst.stored = true // writeback must not unblock Rd again once a younger instruction blocked it
+		m.stored(uint(inst.DestMemAddr), 4)
+
+	default:
+		m.pipeline.log.Panic().Msgf("[Memory Stage] Unsupported memory operation: %d", m.currInst.BaseInstruction.MemMode) // Handle unsupported memory operations
+	}
+}
+
+// Load or store a whole vector with a single cache access, the address is aligned by execute
+func (m *MemoryStage) vector() {
+	inst := m.currInst
+	cache := m.pipeline.cpu.Cache
+	destAddr := uint(inst.DestMemAddr)
+	switch inst.VectorInstruction.MemMode {
+	case types.LDW:
+		attempt := cache.ReadMulti(destAddr, types.VectorLanes, 0, memory.MEMORY_STAGE)
+		if attempt.State == memory.WAIT || attempt.State == memory.WAIT_NEXT_LEVEL {
+			m.pipeline.sTracef(m, "Waiting for cache vector read at address 0x%X\n", inst.DestMemAddr)
+			m.waiting = true
+			return
+		}
+		if attempt.State != memory.SUCCESS {
+			m.failed(destAddr, attempt.State)
+			return
+		}
+		copy(inst.VectorResult[:], attempt.Value)
+		m.waiting = false
+		m.pipeline.sTracef(m, "Successfully loaded vector from cache at address 0x%X, value: %x\n", inst.DestMemAddr, inst.VectorResult)
+
+	case types.STW:
+		writeResult := cache.WriteMulti(destAddr, memory.MEMORY_STAGE, inst.VectorResult[:])
 		if writeResult.State == memory.WAIT || writeResult.State == memory.WAIT_NEXT_LEVEL {
-			// Handle waiting or next level cache logic here if needed
-			m.pipeline.sTracef(m, "Waiting for cache write at address 0x%X\n", m.currInst.DestMemAddr)
+			m.pipeline.sTracef(m, "Waiting for cache vector write at address 0x%X\n", inst.DestMemAddr)
 			m.waiting = true
-		} else {
-			// Successfully wrote to cache
-			if m.currInst.BaseInstruction.MemMode == types.PUSH {
-				m.currInst.DestMemAddr++
-			}
-			m.pipeline.sTracef(m, "Successfully stored to cache at address 0x%X\n", m.currInst.DestMemAddr)
-			m.pipeline.cpu.unblockIntR(m.currInst.BaseInstruction.Rd) // Unblock the register after successful write
-			m.waiting = false // Clear waiting state since the write was successful
+			return
+		}
+		if writeResult.State != memory.SUCCESS {
+			m.failed(destAddr, writeResult.State)
+			return
+		}
+		m.waiting = false
+		m.pipeline.sTracef(m, "Successfully stored vector to cache at address 0x%X\n", inst.DestMemAddr)
+		m.stored(destAddr, 4*types.VectorLanes)
+	}
+}
+
+// Load or store a byte or halfword, as a word load or store but sign or zero extended
+func (m *MemoryStage) subWord() {
+	inst := m.currInst
+	sw := inst.SubWordInstruction
+	if sw.MemMode == types.SUB_STORE {
+		if _, done := m.access(uint(inst.DestMemAddr), sw.Bytes(), true, inst.Result); !done {
+			return
+		}
+		m.pipeline.cpu.unblockIntR(sw.Rd)
+		inst.stored = true // as for stw
+		m.stored(uint(inst.DestMemAddr), sw.Bytes())
+	} else {
+		value, done := m.access(uint(inst.DestMemAddr), sw.Bytes(), false, 0)
+		if !done {
+			return
 		}
+		inst.Result = sw.Extend(value)
+	}
+	m.pipeline.sTracef(m, "Byte access at address 0x%X done, value: %x\n", inst.DestMemAddr, inst.Result)
+}
 
+// Load or store the low size bytes of value at addr, a load returns the bytes it read. An
+// aligned access takes a single cache access, a word or halfword at an address that is not a
+// multiple of its size is split into byte accesses, one per clock, or raises EXC_MISALIGNED
+// when the alignment policy is ALIGN_TRAP. Returns false until the access has completed, and
+// when it raised an exception
+func (m *MemoryStage) access(addr, size uint, store bool, value uint32) (uint32, bool) {
+	inst := m.currInst
+	cache := m.pipeline.cpu.Cache
+	split := addr%size != 0
+	if split {
+		if m.pipeline.cpu.Alignment == ALIGN_TRAP {
+			m.pipeline.sTracef(m, "Misaligned %d byte access at address 0x%X", size, addr)
+			inst.raise(EXC_MISALIGNED, uint32(addr))
+			m.instStr += fmt.Sprintf("\nException: %s", LookUpException(inst.Exception))
+			return 0, false
+		}
+		addr = addr + m.splitDone
+	}
+	n := size // bytes accessed this clock
+	if split {
+		n = 1
+	}
+	var state memory.MemoryResult
+	switch {
+	case store && n == 4:
+		state = cache.Write(addr, memory.MEMORY_STAGE, value).State
+	case store:
+		state = cache.WriteBytes(addr, memory.MEMORY_STAGE, value>>(8*m.splitDone), n).State
 	default:
-		m.pipeline.log.Panic().Msgf("[Memory Stage] Unsupported memory operation: %d", m.currInst.BaseInstruction.MemMode) // Handle unsupported memory operations
+		attempt := cache.Read(addr&^3, memory.MEMORY_STAGE) // the aligned word holding the bytes
+		state = attempt.State
+		if state == memory.SUCCESS {
+			bytes := attempt.Value >> (8 * (addr % 4)) & (1<<(8*n) - 1)
+			m.splitValue |= bytes << (8 * m.splitDone)
+		}
+	}
+	if state == memory.WAIT || state == memory.WAIT_NEXT_LEVEL {
+		m.pipeline.sTracef(m, "Waiting for cache access at address 0x%X\n", addr)
+		m.waiting = true
+		return 0, false
+	}
+	if state != memory.SUCCESS {
+		m.failed(addr, state)
+		return 0, false
 	}
+	if split && m.splitDone+1 < size {
+		// one more byte done, the next is accessed in the next clock
+		m.splitDone++
+		m.waiting = true
+		return 0, false
+	}
+	value = m.splitValue
+	m.splitDone, m.splitValue = 0, 0
+	m.waiting = false
+	return value, true
+}
+
+// Raises an exception on the current instruction for an access to byte address addr the memory
+// failed with state, instead of retrying it. A failure the cache passes up from a refill is
+// reported the same as one of the level the stage accesses
+func (m *MemoryStage) failed(addr uint, state memory.MemoryResult) {
+	m.pipeline.sTracef(m, "Access to address 0x%X failed: %s", addr, memory.LookUpMemoryResult(state))
+	if state == memory.FAILURE_MISALIGNED {
+		m.currInst.raise(EXC_MISALIGNED, uint32(addr))
+	} else {
+		m.currInst.raise(EXC_BAD_ADDRESS, uint32(addr))
+	}
+	m.instStr += fmt.Sprintf("\nException: %s", LookUpException(m.currInst.Exception))
+	m.splitDone, m.splitValue = 0, 0
+	m.waiting = false
+}
+
+// Keeps instruction fetch coherent with a store that has just written n bytes at byte address
+// addr. The instruction cache of a split L1 drops the lines holding them, and if an instruction
+// younger than the store was fetched from one of the words, execute, decode and fetch are
+// squashed and fetch starts over at the oldest of them, so code a program writes runs as
+// written from the instruction after the store on
+func (m *MemoryStage) stored(addr, n uint) {
+	cpu := m.pipeline.cpu
+	first, last := addr&^3, (addr+n-1)&^3
+	if cpu.ICache != nil {
+		for a := first; a <= last; a += 4 {
+			cpu.ICache.Invalidate(a)
+		}
+	}
+	exec := m.prev
+	younger := []*InstructionIR{exec.currInst, exec.prev.currInst, exec.prev.prev.currInst} // oldest first
+	stale := false
+	for _, i := range younger {
+		if i != nil && uint(i.PC) >= first && uint(i.PC) <= last {
+			stale = true
+		}
+	}
+	if !stale {
+		return
+	}
+	for _, i := range younger {
+		if i != nil {
+			m.pipeline.sTracef(m, "Store wrote code fetched already, fetching again from %v", i.PC)
+			cpu.ProgramCounter = i.PC
+			break
+		}
+	}
+	exec.Squash()
+	exec.prev.Squash()
+	exec.prev.prev.Squash()
 }
 
 func (m *MemoryStage) Advance(i *InstructionIR, prevstalled bool) bool {
@@ -138,21 +299,28 @@ func (m *MemoryStage) Advance(i *InstructionIR, prevstalled bool) bool {
 func (m *MemoryStage) Squash() bool {
 	m.pipeline.sTracef(m, "Squashing instruction: %+v\n", m.currInst) // For debugging purposes
 	if m.currInst != nil {
-		m.pipeline.cpu.unblockIntR(m.currInst.BaseInstruction.Rd) // Unblock the register if it was blocked
-		m.pipeline.cpu.unblockIntR(m.currInst.BaseInstruction.RMem) // Unblock the memory register if it was blocked
+		m.pipeline.cpu.unblockIntR(m.currInst.intDest()) // Unblock the register if it was blocked
+		m.pipeline.cpu.unblockIntR(m.currInst.memBase()) // Unblock the memory register if it was blocked
 		m.pipeline.cpu.unblockIntR(m.currInst.RDestAux) // Unblock the auxiliary register if it was blocked
+		if f, ok := m.currInst.FloatDest(); ok {
+			m.pipeline.cpu.unblockFloatR(f)
+		}
+		if v, ok := m.currInst.VectorDest(); ok {
+			m.pipeline.cpu.unblockVectorR(v)
+		}
 	}
 	m.currInst = nil
 	m.waiting = false
+	m.splitDone, m.splitValue = 0, 0
 
 	// Cancel request to memory/cache if necessary
 	cache := m.pipeline.cpu.Cache
 	ram := m.pipeline.cpu.RAM
-	// Check if cache/ram currently serving MEM_STAGE
+	// Check if cache/ram currently serving MEM_STAGE, the cache also cancels the levels below it
 	if cache.Requester() == memory.MEMORY_STAGE {
 		m.pipeline.sTrace(m, "Cancelling Cache Memory Stage Request") // for debugging
-		m.pipeline.cpu.Cache.CancelRequest()
 	}
+	cache.Cancel(memory.MEMORY_STAGE)
 	if ram.Requester() == memory.MEMORY_STAGE {
 		m.pipeline.sTrace(m, "Cancelling RAM Memory Stage Request") // for debugging
 		m.pipeline.cpu.RAM.CancelRequest()
@@ -167,3 +335,7 @@ func (m *MemoryStage) CanAdvance() bool {
 func (m *MemoryStage) FormatInstruction() string {
 	return m.instStr
 }
+
+func (m *MemoryStage) Instruction() *InstructionIR {
+	return m.currInst
+}
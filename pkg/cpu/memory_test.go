@@ -0,0 +1,41 @@
+package cpu
+
+import (
+	"testing"
+
+	"github.com/leon332157/risc-y-8/pkg/memory"
+	"github.com/leon332157/risc-y-8/pkg/types"
+	"github.com/rs/zerolog"
+)
+
+func TestMemoryAccessFailureTraps(t *testing.T) {
+	// the refill of a line past the end of RAM fails, execute raises EXC_BAD_ADDRESS for such an
+	// address, here the failure reaches the memory stage as from a level execute does not check
+	const addr = 64
+	var test = []struct {
+		name string
+		inst *InstructionIR
+	}{
+		{"ldw", &InstructionIR{BaseInstruction: &types.BaseInstruction{OpType: types.LoadStore, MemMode: types.LDW}}},
+		{"stw", &InstructionIR{BaseInstruction: &types.BaseInstruction{OpType: types.LoadStore, MemMode: types.STW}}},
+		{"vldw", &InstructionIR{BaseInstruction: &types.BaseInstruction{OpType: types.LoadStore}, VectorInstruction: &types.VectorInstruction{MemMode: types.LDW}}},
+		{"vstw", &InstructionIR{BaseInstruction: &types.BaseInstruction{OpType: types.LoadStore}, VectorInstruction: &types.VectorInstruction{MemMode: types.STW}}},
+	}
+	for _, tt := range test {
+		ram := memory.CreateRAM(4, 4, 1)
+		cache := memory.CreateCache(2, 1, 4, 0, &ram)
+		log := zerolog.Nop()
+		m := &MemoryStage{pipeline: &Pipeline{cpu: &CPU{Cache: &cache}, log: &log}}
+		m.currInst = tt.inst
+		tt.inst.DestMemAddr = addr
+		for i := 0; i < 10 && tt.inst.Exception == EXC_NONE; i++ {
+			m.Execute()
+		}
+		if tt.inst.Exception != EXC_BAD_ADDRESS || tt.inst.TrapValue != addr {
+			t.Errorf("%s: expected %s with tval %d, got %s %d", tt.name, LookUpException(EXC_BAD_ADDRESS), addr, LookUpException(tt.inst.Exception), tt.inst.TrapValue)
+		}
+		if m.waiting {
+			t.Errorf("%s: expected the stage not to wait after the access failed", tt.name)
+		}
+	}
+}
@@ -40,6 +40,11 @@ type Pipeline struct {
 	cpu        *CPU            // Reference to the CPU instance
 	canFetch   bool
 	scalarMode bool // Flag to indicate if the pipeline is in scalar mode
+	Forwarding bool // decode takes integer operands from older instructions that computed them, see readIntR
+	Branch     *BranchUnit // predicts branches, nil resolves them in writeback, see BranchPredictor
+
+	Symbolize func(addr uint32) string // for TUI, names branch targets in FormatInstruction, nil shows them in hex
+	worked    []*InstructionIR         // instruction each stage worked on in the last clock
 }
 
 func (p *Pipeline) AddStage(stage Stage) {
@@ -66,8 +71,13 @@ func (p *Pipeline) RunOneClock() {
 }
 
 func (p *Pipeline) RunBackPass() {
+	p.worked = make([]*InstructionIR, len(p.Stages))
 	for i := 0; i < len(p.Stages); i++ {
+		p.worked[i] = p.Stages[i].Instruction()
 		p.Stages[i].Execute()
+		if p.worked[i] == nil {
+			p.worked[i] = p.Stages[i].Instruction() // fetched this clock
+		}
 	}
 	p.pLog.Trace().Msgf("canFetch: %v\n", p.canFetch)
 }
@@ -75,6 +85,7 @@ func (p *Pipeline) RunBackPass() {
 func (p *Pipeline) RunForwardPass() {
 	p.Stages[len(p.Stages)-1].Advance(nil, p.canFetch) // Ensure the last stage can advance even if no instruction was passed to it, this is for the last stage in the pipeline (like WriteBack)
 	p.cpu.Clock++
+	p.cpu.tick()
 }
 
 func (p *Pipeline) WriteBackHook() {
@@ -89,6 +100,23 @@ func (p *Pipeline) SquashALL() {
 	}
 }
 
+// Returns the instruction stage i worked on in the last clock, which FormatInstruction
+// describes, or nil for a bubble. The instruction may have moved on to the next stage since
+func (p *Pipeline) StageInstruction(i int) *InstructionIR {
+	if i < 0 || i >= len(p.worked) {
+		return nil
+	}
+	return p.worked[i]
+}
+
+// Format a branch target with Symbolize if it is set
+func (p *Pipeline) formatTarget(addr uint32) string {
+	if p.Symbolize == nil {
+		return fmt.Sprintf("%x", addr)
+	}
+	return p.Symbolize(addr)
+}
+
 func (p *Pipeline) sTrace(stage Stage, msg string) {
 	if stage == nil {
 		return
@@ -130,21 +158,144 @@ type Stage interface {
 	Squash() bool                                          // Squash the instruction in the stage, return true if the stage was squashed
 	CanAdvance() bool                                      // Check if the stage can take in new instruction
 	FormatInstruction() string                             // for TUI
+	Instruction() *InstructionIR                           // for TUI, the instruction in the stage or nil
 }
 
 type AssembledInst interface {
 }
 type InstructionIR struct {
 	BaseInstruction *types.BaseInstruction // base instruction structure, if applicable
-	//FloatInstruction types.FloatInstruction
-	//VecInstruction types.VecInstruction
+	FloatInstruction *types.FloatInstruction // float instruction, BaseInstruction then holds the integer registers it uses
+	VectorInstruction *types.VectorInstruction // vector instruction, BaseInstruction then holds the integer registers it uses
+	SubWordInstruction *types.SubWordInstruction // byte or halfword load/store, BaseInstruction then holds it as an ldw or stw
+	VectorOperand  [4]uint32 // Vs of a vector instruction, vt for vdot
+	VectorResult   [4]uint32 // Vd of a vector instruction, vs for vdot
 	Operand        uint32
 	Result         uint32 // Calculated as "result = Rd op Rs/imm"
 	RDestAux       uint8  // Auxiliary register destination, used in some instructions (like PUSH, POP, CALL)
 	ResultAux      uint32 // Auxiliary Result of the instruction, used in some instructions (like PUSH, POP, CALL)
 	DestMemAddr    uint32 // Memory address for load/store operations, and branch destination
 	BranchTaken    bool
+	Exception      ExceptionCause // exception raised by the instruction, taken when it reaches writeback
+	TrapValue      uint32         // value for tval when the exception is taken
+	PC             uint32 // Address the instruction was fetched from
+	NextPC         uint32 // Address fetch continued at after the instruction, checked against the branch outcome in execute
 	rawInstruction uint32 // The instruction to be executed
+	stored         bool   // a store that has written memory, see intDest
+	btbHit         bool   // fetch found the instruction in the BTB, counted once execute resolves it as a branch
+	history        uint32 // history the predictor predicted the branch with in decode, passed back when execute resolves it
+}
+
+// encoding of hlt, "bunc [r0 - 1]", a branch to itself
+var haltInstruction = (&types.BaseInstruction{
+	OpType:   types.Control,
+	CtrlMode: types.UNC.Mode,
+	CtrlFlag: types.UNC.Flag,
+	Imm:      -1,
+}).Encode()
+
+// Returns true if the instruction is hlt, which stops the cpu when it reaches writeback
+func (i *InstructionIR) IsHalt() bool {
+	if i == nil || i.BaseInstruction == nil {
+		return false
+	}
+	b := i.BaseInstruction
+	return b.OpType == types.Control && b.RMem == 0 && b.Imm == -1
+}
+
+// Returns true if the instruction is iret, which branches to epc when it reaches writeback
+func (i *InstructionIR) IsIret() bool {
+	if i == nil || i.BaseInstruction == nil {
+		return false
+	}
+	b := i.BaseInstruction
+	return b.OpType == types.Control && b.CtrlMode == types.IRET.Mode && b.CtrlFlag == types.IRET.Flag
+}
+
+// Returns true if the instruction is ecall, which is serviced when it reaches writeback
+func (i *InstructionIR) IsEcall() bool {
+	if i == nil || i.BaseInstruction == nil {
+		return false
+	}
+	b := i.BaseInstruction
+	return b.OpType == types.Control && b.CtrlMode == types.ECALL.Mode && b.CtrlFlag == types.ECALL.Flag
+}
+
+// Integer view of a float instruction with the integer registers it reads and writes, so the
+// stages block, unblock and write them back as for a base instruction
+func floatBase(f *types.FloatInstruction) *types.BaseInstruction {
+	b := &types.BaseInstruction{OpType: f.OpType, RMem: f.RMem, MemMode: f.MemMode, Imm: f.Imm}
+	if f.OpType == types.RegReg && types.FloatWritesInt(f.FPU) {
+		b.Rd = f.Fd
+	}
+	if f.OpType == types.RegReg && types.FloatReadsInt(f.FPU) {
+		b.Rs = f.Fs
+	}
+	return b
+}
+
+// Returns the float register written by the instruction, if any
+func (i *InstructionIR) FloatDest() (uint8, bool) {
+	if i == nil || i.FloatInstruction == nil {
+		return 0, false
+	}
+	f := i.FloatInstruction
+	if f.OpType == types.LoadStore {
+		return f.Fd, f.MemMode == types.LDW
+	}
+	return f.Fd, f.FPU != types.FPU_CMP && !types.FloatWritesInt(f.FPU)
+}
+
+// Returns the integer register writeback writes Result to, r0 for none. A store writes none, its
+// Rd is the register it stores, which the memory stage unblocks once the store has completed
+func (i *InstructionIR) intDest() uint8 {
+	if i.stored {
+		return 0
+	}
+	return i.BaseInstruction.Rd
+}
+
+// Returns the base register of the instruction, r0 once a store has completed whose base is the
+// register it stores, as in stw r2, [r2], the memory stage unblocked it with Rd
+func (i *InstructionIR) memBase() uint8 {
+	if i.stored && i.BaseInstruction.RMem == i.BaseInstruction.Rd {
+		return 0
+	}
+	return i.BaseInstruction.RMem
+}
+
+// Integer view of a vector instruction, as floatBase
+func vectorBase(v *types.VectorInstruction) *types.BaseInstruction {
+	b := &types.BaseInstruction{OpType: v.OpType, RMem: v.RMem, MemMode: v.MemMode, Imm: v.Imm}
+	if v.OpType == types.RegReg && types.VectorWritesInt(v.VPU) {
+		b.Rd = v.Vd
+	}
+	if v.OpType == types.RegReg && types.VectorReadsInt(v.VPU) {
+		b.Rs = v.Vs
+	}
+	return b
+}
+
+// Returns the vector register written by the instruction, if any
+func (i *InstructionIR) VectorDest() (uint8, bool) {
+	if i == nil || i.VectorInstruction == nil {
+		return 0, false
+	}
+	v := i.VectorInstruction
+	if v.OpType == types.LoadStore {
+		return v.Vd, v.MemMode == types.LDW
+	}
+	return v.Vd, !types.VectorWritesInt(v.VPU)
+}
+
+// Base view of a byte or halfword load or store, an ldw or stw of the same registers
+// whose address is a byte address
+func subWordBase(s *types.SubWordInstruction) *types.BaseInstruction {
+	b := &types.BaseInstruction{OpType: types.LoadStore, Rd: s.Rd, RMem: s.RMem, MemMode: types.LDW, Imm: s.Imm}
+	if s.MemMode == types.SUB_STORE {
+		b.MemMode = types.STW
+	}
+	return b
 }
 
 func (i *InstructionIR) FormatLines() string {
@@ -152,11 +303,45 @@ func (i *InstructionIR) FormatLines() string {
 		return "<bubble>"
 	}
 	s := fmt.Sprintf("raw: %x\n", i.rawInstruction)
+	if i.Exception != EXC_NONE {
+		s += fmt.Sprintf("Exception: %s\n", LookUpException(i.Exception))
+	}
 	if i.BaseInstruction == nil {
 		s += "BaseInstruction: <nil>\n"
 		return s
 	}
 	s += fmt.Sprintf("OpType: %x\n", i.BaseInstruction.OpType)
+	if f := i.FloatInstruction; f != nil {
+		s += fmt.Sprintf("Fd: %x\n", f.Fd)
+		if f.OpType == types.RegReg {
+			s += fmt.Sprintf("FPU: %s\n", types.FloatALUInverse[f.FPU])
+			s += fmt.Sprintf("Fs: %x\n", f.Fs)
+		} else {
+			s += fmt.Sprintf("RMem: %x\n", f.RMem)
+			s += fmt.Sprintf("DestMemAddr: %x\n", i.DestMemAddr)
+			s += fmt.Sprintf("MemMode: %x\n", f.MemMode)
+		}
+		return s
+	}
+	if v := i.VectorInstruction; v != nil {
+		s += fmt.Sprintf("Vd: %x\n", v.Vd)
+		if v.OpType == types.RegReg {
+			s += fmt.Sprintf("VPU: %s\n", types.VectorALUInverse[v.VPU])
+			s += fmt.Sprintf("Vs: %x\n", v.Vs)
+		} else {
+			s += fmt.Sprintf("RMem: %x\n", v.RMem)
+			s += fmt.Sprintf("DestMemAddr: %x\n", i.DestMemAddr)
+			s += fmt.Sprintf("MemMode: %x\n", v.MemMode)
+		}
+		return s
+	}
+	if sw := i.SubWordInstruction; sw != nil {
+		s += fmt.Sprintf("Rd: %x\n", sw.Rd)
+		s += fmt.Sprintf("RMem: %x\n", sw.RMem)
+		s += fmt.Sprintf("DestMemAddr: %x (byte)\n", i.DestMemAddr)
+		s += fmt.Sprintf("Op: %s\n", types.SubWordOpsInverse[types.SubWordOp{Size: sw.Size, MemMode: sw.MemMode}])
+		return s
+	}
 	switch i.BaseInstruction.OpType {
 	case types.RegReg, types.RegImm:
 		s += fmt.Sprintf("Rd: %x\n", i.BaseInstruction.Rd)
@@ -0,0 +1,343 @@
+package cpu
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/leon332157/risc-y-8/pkg/types"
+)
+
+// Branch prediction. Without a BranchUnit fetch always continues at the next address and a
+// taken branch redirects fetch when it reaches writeback, squashing the whole pipeline. With
+// Pipeline.Branch set:
+//   - fetch continues at the target of a branch that hits in the BTB and is predicted taken
+//   - decode knows the target of every branch once it has read its registers, and redirects
+//     fetch to it if the branch is predicted taken, or back to the next address if fetch
+//     followed a stale BTB entry
+//   - execute resolves the branch and, if the address fetch continued at is wrong, squashes
+//     decode and fetch and redirects fetch to the right address
+//
+// so writeback only redirects for iret, whose target is epc. InstructionIR.NextPC is the
+// address fetch continued at after the instruction. The history a predictor predicts a branch
+// with is kept in the InstructionIR and passed back when the branch is resolved, as younger
+// branches may have been predicted in between
+type BranchPredictor interface {
+	Name() string
+	Predict(pc, target uint32) (taken bool, history uint32) // Returns true if the conditional branch at pc is predicted taken, and the history it was predicted with
+	Update(pc, target, history uint32, taken bool)          // Called when the conditional branch at pc is resolved
+}
+
+// Names of the predictors of NewPredictor
+var Predictors = []string{"not-taken", "btfn", "bimodal", "gshare"}
+
+// Returns the predictor called name, entries is the number of counters of bimodal and gshare
+// and is rounded down to a power of two
+func NewPredictor(name string, entries uint) (BranchPredictor, error) {
+	switch name {
+	case "not-taken":
+		return NotTaken{}, nil
+	case "btfn":
+		return BTFN{}, nil
+	case "bimodal":
+		return NewBimodal(entries), nil
+	case "gshare":
+		return NewGshare(entries), nil
+	}
+	return nil, fmt.Errorf("unknown branch predictor %s, expected one of %s", name, strings.Join(Predictors, ", "))
+}
+
+// Predicts every conditional branch not taken
+type NotTaken struct{}
+
+func (NotTaken) Name() string                       { return "not-taken" }
+func (NotTaken) Predict(_, _ uint32) (bool, uint32) { return false, 0 }
+func (NotTaken) Update(_, _, _ uint32, taken bool)  {}
+
+// Backward taken, forward not taken, predicts loops taken
+type BTFN struct{}
+
+func (BTFN) Name() string                             { return "btfn" }
+func (BTFN) Predict(pc, target uint32) (bool, uint32) { return target <= pc, 0 }
+func (BTFN) Update(_, _, _ uint32, taken bool)        {}
+
+// 2-bit saturating counters, 0 and 1 predict not taken and 2 and 3 taken
+type counters []uint8
+
+func newCounters(entries uint) counters {
+	size := uint(1)
+	for size*2 <= entries {
+		size *= 2
+	}
+	c := make(counters, size)
+	for i := range c {
+		c[i] = 1 // weakly not taken
+	}
+	return c
+}
+
+// Instructions are at multiples of 4, so the low two bits of their address do not index a table
+func slot(pc uint32) uint32 {
+	return pc >> 2
+}
+
+func (c counters) index(i uint32) uint32 {
+	return i & uint32(len(c)-1)
+}
+
+func (c counters) taken(i uint32) bool {
+	return c[c.index(i)] >= 2
+}
+
+func (c counters) update(i uint32, taken bool) {
+	i = c.index(i)
+	if taken && c[i] < 3 {
+		c[i]++
+	} else if !taken && c[i] > 0 {
+		c[i]--
+	}
+}
+
+// A table of 2-bit counters indexed by the address of the branch
+type Bimodal struct {
+	table counters
+}
+
+func NewBimodal(entries uint) *Bimodal {
+	return &Bimodal{table: newCounters(entries)}
+}
+
+func (b *Bimodal) Name() string                        { return "bimodal" }
+func (b *Bimodal) Predict(pc, _ uint32) (bool, uint32) { return b.table.taken(slot(pc)), 0 }
+func (b *Bimodal) Update(pc, _, _ uint32, taken bool)  { b.table.update(slot(pc), taken) }
+
+// A table of 2-bit counters indexed by the address of the branch xor the outcomes of the last
+// conditional branches, one bit per branch. The history is updated when a branch is resolved,
+// which may be after a younger branch was predicted, so a branch updates the counter it was
+// predicted with
+type Gshare struct {
+	table   counters
+	History uint32
+}
+
+func NewGshare(entries uint) *Gshare {
+	return &Gshare{table: newCounters(entries)}
+}
+
+func (g *Gshare) Name() string { return "gshare" }
+
+func (g *Gshare) Predict(pc, _ uint32) (bool, uint32) {
+	return g.table.taken(slot(pc) ^ g.History), g.History
+}
+
+func (g *Gshare) Update(pc, _, history uint32, taken bool) {
+	g.table.update(slot(pc)^history, taken)
+	g.History <<= 1
+	if taken {
+		g.History |= 1
+	}
+	g.History = g.table.index(g.History) // only as many bits as index the table
+}
+
+// Branch target buffer, a direct mapped table of the targets of taken branches. Fetch looks up
+// every instruction before it is known to be a branch, Hits and Misses count the lookups of the
+// branches execute resolves
+type BTB struct {
+	entries []btbEntry
+	Hits    uint32
+	Misses  uint32
+}
+
+type btbEntry struct {
+	valid  bool
+	pc     uint32
+	target uint32
+	always bool // unconditional branch or call, taken without asking the predictor
+}
+
+func NewBTB(entries uint) *BTB {
+	return &BTB{entries: make([]btbEntry, max(entries, 1))}
+}
+
+// Returns the target of the branch at pc, false if it is not in the BTB
+func (b *BTB) Lookup(pc uint32) (target uint32, always, ok bool) {
+	e := b.entries[slot(pc)%uint32(len(b.entries))]
+	if !e.valid || e.pc != pc {
+		return 0, false, false
+	}
+	return e.target, e.always, true
+}
+
+// Counts the lookup of a branch, hit if fetch found it in the BTB
+func (b *BTB) count(hit bool) {
+	if hit {
+		b.Hits++
+	} else {
+		b.Misses++
+	}
+}
+
+func (b *BTB) Insert(pc, target uint32, always bool) {
+	b.entries[slot(pc)%uint32(len(b.entries))] = btbEntry{valid: true, pc: pc, target: target, always: always}
+}
+
+// Outcomes of a branch, or of all branches
+type BranchStats struct {
+	Executed     uint32
+	Taken        uint32
+	Mispredicted uint32 // execute redirected fetch
+}
+
+// Returns the fraction of the branches that were predicted correctly
+func (s BranchStats) Accuracy() float64 {
+	if s.Executed == 0 {
+		return 0
+	}
+	return 1 - float64(s.Mispredicted)/float64(s.Executed)
+}
+
+func (s *BranchStats) add(o BranchStats) {
+	s.Executed += o.Executed
+	s.Taken += o.Taken
+	s.Mispredicted += o.Mispredicted
+}
+
+type BranchUnit struct {
+	Predictor BranchPredictor
+	BTB       *BTB                    // nil redirects fetch to predicted taken branches from decode
+	Stats     map[uint32]*BranchStats // by address of the branch
+}
+
+func NewBranchUnit(p BranchPredictor, btb *BTB) *BranchUnit {
+	return &BranchUnit{Predictor: p, BTB: btb, Stats: make(map[uint32]*BranchStats)}
+}
+
+// Returns the stats of all branches
+func (u *BranchUnit) Total() BranchStats {
+	var total BranchStats
+	for _, s := range u.Stats {
+		total.add(*s)
+	}
+	return total
+}
+
+// Returns the addresses of the branches that were executed in ascending order
+func (u *BranchUnit) Branches() []uint32 {
+	pcs := make([]uint32, 0, len(u.Stats))
+	for pc := range u.Stats {
+		pcs = append(pcs, pc)
+	}
+	sort.Slice(pcs, func(i, j int) bool { return pcs[i] < pcs[j] })
+	return pcs
+}
+
+// Returns the address fetch continues at after the instruction it has just fetched
+func (u *BranchUnit) fetchNext(inst *InstructionIR) uint32 {
+	pc := inst.PC
+	if u.BTB == nil {
+		return pc + 4
+	}
+	target, always, ok := u.BTB.Lookup(pc)
+	inst.btbHit = ok
+	if !ok {
+		return pc + 4
+	}
+	if !always {
+		if taken, _ := u.Predictor.Predict(pc, target); !taken {
+			return pc + 4
+		}
+	}
+	return target
+}
+
+// Returns true if the branch is resolved by the branch unit, halt, iret and ecall are left
+// to writeback
+func (i *InstructionIR) isPredicted() bool {
+	if i == nil || i.BaseInstruction == nil || i.BaseInstruction.OpType != types.Control || i.FloatInstruction != nil || i.VectorInstruction != nil {
+		return false
+	}
+	return !i.IsHalt() && !i.IsIret() && !i.IsEcall()
+}
+
+// Returns true if the branch is taken whatever the flags are
+func (i *InstructionIR) isUnconditional() bool {
+	mode := combineFlags(i.BaseInstruction.CtrlMode, i.BaseInstruction.CtrlFlag)
+	return mode == types.GetModeFlag(types.UNC) || mode == types.GetModeFlag(types.CALL)
+}
+
+// Returns the target of a branch from its base and offset as execute computes it, false if
+// it is not an instruction in RAM, where fetch is not redirected to before the branch is resolved
+func (c *CPU) branchTarget(base, offset uint32) (uint32, bool) {
+	size := int32(c.addressSpace())
+	target := (int32(base) + int32(offset)) % size
+	return uint32(target), target >= 0 && uint(target) < c.RAM.SizeBytes() && target%4 == 0
+}
+
+// Predicts the address after the instruction in decode now that its registers are read, and
+// redirects fetch if it continued somewhere else
+func (d *DecodeStage) predict() {
+	u, inst := d.pipe.Branch, d.currInst
+	if u == nil || inst.Exception != EXC_NONE {
+		return
+	}
+	next := inst.PC + 4
+	if inst.isPredicted() {
+		target, ok := d.pipe.cpu.branchTarget(inst.DestMemAddr, inst.Operand)
+		taken := inst.isUnconditional()
+		if !taken {
+			taken, inst.history = u.Predictor.Predict(inst.PC, target)
+		}
+		if ok && taken {
+			next = target
+		}
+	}
+	if next == inst.NextPC {
+		return
+	}
+	d.pipe.sTracef(d, "Redirecting fetch from %v to %v", inst.NextPC, next)
+	d.prev.Squash()
+	d.pipe.cpu.ProgramCounter = next
+	inst.NextPC = next
+}
+
+// Resolves the branch execute has just finished, updates the predictor and redirects fetch if
+// it continued at the wrong address
+func (e *ExecuteStage) resolve() {
+	u, inst := e.pipeline.Branch, e.currInst
+	if u == nil || inst.Exception != EXC_NONE || inst.IsHalt() || inst.IsIret() || inst.IsEcall() {
+		return
+	}
+	next := inst.PC + 4
+	if inst.isPredicted() {
+		stats := u.Stats[inst.PC]
+		if stats == nil {
+			stats = new(BranchStats)
+			u.Stats[inst.PC] = stats
+		}
+		stats.Executed++
+		if u.BTB != nil {
+			u.BTB.count(inst.btbHit)
+		}
+		if inst.BranchTaken {
+			stats.Taken++
+			next = inst.DestMemAddr
+			if u.BTB != nil {
+				u.BTB.Insert(inst.PC, inst.DestMemAddr, inst.isUnconditional())
+			}
+		}
+		if !inst.isUnconditional() {
+			u.Predictor.Update(inst.PC, inst.DestMemAddr, inst.history, inst.BranchTaken)
+		}
+		if next != inst.NextPC {
+			stats.Mispredicted++
+		}
+	}
+	if next == inst.NextPC {
+		return
+	}
+	e.pipeline.sTracef(e, "Mispredicted, redirecting fetch from %v to %v", inst.NextPC, next)
+	e.prev.Squash()
+	e.prev.prev.Squash()
+	e.pipeline.cpu.ProgramCounter = next
+	inst.NextPC = next
+}
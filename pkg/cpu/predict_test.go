@@ -0,0 +1,101 @@
+package cpu
+
+import (
+	"testing"
+)
+
+func TestPredictors(t *testing.T) {
+	// a loop branch at 40 back to 16, taken three times then not taken, run twice
+	loop := []bool{true, true, true, false, true, true, true, false}
+	var test = []struct {
+		name      string
+		predictor BranchPredictor
+		correct   int // predictions of loop that are right
+	}{
+		{"not-taken", NotTaken{}, 2},
+		{"btfn", BTFN{}, 6},
+		{"bimodal", NewBimodal(16), 5},
+		{"gshare", NewGshare(16), 2}, // every history is new while it warms up
+	}
+	for _, tt := range test {
+		correct := 0
+		for _, taken := range loop {
+			predicted, history := tt.predictor.Predict(40, 16)
+			if predicted == taken {
+				correct++
+			}
+			tt.predictor.Update(40, 16, history, taken)
+		}
+		if correct != tt.correct {
+			t.Errorf("%s: expected %d correct predictions, got %d", tt.name, tt.correct, correct)
+		}
+	}
+}
+
+func TestGshareLearnsPattern(t *testing.T) {
+	// a branch that alternates, which gshare predicts from its history and bimodal cannot
+	g := NewGshare(64)
+	wrong := 0
+	for i := 0; i < 64; i++ {
+		taken := i%2 == 0
+		predicted, history := g.Predict(80, 120)
+		if predicted != taken && i >= 32 {
+			wrong++
+		}
+		g.Update(80, 120, history, taken)
+	}
+	if wrong != 0 {
+		t.Errorf("expected gshare to have learned the pattern, got %d wrong predictions", wrong)
+	}
+}
+
+func TestGshareUpdatesPredictedCounter(t *testing.T) {
+	// the branch at 40 is predicted, then an older branch resolves and changes the history
+	// before the branch at 40 is resolved with the history it was predicted with
+	g := NewGshare(16)
+	_, history := g.Predict(40, 16)
+	g.Update(8, 0, g.History, true)
+	g.Update(40, 16, history, true)
+	if got := g.table[g.table.index(slot(40)^history)]; got != 2 {
+		t.Errorf("expected the counter the branch was predicted with to be weakly taken, got %d", got)
+	}
+	if got := g.table[g.table.index(slot(40)^1)]; got != 1 {
+		t.Errorf("expected the counter of the newer history unchanged, got %d", got)
+	}
+}
+
+func TestBimodalSaturates(t *testing.T) {
+	b := NewBimodal(4)
+	for i := 0; i < 5; i++ {
+		b.Update(4, 0, 0, true)
+	}
+	b.Update(4, 0, 0, false)
+	if taken, _ := b.Predict(4, 0); !taken {
+		t.Errorf("expected a strongly taken branch to stay taken after one not taken")
+	}
+	if taken, _ := b.Predict(8, 0); taken {
+		t.Errorf("expected another branch to be predicted not taken")
+	}
+	shared, _ := b.Predict(20, 0)
+	if own, _ := b.Predict(4, 0); shared != own {
+		t.Errorf("expected 20 to share the counter of 4 in a table of 4")
+	}
+}
+
+func TestBTB(t *testing.T) {
+	btb := NewBTB(8)
+	if _, _, ok := btb.Lookup(12); ok {
+		t.Errorf("expected an empty BTB to miss")
+	}
+	btb.Insert(12, 40, true)
+	if target, always, ok := btb.Lookup(12); !ok || target != 40 || !always {
+		t.Errorf("expected target 40 always taken, got %v %v %v", target, always, ok)
+	}
+	btb.Insert(44, 52, false) // same entry as 12
+	if _, _, ok := btb.Lookup(12); ok {
+		t.Errorf("expected 12 to be replaced by 44")
+	}
+	if _, err := NewPredictor("perfect", 16); err == nil {
+		t.Errorf("expected an unknown predictor to fail")
+	}
+}
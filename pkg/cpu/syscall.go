@@ -0,0 +1,36 @@
+package cpu
+
+// System calls. ecall takes the number in SYSCALL_NUMBER and up to SYSCALL_ARGS arguments in the
+// registers that follow it. When the cpu has a SyscallHandler, ecall is serviced when it
+// reaches writeback, the result is written to SYSCALL_NUMBER and the cpu continues after the
+// ecall. Otherwise ecall raises EXC_ECALL, so a program can service its own calls
+const (
+	SYSCALL_NUMBER = 1 // r1, holds the result after the call
+	SYSCALL_ARGS   = 3 // r2 to r4
+)
+
+// Raised by ecall when the cpu has no SyscallHandler, epc is the address of the ecall and tval
+// holds the number
+const EXC_ECALL ExceptionCause = 5
+
+// Services a system call on the host and returns its result. Every older instruction has
+// completed and no younger one has run, so the handler sees the registers and memory as the
+// program left them
+type SyscallHandler func(c *CPU, number uint32, args [SYSCALL_ARGS]uint32) uint32
+
+// Service the ecall in writeback and continue at the next instruction. The pipeline is squashed
+// as the younger instructions may have read r1 or memory that the call changed
+func (c *CPU) ecall(inst *InstructionIR) {
+	number := c.ReadIntRNoBlock(SYSCALL_NUMBER)
+	var args [SYSCALL_ARGS]uint32
+	for i := range args {
+		args[i] = c.ReadIntRNoBlock(uint8(SYSCALL_NUMBER + 1 + i))
+	}
+	result := c.Syscall(c, number, args)
+	c.log.Info().Msgf("ecall %d %v returned 0x%x", number, args, result)
+	c.WriteIntRNoBlock(SYSCALL_NUMBER, result)
+	c.Retired++
+	c.ProgramCounter = inst.PC + 4
+	c.pollInterrupt(c.ProgramCounter)
+	c.Pipeline.SquashALL()
+}
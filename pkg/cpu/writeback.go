@@ -2,6 +2,7 @@ package cpu
 
 import (
 	"fmt"
+	"math"
 
 	"github.com/leon332157/risc-y-8/pkg/types"
 )
@@ -49,23 +50,62 @@ func (w *WriteBackStage) Execute() {
 	w.instStr += fmt.Sprintf("Result: %x\n", w.currInst.Result)
 	w.instStr += fmt.Sprintf("RDestAux: %x\n", w.currInst.RDestAux)
 	w.instStr += fmt.Sprintf("ResultAux: %x\n", w.currInst.ResultAux)
+	if f, ok := w.currInst.FloatDest(); ok {
+		w.instStr += fmt.Sprintf("Fd: %x = %g\n", f, math.Float32frombits(w.currInst.Result))
+	}
+	if v, ok := w.currInst.VectorDest(); ok {
+		w.instStr += fmt.Sprintf("Vd: %x = %x\n", v, w.currInst.VectorResult)
+	}
 	if w.currInst.BaseInstruction.OpType == types.Control {
 		w.instStr += fmt.Sprintf("BranchTaken: %v\n", w.currInst.BranchTaken)
-		w.instStr += fmt.Sprintf("DestMemAddr: %x\n", w.currInst.DestMemAddr)
+		w.instStr += fmt.Sprintf("DestMemAddr: %s\n", w.pipeline.formatTarget(w.currInst.DestMemAddr))
 		w.instStr += fmt.Sprintf("RMem: %x\n", w.currInst.BaseInstruction.RMem)
 		w.instStr += fmt.Sprintf("CtrlModeFlag: %x\n", w.currInst.BaseInstruction.CtrlMode<<4|w.currInst.BaseInstruction.CtrlFlag)
 	}
 
 	w.pipeline.sTracef(w, "Processing instruction: %+v\n", w.currInst) // For debugging purposes
 
+	if w.currInst.Exception != EXC_NONE {
+		w.pipeline.sTracef(w, "Taking trap for %s at %v\n", LookUpException(w.currInst.Exception), w.currInst.PC)
+		w.instStr += fmt.Sprintf("Exception: %s\n", LookUpException(w.currInst.Exception))
+		w.pipeline.cpu.takeTrap(w.currInst)
+		return
+	}
+
+	if w.currInst.IsHalt() {
+		w.pipeline.sTrace(w, "Halt instruction reached writeback, halting cpu")
+		w.pipeline.cpu.Retired++
+		w.pipeline.cpu.Halt()
+		w.currInst = nil
+		return
+	}
+
+	if w.currInst.IsEcall() {
+		w.pipeline.sTrace(w, "Servicing system call")
+		w.pipeline.cpu.ecall(w.currInst)
+		return
+	}
+
 	if w.currInst.BaseInstruction.OpType == types.Control {
 		// Control instruction, write back to the Program Counter and RDestAUX
 		w.pipeline.sTrace(w, "Control instruction detected")
-		if w.currInst.BranchTaken {
+		if w.currInst.BranchTaken && w.pipeline.Branch != nil && !w.currInst.IsIret() {
+			w.pipeline.sTrace(w, "Branch taken, fetch was redirected before")
+		} else if w.currInst.BranchTaken {
+			if w.currInst.IsIret() {
+				w.currInst.DestMemAddr = w.pipeline.cpu.returnFromTrap()
+			}
 			if w.currInst.BaseInstruction.Rd == 0 {
 				// writing to PC
 				w.pipeline.sTracef(w, "Writing to Program Counter directly from control instruction to %v\n", w.currInst.DestMemAddr)
 				w.pipeline.cpu.ProgramCounter = w.currInst.DestMemAddr // Update the Program Counter if this is a control instruction
+				if w.currInst.RDestAux != 0 {
+					// call writes the return address to the link register before redirecting
+					w.pipeline.sTracef(w, "Writing back return address: %v to r%v\n", w.currInst.ResultAux, w.currInst.RDestAux)
+					w.pipeline.cpu.WriteIntRNoBlock(w.currInst.RDestAux, w.currInst.ResultAux)
+				}
+				w.pipeline.cpu.Retired++
+				w.pipeline.cpu.pollInterrupt(w.pipeline.cpu.ProgramCounter) // the branch completed, an interrupt returns to its target
 				w.pipeline.SquashALL()
 				return
 			}
@@ -74,14 +114,36 @@ func (w *WriteBackStage) Execute() {
 		}
 	}
 
-	w.pipeline.cpu.unblockIntR(w.currInst.BaseInstruction.Rd)
-	w.pipeline.sTracef(w, "Unblocked register r%v for write back\n", w.currInst.BaseInstruction.Rd) // For debugging purposes
-	w.pipeline.sTracef(w, "Writing back result: %v to r%v\n", w.currInst.Result, w.currInst.BaseInstruction.Rd)
-	_, status := w.pipeline.cpu.WriteIntR(w.currInst.BaseInstruction.Rd, w.currInst.Result) // Write the result to the destination register
+	if b := w.currInst.BaseInstruction; b.OpType == types.RegImm && b.ALU == types.IMM_SR {
+		// special registers are only read and written here so that they change in program order
+		sr := uint8(b.Imm)
+		if b.Imm&types.SR_WRITE != 0 {
+			w.pipeline.sTracef(w, "Writing %v to special register %v\n", w.currInst.Result, types.SpecialRegistersInverse[sr])
+			w.pipeline.cpu.WriteSR(sr, w.currInst.Result)
+		} else {
+			w.currInst.Result = w.pipeline.cpu.ReadSR(sr)
+		}
+	}
+
+	rd := w.currInst.intDest()
+	w.pipeline.cpu.unblockIntR(rd)
+	w.pipeline.sTracef(w, "Unblocked register r%v for write back\n", rd) // For debugging purposes
+	w.pipeline.sTracef(w, "Writing back result: %v to r%v\n", w.currInst.Result, rd)
+	_, status := w.pipeline.cpu.WriteIntR(rd, w.currInst.Result) // Write the result to the destination register
 	if status != SUCCESS {
-		w.pipeline.sTracef(w, "Failed to write back to register r%v: %v\n", w.currInst.BaseInstruction.Rd, status)
+		w.pipeline.sTracef(w, "Failed to write back to register r%v: %v\n", rd, status)
 		return
 	}
+	if f, ok := w.currInst.FloatDest(); ok {
+		w.pipeline.cpu.unblockFloatR(f)
+		w.pipeline.sTracef(w, "Writing back result: %v to f%v\n", math.Float32frombits(w.currInst.Result), f+1)
+		w.pipeline.cpu.WriteFloatR(f, math.Float32frombits(w.currInst.Result))
+	}
+	if v, ok := w.currInst.VectorDest(); ok {
+		w.pipeline.cpu.unblockVectorR(v)
+		w.pipeline.sTracef(w, "Writing back result: %x to v%v\n", w.currInst.VectorResult, v+1)
+		w.pipeline.cpu.WriteVectorR(v, w.currInst.VectorResult)
+	}
 	w.pipeline.cpu.unblockIntR(w.currInst.RDestAux)
 	w.pipeline.sTracef(w, "Unblocked register r%v for write back\n", w.currInst.RDestAux) // For debugging purposes
 	w.pipeline.sTracef(w, "Writing back result: %v to r%v\n", w.currInst.ResultAux, w.currInst.RDestAux)
@@ -90,15 +152,27 @@ func (w *WriteBackStage) Execute() {
 		w.pipeline.sTracef(w, "Failed to write back to register r%v: %v\n", w.currInst.RDestAux, status)
 		return
 	}
-	w.pipeline.cpu.unblockIntR(w.currInst.BaseInstruction.RMem)
-	w.pipeline.sTracef(w, "Unblocked register r%v for mem\n", w.currInst.BaseInstruction.RMem) // For debugging purposes
+	if w.currInst.BaseInstruction.OpType != types.Control {
+		// a branch does not block its base, a younger instruction may have blocked it
+		w.pipeline.cpu.unblockIntR(w.currInst.memBase())
+		w.pipeline.sTracef(w, "Unblocked register r%v for mem\n", w.currInst.memBase()) // For debugging purposes
+	}
 	w.pipeline.sTracef(w, "Write back completed for instruction: %+v\n", w.currInst) // For debugging purposes
 	w.pipeline.sTracef(w, "Write back completed for base instruction: %+v\n", *w.currInst.BaseInstruction) // For debugging purposes
+	next := w.currInst.PC + 4
+	if w.currInst.BaseInstruction.OpType == types.Control && w.currInst.BranchTaken {
+		next = w.currInst.DestMemAddr
+	}
 	w.currInst = nil
+	w.pipeline.cpu.Retired++
 
 	if w.pipeline.scalarMode {
 		w.pipeline.canFetch = true // In scalar mode, we can fetch the next instruction after write back
 	}
+	// interrupts are taken between instructions, after this one has completed
+	if w.pipeline.cpu.pollInterrupt(next) {
+		w.pipeline.sTracef(w, "Took %s, returning to %v\n", LookUpException(w.pipeline.cpu.Cause), next)
+	}
 }
 
 func (w *WriteBackStage) Advance(i *InstructionIR, prevstalled bool) bool {
@@ -114,9 +188,19 @@ func (w *WriteBackStage) Advance(i *InstructionIR, prevstalled bool) bool {
 
 func (w *WriteBackStage) Squash() bool {
 	w.pipeline.sTracef(w, "Squashing instruction: %+v\n", w.currInst) // For debugging purposes
-	w.pipeline.cpu.unblockIntR(w.currInst.BaseInstruction.Rd)
-	w.pipeline.cpu.unblockIntR(w.currInst.BaseInstruction.RMem)
+	if w.currInst == nil {
+		w.pipeline.canFetch = true
+		return true
+	}
+	w.pipeline.cpu.unblockIntR(w.currInst.intDest())
+	w.pipeline.cpu.unblockIntR(w.currInst.memBase())
 	w.pipeline.cpu.unblockIntR(w.currInst.RDestAux)
+	if f, ok := w.currInst.FloatDest(); ok {
+		w.pipeline.cpu.unblockFloatR(f)
+	}
+	if v, ok := w.currInst.VectorDest(); ok {
+		w.pipeline.cpu.unblockVectorR(v)
+	}
 	w.currInst = nil
 	w.pipeline.canFetch = true
 	return true
@@ -129,3 +213,7 @@ func (w *WriteBackStage) CanAdvance() bool {
 func (w *WriteBackStage) FormatInstruction() string {
 	return w.instStr
 }
+
+func (w *WriteBackStage) Instruction() *InstructionIR {
+	return w.currInst
+}
@@ -0,0 +1,158 @@
+package memory
+
+// Arbiter shares a lower level, RAM or a cache, between the instruction and data caches of a
+// split L1. The lower level serves one request at a time, the arbiter grants it to the first
+// cache that asks and makes the other wait until the access completes. The memory stage runs before fetch in a
+// clock, so data wins when both miss in the same clock. With DataFirst a data access also takes
+// the lower level from an instruction refill that has not completed, which starts over once
+// the lower level is free again. Device addresses are never arbitrated as they respond at once
+type Arbiter struct {
+	Lower     Memory
+	DataFirst bool
+	Stats     map[Requester]*ArbiterStats // by requester, FETCH_STAGE, MEMORY_STAGE and WRITE_BUFFER
+}
+
+type ArbiterStats struct {
+	Accesses  uint32 // accesses to the lower level that completed
+	Conflicts uint32 // attempts that waited because the lower level served the other cache
+	Preempted uint32 // refills aborted for a data access
+}
+
+func NewArbiter(lower Memory, dataFirst bool) *Arbiter {
+	return &Arbiter{Lower: lower, DataFirst: dataFirst, Stats: make(map[Requester]*ArbiterStats)}
+}
+
+func (a *Arbiter) stats(who Requester) *ArbiterStats {
+	s := a.Stats[who]
+	if s == nil {
+		s = new(ArbiterStats)
+		a.Stats[who] = s
+	}
+	return s
+}
+
+// Returns true if who may access the lower level at byte address addr now
+func (a *Arbiter) grant(addr uint, who Requester) bool {
+	if a.Uncached(addr) {
+		return true
+	}
+	holder := a.Lower.RequestState().requester
+	if holder == NONE || holder == who {
+		return true
+	}
+	if a.DataFirst && who == MEMORY_STAGE && holder == FETCH_STAGE {
+		if c, ok := a.Lower.(canceler); ok {
+			c.Cancel(holder)
+			a.stats(holder).Preempted++
+			return true
+		}
+	}
+	a.stats(who).Conflicts++
+	return false
+}
+
+// Counts the access of who if it completed and returns its state
+func (a *Arbiter) done(who Requester, state MemoryResult) MemoryResult {
+	if state == SUCCESS {
+		a.stats(who).Accesses++
+	}
+	return state
+}
+
+// Returns the holder of the lower level, NONE if it is free
+func (a *Arbiter) Requester() Requester {
+	return a.Lower.RequestState().requester
+}
+
+// Returns true if the lower level does not allow byte address addr to be cached
+func (a *Arbiter) Uncached(addr uint) bool {
+	u, ok := a.Lower.(Uncacheable)
+	return ok && u.Uncached(addr)
+}
+
+// Cancels the requests of the lower level for who
+func (a *Arbiter) Cancel(who Requester) {
+	if c, ok := a.Lower.(canceler); ok {
+		c.Cancel(who)
+	}
+}
+
+// Passes a line a cache above evicted to the lower level
+func (a *Arbiter) takeVictim(addr uint, data []uint32) {
+	if v, ok := a.Lower.(victimTaker); ok {
+		v.takeVictim(addr, data)
+	}
+}
+
+func (a *Arbiter) Sync(addr uint, val uint32, size uint) {
+	syncBytes(a.Lower, addr, val, size)
+}
+
+func (a *Arbiter) IsBusy() bool {
+	return a.Lower.IsBusy()
+}
+
+func (a *Arbiter) service(who Requester) bool {
+	return a.grant(0, who) && a.Lower.service(who)
+}
+
+func (a *Arbiter) Read(addr uint, who Requester) ReadResult {
+	if !a.grant(addr, who) {
+		return ReadResult{WAIT, 0}
+	}
+	r := a.Lower.Read(addr, who)
+	r.State = a.done(who, r.State)
+	return r
+}
+
+func (a *Arbiter) ReadMulti(addr, numWords, offset uint, who Requester) ReadLineResult {
+	if !a.grant(addr-offset, who) {
+		return ReadLineResult{WAIT, []uint32{}}
+	}
+	r := a.Lower.ReadMulti(addr, numWords, offset, who)
+	r.State = a.done(who, r.State)
+	return r
+}
+
+func (a *Arbiter) Write(addr uint, who Requester, val uint32) WriteResult {
+	if !a.grant(addr, who) {
+		return WriteResult{WAIT, 0}
+	}
+	w := a.Lower.Write(addr, who, val)
+	w.State = a.done(who, w.State)
+	return w
+}
+
+func (a *Arbiter) WriteMulti(addr uint, who Requester, vals []uint32) WriteResult {
+	if !a.grant(addr, who) {
+		return WriteResult{WAIT, 0}
+	}
+	w := a.Lower.WriteMulti(addr, who, vals)
+	w.State = a.done(who, w.State)
+	return w
+}
+
+func (a *Arbiter) WriteBytes(addr uint, who Requester, val uint32, size uint) WriteResult {
+	if !a.grant(addr, who) {
+		return WriteResult{WAIT, 0}
+	}
+	w := a.Lower.WriteBytes(addr, who, val, size)
+	w.State = a.done(who, w.State)
+	return w
+}
+
+func (a *Arbiter) SizeBytes() uint {
+	return a.Lower.SizeBytes()
+}
+
+func (a *Arbiter) SizeWords() uint {
+	return a.Lower.SizeWords()
+}
+
+func (a *Arbiter) SizeLines() uint {
+	return a.Lower.SizeLines()
+}
+
+func (a *Arbiter) RequestState() MemoryRequestState {
+	return a.Lower.RequestState()
+}
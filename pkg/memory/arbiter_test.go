@@ -0,0 +1,86 @@
+package memory
+
+import "testing"
+
+// Calls read until it completes, returns the number of calls
+func untilDone(t *testing.T, read func() MemoryResult) int {
+	for i := 1; i <= 20; i++ {
+		if state := read(); state == SUCCESS {
+			return i
+		} else if state != WAIT && state != WAIT_NEXT_LEVEL {
+			t.Fatalf("access failed: %s", LookUpMemoryResult(state))
+		}
+	}
+	t.Fatalf("access did not complete")
+	return 0
+}
+
+func TestArbiterFirstComeFirstServed(t *testing.T) {
+	mem := CreateRAM(32, 8, 5)
+	mem.Contents[0], mem.Contents[16] = 0x11, 0x22
+	arb := NewArbiter(&mem, false)
+	ic := CreateCache(4, 1, 4, 0, arb)
+	dc := CreateCache(4, 1, 4, 0, arb)
+
+	// the instruction refill takes RAM first, the data access waits for it
+	if r := ic.Read(0, FETCH_STAGE); r.State != WAIT_NEXT_LEVEL {
+		t.Fatalf("wanted the refill to wait for RAM, got %s", LookUpMemoryResult(r.State))
+	}
+	if r := dc.Read(64, MEMORY_STAGE); r.State != WAIT_NEXT_LEVEL {
+		t.Fatalf("wanted the data access to wait, got %s", LookUpMemoryResult(r.State))
+	}
+	untilDone(t, func() MemoryResult { return ic.Read(0, FETCH_STAGE).State })
+	var val uint32
+	untilDone(t, func() MemoryResult {
+		r := dc.Read(64, MEMORY_STAGE)
+		val = r.Value
+		return r.State
+	})
+	if val != 0x22 {
+		t.Errorf("wanted 0x22, got %x", val)
+	}
+	if s := arb.Stats[MEMORY_STAGE]; s.Conflicts != 1 || s.Accesses != 1 {
+		t.Errorf("wanted 1 conflict and 1 access for data, got %+v", *s)
+	}
+	if s := arb.Stats[FETCH_STAGE]; s.Conflicts != 0 || s.Accesses != 1 || s.Preempted != 0 {
+		t.Errorf("wanted 1 access for instructions, got %+v", *s)
+	}
+}
+
+func TestArbiterDataFirst(t *testing.T) {
+	mem := CreateRAM(32, 8, 5)
+	mem.Contents[0], mem.Contents[16] = 0x11, 0x22
+	arb := NewArbiter(&mem, true)
+	ic := CreateCache(4, 1, 4, 0, arb)
+	dc := CreateCache(4, 1, 4, 0, arb)
+
+	ic.Read(0, FETCH_STAGE)
+	ic.Read(0, FETCH_STAGE)
+	// the data access takes RAM from the refill, which starts over once it completes
+	if n := untilDone(t, func() MemoryResult { return dc.Read(64, MEMORY_STAGE).State }); n != 6 {
+		t.Errorf("wanted the data access to take the delay of RAM, took %d calls", n)
+	}
+	if n := untilDone(t, func() MemoryResult { return ic.Read(0, FETCH_STAGE).State }); n != 6 {
+		t.Errorf("wanted the refill to start over, took %d calls", n)
+	}
+	if s := arb.Stats[FETCH_STAGE]; s.Preempted != 1 || s.Accesses != 1 {
+		t.Errorf("wanted 1 preempted refill and 1 access, got %+v", *s)
+	}
+	if s := arb.Stats[MEMORY_STAGE]; s.Conflicts != 0 {
+		t.Errorf("wanted no conflicts for data, got %+v", *s)
+	}
+}
+
+func TestArbiterDevices(t *testing.T) {
+	mem := CreateRAM(32, 8, 5)
+	bus := NewBus(&mem)
+	exit := new(ExitPort)
+	bus.Map(EXIT_ADDR, exit)
+	arb := NewArbiter(bus, false)
+	dc := CreateCache(4, 1, 4, 0, arb)
+
+	arb.Read(0, FETCH_STAGE) // RAM serves fetch
+	if w := dc.Write(EXIT_ADDR, MEMORY_STAGE, 3); w.State != SUCCESS || !exit.Exited {
+		t.Errorf("wanted a device store to complete while RAM is busy, got %s", LookUpMemoryResult(w.State))
+	}
+}
@@ -0,0 +1,203 @@
+package memory
+
+import "fmt"
+
+// The device window of a Bus, devices are mapped at byte addresses from IO_BASE to
+// IO_BASE + IO_SIZE, above RAM
+const (
+	IO_BASE = 0x8000
+	IO_SIZE = 0x100
+)
+
+// Byte addresses of the devices mapped by the simulator
+const (
+	CONSOLE_ADDR = IO_BASE + 0x00 // Console data register
+	EXIT_ADDR    = IO_BASE + 0x10 // ExitPort code register
+	RANDOM_ADDR  = IO_BASE + 0x20 // Random value register
+)
+
+// A memory mapped device. Offsets are byte offsets from the base address of the device
+type Device interface {
+	Name() string
+	Size() uint                               // bytes of address space the device takes, a multiple of 4
+	Load(offset uint) uint32                  // read the word at offset, which may have side effects such as consuming input
+	Store(offset uint, val uint32, size uint) // write the low size bytes of val at offset
+}
+
+// Implemented by a memory whose addresses may not be cached, a cache passes accesses to them
+// straight to it
+type Uncacheable interface {
+	Uncached(addr uint) bool
+}
+
+type mappedDevice struct {
+	base uint
+	Device
+}
+
+// Bus routes byte addresses below the size of RAM to RAM and addresses in the device window to
+// the devices mapped there. Device accesses complete at once and are never cached, any other
+// address fails with FAILURE_OUT_OF_RANGE
+type Bus struct {
+	RAM     Memory
+	devices []mappedDevice
+}
+
+func NewBus(ram Memory) *Bus {
+	if ram.SizeBytes() > IO_BASE {
+		panic(fmt.Sprintf("NewBus: RAM of %d bytes overlaps the device window at 0x%x", ram.SizeBytes(), IO_BASE))
+	}
+	return &Bus{RAM: ram}
+}
+
+// Map a device at byte address base in the device window
+func (b *Bus) Map(base uint, d Device) error {
+	end := base + d.Size()
+	if base%4 != 0 || base < IO_BASE || end > IO_BASE+IO_SIZE {
+		return fmt.Errorf("[Bus Map] %s at 0x%x is not an aligned range in the device window", d.Name(), base)
+	}
+	for _, m := range b.devices {
+		if base < m.base+m.Size() && m.base < end {
+			return fmt.Errorf("[Bus Map] %s at 0x%x overlaps %s at 0x%x", d.Name(), base, m.Name(), m.base)
+		}
+	}
+	b.devices = append(b.devices, mappedDevice{base, d})
+	return nil
+}
+
+// Returns the device mapped at byte address addr, or nil
+func (b *Bus) device(addr uint) *mappedDevice {
+	for i := range b.devices {
+		if m := &b.devices[i]; addr >= m.base && addr < m.base+m.Size() {
+			return m
+		}
+	}
+	return nil
+}
+
+// Returns true if a device is mapped at byte address addr
+func (b *Bus) Uncached(addr uint) bool {
+	return b.device(addr) != nil
+}
+
+// Returns true if byte address addr is in RAM or a device
+func (b *Bus) Mapped(addr uint) bool {
+	return addr < b.RAM.SizeBytes() || b.device(addr) != nil
+}
+
+func (b *Bus) IsBusy() bool {
+	return b.RAM.IsBusy()
+}
+
+// Cancels the request RAM serves for who
+func (b *Bus) Cancel(who Requester) {
+	if c, ok := b.RAM.(canceler); ok {
+		c.Cancel(who)
+	}
+}
+
+func (b *Bus) service(who Requester) bool {
+	return b.RAM.service(who)
+}
+
+func (b *Bus) Read(addr uint, who Requester) ReadResult {
+	if addr%4 != 0 {
+		return ReadResult{FAILURE_MISALIGNED, 0}
+	}
+	if d := b.device(addr); d != nil {
+		return ReadResult{SUCCESS, d.Load(addr - d.base)}
+	}
+	if addr >= b.RAM.SizeBytes() {
+		return ReadResult{FAILURE_OUT_OF_RANGE, 0}
+	}
+	return b.RAM.Read(addr, who)
+}
+
+// Reads numWords words starting at byte address addr - offset, from RAM or from one device
+func (b *Bus) ReadMulti(addr, numWords, offset uint, who Requester) ReadLineResult {
+	start := addr - offset
+	if start%4 != 0 {
+		return ReadLineResult{FAILURE_MISALIGNED, []uint32{}}
+	}
+	if d := b.device(start); d != nil {
+		if start+4*numWords > d.base+d.Size() {
+			return ReadLineResult{FAILURE_OUT_OF_RANGE, []uint32{}}
+		}
+		line := []uint32{}
+		for i := range numWords {
+			line = append(line, d.Load(start-d.base+4*i))
+		}
+		return ReadLineResult{SUCCESS, line}
+	}
+	if start+4*numWords > b.RAM.SizeBytes() {
+		return ReadLineResult{FAILURE_OUT_OF_RANGE, []uint32{}}
+	}
+	return b.RAM.ReadMulti(addr, numWords, offset, who)
+}
+
+func (b *Bus) Write(addr uint, who Requester, val uint32) WriteResult {
+	return b.WriteBytes(addr, who, val, 4)
+}
+
+// Writes consecutive words starting at byte address addr, to RAM or to one device
+func (b *Bus) WriteMulti(addr uint, who Requester, vals []uint32) WriteResult {
+	if addr%4 != 0 {
+		return WriteResult{FAILURE_MISALIGNED, 0}
+	}
+	if d := b.device(addr); d != nil {
+		if addr+4*uint(len(vals)) > d.base+d.Size() {
+			return WriteResult{FAILURE_OUT_OF_RANGE, 0}
+		}
+		for i, v := range vals {
+			d.Store(addr-d.base+4*uint(i), v, 4)
+		}
+		return WriteResult{SUCCESS, 0}
+	}
+	if addr+4*uint(len(vals)) > b.RAM.SizeBytes() {
+		return WriteResult{FAILURE_OUT_OF_RANGE, 0}
+	}
+	return b.RAM.WriteMulti(addr, who, vals)
+}
+
+func (b *Bus) WriteBytes(addr uint, who Requester, val uint32, size uint) WriteResult {
+	if !fitsWord(addr, size) {
+		return WriteResult{FAILURE_MISALIGNED, 0}
+	}
+	if d := b.device(addr); d != nil {
+		d.Store(addr-d.base, val, size)
+		return WriteResult{SUCCESS, 0}
+	}
+	if addr >= b.RAM.SizeBytes() {
+		return WriteResult{FAILURE_OUT_OF_RANGE, 0}
+	}
+	if size == 4 {
+		return b.RAM.Write(addr, who, val)
+	}
+	return b.RAM.WriteBytes(addr, who, val, size)
+}
+
+// Writes the low size bytes of val at byte address addr to RAM at once, see CacheType.Sync. It
+// does not reach devices
+func (b *Bus) Sync(addr uint, val uint32, size uint) {
+	if addr < b.RAM.SizeBytes() {
+		syncBytes(b.RAM, addr, val, size)
+	}
+}
+
+// Returns the size of the address space in bytes, up to the end of the device window
+func (b *Bus) SizeBytes() uint {
+	return IO_BASE + IO_SIZE
+}
+
+func (b *Bus) SizeWords() uint {
+	return b.SizeBytes() / 4
+}
+
+// Returns the number of lines of RAM
+func (b *Bus) SizeLines() uint {
+	return b.RAM.SizeLines()
+}
+
+func (b *Bus) RequestState() MemoryRequestState {
+	return b.RAM.RequestState()
+}
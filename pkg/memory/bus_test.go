@@ -0,0 +1,88 @@
+package memory
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestBusMap(t *testing.T) {
+	mem := CreateRAM(32, 8, 0)
+	bus := NewBus(&mem)
+	if err := bus.Map(CONSOLE_ADDR, new(Console)); err != nil {
+		t.Errorf("mapping the console failed: %v", err)
+	}
+	if err := bus.Map(CONSOLE_ADDR, new(ExitPort)); err == nil {
+		t.Errorf("a device overlapping the console should not map")
+	}
+	if err := bus.Map(0x100, new(ExitPort)); err == nil {
+		t.Errorf("a device below the device window should not map")
+	}
+	if err := bus.Map(IO_BASE+IO_SIZE-2, new(ExitPort)); err == nil {
+		t.Errorf("an unaligned device should not map")
+	}
+	if !bus.Mapped(0) || !bus.Mapped(CONSOLE_ADDR+3) || bus.Mapped(CONSOLE_ADDR+4) || bus.Mapped(mem.SizeBytes()) {
+		t.Errorf("wrong mapped addresses")
+	}
+}
+
+func TestBusDevices(t *testing.T) {
+	mem := CreateRAM(32, 8, 5)
+	bus := NewBus(&mem)
+	var out bytes.Buffer
+	console := &Console{In: strings.NewReader("a"), Out: &out}
+	exit := new(ExitPort)
+	bus.Map(CONSOLE_ADDR, console)
+	bus.Map(EXIT_ADDR, exit)
+
+	// devices respond at once and RAM keeps its delay
+	if r := bus.Read(CONSOLE_ADDR, MEMORY_STAGE); r.State != SUCCESS || r.Value != 'a' {
+		t.Errorf("wanted 'a' from the console, got %v %x", LookUpMemoryResult(r.State), r.Value)
+	}
+	if r := bus.Read(CONSOLE_ADDR, MEMORY_STAGE); r.Value != 0xFFFFFFFF {
+		t.Errorf("wanted 0xFFFFFFFF at the end of input, got %x", r.Value)
+	}
+	if r := bus.Read(0, MEMORY_STAGE); r.State != WAIT {
+		t.Errorf("wanted RAM to wait, got %v", LookUpMemoryResult(r.State))
+	}
+	if w := bus.WriteBytes(CONSOLE_ADDR, FETCH_STAGE, 'b', 1); w.State != SUCCESS || out.String() != "b" {
+		t.Errorf("wanted b on the console, got %v %q", LookUpMemoryResult(w.State), out.String())
+	}
+	if w := bus.Write(EXIT_ADDR, FETCH_STAGE, 3); w.State != SUCCESS || !exit.Exited || exit.Code != 3 {
+		t.Errorf("wanted exit with code 3, got %v %v %d", LookUpMemoryResult(w.State), exit.Exited, exit.Code)
+	}
+	if r := bus.Read(RANDOM_ADDR, FETCH_STAGE); r.State != FAILURE_OUT_OF_RANGE {
+		t.Errorf("wanted an unmapped address to fail, got %v", LookUpMemoryResult(r.State))
+	}
+}
+
+func TestCacheBypassesDevices(t *testing.T) {
+	mem := CreateRAM(32, 8, 0)
+	bus := NewBus(&mem)
+	random := new(Random)
+	bus.Map(RANDOM_ADDR, random)
+	c := CreateCacheDefault(bus)
+
+	// every read of an uncached device reaches it
+	var first, second ReadResult
+	for range 3 {
+		if first = c.Read(RANDOM_ADDR, MEMORY_STAGE); first.State == SUCCESS {
+			break
+		}
+	}
+	for range 3 {
+		if second = c.Read(RANDOM_ADDR, MEMORY_STAGE); second.State == SUCCESS {
+			break
+		}
+	}
+	if first.State != SUCCESS || second.State != SUCCESS || first.Value == second.Value {
+		t.Errorf("wanted two different random values, got %v %x and %v %x", LookUpMemoryResult(first.State), first.Value, LookUpMemoryResult(second.State), second.Value)
+	}
+	for _, set := range c.Contents {
+		for _, line := range set {
+			if line.Valid {
+				t.Errorf("a device read should not allocate a line")
+			}
+		}
+	}
+}
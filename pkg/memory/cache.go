@@ -13,6 +13,36 @@ type CacheType struct {
 	WordsPerLine uint
 	LowerLevel   Memory
 	MemoryRequestState
+
+	// caches whose lower level this cache is, see SetInclusion
+	Inclusion InclusionPolicy
+	Upper     []*CacheType
+
+	WritePolicy     WritePolicy
+	NoWriteAllocate bool
+	Buffer          *WriteBuffer // nil without a write buffer
+	Snoop           *CacheType   // data cache a refill of an instruction cache cleans first, see Clean
+
+	Replacement ReplacementPolicy // LRU unless SetReplacement chose another
+
+	Stats  CacheStats
+	missed bool // the access being served allocated a line
+
+	// words a read spanning lines has read for its requester while it waits for the next line, the
+	// refill of that line may replace the line holding them, see ReadMulti
+	partial partialRead
+	storing pendingStore // the store waiting for the lower level to write it through, see store
+}
+
+type partialRead struct {
+	who   Requester
+	start uint
+	vals  []uint32
+}
+
+type pendingStore struct {
+	who     Requester
+	addr, n uint
 }
 
 type CacheLine struct {
@@ -20,12 +50,15 @@ type CacheLine struct {
 	Tag   uint
 	Data  []uint32
 	LRU   int
+	Dirty bool // written since it was read from the lower level, a write-back cache writes it back
+
+	known []bool // the words of a line a write allocated that hold data, nil once it holds all of them
 }
 
 type IdxTagOffs struct {
 	index  uint
 	tag    uint
-	offset uint
+	offset uint // byte offset in the line, the word is Data[offset/4]
 }
 
 func CreateCache(numSets, numWays, wordsPerLine, delay uint, lower Memory) CacheType {
@@ -57,6 +90,7 @@ func CreateCache(numSets, numWays, wordsPerLine, delay uint, lower Memory) Cache
 		WordsPerLine:       wordsPerLine,
 		LowerLevel:         lower,
 		MemoryRequestState: r,
+		Replacement:        LRU{},
 	}
 }
 
@@ -81,11 +115,41 @@ func (c *CacheType) CancelRequest() {
 		int(c.MemoryRequestState.Delay),
 		false,
 	}
+	c.missed = false
+	c.partial = partialRead{}
+	c.storing = pendingStore{}
 
 	// c.sTracef("Cache cancelled request")
 	// fmt.Printf("Cache MemoryRequestState is now %v \n", c.MemoryRequestState)
 }
 
+// Returns the size of the lower level, a cache adds no addresses
+func (c *CacheType) SizeBytes() uint {
+	return c.LowerLevel.SizeBytes()
+}
+
+func (c *CacheType) SizeWords() uint {
+	return c.LowerLevel.SizeWords()
+}
+
+func (c *CacheType) SizeLines() uint {
+	return c.LowerLevel.SizeLines()
+}
+
+func (c *CacheType) RequestState() MemoryRequestState {
+	return c.MemoryRequestState
+}
+
+// Cancels the request the cache serves for who and the requests of the levels below it for who
+func (c *CacheType) Cancel(who Requester) {
+	if c.Requester() == who {
+		c.CancelRequest()
+	}
+	if l, ok := c.LowerLevel.(canceler); ok {
+		l.Cancel(who)
+	}
+}
+
 func (c *CacheType) service(who Requester) bool {
 	if c.Sets == 0 || c.Ways == 0 {
 		return true
@@ -119,7 +183,8 @@ func (c *CacheType) service(who Requester) bool {
 			return false
 		}
 	} else {
-		return true
+		// the delay is over, but a cache waiting on the lower level is still held by its requester
+		return c.MemoryRequestState.requester == who || !c.MemoryRequestState.WaitNext
 	}
 	panic("oop cache")
 	/* else {
@@ -130,9 +195,26 @@ func (c *CacheType) service(who Requester) bool {
 	} */
 }
 
+// Returns true if the lower level does not allow byte address addr to be cached, such as a
+// device register on a Bus. Accesses to it go straight to the lower level and are never allocated
+func (c *CacheType) Uncached(addr uint) bool {
+	u, ok := c.LowerLevel.(Uncacheable)
+	return ok && u.Uncached(addr)
+}
+
+// Returns the state of an access passed straight to the lower level, freeing the cache once it completes
+func (c *CacheType) bypassed(state MemoryResult) MemoryResult {
+	if state == WAIT || state == WAIT_NEXT_LEVEL {
+		c.MemoryRequestState.WaitNext = true
+		return WAIT_NEXT_LEVEL
+	}
+	c.CancelRequest()
+	return state
+}
+
 func (c *CacheType) FindIndexTagOffset(addr uint) IdxTagOffs {
-	// get lowest order 2 bit for data offset (reps 4 words)
-	offsetBits := bits.Len32(uint32(c.WordsPerLine)) - 1
+	// get lowest order 4 bit for byte offset (reps 4 words of 4 bytes)
+	offsetBits := bits.Len32(uint32(c.WordsPerLine*4)) - 1
 	offset := addr & ((1 << offsetBits) - 1)
 
 	// Get set index from address
@@ -161,8 +243,8 @@ func (c *CacheType) FindIndexTagOffset(addr uint) IdxTagOffs {
 }
 
 func (c *CacheType) Read(addr uint, who Requester) ReadResult {
-	if who >= 0 {
-		panic("Cache Read: Non-pipeline requester cannot read from cache")
+	if addr%4 != 0 {
+		return ReadResult{FAILURE_MISALIGNED, 0}
 	}
 
 	if !c.service(who) {
@@ -174,49 +256,33 @@ func (c *CacheType) Read(addr uint, who Requester) ReadResult {
 		read := c.LowerLevel.Read(addr, who)
 		return read
 	}
-
-	// Given the address, find the index of the set and tag
-	ito := c.FindIndexTagOffset(addr)
-	index, tag, offset := ito.index, ito.tag, ito.offset
-
-	// If tag exists, check valid bit (false -> miss, true -> hit) cache hit: return the data, update lru
-	set := c.Contents[index]
-	for i := range c.Ways {
-		if (set[i].Tag == tag) && (set[i].Valid) {
-			c.UpdateLRU(index, i)
-			c.CancelRequest() // Free up the cache for service
-			return ReadResult{SUCCESS, set[i].Data[offset]}
-		}
+	if c.Uncached(addr) {
+		read := c.LowerLevel.Read(addr, who)
+		read.State = c.bypassed(read.State)
+		return read
 	}
 
-	// Else, cache miss: read LINE from memory, load into cache, return data (no need to write back to mem)
-	read := c.LowerLevel.ReadMulti(addr, c.WordsPerLine, offset, who)
-	switch read.State {
-	case WAIT:
-		//fmt.Println("Cache miss, waiting for ram")
-		c.MemoryRequestState.WaitNext = true
-		return ReadResult{WAIT_NEXT_LEVEL, 0}
+	// Hit: return the data, miss: read the LINE from memory and load it into the cache first
+	line, state := c.fill(addr, 4, who)
+	switch state {
+	case SUCCESS:
+		c.count(false)
+		c.CancelRequest() // Free up the cache for service
 	case WAIT_NEXT_LEVEL:
-		//fmt.Println("Cache miss, waiting for next level memory")
-		c.MemoryRequestState.WaitNext = true
 		return ReadResult{WAIT_NEXT_LEVEL, 0}
-	case SUCCESS:
-		c.CancelRequest() // reset the request state
 	default:
-		panic("AHHHH")
-		//return ReadResult{read.State, 0}
-		// do nothing
+		// the stage sees why the refill failed, as from the level below
+		c.CancelRequest()
+		return ReadResult{state, 0}
 	}
-
-	lruIdx := c.GetLRU(index)
-	c.Contents[index][lruIdx] = &CacheLine{Valid: true, Tag: tag, Data: read.Value, LRU: c.Contents[index][lruIdx].LRU}
-	c.UpdateLRU(index, lruIdx)
-
-	return ReadResult{SUCCESS, read.Value[offset]}
+	return ReadResult{SUCCESS, line.Data[addr%c.lineBytes()/4]}
 }
 
-// Write through, allocate policy
+// Writes the word at byte address addr as the write policy says
 func (c *CacheType) Write(addr uint, who Requester, val uint32) WriteResult {
+	if addr%4 != 0 {
+		return WriteResult{FAILURE_MISALIGNED, 0}
+	}
 	if !c.service(who) {
 		return WriteResult{WAIT, 0}
 	}
@@ -225,48 +291,137 @@ func (c *CacheType) Write(addr uint, who Requester, val uint32) WriteResult {
 		written := c.LowerLevel.Write(addr, who, val)
 		return written
 	}
+	if c.Uncached(addr) {
+		written := c.LowerLevel.Write(addr, who, val)
+		written.State = c.bypassed(written.State)
+		return written
+	}
+	if c.exclusive() {
+		c.drop(addr, 4)
+		return c.wroteThrough(c.LowerLevel.Write(addr, who, val))
+	}
 
-	// Given address find the set index and tag
-	ito := c.FindIndexTagOffset(addr)
-	index, tag, offset := ito.index, ito.tag, ito.offset
-	valid := false
-	set := c.Contents[index]
-	for i := range c.Ways {
-
-		// If idx-tag exits, write to cache and write-through to memory
-		curTag := set[i].Tag
-		curValid := set[i].Valid
-
-		if (curTag == tag) && curValid {
-
-			// if data is the same, update lru, do nothing
-			/*if set[i].Data == val {
-				c.UpdateLRU(index, i)
-				return SUCCESS
-			}*/
-			// if data is different, write-through to memory
-			c.Contents[index][i].Data[offset] = val
-			c.UpdateLRU(index, i)
-			valid = true
+	return c.store(addr, 4, who, func(word *uint32, _ uint) { *word = val }, func() WriteResult {
+		return c.writeLower(addr, []uint32{val}, 0, func() WriteResult { return c.LowerLevel.Write(addr, who, val) })
+	})
+}
+
+// Reads numWords consecutive words starting at byte address addr - offset with a single access, as
+// RAM.ReadMulti. A miss loads the lines holding the words, which may be more than one when the
+// cache above has longer lines
+func (c *CacheType) ReadMulti(addr, numWords, offset uint, who Requester) ReadLineResult {
+	if (addr-offset)%4 != 0 {
+		return ReadLineResult{FAILURE_MISALIGNED, []uint32{}}
+	}
+
+	if !c.service(who) {
+		return ReadLineResult{WAIT, []uint32{}}
+	}
+
+	// If cache is disabled, read straight from memory
+	if c.Sets == 0 || c.Ways == 0 || c.WordsPerLine == 0 {
+		return c.LowerLevel.ReadMulti(addr, numWords, offset, who)
+	}
+	if c.Uncached(addr - offset) {
+		read := c.LowerLevel.ReadMulti(addr, numWords, offset, who)
+		read.State = c.bypassed(read.State)
+		return read
+	}
+
+	start := addr - offset
+	if c.exclusive() {
+		return c.readExclusive(start, numWords, who)
+	}
+	vals := make([]uint32, 0, numWords)
+	if p := c.partial; p.who == who && p.start == start && p.vals != nil {
+		vals = p.vals
+	}
+	for a, end := start+4*uint(len(vals)), start+4*numWords; a < end; {
+		line, state := c.fill(a, min(end, c.lineStart(a)+c.lineBytes())-a, who)
+		switch state {
+		case SUCCESS:
+		case WAIT_NEXT_LEVEL:
+			// the lines already read are not read again, their refill could replace this one
+			c.partial = partialRead{who, start, vals}
+			return ReadLineResult{WAIT_NEXT_LEVEL, []uint32{}}
+		default:
+			c.CancelRequest()
+			return ReadLineResult{state, []uint32{}}
+		}
+		// the words of this line, the next line is loaded once they are read
+		for lineEnd := c.lineStart(a) + c.lineBytes(); a < end && a < lineEnd; a += 4 {
+			vals = append(vals, line.Data[a%c.lineBytes()/4])
 		}
 	}
+	c.count(false)
+	c.CancelRequest() // Free up the cache for service
+	return ReadLineResult{SUCCESS, vals}
+}
 
-	if !valid {
-		// Find next empty line or LRU (empty line will be lru!), allocate in the cache
-		lruIdx := c.GetLRU(index)
-		d := c.Contents[index][lruIdx]
-		d.Data[offset] = val
-		c.Contents[index][lruIdx] = &CacheLine{Valid: true, Tag: tag, Data: d.Data, LRU: d.LRU} // keep lru the same, then use update function
-		c.UpdateLRU(index, lruIdx)
+// Writes consecutive words starting at byte address addr with a single access, they may span
+// lines. The write policy applies as for Write
+func (c *CacheType) WriteMulti(addr uint, who Requester, vals []uint32) WriteResult {
+	if addr%4 != 0 {
+		return WriteResult{FAILURE_MISALIGNED, 0}
+	}
+	if !c.service(who) {
+		return WriteResult{WAIT, 0}
+	}
+	// If cache is disabled, write straight to memory
+	if c.Sets == 0 || c.Ways == 0 {
+		return c.LowerLevel.WriteMulti(addr, who, vals)
+	}
+	if c.Uncached(addr) {
+		written := c.LowerLevel.WriteMulti(addr, who, vals)
+		written.State = c.bypassed(written.State)
+		return written
+	}
+	if c.exclusive() {
+		c.drop(addr, 4*uint(len(vals)))
+		return c.wroteThrough(c.LowerLevel.WriteMulti(addr, who, vals))
 	}
 
-	// write through to memory
-	written := c.LowerLevel.Write(addr, who, val)
+	return c.store(addr, 4*uint(len(vals)), who, func(word *uint32, a uint) { *word = vals[(a-addr)/4] }, func() WriteResult {
+		return c.writeLower(addr, vals, 0, func() WriteResult { return c.LowerLevel.WriteMulti(addr, who, vals) })
+	})
+}
+
+// Writes the low size bytes of val at byte address addr, they must lie in one word. The write
+// policy applies as for Write
+func (c *CacheType) WriteBytes(addr uint, who Requester, val uint32, size uint) WriteResult {
+	if !fitsWord(addr, size) {
+		return WriteResult{FAILURE_MISALIGNED, 0}
+	}
+	if !c.service(who) {
+		return WriteResult{WAIT, 0}
+	}
+	// If cache is disabled, write straight to memory
+	if c.Sets == 0 || c.Ways == 0 {
+		return c.LowerLevel.WriteBytes(addr, who, val, size)
+	}
+	if c.Uncached(addr) {
+		written := c.LowerLevel.WriteBytes(addr, who, val, size)
+		written.State = c.bypassed(written.State)
+		return written
+	}
+	if c.exclusive() {
+		c.drop(addr, size)
+		return c.wroteThrough(c.LowerLevel.WriteBytes(addr, who, val, size))
+	}
+
+	return c.store(addr, size, who, func(word *uint32, _ uint) { *word = mergeBytes(*word, addr, val, size) }, func() WriteResult {
+		return c.writeLower(addr, []uint32{val}, size, func() WriteResult { return c.LowerLevel.WriteBytes(addr, who, val, size) })
+	})
+}
+
+// Returns the result of a write through to the lower level, freeing the cache once it completes
+func (c *CacheType) wroteThrough(written WriteResult) WriteResult {
 	switch written.State {
 	case WAIT, WAIT_NEXT_LEVEL:
 		c.MemoryRequestState.WaitNext = true
 		return WriteResult{WAIT_NEXT_LEVEL, 0} // Waiting for next level memory to service the request
 	case SUCCESS:
+		c.count(true)
 		c.CancelRequest()
 		return WriteResult{SUCCESS, written.Written} // Successfully wrote to memory (write-through)
 	default:
@@ -274,46 +429,218 @@ func (c *CacheType) Write(addr uint, who Requester, val uint32) WriteResult {
 	}
 }
 
-func (c *CacheType) UpdateLRU(setIndex uint, line uint) {
-	set := c.Contents[setIndex]
-	accessedLRU := set[line].LRU
+// Returns the line holding the n bytes at byte address addr, reading it from the lower level and
+// allocating it on a miss. A line a write allocated reads the words it lacks. It returns
+// WAIT_NEXT_LEVEL while the lower level is busy, or while the write buffer holds writes to the line
+func (c *CacheType) fill(addr, n uint, who Requester) (*CacheLine, MemoryResult) {
+	index, way, held := c.find(addr)
+	if held && c.Contents[index][way].holdsAll(addr%c.lineBytes()/4, n) {
+		c.touch(index, way)
+		return c.Contents[index][way], SUCCESS
+	}
+	start := c.lineStart(addr)
+	if c.Buffer != nil && c.Buffer.Pending(start, c.lineBytes()) {
+		c.waitNext(who)
+		return nil, WAIT_NEXT_LEVEL
+	}
+	if c.Snoop != nil {
+		c.Snoop.Clean(start, c.lineBytes())
+	}
+	if !held {
+		if state := c.makeRoom(start, who); state != SUCCESS {
+			return nil, state
+		}
+	}
+	read := c.LowerLevel.ReadMulti(start, c.WordsPerLine, 0, who)
+	switch read.State {
+	case SUCCESS:
+	case WAIT, WAIT_NEXT_LEVEL:
+		c.waitNext(who)
+		return nil, WAIT_NEXT_LEVEL
+	default:
+		return nil, read.State
+	}
+	c.missed = true
+	if !held {
+		return c.allocate(start, read.Value), SUCCESS
+	}
+	// a line a write allocated keeps the words written to it
+	line := c.Contents[index][way]
+	for i, known := range line.known {
+		if !known {
+			line.Data[i] = read.Value[i]
+		}
+	}
+	line.known = nil
+	c.touch(index, way)
+	return line, SUCCESS
+}
+
+// Drops the words a read spanning lines has read when the n bytes at byte address addr change
+func (c *CacheType) dropPartial(addr, n uint) {
+	if p := c.partial; addr < p.start+4*uint(len(p.vals)) && p.start < addr+n {
+		c.partial = partialRead{}
+	}
+}
 
-	// Only update if not already MRU
-	if accessedLRU != 0 {
-		for i := range c.Ways {
-			if i == line {
-				set[i].LRU = 0 // Set accessed line to MRU
-			} else if set[i].LRU < accessedLRU {
-				set[i].LRU += 1 // Bump more-recently-used lines downward
-			}
+// Puts the line starting at byte address start in the place of the line the replacement policy
+// picks in its set and returns it
+func (c *CacheType) allocate(start uint, data []uint32) *CacheLine {
+	ito := c.FindIndexTagOffset(start)
+	way := c.victim(ito.index)
+	c.evict(ito.index, way)
+	line := &CacheLine{Valid: true, Tag: ito.tag, Data: data, LRU: c.Contents[ito.index][way].LRU}
+	c.Contents[ito.index][way] = line
+	c.Replacement.Insert(c.Contents[ito.index], ito.index, way)
+	return line
+}
+
+// Tells the replacement policy the line at way of set index was read or written
+func (c *CacheType) touch(index, way uint) {
+	c.Replacement.Touch(c.Contents[index], index, way)
+}
+
+// Returns the way of set index the next line replaces, the first invalid line or the line the
+// replacement policy picks
+func (c *CacheType) victim(index uint) uint {
+	for i, line := range c.Contents[index] {
+		if !line.Valid {
+			return uint(i)
+		}
+	}
+	return c.Replacement.Victim(c.Contents[index], index)
+}
+
+// Returns the set and the way of the valid line holding byte address addr, false if the cache
+// does not hold it
+func (c *CacheType) find(addr uint) (index, way uint, ok bool) {
+	if c.Sets == 0 || c.Ways == 0 || c.WordsPerLine == 0 {
+		return 0, 0, false
+	}
+	ito := c.FindIndexTagOffset(addr)
+	for i, line := range c.Contents[ito.index] {
+		if line.Valid && line.Tag == ito.tag {
+			return ito.index, uint(i), true
 		}
 	}
+	return 0, 0, false
+}
+
+// Returns the valid line holding byte address addr, or nil
+func (c *CacheType) lookUp(addr uint) *CacheLine {
+	if index, way, ok := c.find(addr); ok {
+		return c.Contents[index][way]
+	}
+	return nil
+}
+
+func (c *CacheType) lineBytes() uint {
+	return c.WordsPerLine * 4
 }
 
+// Returns the byte address of the line holding byte address addr
+func (c *CacheType) lineStart(addr uint) uint {
+	return addr - addr%c.lineBytes()
+}
+
+// Returns the byte address of the line with tag in set index
+func (c *CacheType) lineAddr(index, tag uint) uint {
+	offsetBits := bits.Len32(uint32(c.lineBytes())) - 1
+	indexBits := bits.Len32(uint32(c.Sets)) - 1
+	return tag<<(offsetBits+indexBits) | index<<offsetBits
+}
+
+// Returns true if word i of the line holds data
+func (l *CacheLine) holds(i uint) bool {
+	return l.known == nil || l.known[i]
+}
+
+// Marks the n words from word i of the line as holding no data, the line is invalid once none of
+// its words do
+func (l *CacheLine) forget(i, n uint) {
+	if l.known == nil {
+		l.known = make([]bool, len(l.Data))
+		for j := range l.known {
+			l.known[j] = true
+		}
+	}
+	for end := i + n; i < end; i++ {
+		l.known[i] = false
+	}
+	for _, known := range l.known {
+		if known {
+			return
+		}
+	}
+	l.Valid, l.known = false, nil
+}
 
-func (c *CacheType) GetLRU(setIndex uint) uint {
-	set := c.Contents[setIndex]
-	lru := -1
-	lruIdx := -1
+// Returns true if the line holds data in the words of the n bytes from word i
+func (l *CacheLine) holdsAll(i, n uint) bool {
+	for end := i + (n+3)/4; i < end; i++ {
+		if !l.holds(i) {
+			return false
+		}
+	}
+	return true
+}
 
-	for i := range c.Ways {
-		if set[i].LRU > lru {
-			lru = set[i].LRU
-			lruIdx = int(i)
+// Marks word i of the line as holding data
+func (l *CacheLine) wrote(i uint) {
+	if l.known == nil {
+		return
+	}
+	l.known[i] = true
+	for _, known := range l.known {
+		if !known {
+			return
 		}
 	}
-	if lru < 0 {
-		panic("GetLRU: No valid LRU found in set index " + fmt.Sprint(setIndex))
+	l.known = nil
+}
+
+// Invalidates the line holding byte address addr, returns false if the cache does not hold it.
+// The writes to a dirty line are lost
+func (c *CacheType) Invalidate(addr uint) bool {
+	line := c.lookUp(addr)
+	if line == nil {
+		return false
+	}
+	line.Valid, line.Dirty = false, false
+	return true
+}
+
+// Returns the word at byte address addr if the cache holds it, without delay and without
+// changing the state of the replacement policy, for the simulator to inspect memory as the cpu
+// sees it
+func (c *CacheType) Peek(addr uint) (uint32, bool) {
+	line := c.lookUp(addr)
+	if line == nil || !line.holds(addr%c.lineBytes()/4) {
+		return 0, false
+	}
+	return line.Data[addr%(c.WordsPerLine*4)/4], true
+}
+
+// Sets the word at byte address addr if the cache holds it, without delay and without changing
+// the state of the replacement policy, so the cache stays coherent with a write to the lower
+// level that bypassed it
+func (c *CacheType) Poke(addr uint, val uint32) bool {
+	line := c.lookUp(addr)
+	if line == nil {
+		return false
 	}
-	return uint(lruIdx)
+	line.Data[addr%(c.WordsPerLine*4)/4] = val
+	line.wrote(addr % c.lineBytes() / 4)
+	return true
 }
 
 func (cache *CacheType) PrintCache() {
-	fmt.Println("Tag    Index        Data    Valid    LRU")
+	fmt.Printf("Tag    Index        Data    Valid    %s    Dirty\n", cache.Replacement.MetaName())
 	for i := range cache.Contents {
 		for j := 0; j < len(cache.Contents[i]); j++ {
 			line := cache.Contents[i][j]
-			fmt.Printf("%05b    %03b    %08x    %t    %d\n", line.Tag, i, line.Data, line.Valid, line.LRU)
+			meta := cache.Replacement.Meta(cache.Contents[i], uint(i), uint(j))
+			fmt.Printf("%05b    %03b    %08x    %t    %s    %t\n", line.Tag, i, line.Data, line.Valid, meta, line.Dirty)
 		} // might have to adjust depending on cache configs --> but nice looking for default cache
 	}
 	fmt.Println("")
@@ -11,17 +11,17 @@ func TestFindIndexAndTagAndOffset(t *testing.T) {
 	newMem := CreateRAM(32, 8, 5)
 	c := CreateCacheDefault(&newMem) // 8 sets, 2 ways, 4 wpl 
 
-	idxTag := c.FindIndexTagOffset(2)
+	idxTag := c.FindIndexTagOffset(8)
 	idx, tag, offset := idxTag.index, idxTag.tag, idxTag.offset
 
-	// addr = 0b0000010
-	// 4 wpl --> 2 bits for offset
+	// addr = 0b0001000, byte address of word 2
+	// 4 wpl --> 16 bytes per line, 4 bits for offset
 	// 8 sets --> 3 bits for index
 	if idx != 0b000 {
 		t.Errorf("index = %b; want 000", idx)
 	}
-	if offset != 0b10 {
-		t.Errorf("offset = %d; want 10", offset)
+	if offset != 0b1000 {
+		t.Errorf("offset = %b; want 1000", offset)
 	}
 	if tag != 0 {
 		t.Errorf("tag = %b; want 0", tag)
@@ -49,13 +49,13 @@ func TestReadHitAndMiss(t *testing.T) {
 
 	//load into mem, read miss empty cache
 	for range 6 {
-		newMem.Write(32, LAST_LEVEL_CACHE, 0xDEADBEEF)
+		newMem.Write(128, LAST_LEVEL_CACHE, 0xDEADBEEF)
 	}
 
 	var read ReadResult
 
 	for range 6 {
-		read = c.Read(32, FETCH_STAGE)
+		read = c.Read(128, FETCH_STAGE)
 	}
 
 	if read.Value != 3735928559 {
@@ -63,8 +63,8 @@ func TestReadHitAndMiss(t *testing.T) {
 	}
 
 	// Check if loaded into cache, read hit
-	newMem.Write(32, LAST_LEVEL_CACHE, 0xFFFF)
-	read = c.Read(32, FETCH_STAGE)
+	newMem.Write(128, LAST_LEVEL_CACHE, 0xFFFF)
+	read = c.Read(128, FETCH_STAGE)
 
 	if read.Value != 3735928559 {
 		t.Errorf("read 2 resulted in %08x; want 0xDEADBEEF", read.Value)
@@ -79,15 +79,15 @@ func TestCacheHit(t *testing.T) {
 
 	// writes to cache and memory
 	for range c.MemoryRequestState.Delay + 1{
-		c.Write(32, LAST_LEVEL_CACHE, 0xDEADBEEF)
+		c.Write(128, LAST_LEVEL_CACHE, 0xDEADBEEF)
 	}
 
 	for range c.MemoryRequestState.Delay + 1{
-		c.Write(33, LAST_LEVEL_CACHE, 0xCAFEBABE)
+		c.Write(132, LAST_LEVEL_CACHE, 0xCAFEBABE)
 	}
 
 	// if 0 cycle read, it was a hit
-	read := c.Read(32, FETCH_STAGE)
+	read := c.Read(128, FETCH_STAGE)
 
 	if read.State != SUCCESS || c.Contents[0][0].Data[0] != 0xDEADBEEF || c.Contents[0][0].Data[1] != 0xCAFEBABE {
 		t.Errorf("read 1 resulted in %08x; want 0xDEADBEEF", read.Value)
@@ -102,14 +102,14 @@ func TestCacheHitDelay(t *testing.T) {
 
 	// writes to cache and memory
 	for range c.MemoryRequestState.Delay + 1{
-		c.Write(32, LAST_LEVEL_CACHE, 0xDEADBEEF)
+		c.Write(128, LAST_LEVEL_CACHE, 0xDEADBEEF)
 	}
 
 	// if 0 cycle read, it was a hit
 	var read ReadResult
 	
 	for range 6 {
-		read = c.Read(32, FETCH_STAGE)
+		read = c.Read(128, FETCH_STAGE)
 	}
 
 	if read.State != SUCCESS {
@@ -123,13 +123,13 @@ func TestWriteThrough(t *testing.T) {
 	c := CreateCacheDefault(&newMem)
 
 	for range 6 {
-		c.Write(3, MEMORY_STAGE, 0x123456)
+		c.Write(12, MEMORY_STAGE, 0x123456)
 	}
 	for range 5 {
-		newMem.Read(3, LAST_LEVEL_CACHE)
+		newMem.Read(12, LAST_LEVEL_CACHE)
 	}
-	readMem := newMem.Read(3, LAST_LEVEL_CACHE)
-	readC := c.Read(3, MEMORY_STAGE)
+	readMem := newMem.Read(12, LAST_LEVEL_CACHE)
+	readC := c.Read(12, MEMORY_STAGE)
 
 	if readMem.Value != 0x123456 || readC.Value != 0x123456 {
 		t.Errorf("mem read resulted in %08x; want 0x123456", readMem.Value)
@@ -141,7 +141,7 @@ func TestStagingDelay(t *testing.T) {
 	newMem := CreateRAM(32, 8, 5)
 	c := CreateCache(8, 2, 4, 1, &newMem)
 
-	c.Write(3, FETCH_STAGE, 0xFFFFFF)
+	c.Write(12, FETCH_STAGE, 0xFFFFFF)
 
 }
 
@@ -149,12 +149,12 @@ func TestStagingReadDelay(t *testing.T) {
 	mem := CreateRAM(32, 8, 2)
 	c := CreateCache(8, 2, 4, 2, &mem)
 
-	call1 := c.Read(1, FETCH_STAGE)
-	call2 := c.Read(1, FETCH_STAGE)
-	call3 := c.Read(1, MEMORY_STAGE)
-	call4 := c.Read(1, FETCH_STAGE)
-	call5 := c.Read(1, FETCH_STAGE)
-	call6 := c.Read(1, FETCH_STAGE)
+	call1 := c.Read(4, FETCH_STAGE)
+	call2 := c.Read(4, FETCH_STAGE)
+	call3 := c.Read(4, MEMORY_STAGE)
+	call4 := c.Read(4, FETCH_STAGE)
+	call5 := c.Read(4, FETCH_STAGE)
+	call6 := c.Read(4, FETCH_STAGE)
 
 	if call1.State != WAIT {
 		t.Errorf("should be wait on mem, got %d", call1.State)
@@ -185,8 +185,8 @@ func TestCacheLoadsLineNoDelay(t *testing.T) {
 	mem.Contents[1] = 0xdead00
 	mem.Contents[2] = 0x123456
 	mem.Contents[3] = 0x765432
-	read1 := c.Read(1, MEMORY_STAGE)
-	read2 := c.Read(3, MEMORY_STAGE)
+	read1 := c.Read(4, MEMORY_STAGE)
+	read2 := c.Read(12, MEMORY_STAGE)
 	contents := c.Contents[0][0].Data[2]
 
 	if read2.State != SUCCESS {
@@ -239,15 +239,15 @@ func TestCacheReadWithDelay(t *testing.T) {
 	}
 
 	for range mem.MemoryRequestState.Delay + cache.MemoryRequestState.Delay + 2 {
-		cache.Write(1, MEMORY_STAGE, 0x44556677)
+		cache.Write(4, MEMORY_STAGE, 0x44556677)
 	}
 
 	for range mem.MemoryRequestState.Delay + cache.MemoryRequestState.Delay + 2 {
-		cache.Write(2, MEMORY_STAGE, 0x8899AABB)
+		cache.Write(8, MEMORY_STAGE, 0x8899AABB)
 	}
 
 	for range mem.MemoryRequestState.Delay + cache.MemoryRequestState.Delay + 2 {
-		cache.Write(3, MEMORY_STAGE, 0xCCDDEEFF)
+		cache.Write(12, MEMORY_STAGE, 0xCCDDEEFF)
 	}
 
 	if mem.Contents[0] != 0x00112233 || mem.Contents[1] != 0x44556677 ||
@@ -260,15 +260,15 @@ func TestCacheReadWithDelay(t *testing.T) {
 	}
 
 	for range cache.MemoryRequestState.Delay + 1 {
-		cache.Read(1, MEMORY_STAGE)
+		cache.Read(4, MEMORY_STAGE)
 	}
 
 	for range cache.MemoryRequestState.Delay + 1 {
-		cache.Read(2, MEMORY_STAGE)
+		cache.Read(8, MEMORY_STAGE)
 	}
 
 	for range cache.MemoryRequestState.Delay + 1 {
-		cache.Read(3, MEMORY_STAGE)
+		cache.Read(12, MEMORY_STAGE)
 	}
 
 	if cache.Contents[0][0].Data[0] != 0x00112233 ||
@@ -291,15 +291,15 @@ func TestCacheReadValuesWithDelay(t *testing.T) {
     }
 
     for range mem.MemoryRequestState.Delay + cache.MemoryRequestState.Delay + 2 {
-        cache.Write(1, MEMORY_STAGE, 0x44556677)
+        cache.Write(4, MEMORY_STAGE, 0x44556677)
     }
 
     for range mem.MemoryRequestState.Delay + cache.MemoryRequestState.Delay + 2 {
-        cache.Write(2, MEMORY_STAGE, 0x8899AABB)
+        cache.Write(8, MEMORY_STAGE, 0x8899AABB)
     }
 
     for range mem.MemoryRequestState.Delay + cache.MemoryRequestState.Delay + 2 {
-        cache.Write(3, MEMORY_STAGE, 0xCCDDEEFF)
+        cache.Write(12, MEMORY_STAGE, 0xCCDDEEFF)
     }
 
     if mem.Contents[0] != 0x00112233 || mem.Contents[1] != 0x44556677 ||
@@ -317,15 +317,15 @@ func TestCacheReadValuesWithDelay(t *testing.T) {
     }
 
     for range cache.MemoryRequestState.Delay + 1 {
-        read2 = cache.Read(1, MEMORY_STAGE)
+        read2 = cache.Read(4, MEMORY_STAGE)
     }
 
     for range cache.MemoryRequestState.Delay + 1 {
-        read3 = cache.Read(2, MEMORY_STAGE)
+        read3 = cache.Read(8, MEMORY_STAGE)
     }
 
     for range cache.MemoryRequestState.Delay + 1 {
-        read4 = cache.Read(3, MEMORY_STAGE)
+        read4 = cache.Read(12, MEMORY_STAGE)
     }
 
     if read1.Value != 0x00112233 || read2.Value != 0x44556677 || read3.Value != 0x8899AABB || read4.Value != 0xCCDDEEFF {
@@ -362,7 +362,7 @@ func TestCacheFilled(t *testing.T) {
 
 	for i := range 64 {
 		for range 6 {
-			c.Write(uint(i), MEMORY_STAGE, uint32(i))
+			c.Write(uint(i*4), MEMORY_STAGE, uint32(i))
 		}
 	}
 
@@ -385,7 +385,7 @@ func TestCacheFilledTwice(t *testing.T) {
 
 	for i := range 128 {
 		for range 6 {
-			c.Write(uint(i), MEMORY_STAGE, uint32(i))
+			c.Write(uint(i*4), MEMORY_STAGE, uint32(i))
 		}
 	}
 
@@ -399,7 +399,7 @@ func TestCacheFilledLRU(t *testing.T) {
 
 	for i := range 128 {
 		for range 6 {
-			c.Write(uint(i), MEMORY_STAGE, uint32(i))
+			c.Write(uint(i*4), MEMORY_STAGE, uint32(i))
 		}
 	}
 
@@ -427,7 +427,7 @@ func TestCacheFilledLRUManyWays(t *testing.T) {
 	// Fill the cache once with random numbers
 	for i := range 96 {
 		for range 6 {
-			c.Write(uint(i), MEMORY_STAGE, rand.Uint32())
+			c.Write(uint(i*4), MEMORY_STAGE, rand.Uint32())
 		}
 	}
 
@@ -441,7 +441,7 @@ func TestCacheFilledLRUManyWays(t *testing.T) {
 	// Add to every first line (8 * 4 = 36 words to fill)
 	for i := 96; i < 128; i++ {
 		for range 6 {
-			c.Write(uint(i), MEMORY_STAGE, rand.Uint32())
+			c.Write(uint(i*4), MEMORY_STAGE, rand.Uint32())
 		}
 	}
 
@@ -454,7 +454,7 @@ func TestCacheFilledLRUManyWays(t *testing.T) {
 
 	// Add data to one line in every set, evict lru and update correctly (should evict 2)
 	for i := range 32 {
-		c.Write(uint(i), MEMORY_STAGE, 0xBEEEEEEF)
+		c.Write(uint(i*4), MEMORY_STAGE, 0xBEEEEEEF)
 	}
 	
 	// Check LRU and data, added to every set's second line, LRU should be 1, 0, 2
@@ -477,7 +477,7 @@ func TestZeroLineZeroDelayCacheWrite(t *testing.T) {
 
 	for i := range 20 {
 		for range 6 {
-			c.Write(uint(i), MEMORY_STAGE, uint32(i))
+			c.Write(uint(i*4), MEMORY_STAGE, uint32(i))
 		}
 	}
 
@@ -514,20 +514,162 @@ func TestDisabledCacheRead(t *testing.T) {
 		beef1 = c.Read(0, FETCH_STAGE).Value
 	}
 	for range 6 {
-		beef2 = c.Read(1, FETCH_STAGE).Value
+		beef2 = c.Read(4, FETCH_STAGE).Value
 	}
 	for range 6 {
-		beef3 = c.Read(2, FETCH_STAGE).Value
+		beef3 = c.Read(8, FETCH_STAGE).Value
 	}
 	for range 6 {
-		dead = c.Read(3, FETCH_STAGE).Value
+		dead = c.Read(12, FETCH_STAGE).Value
 	}
 	for range 6 {
-		dad = c.Read(4, FETCH_STAGE).Value
+		dad = c.Read(16, FETCH_STAGE).Value
 	}
 	for range 6 {
-		fad = c.Read(5, FETCH_STAGE).Value
+		fad = c.Read(20, FETCH_STAGE).Value
 	}
 
 	fmt.Printf("%08x, %08x, %08x, %08x, %08x, %08x", beef1, beef2, beef3, dead, dad, fad)
-}
\ No newline at end of file
+}
+func TestCacheReadMulti(t *testing.T) {
+	mem := CreateRAM(32, 8, 5)
+	c := CreateCacheDefault(&mem)
+	for i := range 12 {
+		mem.Contents[i] = uint32(i + 1)
+	}
+
+	var read ReadLineResult
+	for range 6 {
+		read = c.ReadMulti(16, 4, 0, MEMORY_STAGE)
+	}
+	if read.State != SUCCESS || fmt.Sprint(read.Value) != "[5 6 7 8]" {
+		t.Errorf("wanted line [5 6 7 8], got %v %v", LookUpMemoryResult(read.State), read.Value)
+	}
+
+	// the line is cached, so a single word and the upper half of the line hit without delay
+	if r := c.Read(24, MEMORY_STAGE); r.State != SUCCESS || r.Value != 7 {
+		t.Errorf("wanted a hit with 7, got %v %d", LookUpMemoryResult(r.State), r.Value)
+	}
+	if r := c.ReadMulti(24, 2, 0, MEMORY_STAGE); r.State != SUCCESS || fmt.Sprint(r.Value) != "[7 8]" {
+		t.Errorf("wanted a hit with [7 8], got %v %v", LookUpMemoryResult(r.State), r.Value)
+	}
+	// words in two lines load the line that misses
+	for range 6 {
+		read = c.ReadMulti(24, 4, 0, MEMORY_STAGE)
+	}
+	if read.State != SUCCESS || fmt.Sprint(read.Value) != "[7 8 9 10]" {
+		t.Errorf("wanted [7 8 9 10] from two lines, got %v %v", LookUpMemoryResult(read.State), read.Value)
+	}
+}
+
+func TestCacheWriteMulti(t *testing.T) {
+	mem := CreateRAM(32, 8, 5)
+	c := CreateCacheDefault(&mem)
+
+	var write WriteResult
+	for range 6 {
+		write = c.WriteMulti(32, MEMORY_STAGE, []uint32{1, 2, 3, 4})
+	}
+	if write.State != SUCCESS {
+		t.Errorf("wanted success, got %v", LookUpMemoryResult(write.State))
+	}
+	if fmt.Sprint(mem.Contents[8:12]) != "[1 2 3 4]" {
+		t.Errorf("line was not written through, got %v", mem.Contents[8:12])
+	}
+	if r := c.ReadMulti(32, 4, 0, MEMORY_STAGE); r.State != SUCCESS || fmt.Sprint(r.Value) != "[1 2 3 4]" {
+		t.Errorf("wanted a hit with [1 2 3 4], got %v %v", LookUpMemoryResult(r.State), r.Value)
+	}
+}
+
+func TestDisabledCacheMulti(t *testing.T) {
+	mem := CreateRAM(32, 8, 5)
+	c := CreateCache(0, 0, 0, 0, &mem)
+
+	for range 6 {
+		c.WriteMulti(48, MEMORY_STAGE, []uint32{9, 8, 7, 6})
+	}
+	var read ReadLineResult
+	for range 6 {
+		read = c.ReadMulti(48, 4, 0, MEMORY_STAGE)
+	}
+	if read.State != SUCCESS || fmt.Sprint(read.Value) != "[9 8 7 6]" {
+		t.Errorf("wanted [9 8 7 6], got %v %v", LookUpMemoryResult(read.State), read.Value)
+	}
+}
+
+func TestCacheWriteBytes(t *testing.T) {
+	mem := CreateRAM(32, 8, 5)
+	c := CreateCacheDefault(&mem)
+	mem.Contents[1] = 0x11223344
+
+	// a miss writes through without allocating a line
+	var write WriteResult
+	for range 6 {
+		write = c.WriteBytes(7, MEMORY_STAGE, 0xAA, 1)
+	}
+	if write.State != SUCCESS || mem.Contents[1] != 0xAA223344 {
+		t.Errorf("wanted 0xAA223344 in memory, got %v %08x", LookUpMemoryResult(write.State), mem.Contents[1])
+	}
+	if c.Contents[0][0].Valid || c.Contents[0][1].Valid {
+		t.Errorf("a byte write miss should not allocate a line")
+	}
+
+	// a hit updates the line and memory
+	for range 6 {
+		c.Read(4, MEMORY_STAGE)
+	}
+	for range 6 {
+		write = c.WriteBytes(4, MEMORY_STAGE, 0xBEEF, 2)
+	}
+	if r := c.Read(4, MEMORY_STAGE); r.State != SUCCESS || r.Value != 0xAA22BEEF || mem.Contents[1] != 0xAA22BEEF {
+		t.Errorf("wanted a hit with 0xAA22BEEF, got %v %08x, memory %08x", LookUpMemoryResult(r.State), r.Value, mem.Contents[1])
+	}
+}
+
+func TestCachePeekPoke(t *testing.T) {
+	mem := CreateRAM(32, 8, 0)
+	c := CreateCacheDefault(&mem)
+	mem.Contents[5] = 0x1234
+
+	if _, ok := c.Peek(20); ok {
+		t.Errorf("peek should miss before the line is loaded")
+	}
+	if c.Poke(20, 1) {
+		t.Errorf("poke should miss before the line is loaded")
+	}
+	c.Read(20, MEMORY_STAGE)
+	lru := c.Contents[1][0].LRU
+	if v, ok := c.Peek(20); !ok || v != 0x1234 {
+		t.Errorf("wanted a hit with 0x1234, got %v %x", ok, v)
+	}
+	if !c.Poke(20, 0x5678) {
+		t.Errorf("poke should hit the loaded line")
+	}
+	if r := c.Read(20, MEMORY_STAGE); r.Value != 0x5678 || mem.Contents[5] != 0x1234 {
+		t.Errorf("wanted 0x5678 in the cache only, got %x, memory %x", r.Value, mem.Contents[5])
+	}
+	if c.Contents[1][0].LRU != lru {
+		t.Errorf("peek and poke should not change the LRU order")
+	}
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	mem := CreateRAM(32, 8, 0)
+	c := CreateCacheDefault(&mem)
+	mem.Contents[5] = 0x1234
+
+	if c.Invalidate(20) {
+		t.Errorf("invalidate should miss before the line is loaded")
+	}
+	c.Read(20, MEMORY_STAGE)
+	mem.Contents[5] = 0x5678 // written around the cache
+	if !c.Invalidate(16) {
+		t.Errorf("invalidate should hit any word of the loaded line")
+	}
+	if _, ok := c.Peek(20); ok {
+		t.Errorf("the line should be invalid")
+	}
+	if r := c.Read(20, MEMORY_STAGE); r.Value != 0x5678 {
+		t.Errorf("wanted the line loaded again with 0x5678, got %x", r.Value)
+	}
+}
@@ -0,0 +1,90 @@
+package memory
+
+import (
+	"io"
+)
+
+// Console is a UART with one data register. A store writes its low byte to Out, a load returns
+// the next byte of In, or 0xFFFFFFFF when In is nil or at its end
+type Console struct {
+	In  io.Reader
+	Out io.Writer
+}
+
+func (c *Console) Name() string {
+	return "console"
+}
+
+func (c *Console) Size() uint {
+	return 4
+}
+
+func (c *Console) Load(offset uint) uint32 {
+	if c.In == nil {
+		return 0xFFFFFFFF
+	}
+	var b [1]byte
+	if _, err := io.ReadFull(c.In, b[:]); err != nil {
+		return 0xFFFFFFFF
+	}
+	return uint32(b[0])
+}
+
+func (c *Console) Store(offset uint, val uint32, size uint) {
+	if c.Out != nil && offset == 0 {
+		c.Out.Write([]byte{byte(val)})
+	}
+}
+
+// ExitPort stops the program, a store sets Exited and the exit code, a load returns the code
+type ExitPort struct {
+	Exited bool
+	Code   uint32
+}
+
+func (e *ExitPort) Name() string {
+	return "exit"
+}
+
+func (e *ExitPort) Size() uint {
+	return 4
+}
+
+func (e *ExitPort) Load(offset uint) uint32 {
+	return e.Code
+}
+
+func (e *ExitPort) Store(offset uint, val uint32, size uint) {
+	e.Exited = true
+	e.Code = mergeBytes(0, offset, val, size)
+}
+
+// Random is a xorshift32 generator, a load returns the next value and a store sets the seed.
+// The sequence is the same on every run unless the program seeds it, for example from time
+type Random struct {
+	State uint32
+}
+
+const RANDOM_SEED = 0x2545F491
+
+func (r *Random) Name() string {
+	return "random"
+}
+
+func (r *Random) Size() uint {
+	return 4
+}
+
+func (r *Random) Load(offset uint) uint32 {
+	if r.State == 0 {
+		r.State = RANDOM_SEED // xorshift stays at 0
+	}
+	r.State ^= r.State << 13
+	r.State ^= r.State >> 17
+	r.State ^= r.State << 5
+	return r.State
+}
+
+func (r *Random) Store(offset uint, val uint32, size uint) {
+	r.State = mergeBytes(0, offset, val, size)
+}
@@ -0,0 +1,233 @@
+package memory
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Caches stack, the lower level of a cache may be another cache, or an Arbiter in front of one,
+// down to a Bus or RAM. A cache passes the requester of an access on to the levels below, so
+// RAM still tells fetch from the memory stage, and reads the lines it misses from the level
+// below whatever the size of its lines. The inclusion policy of a cache says how its lines
+// relate to the lines of the caches above it:
+//   - a non-inclusive cache keeps the lines it reads for them, with no further rule
+//   - an inclusive cache holds every line they hold, when it evicts a line it invalidates the
+//     line above
+//   - an exclusive cache holds none of their lines, it gives a line they read up to them and
+//     keeps the lines they evict instead. A line they write is dropped, as they allocate it. Its
+//     lines may be longer than theirs, a line then holds the words of the lines they evicted
+//     into it and gives up the words they read
+type InclusionPolicy int
+
+const (
+	NON_INCLUSIVE InclusionPolicy = iota
+	INCLUSIVE
+	EXCLUSIVE
+)
+
+// Names of the inclusion policies, in the order of their values
+var InclusionPolicies = []string{"non-inclusive", "inclusive", "exclusive"}
+
+func (p InclusionPolicy) String() string {
+	if int(p) < len(InclusionPolicies) {
+		return InclusionPolicies[p]
+	}
+	return "UNKNOWN"
+}
+
+func ParseInclusion(name string) (InclusionPolicy, error) {
+	for i, n := range InclusionPolicies {
+		if n == name {
+			return InclusionPolicy(i), nil
+		}
+	}
+	return NON_INCLUSIVE, fmt.Errorf("unknown inclusion policy %s, expected one of %s", name, strings.Join(InclusionPolicies, ", "))
+}
+
+// Accesses of a cache, counted when they complete, and the lines it replaced
+type CacheStats struct {
+	ReadHits          uint32
+	ReadMisses        uint32
+	WriteHits         uint32
+	WriteMisses       uint32
+	Evictions         uint32 // valid lines replaced by other lines
+	Writebacks        uint32 // dirty lines written back to the lower level
+	BackInvalidations uint32 // lines of the caches above invalidated by the evictions of an inclusive cache
+}
+
+func (s CacheStats) Accesses() uint32 {
+	return s.ReadHits + s.ReadMisses + s.WriteHits + s.WriteMisses
+}
+
+// Returns the fraction of the accesses that hit
+func (s CacheStats) HitRate() float64 {
+	if s.Accesses() == 0 {
+		return 0
+	}
+	return float64(s.ReadHits+s.WriteHits) / float64(s.Accesses())
+}
+
+// Sets the inclusion policy of the cache with respect to uppers, the caches whose lower level it
+// is, directly or through an Arbiter. An exclusive cache swaps lines with them, so its lines must
+// be at least as long as theirs
+func (c *CacheType) SetInclusion(p InclusionPolicy, uppers ...*CacheType) error {
+	if p == EXCLUSIVE {
+		for _, u := range uppers {
+			if u.WordsPerLine > c.WordsPerLine {
+				return fmt.Errorf("an exclusive cache needs lines at least as long as the lines of the caches above it, %d words and not %d", u.WordsPerLine, c.WordsPerLine)
+			}
+		}
+	}
+	c.Inclusion, c.Upper = p, uppers
+	return nil
+}
+
+func (c *CacheType) exclusive() bool {
+	return c.Inclusion == EXCLUSIVE && len(c.Upper) > 0 && c.Sets > 0 && c.Ways > 0
+}
+
+// Counts an access that completed, as a miss if it allocated a line
+func (c *CacheType) count(write bool) {
+	switch {
+	case write && c.missed:
+		c.Stats.WriteMisses++
+	case write:
+		c.Stats.WriteHits++
+	case c.missed:
+		c.Stats.ReadMisses++
+	default:
+		c.Stats.ReadHits++
+	}
+	c.missed = false
+}
+
+// Makes room in place of the line at way of set index. A valid line is evicted, which passes it
+// to an exclusive cache below unless a write allocated it and it lacks words, see makeRoom for
+// what happens before
+func (c *CacheType) evict(index, way uint) {
+	line := c.Contents[index][way]
+	if !line.Valid {
+		return
+	}
+	c.Stats.Evictions++
+	if v, ok := c.LowerLevel.(victimTaker); ok && line.known == nil {
+		v.takeVictim(c.lineAddr(index, line.Tag), append([]uint32{}, line.Data...))
+	}
+}
+
+// The caches above an inclusive cache give up their copies of the line at byte address addr the
+// cache is about to evict. The words they wrote back go to line, or to the other lines of the
+// cache that hold them when their lines are longer
+func (c *CacheType) release(addr uint, line *CacheLine) {
+	if c.Inclusion != INCLUSIVE {
+		return
+	}
+	for _, u := range c.Upper {
+		if u.Sets == 0 || u.Ways == 0 || u.WordsPerLine == 0 {
+			continue
+		}
+		for a := addr; a < addr+c.lineBytes(); a += min(u.lineBytes(), c.lineBytes()) {
+			upper := u.lookUp(a)
+			if upper == nil {
+				continue
+			}
+			if upper.Dirty {
+				start := u.lineStart(a)
+				for i, val := range upper.Data {
+					wa := start + 4*uint(i)
+					target := line
+					if wa < addr || wa >= addr+c.lineBytes() {
+						target = c.lookUp(wa)
+					}
+					if target != nil {
+						target.Data[wa%c.lineBytes()/4] = val
+						target.Dirty = true
+					}
+					if u.Buffer != nil {
+						u.Buffer.sync(wa, val, 4) // older waiting writes must not undo it
+					}
+				}
+			}
+			u.Invalidate(a)
+			c.Stats.BackInvalidations++
+		}
+	}
+}
+
+// Implemented by a memory that takes the lines a cache above it evicts
+type victimTaker interface {
+	takeVictim(addr uint, data []uint32)
+}
+
+// An exclusive cache keeps the line starting at byte address addr that a cache above evicted,
+// moving a line between levels takes no time. A longer line of its own holds none of its words
+// but the ones of the lines evicted into it
+func (c *CacheType) takeVictim(addr uint, data []uint32) {
+	if !c.exclusive() {
+		return
+	}
+	var line *CacheLine
+	if index, way, ok := c.find(addr); ok {
+		line = c.Contents[index][way]
+		c.Replacement.Insert(c.Contents[index], index, way)
+	} else {
+		line = c.allocate(c.lineStart(addr), make([]uint32, c.WordsPerLine))
+		line.known = make([]bool, c.WordsPerLine)
+	}
+	first := addr % c.lineBytes() / 4
+	copy(line.Data[first:], data)
+	for i := range uint(len(data)) {
+		line.wrote(first + i)
+	}
+}
+
+// An exclusive cache gives the words of the line a cache above reads up to it, and reads a line
+// it does not hold all of from the lower level without keeping it
+func (c *CacheType) readExclusive(start, numWords uint, who Requester) ReadLineResult {
+	index, way, held := c.find(start)
+	first := start % c.lineBytes() / 4
+	if held && c.Contents[index][way].holdsAll(first, 4*numWords) {
+		line := c.Contents[index][way]
+		vals := append([]uint32{}, line.Data[first:first+numWords]...)
+		line.forget(first, numWords)
+		c.count(false)
+		c.CancelRequest()
+		return ReadLineResult{SUCCESS, vals}
+	}
+	read := c.LowerLevel.ReadMulti(start, numWords, 0, who)
+	switch read.State {
+	case WAIT, WAIT_NEXT_LEVEL:
+		c.MemoryRequestState.WaitNext = true
+		return ReadLineResult{WAIT_NEXT_LEVEL, []uint32{}}
+	case SUCCESS:
+		c.missed = true
+		c.count(false)
+		if held {
+			c.Contents[index][way].forget(first, numWords) // the words it held are the ones read
+		}
+	}
+	c.CancelRequest()
+	return read
+}
+
+// An exclusive cache drops the words of the lines of the caches above that hold the n bytes at
+// byte address addr they write, as they allocate those lines. A write to words it does not hold
+// is a miss
+func (c *CacheType) drop(addr, n uint) {
+	start, end := addr&^3, addr+n
+	for _, u := range c.Upper {
+		if u.WordsPerLine > 0 {
+			start, end = min(start, u.lineStart(addr)), max(end, u.lineStart(addr+n-1)+u.lineBytes())
+		}
+	}
+	held := false
+	for a := start; a < end; a += 4 {
+		if line := c.lookUp(a); line != nil && line.holds(a%c.lineBytes()/4) {
+			line.forget(a%c.lineBytes()/4, 1)
+			held = true
+		}
+	}
+	if !held && !c.MemoryRequestState.WaitNext {
+		c.missed = true
+	}
+}
@@ -0,0 +1,273 @@
+package memory
+
+import (
+	"fmt"
+	"testing"
+)
+
+// Returns RAM holding 1, 2, 3 and so on from address 0
+func countingRAM() *RAM {
+	mem := CreateRAM(32, 8, 2)
+	for i := range mem.Contents {
+		mem.Contents[i] = uint32(i + 1)
+	}
+	return &mem
+}
+
+func readWord(t *testing.T, c *CacheType, addr uint) uint32 {
+	var val uint32
+	untilDone(t, func() MemoryResult {
+		r := c.Read(addr, MEMORY_STAGE)
+		val = r.Value
+		return r.State
+	})
+	return val
+}
+
+func TestHierarchyShortLinesOverLongLines(t *testing.T) {
+	mem := countingRAM()
+	l2 := CreateCache(4, 2, 8, 0, mem)
+	l1 := CreateCache(4, 1, 4, 0, &l2)
+
+	if v := readWord(t, &l1, 4); v != 2 {
+		t.Errorf("wanted 2, got %d", v)
+	}
+	// the refill of the L1 loaded the whole line of the L2, the second half of it hits there
+	if v := readWord(t, &l1, 20); v != 6 {
+		t.Errorf("wanted 6, got %d", v)
+	}
+	if l2.Stats.ReadMisses != 1 || l2.Stats.ReadHits != 1 {
+		t.Errorf("wanted 1 miss and 1 hit in the L2, got %+v", l2.Stats)
+	}
+	if l1.Stats.ReadMisses != 2 || l1.Stats.ReadHits != 0 {
+		t.Errorf("wanted 2 misses in the L1, got %+v", l1.Stats)
+	}
+}
+
+func TestHierarchyLongLinesOverShortLines(t *testing.T) {
+	mem := countingRAM()
+	l2 := CreateCache(4, 2, 2, 0, mem)
+	l1 := CreateCache(2, 1, 8, 0, &l2)
+
+	if v := readWord(t, &l1, 28); v != 8 {
+		t.Errorf("wanted 8, got %d", v)
+	}
+	// the refill of the L1 spans four lines of the L2
+	if l2.Stats.ReadMisses != 1 || l2.Stats.Accesses() != 1 {
+		t.Errorf("wanted the refill to be one access of the L2, got %+v", l2.Stats)
+	}
+	for a := uint(0); a < 32; a += 8 {
+		if l2.lookUp(a) == nil {
+			t.Errorf("wanted the L2 to hold the line at %d", a)
+		}
+	}
+	if r := l1.ReadMulti(0, 8, 0, MEMORY_STAGE); r.State != SUCCESS || fmt.Sprint(r.Value) != "[1 2 3 4 5 6 7 8]" {
+		t.Errorf("wanted a hit with the line, got %s %v", LookUpMemoryResult(r.State), r.Value)
+	}
+}
+
+func TestHierarchyInclusive(t *testing.T) {
+	mem := countingRAM()
+	l2 := CreateCache(1, 1, 8, 0, mem)
+	l1 := CreateCache(2, 1, 4, 0, &l2)
+	if err := l2.SetInclusion(INCLUSIVE, &l1); err != nil {
+		t.Fatal(err)
+	}
+
+	readWord(t, &l1, 0)
+	readWord(t, &l1, 16)
+	// the L2 holds a single line, replacing it invalidates both lines of the L1
+	if v := readWord(t, &l1, 32); v != 9 {
+		t.Errorf("wanted 9, got %d", v)
+	}
+	if l1.lookUp(16) != nil {
+		t.Errorf("wanted the L1 line at 16 to be invalidated")
+	}
+	if l2.Stats.Evictions != 1 || l2.Stats.BackInvalidations != 2 {
+		t.Errorf("wanted 1 eviction and 2 back invalidations, got %+v", l2.Stats)
+	}
+}
+
+func TestHierarchyExclusive(t *testing.T) {
+	mem := countingRAM()
+	l2 := CreateCache(1, 2, 4, 0, mem)
+	l1 := CreateCache(1, 1, 4, 0, &l2)
+	if err := l2.SetInclusion(EXCLUSIVE, &l1); err != nil {
+		t.Fatal(err)
+	}
+
+	readWord(t, &l1, 0)
+	if l2.lookUp(0) != nil {
+		t.Errorf("wanted the L2 not to keep a line it gave to the L1")
+	}
+	// the L1 evicts the line at 0 into the L2
+	readWord(t, &l1, 16)
+	if l2.lookUp(0) == nil {
+		t.Fatalf("wanted the L2 to keep the line the L1 evicted")
+	}
+	// and takes it back, swapping it for the line at 16
+	if v := readWord(t, &l1, 8); v != 3 {
+		t.Errorf("wanted 3, got %d", v)
+	}
+	if l2.lookUp(0) != nil || l2.lookUp(16) == nil {
+		t.Errorf("wanted the L2 to swap the lines with the L1")
+	}
+	if l2.Stats.ReadHits != 1 || l2.Stats.ReadMisses != 2 {
+		t.Errorf("wanted 1 hit and 2 misses in the L2, got %+v", l2.Stats)
+	}
+
+	// a write allocates in the L1, so the L2 drops its copy
+	untilDone(t, func() MemoryResult { return l1.Write(16, MEMORY_STAGE, 0xff).State })
+	if l2.lookUp(16) != nil {
+		t.Errorf("wanted the L2 to drop a line the L1 writes")
+	}
+
+	// the line the write allocated holds words not read from memory, the L2 does not keep it
+	readWord(t, &l1, 32)
+	if l2.lookUp(16) != nil {
+		t.Errorf("wanted the L2 not to keep a line partially written in the L1")
+	}
+	if v := readWord(t, &l1, 20); v != 6 {
+		t.Errorf("wanted 6 from memory, got %d", v)
+	}
+
+	if err := l2.SetInclusion(EXCLUSIVE, &l1, &CacheType{WordsPerLine: 8}); err == nil {
+		t.Errorf("wanted an error for lines longer than the lines of the L2")
+	}
+}
+
+func TestHierarchyExclusiveLongerLines(t *testing.T) {
+	mem := countingRAM()
+	l2 := CreateCache(1, 2, 8, 0, mem)
+	l1 := CreateCache(2, 1, 4, 0, &l2)
+	if err := l2.SetInclusion(EXCLUSIVE, &l1); err != nil {
+		t.Fatal(err)
+	}
+
+	// a line of the L2 holds the two lines of the L1 the reads at 32 and 48 evict
+	for _, addr := range []uint{0, 16, 32, 48} {
+		readWord(t, &l1, addr)
+	}
+	if v, ok := l2.Peek(4); !ok || v != 2 {
+		t.Errorf("wanted the L2 to keep the line at 0 the L1 evicted, got %d %v", v, ok)
+	}
+	if v, ok := l2.Peek(20); !ok || v != 6 {
+		t.Errorf("wanted the L2 to keep the line at 16 the L1 evicted, got %d %v", v, ok)
+	}
+	if _, ok := l2.Peek(32); ok {
+		t.Errorf("wanted the L2 not to hold the words the L1 holds")
+	}
+
+	// a write drops the words of the line of the L1 it allocates, the L2 keeps the rest of its line
+	untilDone(t, func() MemoryResult { return l1.Write(4, MEMORY_STAGE, 0xff).State })
+	if _, ok := l2.Peek(0); ok {
+		t.Errorf("wanted the L2 to drop the line the L1 writes")
+	}
+	// and gives the rest up to the L1
+	if v := readWord(t, &l1, 16); v != 5 {
+		t.Errorf("wanted 5, got %d", v)
+	}
+	if l2.lookUp(0) != nil {
+		t.Errorf("wanted the L2 line to be invalid once it gave up all of its words")
+	}
+	if v, ok := l2.Peek(48); !ok || v != 13 {
+		t.Errorf("wanted the L2 to keep the line at 48 the L1 evicted, got %d %v", v, ok)
+	}
+	if l2.Stats.ReadHits != 1 || l2.Stats.ReadMisses != 4 || l2.Stats.WriteHits != 1 {
+		t.Errorf("wanted 1 read hit, 4 read misses and 1 write hit in the L2, got %+v", l2.Stats)
+	}
+}
+
+func TestHierarchyCancel(t *testing.T) {
+	mem := countingRAM()
+	l2 := CreateCache(4, 2, 4, 1, mem)
+	l1 := CreateCache(4, 1, 4, 0, &l2)
+
+	l1.Read(0, FETCH_STAGE)
+	l1.Read(0, FETCH_STAGE)
+	if mem.Requester() != FETCH_STAGE {
+		t.Fatalf("wanted the refill to reach RAM")
+	}
+	l1.Cancel(FETCH_STAGE)
+	if l1.Requester() != NONE || l2.Requester() != NONE || mem.Requester() != NONE {
+		t.Errorf("wanted every level to be free after the cancel")
+	}
+	if v := readWord(t, &l1, 0); v != 1 {
+		t.Errorf("wanted 1 after the cancel, got %d", v)
+	}
+}
+
+func TestHierarchyRefillSpanningOneSet(t *testing.T) {
+	mem := countingRAM()
+	l2 := CreateCache(1, 1, 1, 0, mem)
+	l1 := CreateCache(2, 1, 4, 0, &l2)
+
+	// each line of the L2 the refill reads replaces the one before it, the words read are kept
+	for i := 1; ; i++ {
+		r := l1.ReadMulti(20, 4, 4, MEMORY_STAGE)
+		if r.State == SUCCESS {
+			if fmt.Sprint(r.Value) != "[5 6 7 8]" {
+				t.Errorf("wanted the line at 16, got %v", r.Value)
+			}
+			break
+		}
+		if i == 100 {
+			t.Fatalf("the refill did not complete, the L2 holds %+v", l2.Contents[0][0])
+		}
+	}
+	if l2.lookUp(28) == nil {
+		t.Errorf("wanted the L2 to hold the last line read")
+	}
+}
+
+func TestHierarchyRefillHeldByRequester(t *testing.T) {
+	mem := countingRAM()
+	l2 := CreateCache(2, 1, 2, 1, mem)
+	l1 := CreateCache(4, 1, 4, 1, &l2)
+
+	// the memory stage goes before fetch every cycle, as in the pipeline, and stores to a line in
+	// the set of the first line of the L2 the refill for fetch reads. The stores must wait for the
+	// refill instead of replacing that line before the refill has read it
+	fetched := false
+	for i := 0; i < 100 && !fetched; i++ {
+		l1.Write(32, MEMORY_STAGE, uint32(i))
+		fetched = l1.Read(0, FETCH_STAGE).State == SUCCESS
+	}
+	if !fetched {
+		t.Fatalf("wanted the fetch to complete, the L2 holds %+v", l2.Contents[0][0])
+	}
+}
+
+func TestHierarchyWriteSpanningOneSet(t *testing.T) {
+	mem := countingRAM()
+	l2 := CreateCache(1, 1, 2, 0, mem)
+	l2.WritePolicy = WRITE_BACK
+	writeWord(t, &l2, 32, 0xAA)
+
+	// the write back of a longer line of the L1 spans two lines of the L2, the second replaces
+	// the first, so the write goes through to memory. It must not allocate them again while it waits
+	vals := []uint32{0xB0, 0xB1, 0xB2, 0xB3}
+	untilDone(t, func() MemoryResult { return l2.WriteMulti(0, MEMORY_STAGE, vals).State })
+	if fmt.Sprint(mem.Contents[:4]) != fmt.Sprint(vals) || mem.Contents[8] != 0xAA {
+		t.Errorf("wanted the writes in memory, got %x and %x", mem.Contents[:4], mem.Contents[8])
+	}
+}
+
+func TestHierarchyRefillFailure(t *testing.T) {
+	mem := countingRAM()
+	l2 := CreateCache(4, 2, 8, 0, mem)
+	l1 := CreateCache(4, 1, 4, 0, &l2)
+
+	// a refill past the end of RAM fails in each level, the failure reaches the stage
+	var state MemoryResult = WAIT
+	for i := 0; i < 20 && (state == WAIT || state == WAIT_NEXT_LEVEL); i++ {
+		state = l1.Read(4*uint(len(mem.Contents)), MEMORY_STAGE).State
+	}
+	if state != FAILURE_OUT_OF_RANGE {
+		t.Fatalf("wanted FAILURE_OUT_OF_RANGE, got %s", LookUpMemoryResult(state))
+	}
+	// neither level is left serving the failed read
+	if v := readWord(t, &l1, 4); v != 2 {
+		t.Errorf("wanted 2, got %d", v)
+	}
+}
@@ -60,6 +60,13 @@ func (mem *RAM) CancelRequest() {
 	// fmt.Println("RAM cancelled request")
 }
 
+// Cancels the request RAM serves for who
+func (mem *RAM) Cancel(who Requester) {
+	if mem.Requester() == who {
+		mem.CancelRequest()
+	}
+}
+
 func (mem *RAM) service(who Requester) bool {
 	if mem.Delay == 0 {
 		return true
@@ -97,33 +104,42 @@ func (mem *RAM) service(who Requester) bool {
 	panic("oop ram")
 }
 
-// Reads a value from memory
+// Reads the word at byte address addr from memory
 func (mem *RAM) Read(addr uint, who Requester) ReadResult {
-	
+
+	if addr%4 != 0 {
+		return ReadResult{FAILURE_MISALIGNED, 0}
+	}
+
 	if !mem.service(who) { // if memory is busy, return WAIT
 		return ReadResult{WAIT, 0} // Indicate that we are waiting
 	}
 
-	if addr > uint(len(mem.Contents)-1) {
+	if addr/4 > uint(len(mem.Contents)-1) {
 		//fmt.Println("Address cannot be read. Not a valid address.")
 		return ReadResult{FAILURE_OUT_OF_RANGE, 0}
 	}
 
-	return ReadResult{SUCCESS, mem.Contents[addr]}
+	return ReadResult{SUCCESS, mem.Contents[addr/4]}
 }
 
+// Reads numWords words starting at byte address addr - offset
 func (mem *RAM) ReadMulti(addr, numWords, offset uint, who Requester) ReadLineResult {
-	
+
+	if (addr-offset)%4 != 0 {
+		return ReadLineResult{FAILURE_MISALIGNED, []uint32{}}
+	}
+
 	if !mem.service(who) {
 		return ReadLineResult{WAIT, []uint32{}}
 	}
 
-	if addr > uint(len(mem.Contents)-1) {
+	if addr/4 > uint(len(mem.Contents)-1) {
 		fmt.Println("Address cannot be read. Not a valid address.")
 		return ReadLineResult{FAILURE_OUT_OF_RANGE, []uint32{}}
 	}
 
-	a := addr - offset
+	a := (addr - offset) / 4
 	line := []uint32{}
 	for i := range numWords {
 		line = append(line, mem.Contents[a+i])
@@ -131,23 +147,74 @@ func (mem *RAM) ReadMulti(addr, numWords, offset uint, who Requester) ReadLineRe
 	return ReadLineResult{SUCCESS, line}
 }
 
-// Writes a value to memory
+// Writes the word at byte address addr to memory
 func (mem *RAM) Write(addr uint, who Requester, val uint32) WriteResult {
-	
+
+	if addr%4 != 0 {
+		return WriteResult{FAILURE_MISALIGNED, 0}
+	}
+
 	if !mem.service(who) { // if memory is busy, return WAIT
 		return WriteResult{WAIT, 0} // Indicate that we are waiting
 	}
 
-	if addr > uint(len(mem.Contents)-1) {
+	if addr/4 > uint(len(mem.Contents)-1) {
 		fmt.Println("Address cannot be read. Not a valid address.")
 		return WriteResult{FAILURE_OUT_OF_RANGE, 0}
 	}
 
-	mem.Contents[addr] = val
+	mem.Contents[addr/4] = val
 	return WriteResult{SUCCESS, 0}
 
 }
 
+// Writes consecutive words starting at byte address addr, taking as long as a single write
+func (mem *RAM) WriteMulti(addr uint, who Requester, vals []uint32) WriteResult {
+
+	if addr%4 != 0 {
+		return WriteResult{FAILURE_MISALIGNED, 0}
+	}
+
+	if !mem.service(who) {
+		return WriteResult{WAIT, 0}
+	}
+
+	if addr/4+uint(len(vals)) > uint(len(mem.Contents)) {
+		fmt.Println("Address cannot be written. Not a valid address.")
+		return WriteResult{FAILURE_OUT_OF_RANGE, 0}
+	}
+
+	copy(mem.Contents[addr/4:], vals)
+	return WriteResult{SUCCESS, 0}
+}
+
+// Writes the low size bytes of val starting at byte address addr, leaving the rest of the word unchanged
+func (mem *RAM) WriteBytes(addr uint, who Requester, val uint32, size uint) WriteResult {
+
+	if !fitsWord(addr, size) {
+		return WriteResult{FAILURE_MISALIGNED, 0}
+	}
+
+	if !mem.service(who) {
+		return WriteResult{WAIT, 0}
+	}
+
+	if addr/4 > uint(len(mem.Contents)-1) {
+		fmt.Println("Address cannot be written. Not a valid address.")
+		return WriteResult{FAILURE_OUT_OF_RANGE, 0}
+	}
+
+	mem.Contents[addr/4] = mergeBytes(mem.Contents[addr/4], addr, val, size)
+	return WriteResult{SUCCESS, 0}
+}
+
+// Writes the low size bytes of val at byte address addr at once, see CacheType.Sync
+func (mem *RAM) Sync(addr uint, val uint32, size uint) {
+	if addr/4 < uint(len(mem.Contents)) {
+		mem.Contents[addr/4] = mergeBytes(mem.Contents[addr/4], addr, val, size)
+	}
+}
+
 func (mem *RAM) SizeBytes() uint {
 	return mem.NumLines * mem.WordsPerLine * 4 // 4 bytes per uint32
 }
@@ -169,7 +236,7 @@ func (mem *RAM) PrintMem() {
 	addr := 0
 	for i := range uint(mem.NumLines) {
 		row := []string{}
-		header := fmt.Sprintf("0x%03X", i*mem.WordsPerLine)
+		header := fmt.Sprintf("0x%03X", 4*i*mem.WordsPerLine) // byte address of the row
 		for range mem.WordsPerLine {
 			row = append(row, fmt.Sprintf("0x%08X", mem.Contents[addr]))
 			addr++
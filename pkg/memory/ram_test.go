@@ -22,7 +22,7 @@ func TestReadEmpty(t *testing.T) {
 
 func TestReadRandom(t *testing.T) {
 	newMem := CreateRAM(32, 8, 5)
-	randomZero := newMem.Read(125, LAST_LEVEL_CACHE)
+	randomZero := newMem.Read(500, LAST_LEVEL_CACHE)
 	if randomZero.Value != 0 {
 		t.Errorf("firstZero = %08x; want 0x0", randomZero)
 	}
@@ -39,8 +39,8 @@ func TestWriteFrontNoDelay(t *testing.T) {
 
 func TestWriteEndNoDelay(t *testing.T) {
 	newMem := CreateRAM(32, 8, 0)
-	newMem.Write(255, LAST_LEVEL_CACHE, 28) // 0x1C in hex
-	read := newMem.Read(255, LAST_LEVEL_CACHE).Value
+	newMem.Write(1020, LAST_LEVEL_CACHE, 28) // 0x1C in hex
+	read := newMem.Read(1020, LAST_LEVEL_CACHE).Value
 	if read != 28 {
 		t.Errorf("read resulted in %08x; want 0x1C", read)
 	}
@@ -48,15 +48,15 @@ func TestWriteEndNoDelay(t *testing.T) {
 
 func TestWriteNoDelay(t *testing.T) {
 	newMem := CreateRAM(32, 8, 0)
-	newMem.Write(32, LAST_LEVEL_CACHE, 3735928559)
-	newMem.Write(197, LAST_LEVEL_CACHE, 65535)
+	newMem.Write(128, LAST_LEVEL_CACHE, 3735928559)
+	newMem.Write(788, LAST_LEVEL_CACHE, 65535)
 
-	read1 := newMem.Read(197, LAST_LEVEL_CACHE)
+	read1 := newMem.Read(788, LAST_LEVEL_CACHE)
 	if read1.Value != 65535 {
 		t.Errorf("read resulted in %08x; want 0xFFFF", read1)
 	}
 
-	read2 := newMem.Read(32, LAST_LEVEL_CACHE)
+	read2 := newMem.Read(128, LAST_LEVEL_CACHE)
 	if read2.Value != 3735928559 {
 		t.Errorf("read resulted in %08x; want 0xDEADBEEF", read2)
 	}
@@ -64,10 +64,10 @@ func TestWriteNoDelay(t *testing.T) {
 
 func TestWrite1And9(t *testing.T) {
 	mem := CreateRAM(32, 8, 0)
-	mem.Write(1, LAST_LEVEL_CACHE, 0xfeebdaed)
+	mem.Write(4, LAST_LEVEL_CACHE, 0xfeebdaed)
 
-	read1 := mem.Read(1, LAST_LEVEL_CACHE)
-	read9 := mem.Read(9, LAST_LEVEL_CACHE)
+	read1 := mem.Read(4, LAST_LEVEL_CACHE)
+	read9 := mem.Read(36, LAST_LEVEL_CACHE)
 
 	if read1.Value != 0xfeebdaed {
 		t.Errorf("read 0x1 resulted in %08x; want 0xfeebdaed", read1)
@@ -81,14 +81,14 @@ func TestWrite1And9(t *testing.T) {
 func TestWriteSameLocationNoDelay(t *testing.T) {
 	newMem := CreateRAM(32, 8, 0)
 
-	newMem.Write(32, LAST_LEVEL_CACHE, 3735928559)
-	read1 := newMem.Read(32, LAST_LEVEL_CACHE)
+	newMem.Write(128, LAST_LEVEL_CACHE, 3735928559)
+	read1 := newMem.Read(128, LAST_LEVEL_CACHE)
 	if read1.Value != 3735928559 {
 		t.Errorf("read resulted in %08x; want 0xDEADBEEF", read1)
 	}
 
-	newMem.Write(32, LAST_LEVEL_CACHE, 65535)
-	read2 := newMem.Read(32, LAST_LEVEL_CACHE)
+	newMem.Write(128, LAST_LEVEL_CACHE, 65535)
+	read2 := newMem.Read(128, LAST_LEVEL_CACHE)
 	if read2.Value != 65535 {
 		t.Errorf("read resulted in %08x; want 0xFFFF", read2)
 	}
@@ -97,11 +97,11 @@ func TestWriteSameLocationNoDelay(t *testing.T) {
 func TestDifferentStageAccess(t *testing.T) {
 	mem := CreateRAM(32, 8, 2)
 	for range 3 {
-		mem.Write(1, LAST_LEVEL_CACHE, 0xfeebdaed)
+		mem.Write(4, LAST_LEVEL_CACHE, 0xfeebdaed)
 	}
 
-	read1 := mem.Read(1, LAST_LEVEL_CACHE)
-	write := mem.Write(9, LAST_LEVEL_CACHE, 123)
+	read1 := mem.Read(4, LAST_LEVEL_CACHE)
+	write := mem.Write(36, LAST_LEVEL_CACHE, 123)
 
 	if read1.State != WAIT {
 		t.Errorf("is reading from RAM while it is servicing a different stage %d", read1)
@@ -116,13 +116,13 @@ func TestDifferentStageAccess(t *testing.T) {
 func TestStagingFiveDelayWrite(t *testing.T) {
 	mem := CreateRAM(32, 8, 5)
 
-	call1 := mem.Write(1, LAST_LEVEL_CACHE, 0x122122)
-	call2 := mem.Write(1, LAST_LEVEL_CACHE, 0x122122)
-	call3 := mem.Write(1, LAST_LEVEL_CACHE, 0x122122)
-	call4 := mem.Write(1, LAST_LEVEL_CACHE, 0x122122)
-	call5 := mem.Write(1, LAST_LEVEL_CACHE, 0x122122)
-	call6 := mem.Write(1, LAST_LEVEL_CACHE, 0x122122)
-	call7 := mem.Write(1, LAST_LEVEL_CACHE, 0x122122)
+	call1 := mem.Write(4, LAST_LEVEL_CACHE, 0x122122)
+	call2 := mem.Write(4, LAST_LEVEL_CACHE, 0x122122)
+	call3 := mem.Write(4, LAST_LEVEL_CACHE, 0x122122)
+	call4 := mem.Write(4, LAST_LEVEL_CACHE, 0x122122)
+	call5 := mem.Write(4, LAST_LEVEL_CACHE, 0x122122)
+	call6 := mem.Write(4, LAST_LEVEL_CACHE, 0x122122)
+	call7 := mem.Write(4, LAST_LEVEL_CACHE, 0x122122)
 
 	if call1.State != WAIT {
 		t.Errorf("ram should return wait, got %d", call1)
@@ -147,3 +147,30 @@ func TestStagingFiveDelayWrite(t *testing.T) {
 	}
 
 }
+
+func TestWriteBytesLittleEndian(t *testing.T) {
+	mem := CreateRAM(32, 8, 0)
+	mem.Write(4, LAST_LEVEL_CACHE, 0x11223344)
+
+	mem.WriteBytes(5, LAST_LEVEL_CACHE, 0xAB, 1)
+	if read := mem.Read(4, LAST_LEVEL_CACHE); read.Value != 0x1122AB44 {
+		t.Errorf("byte write resulted in %08x; want 0x1122AB44", read.Value)
+	}
+	mem.WriteBytes(6, LAST_LEVEL_CACHE, 0xBEEF, 2)
+	if read := mem.Read(4, LAST_LEVEL_CACHE); read.Value != 0xBEEFAB44 {
+		t.Errorf("halfword write resulted in %08x; want 0xBEEFAB44", read.Value)
+	}
+	if write := mem.WriteBytes(7, LAST_LEVEL_CACHE, 0xBEEF, 2); write.State != FAILURE_MISALIGNED {
+		t.Errorf("halfword write across words should fail, got %v", LookUpMemoryResult(write.State))
+	}
+}
+
+func TestMisalignedWord(t *testing.T) {
+	mem := CreateRAM(32, 8, 0)
+	if read := mem.Read(6, LAST_LEVEL_CACHE); read.State != FAILURE_MISALIGNED {
+		t.Errorf("read at 6 should be misaligned, got %v", LookUpMemoryResult(read.State))
+	}
+	if write := mem.Write(1, LAST_LEVEL_CACHE, 1); write.State != FAILURE_MISALIGNED {
+		t.Errorf("write at 1 should be misaligned, got %v", LookUpMemoryResult(write.State))
+	}
+}
@@ -0,0 +1,344 @@
+package memory
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+)
+
+// ReplacementPolicy chooses the line of a set a refill replaces. The cache tells it about every
+// read and write of a line and every line it allocates, and asks it for a victim when the set
+// has no invalid line left. Policies keep their own state by set and way, except LRU which keeps
+// the order in CacheLine.LRU
+type ReplacementPolicy interface {
+	Name() string
+	MetaName() string                              // what Meta shows, the header of its column in the cache view
+	Touch(set []*CacheLine, index, way uint)       // the line at way of set index was read or written
+	Insert(set []*CacheLine, index, way uint)      // a line was allocated at way of set index
+	Victim(set []*CacheLine, index uint) uint      // returns the way of set index the next line replaces
+	Meta(set []*CacheLine, index, way uint) string // the state of the line at way of set index
+}
+
+// Names of the replacement policies of NewReplacement
+var ReplacementPolicies = []string{"lru", "fifo", "random", "plru", "lfu", "srrip", "brrip"}
+
+// Returns the replacement policy called name for a cache of sets sets of ways lines. seed seeds
+// random and brrip, the same seed replaces the same lines for the same accesses. plru needs
+// ways to be a power of two
+func NewReplacement(name string, sets, ways uint, seed int64) (ReplacementPolicy, error) {
+	switch name {
+	case "lru":
+		return LRU{}, nil
+	case "fifo":
+		return &FIFO{ages: newAges(sets, ways)}, nil
+	case "random":
+		return NewRandomReplacement(sets, ways, seed), nil
+	case "plru":
+		if ways&(ways-1) != 0 {
+			return nil, fmt.Errorf("plru needs the ways to be a power of two, got %d", ways)
+		}
+		return &TreePLRU{ways: ways, bits: newTable[bool](sets, max(ways, 1)-1)}, nil
+	case "lfu":
+		return &LFU{uses: newTable[uint32](sets, ways)}, nil
+	case "srrip":
+		return NewRRIP(sets, ways, false, seed), nil
+	case "brrip":
+		return NewRRIP(sets, ways, true, seed), nil
+	}
+	return nil, fmt.Errorf("unknown replacement policy %s, expected one of %s", name, strings.Join(ReplacementPolicies, ", "))
+}
+
+// A value for each line, or each node of a tree, of every set
+func newTable[T any](sets, n uint) [][]T {
+	t := make([][]T, sets)
+	for i := range t {
+		t[i] = make([]T, n)
+	}
+	return t
+}
+
+// Ages of the lines of each set, 0 is the youngest and ways-1 the oldest. They start out as
+// CreateCache orders CacheLine.LRU, with way 0 the oldest
+type ages [][]int
+
+func newAges(sets, ways uint) ages {
+	a := newTable[int](sets, ways)
+	for i := range a {
+		for j := range a[i] {
+			a[i][j] = int(ways) - 1 - j
+		}
+	}
+	return a
+}
+
+// Makes the line at way of set index the youngest
+func (a ages) renew(index, way uint) {
+	set := a[index]
+	for i := range set {
+		if set[i] < set[way] {
+			set[i]++
+		}
+	}
+	set[way] = 0
+}
+
+func (a ages) oldest(index uint) uint {
+	oldest := uint(0)
+	for i, age := range a[index] {
+		if age > a[index][oldest] {
+			oldest = uint(i)
+		}
+	}
+	return oldest
+}
+
+// Least recently used, replaces the line that was read or written last the longest ago
+type LRU struct{}
+
+func (LRU) Name() string     { return "lru" }
+func (LRU) MetaName() string { return "LRU" }
+
+func (LRU) Touch(set []*CacheLine, _, way uint) {
+	accessedLRU := set[way].LRU
+
+	// Only update if not already MRU
+	if accessedLRU != 0 {
+		for i := range set {
+			if uint(i) == way {
+				set[i].LRU = 0 // Set accessed line to MRU
+			} else if set[i].LRU < accessedLRU {
+				set[i].LRU += 1 // Bump more-recently-used lines downward
+			}
+		}
+	}
+}
+
+func (p LRU) Insert(set []*CacheLine, index, way uint) {
+	p.Touch(set, index, way)
+}
+
+func (LRU) Victim(set []*CacheLine, index uint) uint {
+	lru := -1
+	lruIdx := -1
+
+	for i := range set {
+		if set[i].LRU > lru {
+			lru = set[i].LRU
+			lruIdx = i
+		}
+	}
+	if lru < 0 {
+		panic("LRU: No valid LRU found in set index " + fmt.Sprint(index))
+	}
+	return uint(lruIdx)
+}
+
+func (LRU) Meta(set []*CacheLine, _, way uint) string {
+	return fmt.Sprint(set[way].LRU)
+}
+
+// First in first out, replaces the line allocated the longest ago whether it was used since or not
+type FIFO struct {
+	ages ages
+}
+
+func (*FIFO) Name() string                             { return "fifo" }
+func (*FIFO) MetaName() string                         { return "Age" }
+func (*FIFO) Touch(_ []*CacheLine, _, _ uint)          {}
+func (p *FIFO) Insert(_ []*CacheLine, index, way uint) { p.ages.renew(index, way) }
+func (p *FIFO) Victim(_ []*CacheLine, index uint) uint { return p.ages.oldest(index) }
+
+func (p *FIFO) Meta(_ []*CacheLine, index, way uint) string {
+	return fmt.Sprint(p.ages[index][way])
+}
+
+// Replaces a line of the set picked at random. The pick is kept until a line is allocated in the
+// set, so asking again before the refill completes gives the same way
+type RandomReplacement struct {
+	ways    uint
+	rand    *rand.Rand
+	victims []int // way picked for each set, -1 if none is
+}
+
+func NewRandomReplacement(sets, ways uint, seed int64) *RandomReplacement {
+	victims := make([]int, sets)
+	for i := range victims {
+		victims[i] = -1
+	}
+	return &RandomReplacement{ways: ways, rand: rand.New(rand.NewSource(seed)), victims: victims}
+}
+
+func (*RandomReplacement) Name() string                    { return "random" }
+func (*RandomReplacement) MetaName() string                { return "Next" }
+func (*RandomReplacement) Touch(_ []*CacheLine, _, _ uint) {}
+
+func (p *RandomReplacement) Insert(_ []*CacheLine, index, _ uint) {
+	p.victims[index] = -1
+}
+
+func (p *RandomReplacement) Victim(_ []*CacheLine, index uint) uint {
+	if p.victims[index] < 0 {
+		p.victims[index] = p.rand.Intn(int(p.ways))
+	}
+	return uint(p.victims[index])
+}
+
+// Marks the way picked to be replaced next
+func (p *RandomReplacement) Meta(_ []*CacheLine, index, way uint) string {
+	if p.victims[index] == int(way) {
+		return "*"
+	}
+	return ""
+}
+
+// Tree pseudo LRU. The ways of a set are the leaves of a binary tree, each node has a bit
+// pointing to the half that holds the victim. A use of a line points the nodes on its path away
+// from it, the victim is found by following the bits from the root
+type TreePLRU struct {
+	ways uint
+	bits [][]bool // nodes of each set in heap order, the root first, true points right
+}
+
+func (*TreePLRU) Name() string     { return "plru" }
+func (*TreePLRU) MetaName() string { return "PLRU" }
+
+func (p *TreePLRU) Touch(_ []*CacheLine, index, way uint) {
+	node := uint(0)
+	for half := p.ways / 2; half > 0; half /= 2 {
+		right := way&half != 0
+		p.bits[index][node] = !right
+		node = 2*node + 1
+		if right {
+			node++
+		}
+	}
+}
+
+func (p *TreePLRU) Insert(set []*CacheLine, index, way uint) {
+	p.Touch(set, index, way)
+}
+
+func (p *TreePLRU) Victim(_ []*CacheLine, index uint) uint {
+	node, way := uint(0), uint(0)
+	for half := p.ways / 2; half > 0; half /= 2 {
+		right := p.bits[index][node]
+		node = 2*node + 1
+		if right {
+			way |= half
+			node++
+		}
+	}
+	return way
+}
+
+// Shows the bits on the path from the root to the line, 1 where the bit points to the line. The
+// victim is the line whose bits are all 1
+func (p *TreePLRU) Meta(_ []*CacheLine, index, way uint) string {
+	var path strings.Builder
+	node := uint(0)
+	for half := p.ways / 2; half > 0; half /= 2 {
+		right := way&half != 0
+		if p.bits[index][node] == right {
+			path.WriteByte('1')
+		} else {
+			path.WriteByte('0')
+		}
+		node = 2*node + 1
+		if right {
+			node++
+		}
+	}
+	return path.String()
+}
+
+// Least frequently used, replaces the line used the fewest times since it was allocated, the
+// first of them in the set on a tie
+type LFU struct {
+	uses [][]uint32
+}
+
+func (*LFU) Name() string                                  { return "lfu" }
+func (*LFU) MetaName() string                              { return "Uses" }
+func (p *LFU) Touch(_ []*CacheLine, index, way uint)       { p.uses[index][way]++ }
+func (p *LFU) Insert(_ []*CacheLine, index, way uint)      { p.uses[index][way] = 1 }
+func (p *LFU) Meta(_ []*CacheLine, index, way uint) string { return fmt.Sprint(p.uses[index][way]) }
+
+func (p *LFU) Victim(_ []*CacheLine, index uint) uint {
+	victim := uint(0)
+	for i, n := range p.uses[index] {
+		if n < p.uses[index][victim] {
+			victim = uint(i)
+		}
+	}
+	return victim
+}
+
+// Maximum re-reference prediction value of RRIP, the 2 bits of each line
+const RRPV_MAX = 3
+
+// Re-reference interval prediction. Each line has a re-reference prediction value, a hit
+// predicts the line is used again soon and sets it to 0, the victim is the first line predicted
+// to be used in the distant future, RRPV_MAX, after aging the set until one is. Static RRIP
+// inserts lines at RRPV_MAX-1, bimodal RRIP at RRPV_MAX and at RRPV_MAX-1 once in
+// BRRIP_THROTTLE insertions, at random, so lines used once leave the cache first
+type RRIP struct {
+	bimodal bool
+	rrpv    [][]uint8
+	rand    *rand.Rand
+}
+
+// One in BRRIP_THROTTLE lines bimodal RRIP inserts is not predicted distant
+const BRRIP_THROTTLE = 32
+
+func NewRRIP(sets, ways uint, bimodal bool, seed int64) *RRIP {
+	rrpv := newTable[uint8](sets, ways)
+	for i := range rrpv {
+		for j := range rrpv[i] {
+			rrpv[i][j] = RRPV_MAX
+		}
+	}
+	return &RRIP{bimodal: bimodal, rrpv: rrpv, rand: rand.New(rand.NewSource(seed))}
+}
+
+func (p *RRIP) Name() string {
+	if p.bimodal {
+		return "brrip"
+	}
+	return "srrip"
+}
+
+func (*RRIP) MetaName() string                              { return "RRPV" }
+func (p *RRIP) Touch(_ []*CacheLine, index, way uint)       { p.rrpv[index][way] = 0 }
+func (p *RRIP) Meta(_ []*CacheLine, index, way uint) string { return fmt.Sprint(p.rrpv[index][way]) }
+
+func (p *RRIP) Insert(_ []*CacheLine, index, way uint) {
+	p.rrpv[index][way] = RRPV_MAX - 1
+	if p.bimodal && p.rand.Intn(BRRIP_THROTTLE) != 0 {
+		p.rrpv[index][way] = RRPV_MAX
+	}
+}
+
+func (p *RRIP) Victim(_ []*CacheLine, index uint) uint {
+	set := p.rrpv[index]
+	for {
+		for i, v := range set {
+			if v == RRPV_MAX {
+				return uint(i)
+			}
+		}
+		for i := range set {
+			set[i]++
+		}
+	}
+}
+
+// Replaces the lines of the cache with the replacement policy called name, see NewReplacement,
+// before the cache is used
+func (c *CacheType) SetReplacement(name string, seed int64) error {
+	p, err := NewReplacement(name, c.Sets, c.Ways, seed)
+	if err != nil {
+		return err
+	}
+	c.Replacement = p
+	return nil
+}
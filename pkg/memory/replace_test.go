@@ -0,0 +1,99 @@
+package memory
+
+import (
+	"fmt"
+	"testing"
+)
+
+// Fills a set of 4 one-word lines with the words at 0, 4, 8 and 12, reads the word at 0 twice
+// more and then the word at 16. Returns the address of the line the last read replaced
+func replaced(t *testing.T, policy string, seed int64) uint {
+	c := CreateCache(1, 4, 1, 0, countingRAM())
+	if err := c.SetReplacement(policy, seed); err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range []uint{0, 4, 8, 12, 0, 0, 16} {
+		readWord(t, &c, addr)
+	}
+	for addr := uint(0); addr < 16; addr += 4 {
+		if c.lookUp(addr) == nil {
+			return addr
+		}
+	}
+	t.Fatalf("%s: no line was replaced", policy)
+	return 0
+}
+
+func TestReplacementPolicies(t *testing.T) {
+	var test = []struct {
+		policy string
+		victim uint
+	}{
+		{"lru", 4},   // the line at 0 was used last
+		{"fifo", 0},  // the line at 0 was allocated first
+		{"plru", 8},  // the tree points away from 0 at the root and away from 12 below it
+		{"lfu", 4},   // the line at 0 was used three times, the others once
+		{"srrip", 4}, // the hits on 0 predicted it is used again soon
+		{"brrip", 4}, // every line was predicted distant but the one at 0
+	}
+	for _, tt := range test {
+		if victim := replaced(t, tt.policy, 1); victim != tt.victim {
+			t.Errorf("%s: expected the line at %d to be replaced, got %d", tt.policy, tt.victim, victim)
+		}
+	}
+}
+
+func TestRandomReplacementSeed(t *testing.T) {
+	run := func(seed int64) string {
+		c := CreateCache(2, 4, 1, 0, countingRAM())
+		if err := c.SetReplacement("random", seed); err != nil {
+			t.Fatal(err)
+		}
+		var held []uint
+		for i := range uint(40) {
+			readWord(t, &c, 4*(i*7%32))
+		}
+		for addr := uint(0); addr < 128; addr += 4 {
+			if c.lookUp(addr) != nil {
+				held = append(held, addr)
+			}
+		}
+		return fmt.Sprint(held)
+	}
+	if a, b := run(7), run(7); a != b {
+		t.Errorf("expected the same seed to replace the same lines, got %s and %s", a, b)
+	}
+}
+
+func TestTreePLRUMeta(t *testing.T) {
+	p, err := NewReplacement("plru", 1, 4, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, way := range []uint{0, 1, 2, 3} {
+		p.Insert(nil, 0, way)
+	}
+	// every bit points to the victim
+	victim := p.Victim(nil, 0)
+	if victim != 0 || p.Meta(nil, 0, victim) != "11" {
+		t.Errorf("expected way 0 with 11 as the victim, got %d with %s", victim, p.Meta(nil, 0, victim))
+	}
+	if m := p.Meta(nil, 0, 3); m != "00" {
+		t.Errorf("expected the line used last to be 00, got %s", m)
+	}
+}
+
+func TestNewReplacement(t *testing.T) {
+	for _, name := range ReplacementPolicies {
+		p, err := NewReplacement(name, 2, 4, 0)
+		if err != nil || p.Name() != name {
+			t.Errorf("expected %s, got %v", name, err)
+		}
+	}
+	if _, err := NewReplacement("plru", 2, 3, 0); err == nil {
+		t.Errorf("expected an error for plru with 3 ways")
+	}
+	if _, err := NewReplacement("mru", 2, 4, 0); err == nil {
+		t.Errorf("expected an error for an unknown policy")
+	}
+}
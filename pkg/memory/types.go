@@ -24,6 +24,7 @@ const (
 	WAIT_NEXT_LEVEL
 	FAILURE_OUT_OF_RANGE
 	FAILURE
+	FAILURE_MISALIGNED // the access does not fit in one aligned word
 )
 
 func LookUpMemoryResult(s MemoryResult) string {
@@ -40,6 +41,8 @@ func LookUpMemoryResult(s MemoryResult) string {
 		return "FAILURE_OUT_OF_RANGE"
 	case FAILURE:
 		return "FAILURE"
+	case FAILURE_MISALIGNED:
+		return "FAILURE_MISALIGNED"
 	default:
 		return "UNKNOWN"
 	}
@@ -57,20 +60,32 @@ const (
 	LAST_LEVEL_CACHE Requester = L1_CACHE
 	L1_CACHE         Requester = 1
 	L2_CACHE         Requester = 2
+	WRITE_BUFFER     Requester = 3 // the write buffer of a cache draining to the level below it
 )
 
+// Memory is byte addressed and little endian, it holds 32 bit words and a word is read or
+// written at a byte address that is a multiple of 4, otherwise the access fails with
+// FAILURE_MISALIGNED. The offset of ReadMulti is in bytes, numWords in words
 type Memory interface {
 	IsBusy() bool               // returns if memory is busy
 	service(who Requester) bool // returns if memory can service a new request, but also update state
 	Read(addr uint, who Requester) ReadResult
 	ReadMulti(addr, numWords, offset uint, who Requester) ReadLineResult
 	Write(addr uint, who Requester, val uint32) WriteResult
+	WriteMulti(addr uint, who Requester, vals []uint32) WriteResult // writes consecutive words in a single request
+	WriteBytes(addr uint, who Requester, val uint32, size uint) WriteResult // writes the low size bytes of val, they must lie in one word
 	SizeBytes() uint                  // Returns the size of the memory in bytes
 	SizeWords() uint                  // Returns the number of words in memory
 	SizeLines() uint                  // Returns the number of lines in the memory
 	RequestState() MemoryRequestState // Returns the current state of the memory request
 }
 
+// Implemented by a memory that can cancel the request it serves for who, along with the requests
+// it made to the levels below it for who
+type canceler interface {
+	Cancel(who Requester)
+}
+
 type MemoryRequestState struct {
 	//busy bool
 	requester  Requester // Who is requesting the memory service (FETCH, MEMORY, CACHE)
@@ -78,3 +93,15 @@ type MemoryRequestState struct {
 	CyclesLeft int
 	WaitNext   bool
 }
+
+// Returns true if the size bytes starting at byte address addr lie in one word
+func fitsWord(addr, size uint) bool {
+	return addr%4+size <= 4
+}
+
+// Returns word with the low size bytes of val stored at byte address addr within it
+func mergeBytes(word uint32, addr uint, val uint32, size uint) uint32 {
+	shift := 8 * (addr % 4)
+	mask := uint32(1<<(8*size)-1) << shift
+	return word&^mask | val<<shift&mask
+}
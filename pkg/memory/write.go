@@ -0,0 +1,422 @@
+package memory
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The write policy of a cache says when a write reaches the lower level:
+//   - a write-through cache writes every write to the lower level as well as to its line
+//   - a write-back cache only writes to its line and marks it dirty, the line is written back
+//     to the lower level when it is evicted
+//
+// On a miss a cache allocates the line and writes to it. A write-back cache reads the line from
+// the lower level first unless the write fills it, a write-through cache reads the words it was
+// not written on the next read of them. With NoWriteAllocate it writes around the cache to the
+// lower level instead. A cache with a WriteBuffer puts the writes to the lower level in the
+// buffer, so they complete at once while the buffer has room, and drains the buffer while the
+// lower level is free
+type WritePolicy int
+
+const (
+	WRITE_THROUGH WritePolicy = iota
+	WRITE_BACK
+)
+
+// Names of the write policies, in the order of their values
+var WritePolicies = []string{"write-through", "write-back"}
+
+func (p WritePolicy) String() string {
+	if int(p) < len(WritePolicies) {
+		return WritePolicies[p]
+	}
+	return "UNKNOWN"
+}
+
+func ParseWritePolicy(name string) (WritePolicy, error) {
+	for i, n := range WritePolicies {
+		if n == name {
+			return WritePolicy(i), nil
+		}
+	}
+	return WRITE_THROUGH, fmt.Errorf("unknown write policy %s, expected one of %s", name, strings.Join(WritePolicies, ", "))
+}
+
+// Implemented by a memory that can take a write at once, without delay, see CacheType.Sync
+type syncer interface {
+	Sync(addr uint, val uint32, size uint)
+}
+
+// A write waiting in a WriteBuffer
+type bufferedWrite struct {
+	addr uint     // byte address of the first word, or of the first byte of a partial word
+	vals []uint32 // consecutive words, or the word holding the bytes of a partial word
+	size uint     // bytes of a partial word write at addr, 0 for whole words
+}
+
+func (w *bufferedWrite) end() uint {
+	if w.size != 0 {
+		return w.addr + w.size
+	}
+	return w.addr + 4*uint(len(w.vals))
+}
+
+// WriteBuffer holds the writes of a cache to its lower level until the lower level is free to
+// take them, in the order they were made. A write to the line of a waiting write of whole words
+// combines with it when it touches or overlaps it
+type WriteBuffer struct {
+	Entries   uint // writes the buffer holds
+	LineWords uint // words per line, writes combine within a line
+	Stats     WriteBufferStats
+	pending   []bufferedWrite
+}
+
+type WriteBufferStats struct {
+	Writes   uint32 // writes taken
+	Combined uint32 // writes taken by combining them with a waiting write
+	Full     uint32 // attempts that waited because the buffer was full
+	Drained  uint32 // writes that reached the lower level
+}
+
+func NewWriteBuffer(entries, lineWords uint) *WriteBuffer {
+	return &WriteBuffer{Entries: entries, LineWords: lineWords}
+}
+
+// Returns the number of writes waiting
+func (b *WriteBuffer) Len() int {
+	return len(b.pending)
+}
+
+// Returns true if a waiting write touches the n bytes at byte address addr
+func (b *WriteBuffer) Pending(addr, n uint) bool {
+	for i := range b.pending {
+		if w := &b.pending[i]; w.addr < addr+n && addr < w.end() {
+			return true
+		}
+	}
+	return false
+}
+
+// Takes the write of vals at byte address addr, size is the bytes of a partial word or 0 for
+// whole words. It returns false if the buffer is full
+func (b *WriteBuffer) push(addr uint, vals []uint32, size uint) bool {
+	if size == 4 {
+		size = 0
+	}
+	if size != 0 {
+		vals = []uint32{mergeBytes(0, addr, vals[0], size)}
+	}
+	w := bufferedWrite{addr, append([]uint32{}, vals...), size}
+	for i := len(b.pending) - 1; i >= 0; i-- {
+		if b.combine(&b.pending[i], &w) {
+			b.Stats.Writes++
+			b.Stats.Combined++
+			return true
+		}
+		if p := &b.pending[i]; p.addr < w.end() && w.addr < p.end() {
+			break // the write must follow this one
+		}
+	}
+	if uint(len(b.pending)) >= b.Entries {
+		b.Stats.Full++
+		return false
+	}
+	b.pending = append(b.pending, w)
+	b.Stats.Writes++
+	return true
+}
+
+// Combines w with the waiting write p if p holds whole words of the same line that w touches or
+// overlaps, returns false if it can not
+func (b *WriteBuffer) combine(p, w *bufferedWrite) bool {
+	lineBytes := 4 * b.LineWords
+	if p.size != 0 || lineBytes == 0 || p.addr/lineBytes != w.addr/lineBytes || (w.end()-1)/lineBytes != w.addr/lineBytes {
+		return false
+	}
+	if w.size != 0 {
+		// bytes combine with a word the waiting write holds
+		if w.addr < p.addr || w.addr >= p.end() {
+			return false
+		}
+		i := (w.addr - p.addr) / 4
+		p.vals[i] = mergeBytes(p.vals[i], w.addr, w.vals[0]>>(8*(w.addr%4)), w.size)
+		return true
+	}
+	if w.addr > p.end() || p.addr > w.end() {
+		return false
+	}
+	start, end := min(p.addr, w.addr), max(p.end(), w.end())
+	vals := make([]uint32, (end-start)/4)
+	copy(vals[(p.addr-start)/4:], p.vals)
+	copy(vals[(w.addr-start)/4:], w.vals)
+	p.addr, p.vals = start, vals
+	return true
+}
+
+// Writes the oldest waiting write to lower, it leaves the buffer once the write completes
+func (b *WriteBuffer) drain(lower Memory) {
+	if len(b.pending) == 0 {
+		return
+	}
+	w := b.pending[0]
+	var written WriteResult
+	if w.size != 0 {
+		written = lower.WriteBytes(w.addr, WRITE_BUFFER, w.vals[0]>>(8*(w.addr%4)), w.size)
+	} else {
+		written = lower.WriteMulti(w.addr, WRITE_BUFFER, w.vals)
+	}
+	switch written.State {
+	case WAIT, WAIT_NEXT_LEVEL:
+		return
+	case SUCCESS:
+		b.pending = b.pending[1:]
+		b.Stats.Drained++
+	default:
+		panic(fmt.Sprintf("WriteBuffer: write of byte address 0x%x failed: %s", w.addr, LookUpMemoryResult(written.State)))
+	}
+}
+
+// Changes the waiting writes of the low size bytes of val at byte address addr to write them
+// instead, for a write that reached the lower levels before them
+func (b *WriteBuffer) sync(addr uint, val uint32, size uint) {
+	for i := range b.pending {
+		w := &b.pending[i]
+		if w.size != 0 && w.addr&^3 == addr&^3 {
+			w.vals[0] = mergeBytes(w.vals[0], addr, val, size)
+		} else if w.size == 0 && addr >= w.addr && addr < w.end() {
+			j := (addr - w.addr) / 4
+			w.vals[j] = mergeBytes(w.vals[j], addr, val, size)
+		}
+	}
+}
+
+// Returns word, the word at byte address addr in the level below, with the waiting writes to it
+func (b *WriteBuffer) Peek(addr uint, word uint32) uint32 {
+	addr &^= 3
+	for _, w := range b.pending {
+		if w.size != 0 && w.addr&^3 == addr {
+			word = mergeBytes(word, w.addr, w.vals[0]>>(8*(w.addr%4)), w.size)
+		} else if w.size == 0 && addr >= w.addr && addr < w.end() {
+			word = w.vals[(addr-w.addr)/4]
+		}
+	}
+	return word
+}
+
+// Writes the waiting writes that touch the n bytes at byte address addr to lower at once and
+// removes them from the buffer
+func (b *WriteBuffer) flush(addr, n uint, lower Memory) {
+	kept := b.pending[:0]
+	for _, w := range b.pending {
+		if w.addr >= addr+n || addr >= w.end() {
+			kept = append(kept, w)
+		} else if w.size != 0 {
+			syncBytes(lower, w.addr, w.vals[0]>>(8*(w.addr%4)), w.size)
+		} else {
+			syncWords(lower, w.addr, w.vals)
+		}
+	}
+	b.pending = kept
+}
+
+// Writes the low size bytes of val at byte address addr to m at once, if m can take it
+func syncBytes(m Memory, addr uint, val uint32, size uint) {
+	if s, ok := m.(syncer); ok {
+		s.Sync(addr, val, size)
+	}
+}
+
+// Writes vals at byte address addr to m at once, if m can take them
+func syncWords(m Memory, addr uint, vals []uint32) {
+	for i, v := range vals {
+		syncBytes(m, addr+4*uint(i), v, 4)
+	}
+}
+
+// Writes the low size bytes of val at byte address addr, which lie in one word, at once to the
+// line holding them and to the levels below, for the simulator to change memory without the
+// cpu. Waiting writes of the bytes in the write buffer are changed to write them instead
+func (c *CacheType) Sync(addr uint, val uint32, size uint) {
+	c.dropPartial(addr, size)
+	if line := c.lookUp(addr); line != nil {
+		i := addr % c.lineBytes() / 4
+		line.Data[i] = mergeBytes(line.Data[i], addr, val, size)
+		if size == 4 {
+			line.wrote(i)
+		}
+	}
+	if c.Buffer != nil {
+		c.Buffer.sync(addr, val, size)
+	}
+	syncBytes(c.LowerLevel, addr, val, size)
+}
+
+// Writes the waiting writes and the dirty lines that hold the n bytes at byte address addr to
+// the lower levels at once, so a read that does not go through the cache sees them. It is how
+// the refill of an instruction cache snoops the data cache, see Snoop
+func (c *CacheType) Clean(addr, n uint) {
+	if c.Buffer != nil {
+		c.Buffer.flush(addr, n, c.LowerLevel)
+	}
+	if c.WordsPerLine == 0 {
+		return
+	}
+	for a := c.lineStart(addr); a < addr+n; a += c.lineBytes() {
+		if line := c.lookUp(a); line != nil && line.Dirty {
+			syncWords(c.LowerLevel, a, line.Data)
+			line.Dirty = false
+		}
+	}
+}
+
+// Writes the write buffer and every dirty line to the lower levels at once, for the simulator
+// to show memory as the program left it
+func (c *CacheType) Flush() {
+	if c.Buffer != nil {
+		c.Buffer.flush(0, c.SizeBytes(), c.LowerLevel)
+	}
+	for index, set := range c.Contents {
+		for _, line := range set {
+			if line.Valid && line.Dirty {
+				syncWords(c.LowerLevel, c.lineAddr(uint(index), line.Tag), line.Data)
+				line.Dirty = false
+			}
+		}
+	}
+}
+
+// Drains the write buffer by one write, called once per clock
+func (c *CacheType) Drain() {
+	if c.Buffer != nil {
+		c.Buffer.drain(c.LowerLevel)
+	}
+}
+
+// Returns the result of write, which writes vals at byte address addr to the lower level, or puts
+// them in the write buffer if the cache has one. size is the bytes of a partial word, 0 for words
+func (c *CacheType) writeLower(addr uint, vals []uint32, size uint, write func() WriteResult) WriteResult {
+	if c.Buffer == nil || c.Uncached(addr) {
+		return write()
+	}
+	if c.Buffer.push(addr, vals, size) {
+		return WriteResult{SUCCESS, 0}
+	}
+	return WriteResult{WAIT, 0}
+}
+
+// Stores to the n bytes at byte address addr as the write policy says. set writes them to the word
+// at byte address a of a line, write writes them to the lower level. A write-through cache
+// allocates a line for whole words without reading it, the next read of the line reads the words
+// that were not written. It does not allocate a line for part of a word
+func (c *CacheType) store(addr, n uint, who Requester, set func(word *uint32, a uint), write func() WriteResult) WriteResult {
+	// once the lines are written the store only waits for the lower level, allocating them again
+	// could replace a line the store spans with another
+	through := func() WriteResult {
+		written := c.wroteThrough(write())
+		if written.State == WAIT_NEXT_LEVEL {
+			c.storing = pendingStore{who, addr, n}
+		}
+		return written
+	}
+	if c.storing == (pendingStore{who, addr, n}) {
+		return through()
+	}
+	words := addr%4 == 0 && n%4 == 0
+	c.dropPartial(addr, n)
+	for a := c.lineStart(addr); a < addr+n && !c.NoWriteAllocate; a += c.lineBytes() {
+		if _, _, ok := c.find(a); ok {
+			continue
+		}
+		var state MemoryResult
+		switch {
+		case addr <= a && a+c.lineBytes() <= addr+n:
+			state = c.claim(a, who) // the write fills the line, there is nothing to read
+		case c.WritePolicy == WRITE_BACK:
+			_, state = c.fill(a, c.lineBytes(), who)
+		case words:
+			state = c.claim(a, who)
+		default:
+			continue
+		}
+		switch state {
+		case SUCCESS:
+		case WAIT_NEXT_LEVEL:
+			return WriteResult{WAIT_NEXT_LEVEL, 0}
+		default:
+			c.CancelRequest()
+			return WriteResult{state, 0}
+		}
+	}
+	held := true
+	for a := addr &^ 3; a < addr+n; a += 4 {
+		index, way, ok := c.find(a)
+		if !ok {
+			held = false
+			c.missed = true
+			continue
+		}
+		line := c.Contents[index][way]
+		set(&line.Data[a%c.lineBytes()/4], a)
+		if words {
+			line.wrote(a % c.lineBytes() / 4)
+		}
+		line.Dirty = line.Dirty || c.WritePolicy == WRITE_BACK
+		c.touch(index, way)
+	}
+	if c.WritePolicy == WRITE_BACK && held {
+		c.count(true)
+		c.CancelRequest()
+		return WriteResult{SUCCESS, 0}
+	}
+	return through()
+}
+
+// Allocates the line starting at byte address start without reading it, for a write. It holds no
+// data until the write marks the words it fills, so a line replaced before the write reaches it
+// is not passed to an exclusive cache below as if it did
+func (c *CacheType) claim(start uint, who Requester) MemoryResult {
+	if state := c.makeRoom(start, who); state != SUCCESS {
+		return state
+	}
+	c.missed = true
+	c.allocate(start, make([]uint32, c.WordsPerLine)).known = make([]bool, c.WordsPerLine)
+	return SUCCESS
+}
+
+// Readies the line that the line starting at byte address start replaces for eviction: the caches
+// above an inclusive cache give up their copies of it, then it is written back if it is dirty.
+// It returns WAIT_NEXT_LEVEL while the write back waits for the lower level
+func (c *CacheType) makeRoom(start uint, who Requester) MemoryResult {
+	index := c.FindIndexTagOffset(start).index
+	line := c.Contents[index][c.victim(index)]
+	if !line.Valid {
+		return SUCCESS
+	}
+	addr := c.lineAddr(index, line.Tag)
+	c.release(addr, line)
+	if !line.Dirty {
+		return SUCCESS
+	}
+	data := line.Data
+	written := c.writeLower(addr, data, 0, func() WriteResult { return c.LowerLevel.WriteMulti(addr, who, data) })
+	switch written.State {
+	case SUCCESS:
+		line.Dirty = false
+		c.Stats.Writebacks++
+		return SUCCESS
+	case WAIT, WAIT_NEXT_LEVEL:
+		c.waitNext(who)
+		return WAIT_NEXT_LEVEL
+	default:
+		return written.State
+	}
+}
+
+// Marks the cache as waiting on the lower level for who, which holds it until the access
+// completes even when it has no delay of its own, so an Arbiter keeps the other requester out
+func (c *CacheType) waitNext(who Requester) {
+	c.MemoryRequestState.WaitNext = true
+	if c.MemoryRequestState.requester == NONE {
+		c.MemoryRequestState.requester = who
+	}
+}
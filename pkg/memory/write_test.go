@@ -0,0 +1,218 @@
+package memory
+
+import (
+	"testing"
+)
+
+func writeWord(t *testing.T, c *CacheType, addr uint, val uint32) int {
+	return untilDone(t, func() MemoryResult { return c.Write(addr, MEMORY_STAGE, val).State })
+}
+
+func TestWriteBackHit(t *testing.T) {
+	mem := countingRAM()
+	c := CreateCache(2, 1, 4, 0, mem)
+	c.WritePolicy = WRITE_BACK
+
+	// the miss reads the line before writing to it
+	writeWord(t, &c, 4, 0xAA)
+	if v := readWord(t, &c, 8); v != 3 {
+		t.Errorf("wanted 3 read with the line, got %d", v)
+	}
+	if line := c.lookUp(4); line == nil || !line.Dirty {
+		t.Fatalf("wanted a dirty line")
+	}
+	if mem.Contents[1] != 2 {
+		t.Errorf("wanted the write to stay in the cache, memory holds %d", mem.Contents[1])
+	}
+	// a hit completes at once
+	if n := writeWord(t, &c, 0, 0xBB); n != 1 {
+		t.Errorf("wanted the hit to take 1 call, took %d", n)
+	}
+	if c.Stats.WriteHits != 1 || c.Stats.WriteMisses != 1 {
+		t.Errorf("wanted 1 write hit and 1 write miss, got %+v", c.Stats)
+	}
+}
+
+func TestWriteBackEviction(t *testing.T) {
+	mem := countingRAM()
+	c := CreateCache(1, 1, 4, 0, mem)
+	c.WritePolicy = WRITE_BACK
+
+	writeWord(t, &c, 4, 0xAA)
+	// the line at 16 replaces the dirty line, which is written back first
+	if v := readWord(t, &c, 16); v != 5 {
+		t.Errorf("wanted 5, got %d", v)
+	}
+	if mem.Contents[1] != 0xAA || mem.Contents[0] != 1 {
+		t.Errorf("wanted the dirty line in memory, got %v", mem.Contents[:4])
+	}
+	if c.Stats.Writebacks != 1 || c.Stats.Evictions != 1 {
+		t.Errorf("wanted 1 write back, got %+v", c.Stats)
+	}
+	if line := c.lookUp(16); line == nil || line.Dirty {
+		t.Errorf("wanted a clean line at 16")
+	}
+}
+
+func TestWriteThroughPartialLine(t *testing.T) {
+	mem := countingRAM()
+	c := CreateCache(2, 1, 4, 0, mem)
+
+	// the write allocates the line without reading it
+	writeWord(t, &c, 4, 0xAA)
+	if c.Stats.ReadMisses != 0 || mem.Contents[1] != 0xAA {
+		t.Fatalf("wanted the write to go through without a read, got %+v", c.Stats)
+	}
+	if r := c.Read(4, MEMORY_STAGE); r.State != SUCCESS || r.Value != 0xAA {
+		t.Errorf("wanted a hit on the word written, got %s %x", LookUpMemoryResult(r.State), r.Value)
+	}
+	if _, ok := c.Peek(8); ok {
+		t.Errorf("wanted no word the write did not write")
+	}
+	// a read of another word reads the rest of the line
+	if v := readWord(t, &c, 8); v != 3 {
+		t.Errorf("wanted 3, got %d", v)
+	}
+	if line := c.lookUp(0); line == nil || line.known != nil || line.Data[1] != 0xAA {
+		t.Errorf("wanted the whole line with the word written, got %+v", line)
+	}
+}
+
+func TestWriteNoAllocate(t *testing.T) {
+	mem := countingRAM()
+	c := CreateCache(2, 1, 4, 0, mem)
+	c.NoWriteAllocate = true
+
+	writeWord(t, &c, 4, 0xAA)
+	if c.lookUp(4) != nil {
+		t.Errorf("wanted the write to go around the cache")
+	}
+	if mem.Contents[1] != 0xAA {
+		t.Errorf("wanted 0xAA in memory, got %x", mem.Contents[1])
+	}
+	// a hit still writes the line
+	readWord(t, &c, 16)
+	writeWord(t, &c, 16, 0xBB)
+	if v, _ := c.Peek(16); v != 0xBB || mem.Contents[4] != 0xBB {
+		t.Errorf("wanted 0xBB in the cache and memory, got %x and %x", v, mem.Contents[4])
+	}
+}
+
+func TestWriteBuffer(t *testing.T) {
+	mem := countingRAM()
+	c := CreateCache(2, 1, 4, 0, mem)
+	c.Buffer = NewWriteBuffer(2, c.WordsPerLine)
+
+	for i := range uint(3) {
+		if n := writeWord(t, &c, 4*i, 0xA0+uint32(i)); n != 1 {
+			t.Errorf("wanted write %d to complete at once, took %d calls", i, n)
+		}
+	}
+	// the three writes to the line combine
+	if c.Buffer.Len() != 1 || c.Buffer.Stats.Combined != 2 {
+		t.Errorf("wanted the writes to combine, got %d waiting and %+v", c.Buffer.Len(), c.Buffer.Stats)
+	}
+	if mem.Contents[0] != 1 {
+		t.Errorf("wanted memory to wait for the buffer, got %x", mem.Contents[0])
+	}
+	if v := c.Buffer.Peek(4, mem.Contents[1]); v != 0xA1 {
+		t.Errorf("wanted the buffer to show 0xA1, got %x", v)
+	}
+
+	writeWord(t, &c, 16, 0xB0)
+	// the buffer is full, the next write waits for it to drain
+	if w := c.Write(32, MEMORY_STAGE, 0xC0); w.State != WAIT_NEXT_LEVEL {
+		t.Errorf("wanted the write to wait, got %s", LookUpMemoryResult(w.State))
+	}
+	if c.Buffer.Stats.Full != 1 {
+		t.Errorf("wanted 1 full buffer, got %+v", c.Buffer.Stats)
+	}
+	for range 6 {
+		c.Drain()
+	}
+	if c.Buffer.Len() != 0 || c.Buffer.Stats.Drained != 2 {
+		t.Errorf("wanted the buffer to drain, got %d waiting and %+v", c.Buffer.Len(), c.Buffer.Stats)
+	}
+	if mem.Contents[0] != 0xA0 || mem.Contents[2] != 0xA2 || mem.Contents[4] != 0xB0 {
+		t.Errorf("wanted the writes in memory, got %x", mem.Contents[:5])
+	}
+}
+
+func TestWriteBufferPendingRead(t *testing.T) {
+	mem := countingRAM()
+	c := CreateCache(2, 1, 4, 0, mem)
+	c.Buffer = NewWriteBuffer(4, c.WordsPerLine)
+	c.NoWriteAllocate = true
+
+	writeWord(t, &c, 4, 0xAA)
+	// the refill waits for the write of its line to drain
+	if r := c.Read(0, MEMORY_STAGE); r.State != WAIT_NEXT_LEVEL {
+		t.Fatalf("wanted the read to wait for the buffer, got %s", LookUpMemoryResult(r.State))
+	}
+	c.CancelRequest()
+	for c.Buffer.Len() != 0 {
+		c.Drain()
+	}
+	if v := readWord(t, &c, 4); v != 0xAA {
+		t.Errorf("wanted 0xAA, got %x", v)
+	}
+}
+
+func TestWriteSyncAndClean(t *testing.T) {
+	mem := countingRAM()
+	c := CreateCache(2, 1, 4, 0, mem)
+	c.WritePolicy = WRITE_BACK
+	c.Buffer = NewWriteBuffer(4, c.WordsPerLine)
+
+	readWord(t, &c, 0)
+	c.Sync(1, 0xFF, 1)
+	if v, _ := c.Peek(0); v != 0xFF01 || mem.Contents[0] != 0xFF01 {
+		t.Errorf("wanted the byte in the cache and memory, got %x and %x", v, mem.Contents[0])
+	}
+
+	writeWord(t, &c, 8, 0xAA)
+	c.Clean(0, 16)
+	if mem.Contents[2] != 0xAA || c.lookUp(8).Dirty {
+		t.Errorf("wanted the clean to write the dirty line, got %x", mem.Contents[2])
+	}
+
+	writeWord(t, &c, 20, 0xBB)
+	c.Flush()
+	if mem.Contents[5] != 0xBB {
+		t.Errorf("wanted the flush to write the dirty line, got %x", mem.Contents[5])
+	}
+}
+
+func TestWriteBackInclusive(t *testing.T) {
+	mem := countingRAM()
+	l2 := CreateCache(1, 1, 4, 0, mem)
+	l1 := CreateCache(2, 1, 4, 0, &l2)
+	l1.WritePolicy, l2.WritePolicy = WRITE_BACK, WRITE_BACK
+	if err := l2.SetInclusion(INCLUSIVE, &l1); err != nil {
+		t.Fatal(err)
+	}
+
+	writeWord(t, &l1, 4, 0xAA)
+	// replacing the line in the L2 takes the dirty word from the L1 and writes it back
+	readWord(t, &l1, 16)
+	if l1.lookUp(4) != nil {
+		t.Errorf("wanted the L1 line to be invalidated")
+	}
+	if mem.Contents[1] != 0xAA {
+		t.Errorf("wanted the dirty word of the L1 in memory, got %x", mem.Contents[1])
+	}
+	if v := readWord(t, &l1, 4); v != 0xAA {
+		t.Errorf("wanted 0xAA, got %x", v)
+	}
+}
+
+func TestParseWritePolicy(t *testing.T) {
+	for i, name := range WritePolicies {
+		if p, err := ParseWritePolicy(name); err != nil || p != WritePolicy(i) || p.String() != name {
+			t.Errorf("wanted %s to parse, got %v %v", name, p, err)
+		}
+	}
+	if _, err := ParseWritePolicy("write-around"); err == nil {
+		t.Errorf("wanted an error for an unknown policy")
+	}
+}
@@ -21,6 +21,10 @@ var (
 	NF   = ControlOp{Mode: 0b000, Flag: 0b0100}
 	UNC  = ControlOp{Mode: 0b111, Flag: 0b0000}
 	CALL = ControlOp{Mode: 0b111, Flag: 0b1111}
+	// return from a trap handler to the address in epc, not a condition so it has no branch mnemonic
+	IRET = ControlOp{Mode: 0b110, Flag: 0b0000}
+	// system call, serviced by the simulator or trapped to the handler of EXC_ECALL
+	ECALL = ControlOp{Mode: 0b110, Flag: 0b0001}
 )
 
 func GetModeFlag(c ControlOp) uint8 {
@@ -59,6 +63,7 @@ const (
 	IMM_LDI
 	IMM_LDX
 	IMM_CMP
+	IMM_SR // mfsr and mtsr, the immediate holds the special register and SR_WRITE for mtsr
 )
 
 var ImmALU = map[string]uint8{
@@ -125,15 +130,20 @@ var RegALU = map[string]uint8{
 
 var RegALUInverse = map[uint8]string{}
 
-func init() {
-	for k, v := range ImmALU {
-		ImmALUInverse[v] = k
-	}
-	for k, v := range RegALU {
-		RegALUInverse[v] = k
+// Aliases map to the same operation, the alphabetically first name is used as the canonical name
+func invertALU(alu map[string]uint8, inverse map[uint8]string) {
+	for k, v := range alu {
+		if name, ok := inverse[v]; !ok || k < name {
+			inverse[v] = k
+		}
 	}
 }
 
+func init() {
+	invertALU(ImmALU, ImmALUInverse)
+	invertALU(RegALU, RegALUInverse)
+}
+
 const (
 	LDW  = iota // Load Word
 	POP         // Pop
@@ -144,7 +154,7 @@ const (
 type DataType uint8
 
 const (
-	//reserved	DataType = 0b00
+	SubWord DataType = 0b00 // byte and halfword loads and stores
 	Integer DataType = 0b01
 	Float   DataType = 0b10
 	Vector  DataType = 0b11
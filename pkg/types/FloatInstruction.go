@@ -0,0 +1,76 @@
+package types
+
+// Float instructions have DataType Float in bits 1-0 and use the float registers f1-f8.
+// Arithmetic, compare and conversions are RegReg, fldw and fstw are LoadStore, the
+// RegImm and Control OpTypes are reserved
+type FloatInstruction struct {
+	OpType  uint8 // 01 for reg-reg, 10 for load/store
+	Fd      uint8 // Destination float register, the integer destination of ftoi and fmvf, the value stored by fstw
+	FPU     uint8 // FPU operation
+	Fs      uint8 // Source float register, the integer source of itof and fmvi
+	RMem    uint8 // Memory register of fldw and fstw
+	MemMode uint8 // LDW or STW
+	Imm     int16 // 16 bit twos complement displacement of fldw and fstw
+}
+
+const (
+	FPU_ADD  = iota // fd = fd + fs
+	FPU_SUB         // fd = fd - fs
+	FPU_MUL         // fd = fd * fs
+	FPU_DIV         // fd = fd / fs
+	FPU_SQRT        // fd = sqrt(fs)
+	FPU_CMP         // compare fd with fs and set the flags
+	FPU_CPY         // fd = fs
+	FPU_NEG         // fd = -fs
+	FPU_ABS         // fd = |fs|
+	FPU_MIN         // fd = min(fd, fs)
+	FPU_MAX         // fd = max(fd, fs)
+	FPU_ITOF        // fd = float(rs), rs is a signed integer
+	FPU_FTOI        // rd = int(fs), truncated towards zero
+	FPU_MVI         // fd = bits of rs
+	FPU_MVF         // rd = bits of fs
+)
+
+var FloatALU = map[string]uint8{
+	"fadd":  FPU_ADD,
+	"fsub":  FPU_SUB,
+	"fmul":  FPU_MUL,
+	"fdiv":  FPU_DIV,
+	"fsqrt": FPU_SQRT,
+	"fcmp":  FPU_CMP,
+	"fcpy":  FPU_CPY,
+	"fmov":  FPU_CPY,
+	"fneg":  FPU_NEG,
+	"fabs":  FPU_ABS,
+	"fmin":  FPU_MIN,
+	"fmax":  FPU_MAX,
+	"itof":  FPU_ITOF,
+	"ftoi":  FPU_FTOI,
+	"fmvi":  FPU_MVI,
+	"fmvf":  FPU_MVF,
+}
+
+var FloatALUInverse = map[uint8]string{}
+
+func init() {
+	invertALU(FloatALU, FloatALUInverse)
+}
+
+// Returns true if the operation reads the integer register in Fs rather than a float register
+func FloatReadsInt(op uint8) bool {
+	return op == FPU_ITOF || op == FPU_MVI
+}
+
+// Returns true if the operation writes the integer register in Fd rather than a float register
+func FloatWritesInt(op uint8) bool {
+	return op == FPU_FTOI || op == FPU_MVF
+}
+
+// Returns true if the operation only reads Fs, the old value of Fd is not used
+func FloatUnary(op uint8) bool {
+	switch op {
+	case FPU_SQRT, FPU_CPY, FPU_NEG, FPU_ABS, FPU_ITOF, FPU_FTOI, FPU_MVI, FPU_MVF:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+package types
+
+// Byte and halfword loads and stores have DataType SubWord in bits 1-0 and the access size
+// in the OpType bits 3-2, the other fields are laid out as a base load/store. Memory is little
+// endian: byte b of the word at address 4*w is at address 4*w + b, and holds bits 8*b+7 to 8*b
+// of the word
+type SubWordInstruction struct {
+	Size    uint8 // SIZE_BYTE or SIZE_HALF
+	Rd      uint8 // Destination register of a load, the register stored by a store
+	MemMode uint8 // SUB_LOAD, SUB_LOADU or SUB_STORE
+	RMem    uint8 // Memory register holding a byte address
+	Imm     int16 // 16 bit twos complement displacement in bytes
+}
+
+const (
+	//reserved  = 0b00, so that the zero word stays invalid
+	SIZE_BYTE = 0b01
+	SIZE_HALF = 0b10
+	//reserved  = 0b11
+)
+
+const (
+	SUB_LOAD  = 0b00 // load and sign extend
+	SUB_LOADU = 0b01 // load and zero extend
+	//reserved  = 0b10
+	SUB_STORE = 0b11 // store the low byte or halfword of Rd
+)
+
+type SubWordOp struct {
+	Size    uint8
+	MemMode uint8
+}
+
+var SubWordOps = map[string]SubWordOp{
+	"ldb":  {SIZE_BYTE, SUB_LOAD},
+	"ldbu": {SIZE_BYTE, SUB_LOADU},
+	"ldh":  {SIZE_HALF, SUB_LOAD},
+	"ldhu": {SIZE_HALF, SUB_LOADU},
+	"stb":  {SIZE_BYTE, SUB_STORE},
+	"sth":  {SIZE_HALF, SUB_STORE},
+}
+
+var SubWordOpsInverse = map[SubWordOp]string{}
+
+func init() {
+	for k, v := range SubWordOps {
+		SubWordOpsInverse[v] = k
+	}
+}
+
+// Returns the number of bytes accessed by the instruction
+func (inst *SubWordInstruction) Bytes() uint {
+	if inst.Size == SIZE_HALF {
+		return 2
+	}
+	return 1
+}
+
+// Sign or zero extend the loaded value, which is in the low bytes of v
+func (inst *SubWordInstruction) Extend(v uint32) uint32 {
+	switch {
+	case inst.Size == SIZE_BYTE && inst.MemMode == SUB_LOAD:
+		return uint32(int32(int8(v)))
+	case inst.Size == SIZE_BYTE:
+		return v & 0xFF
+	case inst.MemMode == SUB_LOAD:
+		return uint32(int32(int16(v)))
+	}
+	return v & 0xFFFF
+}
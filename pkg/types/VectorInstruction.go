@@ -0,0 +1,62 @@
+package types
+
+// Number of 32 bit lanes in a vector register, a vector is one cache line of the default cache
+const VectorLanes = 4
+
+// Vector instructions have DataType Vector in bits 1-0 and use the vector registers v1-v8.
+// Lane-wise arithmetic, dot product and broadcast are RegReg, vldw and vstw are LoadStore,
+// the RegImm and Control OpTypes are reserved
+type VectorInstruction struct {
+	OpType  uint8 // 01 for reg-reg, 10 for load/store
+	Vd      uint8 // Destination vector register, the integer destination of vdot, the value stored by vstw
+	VPU     uint8 // VPU operation
+	Vs      uint8 // Source vector register, the integer source of vbcst
+	Vt      uint8 // Second source vector register of vdot
+	RMem    uint8 // Memory register of vldw and vstw
+	MemMode uint8 // LDW or STW
+	Imm     int16 // 16 bit twos complement displacement of vldw and vstw
+}
+
+const (
+	VPU_ADD  = iota // vd[i] = vd[i] + vs[i]
+	VPU_SUB         // vd[i] = vd[i] - vs[i]
+	VPU_MUL         // vd[i] = vd[i] * vs[i], the low 32 bits
+	VPU_DOT         // rd = sum of vs[i] * vt[i]
+	VPU_BCST        // vd[i] = rs
+	VPU_CPY         // vd = vs
+)
+
+var VectorALU = map[string]uint8{
+	"vadd":  VPU_ADD,
+	"vsub":  VPU_SUB,
+	"vmul":  VPU_MUL,
+	"vdot":  VPU_DOT,
+	"vbcst": VPU_BCST,
+	"vcpy":  VPU_CPY,
+	"vmov":  VPU_CPY,
+}
+
+var VectorALUInverse = map[uint8]string{}
+
+func init() {
+	invertALU(VectorALU, VectorALUInverse)
+}
+
+// Returns true if the operation reads the integer register in Vs rather than a vector register
+func VectorReadsInt(op uint8) bool {
+	return op == VPU_BCST
+}
+
+// Returns true if the operation writes the integer register in Vd rather than a vector register
+func VectorWritesInt(op uint8) bool {
+	return op == VPU_DOT
+}
+
+// Returns true if the operation does not read the old value of Vd
+func VectorUnary(op uint8) bool {
+	switch op {
+	case VPU_DOT, VPU_BCST, VPU_CPY:
+		return true
+	}
+	return false
+}
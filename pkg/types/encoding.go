@@ -42,7 +42,9 @@ func (inst *BaseInstruction) Encode() uint32 {
 	return encoded
 }
 
-func (inst *BaseInstruction) Decode(encoded uint32) {
+// Decode a base instruction, returns false if it is not a valid instruction: its ALU operation,
+// control mode and flag or special register is reserved. The fields are filled in either way
+func (inst *BaseInstruction) Decode(encoded uint32) bool {
 	// Bits 1-0 (DataType) , ignored since this is a base instruction, always has DataType 0b01
 	inst.OpType = uint8((encoded >> 2) & 0b11) // Bits 3-2 (OpType)
 	switch inst.OpType {
@@ -52,6 +54,10 @@ func (inst *BaseInstruction) Decode(encoded uint32) {
 		inst.Rd = uint8((encoded >> 4) & 0x1F)     // 5 bit Rd (Bits 8-4)
 		inst.ALU = uint8((encoded >> 9) & 0xF)     // 4 bit ALU Op (Bits 12-9)
 		inst.Imm = int16((encoded >> 16) & 0xFFFF) // 16 bit Immediate (Bits 28-13)
+		if inst.ALU == IMM_SR {
+			_, ok := SpecialRegistersInverse[uint8(inst.Imm)]
+			return ok && inst.Imm&^(SR_WRITE|0xFF) == 0
+		}
 
 	case RegReg:
 
@@ -72,8 +78,169 @@ func (inst *BaseInstruction) Decode(encoded uint32) {
 		inst.CtrlFlag = uint8((encoded >> 9) & 0xF) // 4 bit Flag (Bits 12-9)
 		inst.CtrlMode = uint8((encoded >> 13) & 0x7) // 3 bit Mode (Bits 15-13)
 		inst.Imm = int16((encoded >> 16) & 0xFFFF)  // 16 bit Immediate (Bits 31-16)
+		return isSystemOp(inst.CtrlMode, inst.CtrlFlag) || isCondition(inst.CtrlMode, inst.CtrlFlag)
 
-	default:
-		panic("Invalid OpType")
 	}
+	return true
+}
+
+// iret and ecall are control instructions that are not conditions
+func isSystemOp(mode, flag uint8) bool {
+	return mode == IRET.Mode && (flag == IRET.Flag || flag == ECALL.Flag)
+}
+
+func isCondition(mode, flag uint8) bool {
+	for _, c := range Conditions {
+		if c.Mode == mode && c.Flag == flag {
+			return true
+		}
+	}
+	return false
+}
+
+func (inst *FloatInstruction) Encode() uint32 {
+
+	var encoded uint32 = 0
+
+	encoded |= uint32(Float)            // Bits 1-0 (DataType)
+	encoded |= uint32(inst.OpType) << 2 // Bits 3-2 (OpType)
+
+	switch inst.OpType {
+
+	case RegReg:
+
+		encoded |= uint32(inst.Fd) << 4  // 5 bit Fd (Bits 8-4)
+		encoded |= uint32(inst.FPU) << 9 // 4 bit FPU Op (Bits 12-9)
+		encoded |= uint32(inst.Fs) << 13 // 5 bit Fs (Bits 17-13)
+
+	case LoadStore:
+
+		encoded |= uint32(inst.Fd) << 4      // 5 bit Fd (Bits 8-4)
+		encoded |= uint32(inst.MemMode) << 9 // 2 bit Mode (Bits 10-9)
+		encoded |= uint32(inst.RMem) << 11   // 5 bit RMem (Bits 15-11)
+		encoded |= uint32(inst.Imm) << 16    // 16 bit Immediate (Bits 31-16)
+
+	}
+
+	return encoded
+}
+
+// Decode a word with DataType Float, returns false if it is not a valid float instruction:
+// its OpType, MemMode or FPU operation is reserved or it names a float register above f8
+func (inst *FloatInstruction) Decode(encoded uint32) bool {
+	inst.OpType = uint8((encoded >> 2) & 0b11) // Bits 3-2 (OpType)
+	switch inst.OpType {
+
+	case RegReg:
+
+		inst.Fd = uint8((encoded >> 4) & 0x1F)  // 5 bit Fd (Bits 8-4)
+		inst.FPU = uint8((encoded >> 9) & 0xF)  // 4 bit FPU Op (Bits 12-9)
+		inst.Fs = uint8((encoded >> 13) & 0x1F) // 5 bit Fs (Bits 17-13)
+		if inst.FPU > FPU_MVF {
+			return false
+		}
+		return (FloatWritesInt(inst.FPU) || isFloatRegister(inst.Fd)) && (FloatReadsInt(inst.FPU) || isFloatRegister(inst.Fs))
+
+	case LoadStore:
+
+		inst.Fd = uint8((encoded >> 4) & 0x1F)     // 5 bit Fd (Bits 8-4)
+		inst.MemMode = uint8((encoded >> 9) & 0x3) // 2 bit Mode (Bits 10-9)
+		inst.RMem = uint8((encoded >> 11) & 0x1F)  // 5 bit RMem (Bits 15-11)
+		inst.Imm = int16((encoded >> 16) & 0xFFFF) // 16 bit Immediate (Bits 31-16)
+		return (inst.MemMode == LDW || inst.MemMode == STW) && isFloatRegister(inst.Fd)
+
+	}
+	return false
+}
+
+func isFloatRegister(r uint8) bool {
+	return int(r) < len(FPRegisters)
+}
+
+func (inst *VectorInstruction) Encode() uint32 {
+
+	var encoded uint32 = 0
+
+	encoded |= uint32(Vector)           // Bits 1-0 (DataType)
+	encoded |= uint32(inst.OpType) << 2 // Bits 3-2 (OpType)
+
+	switch inst.OpType {
+
+	case RegReg:
+
+		encoded |= uint32(inst.Vd) << 4  // 5 bit Vd (Bits 8-4)
+		encoded |= uint32(inst.VPU) << 9 // 4 bit VPU Op (Bits 12-9)
+		encoded |= uint32(inst.Vs) << 13 // 5 bit Vs (Bits 17-13)
+		encoded |= uint32(inst.Vt) << 18 // 5 bit Vt (Bits 22-18)
+
+	case LoadStore:
+
+		encoded |= uint32(inst.Vd) << 4      // 5 bit Vd (Bits 8-4)
+		encoded |= uint32(inst.MemMode) << 9 // 2 bit Mode (Bits 10-9)
+		encoded |= uint32(inst.RMem) << 11   // 5 bit RMem (Bits 15-11)
+		encoded |= uint32(inst.Imm) << 16    // 16 bit Immediate (Bits 31-16)
+
+	}
+
+	return encoded
+}
+
+// Decode a word with DataType Vector, returns false if it is not a valid vector instruction:
+// its OpType, MemMode or VPU operation is reserved or it names a vector register above v8
+func (inst *VectorInstruction) Decode(encoded uint32) bool {
+	inst.OpType = uint8((encoded >> 2) & 0b11) // Bits 3-2 (OpType)
+	switch inst.OpType {
+
+	case RegReg:
+
+		inst.Vd = uint8((encoded >> 4) & 0x1F)  // 5 bit Vd (Bits 8-4)
+		inst.VPU = uint8((encoded >> 9) & 0xF)  // 4 bit VPU Op (Bits 12-9)
+		inst.Vs = uint8((encoded >> 13) & 0x1F) // 5 bit Vs (Bits 17-13)
+		inst.Vt = uint8((encoded >> 18) & 0x1F) // 5 bit Vt (Bits 22-18)
+		if inst.VPU > VPU_CPY {
+			return false
+		}
+		if inst.VPU == VPU_DOT && !isVectorRegister(inst.Vt) {
+			return false
+		}
+		return (VectorWritesInt(inst.VPU) || isVectorRegister(inst.Vd)) && (VectorReadsInt(inst.VPU) || isVectorRegister(inst.Vs))
+
+	case LoadStore:
+
+		inst.Vd = uint8((encoded >> 4) & 0x1F)     // 5 bit Vd (Bits 8-4)
+		inst.MemMode = uint8((encoded >> 9) & 0x3) // 2 bit Mode (Bits 10-9)
+		inst.RMem = uint8((encoded >> 11) & 0x1F)  // 5 bit RMem (Bits 15-11)
+		inst.Imm = int16((encoded >> 16) & 0xFFFF) // 16 bit Immediate (Bits 31-16)
+		return (inst.MemMode == LDW || inst.MemMode == STW) && isVectorRegister(inst.Vd)
+
+	}
+	return false
+}
+
+func isVectorRegister(r uint8) bool {
+	return int(r) < len(VectorRegisters)
+}
+
+func (inst *SubWordInstruction) Encode() uint32 {
+
+	var encoded uint32 = 0
+
+	encoded |= uint32(SubWord)           // Bits 1-0 (DataType)
+	encoded |= uint32(inst.Size) << 2    // Bits 3-2 (Size)
+	encoded |= uint32(inst.Rd) << 4      // 5 bit Rd (Bits 8-4)
+	encoded |= uint32(inst.MemMode) << 9 // 2 bit Mode (Bits 10-9)
+	encoded |= uint32(inst.RMem) << 11   // 5 bit RMem (Bits 15-11)
+	encoded |= uint32(inst.Imm) << 16    // 16 bit Immediate (Bits 31-16)
+
+	return encoded
+}
+
+// Decode a word with DataType SubWord, returns false if its Size or MemMode is reserved
+func (inst *SubWordInstruction) Decode(encoded uint32) bool {
+	inst.Size = uint8((encoded >> 2) & 0b11)   // Bits 3-2 (Size)
+	inst.Rd = uint8((encoded >> 4) & 0x1F)     // 5 bit Rd (Bits 8-4)
+	inst.MemMode = uint8((encoded >> 9) & 0x3) // 2 bit Mode (Bits 10-9)
+	inst.RMem = uint8((encoded >> 11) & 0x1F)  // 5 bit RMem (Bits 15-11)
+	inst.Imm = int16((encoded >> 16) & 0xFFFF) // 16 bit Immediate (Bits 31-16)
+	return (inst.Size == SIZE_BYTE || inst.Size == SIZE_HALF) && inst.MemMode != 0b10
 }
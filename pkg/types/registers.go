@@ -10,6 +10,7 @@ var IntegerRegisters = map[string]uint8{
 	"r21": 0x15, "r22": 0x16, "r23": 0x17, "r24": 0x18,
 	"r25": 0x19, "r26": 0x1A, "r27": 0x1B, "r28": 0x1C,
 	"r29": 0x1D, "r30": 0x1E, "r31": 0x1F,
+	"at": 28, // assembler temporary, reserved for far branch pseudo instructions
 	"bp": 29, // base pointer
 	"sp": 30, // stack pointer
 	"lr": 31, // link register
@@ -24,3 +25,50 @@ var VectorRegisters = map[string]uint8{
 	"v1": 0x00, "v2": 0x01, "v3": 0x02, "v4": 0x03,
 	"v5": 0x04, "v6": 0x05, "v7": 0x06, "v8": 0x07,
 }
+
+// Special registers, read with mfsr and written with mtsr. The cpu sets epc, cause and tval
+// when it takes a trap
+const (
+	SR_EPC     = iota // address of the instruction that trapped, iret returns to it
+	SR_CAUSE          // exception cause of the last trap
+	SR_TVAL           // faulting address of the last trap, or the word of an illegal instruction
+	SR_TVEC           // address of the trap vector table, 0 disables traps
+	SR_STATUS         // STATUS_IE enables interrupts, a trap saves it in STATUS_PIE and iret restores it
+	SR_IMASK          // bit n enables interrupt line n
+	SR_IPEND          // bit n is set while interrupt line n is pending
+	SR_TIME           // clock cycles since reset, read only
+	SR_TCMP           // the timer raises its interrupt when time reaches tcmp, 0 stops the timer
+	SR_TPERIOD        // added to tcmp when the timer fires, 0 for a one shot timer
+	SR_EFLAGS         // the flags when the last trap was taken, iret restores them
+)
+
+// Bits of the status register
+const (
+	STATUS_IE  = 1 << 0 // interrupts enabled
+	STATUS_PIE = 1 << 1 // interrupts enabled before the last trap
+)
+
+// Set in the immediate of an IMM_SR instruction to write the special register
+const SR_WRITE = 0x100
+
+var SpecialRegisters = map[string]uint8{
+	"epc":     SR_EPC,
+	"cause":   SR_CAUSE,
+	"tval":    SR_TVAL,
+	"tvec":    SR_TVEC,
+	"status":  SR_STATUS,
+	"imask":   SR_IMASK,
+	"ipend":   SR_IPEND,
+	"time":    SR_TIME,
+	"tcmp":    SR_TCMP,
+	"tperiod": SR_TPERIOD,
+	"eflags":  SR_EFLAGS,
+}
+
+var SpecialRegistersInverse = map[uint8]string{}
+
+func init() {
+	for k, v := range SpecialRegisters {
+		SpecialRegistersInverse[v] = k
+	}
+}
@@ -0,0 +1,50 @@
+# Print a greeting on the console, echo the input in upper case until it ends, print a
+# random digit and exit with the number of characters read as the exit code of r8 simulate:
+#   echo abc | r8 sim console.bin       prints Hello, ABC and a digit, then exits with 4
+# The device registers are at addresses from 0x8000
+.equ CONSOLE, 0x8000
+.equ EXIT, 0x8010
+.equ RANDOM, 0x8020
+
+	li r10, CONSOLE
+	li r1, msg
+greet:
+	ldbu r2, [r1]
+	cmp r2, 0
+	beq echo
+	stb r2, [r10]
+	inc r1
+	jmp greet
+
+echo:
+	xor r11, r11             # characters read
+read:
+	ldb r2, [r10]            # consumes one byte of input, -1 at its end
+	cmp r2, -1
+	beq roll                 # end of input
+	inc r11
+	cmp r2, 0x61             # 'a'
+	blu print
+	cmp r2, 0x7B             # 'z' + 1
+	bae print
+	sub r2, 0x20
+print:
+	stb r2, [r10]
+	jmp read
+
+roll:
+	li r3, RANDOM
+	ldbu r2, [r3]            # low byte of the next random number
+	ldi r4, 10
+	rem r2, r4
+	add r2, 0x30             # '0'
+	stb r2, [r10]
+	ldi r2, 0x0A             # newline
+	stb r2, [r10]
+
+	li r3, EXIT
+	stw r11, [r3]            # stops the cpu
+	hlt
+
+msg:
+	.string "Hello, "
@@ -1,7 +1,7 @@
-ldi sp, 30
+ldi sp, 120
 ldi r2, 4096
-ldi r3, 15
-ldi r4, 9
+ldi r3, 60
+ldi r4, 36
 ldi r1, 0xdead
 shl r1, 15
 ldi r20, 0xbeef
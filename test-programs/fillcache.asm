@@ -1,13 +1,13 @@
 ldi r1, 0xbeef
-ldi sp, 20
+ldi sp, 80
 ldi r2, 2048
-ldi r3,4
+ldi r3,16
 push r2
 sub r2, 1
 cmp r2, 1
 bne [r3]
 ldi r2, 30
-ldi r3, 10
+ldi r3, 40
 pop r1
 add r2, 1
 cmp r2, 2040
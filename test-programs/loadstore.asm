@@ -1,18 +1,18 @@
-ldi r2, 30
-ldi r3, 2
+ldi r2, 120
+ldi r3, 8
 stw r2, [r2]
-add r2, 1
-cmp r2, 512
+add r2, 4
+cmp r2, 2048
 bne [r3]
 nop
-ldi r2, 30
-ldi r4, 0x201
-ldi r3, 10
+ldi r2, 120
+ldi r4, 0x804
+ldi r3, 40
 ldw r5, [r2]
 stw r5, [r4]
-add r2, 1
-add r4, 1
-cmp r2, 0x300
+add r2, 4
+add r4, 4
+cmp r2, 0xC00
 blt [r3]
 nop
 nop
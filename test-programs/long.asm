@@ -1,5 +1,5 @@
-ldi r5, 3
-ldi r6, 7
+ldi r5, 12
+ldi r6, 28
 ldi r2, 10
 add r4, 2
 sub r2, 1
@@ -0,0 +1,53 @@
+# C = A * B for two 8x8 matrices without the vector unit, the same loops as
+# matrix_mult_vector.asm with one column of C at a time:
+#     C[i][j] += A[i][k] * B[k][j]   for k = 0..7
+.equ N, 8               # matrix size
+.equ A, 0x400           # matrix base addresses
+.equ B, A + 4 * N * N
+.equ C, B + 4 * N * N
+
+	li r20, A
+	li r21, B
+	li r22, C
+	xor r27, r27            # count
+	mov r24, r20
+populate:
+	stw r27, [r24]          # A and B hold 0, 1, 2, ... 2 * N * N - 1
+	inc r27
+	add r24, 4
+	cmp r27, 2 * N * N
+	blt populate
+
+	xor r3, r3              # i = 0
+	mov r7, r20             # r7 = &A[i][0]
+	mov r26, r22            # r26 = &C[i][0]
+loop_i:
+	xor r4, r4              # j = 0
+loop_j:
+	xor r5, r5              # C[i][j] = 0
+	mov r9, r21
+	add r9, r4              # r9 = &B[0][j]
+	xor r6, r6              # k = 0, r6 and r4 count bytes
+loop_k:
+	mov r10, r7
+	add r10, r6
+	ldw r8, [r10]           # A[i][k]
+	ldw r18, [r9]           # B[k][j]
+	mul r18, r8
+	add r5, r18
+	add r9, 4 * N           # next row of B
+	add r6, 4
+	cmp r6, 4 * N
+	blt loop_k
+	mov r11, r26
+	add r11, r4
+	stw r5, [r11]           # store C[i][j]
+	add r4, 4
+	cmp r4, 4 * N
+	blt loop_j
+	add r7, 4 * N
+	add r26, 4 * N
+	inc r3
+	cmp r3, N
+	blt loop_i
+	hlt
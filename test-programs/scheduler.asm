@@ -0,0 +1,61 @@
+# Preemptive round robin between two tasks on the timer interrupt. Each task counts in its own
+# register, the timer handler switches tasks by swapping epc and eflags with the saved state of
+# the other task, and halts after 6 ticks. External interrupt line 1 is counted in r13, run with
+#   r8 sim --irq 300:1 scheduler.bin
+# At the end r10 and r11 count the loops of task a and b, r12 = 6 ticks and r13 = 1
+.equ EXC_TIMER, 8
+.equ EXC_EXTERNAL_1, 9
+.equ PERIOD, 2000
+
+	li r1, vectors
+	mtsr tvec, r1
+	ldi r1, PERIOD
+	mtsr tperiod, r1
+	mfsr r2, time
+	add r2, r1
+	mtsr tcmp, r2           # first tick PERIOD cycles from now
+	ldi r1, 3
+	mtsr imask, r1          # enable lines 0 (timer) and 1
+	li r20, task_b          # saved epc of the task that is not running
+	xor r22, r22            # and its saved flags
+	ldi r1, 1
+	mtsr status, r1         # enable interrupts
+
+task_a:
+	inc r10
+	jmp task_a
+
+task_b:
+	inc r11
+	jmp task_b
+
+# one instruction per cause, at tvec + 4 * cause
+vectors:
+	hlt                     # 0 is not a cause
+	hlt                     # exceptions are not expected here
+	hlt
+	hlt
+	hlt
+	hlt
+	hlt
+	hlt
+	jmp on_timer            # EXC_TIMER
+	jmp on_external         # EXC_EXTERNAL_1
+
+on_timer:
+	inc r12
+	cmp r12, 6
+	beq done
+	mfsr r21, epc           # switch to the other task
+	mtsr epc, r20
+	mov r20, r21
+	mfsr r21, eflags
+	mtsr eflags, r22
+	mov r22, r21
+	iret
+done:
+	hlt
+
+on_external:
+	inc r13
+	iret
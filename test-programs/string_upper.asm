@@ -0,0 +1,48 @@
+# Upper-case a string in place with byte loads and stores, then copy it one halfword
+# at a time to a buffer that starts on an odd address. Characters are at
+# consecutive addresses from the label msg.
+# Run with r8 simulate --trap-misaligned to stop at the first odd halfword store, as
+# there is no trap handler.
+.equ BUF, 0x400 + 1          # odd address of the copy
+
+	li r1, msg
+upper:
+	ldbu r2, [r1]
+	cmp r2, 0
+	beq copy
+	cmp r2, 0x61             # 'a'
+	blu next
+	cmp r2, 0x7B             # 'z' + 1
+	bae next
+	sub r2, 0x20
+	stb r2, [r1]
+next:
+	inc r1
+	jmp upper
+
+copy:
+	li r1, msg
+	li r3, BUF
+	xor r5, r5               # r5 = sum of the characters, read back as halfwords
+loop:
+	ldhu r2, [r1]
+	sth r2, [r3]
+	ldhu r4, [r3]
+	mov r6, r4
+	and r6, 0xFF
+	cmp r6, 0
+	beq done                 # the NUL is in the low byte
+	add r5, r6
+	shr r4, 8
+	cmp r4, 0
+	beq done                 # the NUL is in the high byte
+	add r5, r4
+	add r1, 2
+	add r3, 2
+	jmp loop
+done:
+	ldb r7, [r3 - 1]         # a copied character, sign extended
+	hlt
+
+msg:
+	.string "Hello, world"
@@ -0,0 +1,145 @@
+# System calls serviced by r8 simulate. Greets on stdout, copies a line of stdin to a file in the
+# sandbox, reads the file back and prints it, prints the cycles it took on stderr and exits with
+# 0 if the copy matches and 1 otherwise:
+#   echo hello | r8 sim --sandbox /tmp syscall.bin     prints Hello, copied hello and the cycles
+.equ SYS_EXIT, 1
+.equ SYS_WRITE, 2
+.equ SYS_READ, 3
+.equ SYS_OPEN, 4
+.equ SYS_CLOSE, 5
+.equ SYS_CYCLES, 6
+.equ STDIN, 0
+.equ STDOUT, 1
+.equ STDERR, 2
+.equ OPEN_READ, 0
+.equ OPEN_WRITE, 1
+.equ LINE, 0x4000                # buffer for stdin
+.equ COPY, 0x4040                # buffer for the file
+.equ MAX, 64
+
+	ldi r1, SYS_CYCLES
+	ecall
+	mov r12, r1                  # start
+
+	ldi r1, SYS_WRITE
+	ldi r2, STDOUT
+	li r3, hello
+	ldi r4, 7
+	ecall
+
+	ldi r1, SYS_READ
+	ldi r2, STDIN
+	li r3, LINE
+	ldi r4, MAX
+	ecall
+	mov r10, r1                  # bytes read
+
+	ldi r1, SYS_OPEN
+	li r2, path
+	ldi r3, OPEN_WRITE
+	ecall
+	cmp r1, -1
+	beq fail
+	mov r11, r1
+	ldi r1, SYS_WRITE
+	mov r2, r11
+	li r3, LINE
+	mov r4, r10
+	ecall
+	ldi r1, SYS_CLOSE
+	mov r2, r11
+	ecall
+
+	ldi r1, SYS_OPEN
+	li r2, path
+	ldi r3, OPEN_READ
+	ecall
+	cmp r1, -1
+	beq fail
+	mov r11, r1
+	ldi r1, SYS_READ
+	mov r2, r11
+	li r3, COPY
+	ldi r4, MAX
+	ecall
+	cmp r1, r10
+	bne fail
+	ldi r1, SYS_CLOSE
+	mov r2, r11
+	ecall
+
+	li r5, LINE                  # compare the copy with the line
+	li r6, COPY
+	mov r7, r10
+compare:
+	cmp r7, 0
+	beq matched
+	ldbu r8, [r5]
+	ldbu r9, [r6]
+	cmp r8, r9
+	bne fail
+	inc r5
+	inc r6
+	dec r7
+	jmp compare
+
+matched:
+	ldi r1, SYS_WRITE
+	ldi r2, STDOUT
+	li r3, copied
+	ldi r4, 8
+	ecall
+	ldi r1, SYS_WRITE
+	ldi r2, STDOUT
+	li r3, COPY
+	mov r4, r10
+	ecall
+
+	ldi r1, SYS_CYCLES           # print the cycles since the start in decimal
+	ecall
+	sub r1, r12
+	li r5, digits+10            # the digits are stored backwards from the end of the buffer
+	mov r7, r5
+	ldi r6, 10
+itoa:
+	dec r7
+	mov r8, r1
+	rem r8, r6
+	add r8, 0x30                 # '0'
+	stb r8, [r7]
+	div r1, r6
+	cmp r1, 0
+	bne itoa
+	ldi r1, SYS_WRITE
+	ldi r2, STDERR
+	mov r3, r7
+	mov r4, r5
+	sub r4, r7
+	ecall
+	ldi r1, SYS_WRITE
+	ldi r2, STDERR
+	li r3, cycles
+	ldi r4, 8
+	ecall
+
+	ldi r1, SYS_EXIT
+	ldi r2, 0
+	ecall
+	hlt
+
+fail:
+	ldi r1, SYS_EXIT
+	ldi r2, 1
+	ecall
+	hlt
+
+hello:
+	.string "Hello, "
+copied:
+	.string "copied: "
+cycles:
+	.string " cycles\n"
+path:
+	.string "syscall.txt"
+digits:
+	.fill 3
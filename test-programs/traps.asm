@@ -0,0 +1,49 @@
+# Trap handlers for division by zero, illegal instructions and bad addresses. Each handler
+# counts its traps, sets a result and skips the faulting instruction by returning to epc + 4.
+# At the end r10 = 3 traps, r11 = 0xFFFF from the divide, r12 = the illegal word 0xBAD0000F,
+# r13 = the bad address -5 and r14 = 2 + 1 from the instructions after the faults
+.equ EXC_ILLEGAL_INSTRUCTION, 1
+.equ EXC_DIVIDE_BY_ZERO, 2
+.equ EXC_BAD_ADDRESS, 3
+
+	li r1, vectors
+	mtsr tvec, r1
+	xor r10, r10            # trap count
+
+	ldi r2, 7
+	xor r3, r3
+	div r2, r3              # traps, r2 is unchanged
+	mov r11, r2
+	add r14, 2              # runs after the handler returns
+
+	.word 0xBAD0000F        # reserved vector OpType, not an instruction
+
+	ldi r4, 0
+	sub r4, 5
+	ldw r5, [r4]            # address -5 traps
+	add r14, 1
+	hlt
+
+# one instruction per cause, at tvec + 4 * cause
+vectors:
+	hlt                     # 0 is not a cause
+	jmp on_illegal
+	jmp on_divide
+	jmp on_bad_address
+	hlt                     # misaligned, not expected here
+
+on_divide:
+	li r11, 0xFFFF
+	mov r2, r11             # the result of the failed div
+	jmp skip
+on_illegal:
+	mfsr r12, tval
+	jmp skip
+on_bad_address:
+	mfsr r13, tval
+skip:
+	inc r10
+	mfsr r1, epc
+	add r1, 4               # return past the faulting instruction
+	mtsr epc, r1
+	iret